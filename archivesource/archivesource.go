@@ -0,0 +1,232 @@
+// Package archivesource lets commands that work on a directory also work
+// on archives that can't be walked directly, like .tar.gz or .7z files,
+// or on a tar stream read from stdin. Those get extracted to a temporary
+// directory, which is removed when the source is closed.
+package archivesource
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/itchio/boar"
+	"github.com/itchio/butler/mansion"
+	"github.com/itchio/headway/state"
+	"github.com/itchio/savior"
+	"github.com/itchio/savior/tarextractor"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// IsStdin returns true if path means reading a tar stream from stdin:
+// mansion.Stdin, or a "-" that made it past kingpin, after "--".
+func IsStdin(path string) bool {
+	return path == mansion.Stdin || path == "-"
+}
+
+// boarExtensions are extracted with boar, which picks the right
+// extractor from the file extension
+var boarExtensions = []string{
+	".tar",
+	".tar.gz",
+	".tgz",
+	".tar.bz2",
+	".tbz2",
+	".tar.xz",
+	".txz",
+	".7z",
+}
+
+// zstdExtensions are tar archives compressed with zstd, which boar
+// doesn't know about
+var zstdExtensions = []string{
+	".tar.zst",
+	".tar.zstd",
+	".tzst",
+}
+
+// Source is a directory or archive that can be walked by tlc
+type Source struct {
+	// Path is what should be walked: either the original path, or
+	// the directory the archive was extracted to
+	Path string
+
+	tempDir string
+}
+
+// NeedsExtraction returns true if path is stdin or an archive that
+// has to be extracted before being walked. Directories and .zip
+// files can be walked as-is.
+func NeedsExtraction(path string) bool {
+	if IsStdin(path) {
+		return true
+	}
+
+	if stats, err := os.Stat(path); err != nil || stats.IsDir() {
+		return false
+	}
+
+	return hasExtension(path, boarExtensions) || hasExtension(path, zstdExtensions)
+}
+
+func hasExtension(path string, extensions []string) bool {
+	lowerPath := strings.ToLower(path)
+	for _, ext := range extensions {
+		if strings.HasSuffix(lowerPath, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// Open extracts path to a temporary directory if needed. The
+// returned source must be closed once it's not needed anymore.
+func Open(path string, consumer *state.Consumer) (*Source, error) {
+	if !NeedsExtraction(path) {
+		return &Source{Path: path}, nil
+	}
+
+	tempDir, err := ioutil.TempDir("", "butler-source")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	s := &Source{
+		Path:    filepath.Join(tempDir, "extracted"),
+		tempDir: tempDir,
+	}
+
+	err = s.extract(path, consumer)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Source) extract(path string, consumer *state.Consumer) error {
+	var res *savior.ExtractorResult
+	var err error
+
+	if IsStdin(path) {
+		consumer.Opf("Extracting tar stream from stdin...")
+		res, err = s.extractStream(os.Stdin, consumer)
+	} else {
+		consumer.Opf("Extracting (%s)...", path)
+		res, err = extractFile(path, s.Path, consumer)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "extracting %s", path)
+	}
+
+	consumer.Infof("Extracted %s", res.Stats())
+	return nil
+}
+
+func extractFile(path string, dir string, consumer *state.Consumer) (*savior.ExtractorResult, error) {
+	if hasExtension(path, zstdExtensions) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		defer f.Close()
+
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		defer zr.Close()
+
+		return extractTar(newReaderSource("zstd", zr), dir, consumer)
+	}
+
+	return boar.SimpleExtract(&boar.SimpleExtractParams{
+		ArchivePath:       path,
+		DestinationFolder: dir,
+		Consumer:          consumer,
+	})
+}
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// extractStream extracts a tar stream, which may be compressed
+func (s *Source) extractStream(r io.Reader, consumer *state.Consumer) (*savior.ExtractorResult, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(xzMagic))
+	if err != nil && err != io.EOF {
+		return nil, errors.WithStack(err)
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return extractTar(newReaderSource("gzip", gr), s.Path, consumer)
+	case bytes.HasPrefix(magic, bzip2Magic):
+		return extractTar(newReaderSource("bzip2", bzip2.NewReader(br)), s.Path, consumer)
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		defer zr.Close()
+		return extractTar(newReaderSource("zstd", zr), s.Path, consumer)
+	case bytes.HasPrefix(magic, xzMagic):
+		// the xz decompressor we have needs a file, so spool it first
+		spoolPath := filepath.Join(s.tempDir, "stdin.tar.xz")
+		err := spool(br, spoolPath)
+		if err != nil {
+			return nil, err
+		}
+		return extractFile(spoolPath, s.Path, consumer)
+	default:
+		return extractTar(newReaderSource("tar", br), s.Path, consumer)
+	}
+}
+
+func extractTar(source savior.Source, dir string, consumer *state.Consumer) (*savior.ExtractorResult, error) {
+	ex := tarextractor.New(source)
+	ex.SetConsumer(consumer)
+
+	sink := &savior.FolderSink{
+		Directory: dir,
+		Consumer:  consumer,
+	}
+	defer sink.Close()
+
+	return ex.Resume(nil, sink)
+}
+
+func spool(r io.Reader, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// Close removes the temporary directory the archive was extracted to, if any
+func (s *Source) Close() error {
+	if s.tempDir == "" {
+		return nil
+	}
+	return os.RemoveAll(s.tempDir)
+}
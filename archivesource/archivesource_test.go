@@ -0,0 +1,102 @@
+package archivesource_test
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/itchio/butler/archivesource"
+	"github.com/itchio/headway/state"
+	"github.com/itchio/wharf/wtest"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archivesource-tests")
+	wtest.Must(t, err)
+	defer os.RemoveAll(dir)
+
+	consumer := &state.Consumer{}
+
+	writeTar := func(w io.Writer) {
+		tw := tar.NewWriter(w)
+		wtest.Must(t, tw.WriteHeader(&tar.Header{
+			Name:     "bin/",
+			Typeflag: tar.TypeDir,
+			Mode:     0o755,
+		}))
+		contents := []byte("#!/bin/sh\necho hi\n")
+		wtest.Must(t, tw.WriteHeader(&tar.Header{
+			Name:     "bin/game",
+			Typeflag: tar.TypeReg,
+			Mode:     0o755,
+			Size:     int64(len(contents)),
+		}))
+		_, err := tw.Write(contents)
+		wtest.Must(t, err)
+		wtest.Must(t, tw.Close())
+	}
+
+	makeArchive := func(name string, wrap func(w io.Writer) io.WriteCloser) string {
+		path := filepath.Join(dir, name)
+		f, err := os.Create(path)
+		wtest.Must(t, err)
+		defer f.Close()
+
+		w := wrap(f)
+		writeTar(w)
+		wtest.Must(t, w.Close())
+		return path
+	}
+
+	assertExtracted := func(path string) {
+		assert.True(t, archivesource.NeedsExtraction(path))
+
+		source, err := archivesource.Open(path, consumer)
+		wtest.Must(t, err)
+
+		contents, err := ioutil.ReadFile(filepath.Join(source.Path, "bin", "game"))
+		wtest.Must(t, err)
+		assert.EqualValues(t, "#!/bin/sh\necho hi\n", string(contents))
+
+		wtest.Must(t, source.Close())
+		_, err = os.Stat(source.Path)
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	assertExtracted(makeArchive("build.tar", func(w io.Writer) io.WriteCloser {
+		return nopWriteCloser{w}
+	}))
+
+	assertExtracted(makeArchive("build.tar.gz", func(w io.Writer) io.WriteCloser {
+		return gzip.NewWriter(w)
+	}))
+
+	assertExtracted(makeArchive("build.tar.zst", func(w io.Writer) io.WriteCloser {
+		zw, err := zstd.NewWriter(w)
+		wtest.Must(t, err)
+		return zw
+	}))
+
+	// directories are walked as-is
+	assert.False(t, archivesource.NeedsExtraction(dir))
+	source, err := archivesource.Open(dir, consumer)
+	wtest.Must(t, err)
+	assert.EqualValues(t, dir, source.Path)
+	wtest.Must(t, source.Close())
+	_, err = os.Stat(dir)
+	wtest.Must(t, err)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
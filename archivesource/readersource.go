@@ -0,0 +1,70 @@
+package archivesource
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/itchio/savior"
+	"github.com/pkg/errors"
+)
+
+// readerSource adapts a plain io.Reader, like a decompressor reading
+// from stdin, into a savior.Source. It can't be resumed or report
+// progress, since we don't know how large the stream is.
+type readerSource struct {
+	name   string
+	reader *bufio.Reader
+	offset int64
+}
+
+var _ savior.Source = (*readerSource)(nil)
+
+func newReaderSource(name string, r io.Reader) *readerSource {
+	return &readerSource{
+		name:   name,
+		reader: bufio.NewReader(r),
+	}
+}
+
+func (rs *readerSource) Resume(checkpoint *savior.SourceCheckpoint) (int64, error) {
+	if checkpoint != nil {
+		return 0, errors.Errorf("%s source: can't resume from a checkpoint", rs.name)
+	}
+	if rs.offset != 0 {
+		return 0, errors.Errorf("%s source: can't rewind", rs.name)
+	}
+	return 0, nil
+}
+
+func (rs *readerSource) SetSourceSaveConsumer(ssc savior.SourceSaveConsumer) {
+	// we never emit checkpoints
+}
+
+func (rs *readerSource) WantSave() {
+	// we never emit checkpoints
+}
+
+func (rs *readerSource) Progress() float64 {
+	return -1
+}
+
+func (rs *readerSource) Features() savior.SourceFeatures {
+	return savior.SourceFeatures{
+		Name:          rs.name,
+		ResumeSupport: savior.ResumeSupportNone,
+	}
+}
+
+func (rs *readerSource) Read(buf []byte) (int, error) {
+	n, err := rs.reader.Read(buf)
+	rs.offset += int64(n)
+	return n, err
+}
+
+func (rs *readerSource) ReadByte() (byte, error) {
+	b, err := rs.reader.ReadByte()
+	if err == nil {
+		rs.offset++
+	}
+	return b, err
+}
@@ -0,0 +1,42 @@
+// Package buildtest helps tests make up builds to diff, patch,
+// verify or heal.
+package buildtest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/wtest"
+)
+
+// Compression is fast, which is all tests need. Packages that use it
+// must import brotli's compressor and decompressor.
+var Compression = pwr.CompressionSettings{
+	Algorithm: pwr.CompressionAlgorithm_BROTLI,
+	Quality:   1,
+}
+
+// TempDir creates a temporary directory, which is removed once
+// the test is done.
+func TempDir(t *testing.T, prefix string) string {
+	dir, err := ioutil.TempDir("", prefix)
+	wtest.Must(t, err)
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	return dir
+}
+
+// WriteDir writes files, keyed by their slash-separated path, to root,
+// and returns root.
+func WriteDir(t *testing.T, root string, files map[string]string) string {
+	for path, contents := range files {
+		full := filepath.Join(root, filepath.FromSlash(path))
+		wtest.Must(t, os.MkdirAll(filepath.Dir(full), 0o755))
+		wtest.Must(t, ioutil.WriteFile(full, []byte(contents), 0o644))
+	}
+	return root
+}
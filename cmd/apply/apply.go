@@ -35,6 +35,15 @@ type Params struct {
 	Signature       string
 	SaveInterval    float64
 	Consumer        *state.Consumer
+
+	// Transactional journals every file an in-place apply replaces, so
+	// it can be rolled back if it's interrupted or doesn't verify
+	Transactional bool
+	// Rollback only restores the files of an interrupted transactional apply
+	Rollback bool
+	// StopInCommit stops a transactional apply after committing, but
+	// before recording it, to test rolling back
+	StopInCommit bool
 }
 
 func Register(ctx *mansion.Context) {
@@ -47,6 +56,9 @@ func Register(ctx *mansion.Context) {
 	cmd.Flag("simulate-restart", "Simulate restarting").BoolVar(&params.SimulateRestart)
 	cmd.Flag("signature", "Signature file (.pws) to verify build against after patching").StringVar(&params.Signature)
 	cmd.Flag("save-interval", "Save interval").Default("2").Float64Var(&params.SaveInterval)
+	cmd.Flag("transactional", "When patching in-place, back up every replaced file so an interrupted apply, or one that doesn't match --signature, can be rolled back").BoolVar(&params.Transactional)
+	cmd.Flag("rollback", "Restore the original files of an interrupted transactional apply, then exit").BoolVar(&params.Rollback)
+	cmd.Flag("stop-in-commit", "Stop after committing, before recording it").Hidden().BoolVar(&params.StopInCommit)
 	ctx.Register(cmd, do)
 }
 
@@ -56,6 +68,8 @@ func do(ctx *mansion.Context) {
 		err := Do(params)
 		if errors.Cause(err) == patcher.ErrStop {
 			if params.SimulateRestart {
+				// only stop in the first commit, the next run rolls it back
+				params.StopInCommit = false
 				continue
 			}
 		}
@@ -73,6 +87,40 @@ func Do(params Params) error {
 	dir := params.Dir
 	stagingDir := params.StagingDir
 
+	if params.Transactional || params.Rollback {
+		if dir != "" {
+			return errors.New("transactional apply only works in-place, can't be used with --dir")
+		}
+
+		journal, err := ReadJournal(stagingDir)
+		if err != nil {
+			return err
+		}
+
+		if params.Rollback {
+			if journal == nil {
+				consumer.Statf("Nothing to roll back in %s", stagingDir)
+				return nil
+			}
+			consumer.Opf("Rolling back %s", old)
+			return journal.Rollback(consumer, old, stagingDir)
+		}
+
+		if journal != nil {
+			switch journal.Phase {
+			case JournalCommitted:
+				consumer.Opf("Previous apply was committed, verifying it")
+				return finishTransaction(params, journal)
+			default:
+				consumer.Warnf("Previous apply was interrupted while committing, rolling back")
+				err = journal.Rollback(consumer, old, stagingDir)
+				if err != nil {
+					return errors.WithMessage(err, "rolling back")
+				}
+			}
+		}
+	}
+
 	if dir == "" {
 		consumer.Opf("Patching %s (in-place)", old)
 	} else {
@@ -98,12 +146,12 @@ func Do(params Params) error {
 			return errors.WithMessage(err, "opening checkpoint")
 		}
 	} else {
-		defer checkpointFile.Close()
-
 		checkpoint = &patcher.Checkpoint{}
 
 		dec := gob.NewDecoder(checkpointFile)
 		err := dec.Decode(checkpoint)
+		// closed right away, a transactional apply removes it when done
+		checkpointFile.Close()
 		if err != nil {
 			return errors.WithMessage(err, "decoding checkpoint")
 		}
@@ -189,9 +237,25 @@ func Do(params Params) error {
 		consumer.Statf("Before commit, staging dir is %s", united.FormatBytes(stagingDirSize))
 	}
 
+	var journal *Journal
+	if params.Transactional {
+		consumer.Opf("Backing up replaced files...")
+		journal, err = beginJournal(consumer, old, stagingDir, p.GetTargetContainer(), p.GetSourceContainer(), bwl)
+		if err != nil {
+			return errors.WithMessage(err, "journaling")
+		}
+	}
+
 	consumer.Opf("Committing...")
 	err = bwl.Commit()
 	if err != nil {
+		if journal != nil {
+			consumer.Warnf("Commit failed, rolling back: %+v", err)
+			rErr := journal.Rollback(consumer, old, stagingDir)
+			if rErr != nil {
+				return errors.WithMessage(rErr, "rolling back")
+			}
+		}
 		return errors.WithMessage(err, "committing bowl")
 	}
 
@@ -202,46 +266,80 @@ func Do(params Params) error {
 		united.FormatBPS(out.Size, duration),
 		united.FormatDuration(duration))
 
-	if params.Signature != "" {
-		sigSource, err := filesource.Open(params.Signature)
-		if err != nil {
-			return err
+	if journal != nil {
+		if params.StopInCommit {
+			return errors.WithStack(patcher.ErrStop)
 		}
-		defer sigSource.Close()
-
-		consumer.Opf("Verifying against signature...")
 
-		sigInfo, err := pwr.ReadSignature(context.Background(), sigSource)
+		journal.Phase = JournalCommitted
+		err = writeJournal(stagingDir, journal)
 		if err != nil {
-			return err
+			return errors.WithMessage(err, "writing rollback journal")
 		}
+		return finishTransaction(params, journal)
+	}
 
-		outputDir := dir
-		if outputDir == "" {
-			outputDir = old
-		}
+	outputDir := dir
+	if outputDir == "" {
+		outputDir = old
+	}
+	return verify(params, outputDir)
+}
 
-		vctx := &pwr.ValidatorContext{
-			FailFast: true,
-			Consumer: consumer,
+// finishTransaction verifies a committed transactional apply, rolls it
+// back if it doesn't match the signature, and discards the journal
+func finishTransaction(params Params, journal *Journal) error {
+	err := verify(params, params.Old)
+	if err != nil {
+		params.Consumer.Warnf("Verification failed, rolling back")
+		rErr := journal.Rollback(params.Consumer, params.Old, params.StagingDir)
+		if rErr != nil {
+			return errors.WithMessage(rErr, "rolling back")
 		}
+		return errors.WithMessage(err, "verifying (rolled back)")
+	}
 
-		comm.Progress(0.0)
-		comm.StartProgress()
-		err = vctx.Validate(context.Background(), outputDir, sigInfo)
-		comm.EndProgress()
-		if err != nil {
-			return err
-		}
+	return discardJournal(params.StagingDir)
+}
 
-		err = pwr.AssertNoGhosts(outputDir, sigInfo)
-		if err != nil {
-			return err
-		}
+func verify(params Params, outputDir string) error {
+	if params.Signature == "" {
+		return nil
+	}
+	consumer := params.Consumer
 
-		consumer.Statf("Phew, everything checks out!")
+	sigSource, err := filesource.Open(params.Signature)
+	if err != nil {
+		return err
+	}
+	defer sigSource.Close()
+
+	consumer.Opf("Verifying against signature...")
+
+	sigInfo, err := pwr.ReadSignature(context.Background(), sigSource)
+	if err != nil {
+		return err
+	}
+
+	vctx := &pwr.ValidatorContext{
+		FailFast: true,
+		Consumer: consumer,
+	}
+
+	comm.Progress(0.0)
+	comm.StartProgress()
+	err = vctx.Validate(context.Background(), outputDir, sigInfo)
+	comm.EndProgress()
+	if err != nil {
+		return err
+	}
+
+	err = pwr.AssertNoGhosts(outputDir, sigInfo)
+	if err != nil {
+		return err
 	}
 
+	consumer.Statf("Phew, everything checks out!")
 	return nil
 }
 
@@ -0,0 +1,321 @@
+package apply
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/dchest/safefile"
+	"github.com/itchio/headway/state"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/wharf/pwr/bowl"
+	"github.com/pkg/errors"
+)
+
+// JournalPhase tells how far a transactional apply got
+type JournalPhase string
+
+const (
+	// JournalCommitting means original files are backed up and the patched
+	// files are being moved into place. If a journal is found in that
+	// phase, the commit was interrupted and must be rolled back.
+	JournalCommitting JournalPhase = "committing"
+	// JournalCommitted means all patched files are in place, but they
+	// haven't been verified yet.
+	JournalCommitted JournalPhase = "committed"
+)
+
+// Journal records what a transactional in-place apply replaces, so the
+// original tree can be put back exactly.
+type Journal struct {
+	Phase JournalPhase `json:"phase"`
+
+	// Old is the build that was there before applying
+	Old *tlc.Container `json:"old"`
+	// New is the build the patch produces
+	New *tlc.Container `json:"new"`
+	// BackedUp lists files of Old that were saved before committing,
+	// any other file of Old is left untouched by the commit.
+	BackedUp []string `json:"backedUp"`
+}
+
+func journalPath(stagingDir string) string {
+	return filepath.Join(stagingDir, "rollback.journal")
+}
+
+func backupDir(stagingDir string) string {
+	return filepath.Join(stagingDir, "rollback.files")
+}
+
+// ReadJournal returns the journal left in stagingDir by a transactional
+// apply that didn't finish, or nil if there isn't one
+func ReadJournal(stagingDir string) (*Journal, error) {
+	f, err := os.Open(journalPath(stagingDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	j := &Journal{}
+	err = json.NewDecoder(f).Decode(j)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding rollback journal")
+	}
+	return j, nil
+}
+
+func writeJournal(stagingDir string, j *Journal) error {
+	f, err := safefile.Create(journalPath(stagingDir), 0o644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	err = json.NewEncoder(f).Encode(j)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return f.Commit()
+}
+
+// beginJournal backs up every file of the old build that committing bwl
+// may change or remove, then records them in a journal.
+func beginJournal(consumer *state.Consumer, dir string, stagingDir string, old *tlc.Container, new *tlc.Container, bwl bowl.Bowl) (*Journal, error) {
+	c, err := bwl.Save()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	plan, ok := c.Data.(*bowl.OverlayBowlCheckpoint)
+	if !ok {
+		return nil, errors.New("transactional apply only works in-place")
+	}
+
+	// files that are kept as-is (same path, no overlay) are never
+	// touched when committing, anything else might be.
+	overlaid := make(map[string]bool)
+	for _, i := range plan.OverlayFiles {
+		overlaid[new.Files[i].Path] = true
+	}
+	untouched := make(map[string]bool)
+	for _, t := range plan.Transpositions {
+		oldPath := old.Files[t.TargetIndex].Path
+		if oldPath == new.Files[t.SourceIndex].Path && !overlaid[oldPath] {
+			untouched[oldPath] = true
+		}
+	}
+	newFiles := make(map[string]bool)
+	for _, f := range new.Files {
+		newFiles[f.Path] = true
+	}
+
+	j := &Journal{
+		Phase: JournalCommitting,
+		Old:   old,
+		New:   new,
+	}
+
+	err = os.RemoveAll(backupDir(stagingDir))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var backupSize int64
+	for _, f := range old.Files {
+		if untouched[f.Path] {
+			continue
+		}
+
+		src := filepath.Join(dir, filepath.FromSlash(f.Path))
+		dst := filepath.Join(backupDir(stagingDir), filepath.FromSlash(f.Path))
+		err := os.MkdirAll(filepath.Dir(dst), 0o755)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		// files that aren't in the new build are only ever renamed or
+		// removed, never written to, so a hard link is enough to keep them.
+		linked := false
+		if !newFiles[f.Path] {
+			linked = os.Link(src, dst) == nil
+		}
+		if !linked {
+			err = copyFile(src, dst, os.FileMode(f.Mode))
+			if err != nil {
+				return nil, errors.Wrapf(err, "backing up %s", f.Path)
+			}
+			backupSize += f.Size
+		}
+		j.BackedUp = append(j.BackedUp, f.Path)
+	}
+	consumer.Debugf("Backed up %d files (%d bytes copied)", len(j.BackedUp), backupSize)
+
+	err = writeJournal(stagingDir, j)
+	if err != nil {
+		return nil, errors.Wrap(err, "writing rollback journal")
+	}
+	return j, nil
+}
+
+// Rollback puts back the tree that was in dir before the journaled apply
+// began. It can be interrupted and run again.
+func (j *Journal) Rollback(consumer *state.Consumer, dir string, stagingDir string) error {
+	nativePath := func(p string) string {
+		return filepath.Join(dir, filepath.FromSlash(p))
+	}
+
+	backedUp := make(map[string]bool)
+	for _, p := range j.BackedUp {
+		backedUp[p] = true
+	}
+	kept := make(map[string]bool)
+	oldDirs := make(map[string]bool)
+	for _, f := range j.Old.Files {
+		if !backedUp[f.Path] {
+			kept[f.Path] = true
+		}
+	}
+	for _, d := range j.Old.Dirs {
+		oldDirs[d.Path] = true
+	}
+
+	// remove everything the new build may have put in place
+	for _, f := range j.New.Files {
+		if kept[f.Path] {
+			continue
+		}
+		err := removeIfExists(nativePath(f.Path))
+		if err != nil {
+			return err
+		}
+	}
+	for _, s := range j.New.Symlinks {
+		err := removeIfExists(nativePath(s.Path))
+		if err != nil {
+			return err
+		}
+	}
+
+	var newDirs []string
+	for _, d := range j.New.Dirs {
+		if !oldDirs[d.Path] {
+			newDirs = append(newDirs, d.Path)
+		}
+	}
+	sort.Slice(newDirs, func(a, b int) bool {
+		return len(newDirs[a]) > len(newDirs[b])
+	})
+	for _, d := range newDirs {
+		// may not be empty, in which case restoring a file
+		// in its place below will fail
+		os.Remove(nativePath(d))
+	}
+
+	// then restore the old build
+	for _, d := range j.Old.Dirs {
+		err := os.MkdirAll(nativePath(d.Path), 0o755)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	for _, f := range j.Old.Files {
+		if !backedUp[f.Path] {
+			continue
+		}
+
+		src := filepath.Join(backupDir(stagingDir), filepath.FromSlash(f.Path))
+		dst := nativePath(f.Path)
+		err := os.MkdirAll(filepath.Dir(dst), 0o755)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		// linked or copied, not renamed, so the backup survives
+		// until the journal is gone
+		err = removeIfExists(dst)
+		if err != nil {
+			return err
+		}
+		if os.Link(src, dst) == nil {
+			continue
+		}
+		err = copyFile(src, dst, os.FileMode(f.Mode))
+		if err != nil {
+			return errors.Wrapf(err, "restoring %s", f.Path)
+		}
+	}
+
+	for _, s := range j.Old.Symlinks {
+		p := nativePath(s.Path)
+		if dest, err := os.Readlink(p); err == nil && dest == filepath.FromSlash(s.Dest) {
+			continue
+		}
+
+		err := os.RemoveAll(p)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		err = os.Symlink(filepath.FromSlash(s.Dest), p)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	consumer.Infof("Restored %d files", len(j.BackedUp))
+	return discardJournal(stagingDir)
+}
+
+// discardJournal removes the journal first, so that an interruption
+// never leaves a journal without its backups, then everything else in
+// the staging folder.
+func discardJournal(stagingDir string) error {
+	err := removeIfExists(journalPath(stagingDir))
+	if err != nil {
+		return err
+	}
+	return errors.WithStack(os.RemoveAll(stagingDir))
+}
+
+func removeIfExists(path string) error {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func copyFile(src string, dst string, mode os.FileMode) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer r.Close()
+
+	// the destination may be a hard link to a backup, replace it rather
+	// than writing through it
+	err = removeIfExists(dst)
+	if err != nil {
+		return err
+	}
+
+	w, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode|tlc.ModeMask)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer w.Close()
+
+	_, err = io.Copy(w, r)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = w.Sync()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Chmod(dst, mode|tlc.ModeMask))
+}
@@ -0,0 +1,149 @@
+package apply_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/itchio/butler/buildtest"
+	"github.com/itchio/butler/cmd/apply"
+	"github.com/itchio/butler/cmd/diff"
+	"github.com/itchio/butler/cmd/ditto"
+	"github.com/itchio/butler/cmd/sign"
+	"github.com/itchio/savior/filesource"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/pwr/patcher"
+	"github.com/itchio/wharf/wtest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	_ "github.com/itchio/wharf/compressors/cbrotli"
+	_ "github.com/itchio/wharf/decompressors/cbrotli"
+)
+
+func TestTransactional(t *testing.T) {
+	dir := buildtest.TempDir(t, "apply-tests")
+
+	v1 := buildtest.WriteDir(t, filepath.Join(dir, "v1"), map[string]string{
+		"game.exe":        "version one",
+		"data/old.dat":    "going away",
+		"data/keep.dat":   "always there",
+		"data/before.dat": "about to be renamed",
+	})
+	v2 := buildtest.WriteDir(t, filepath.Join(dir, "v2"), map[string]string{
+		"game.exe":        "version two",
+		"data/keep.dat":   "always there",
+		"data/after.dat":  "about to be renamed",
+		"extra/new.dat":   "brand new",
+		"extra/newer.dat": "even newer",
+	})
+
+	patch := filepath.Join(dir, "patch.pwr")
+	wtest.Must(t, diff.Do(diff.Params{
+		Target:      v1,
+		Source:      v2,
+		Patch:       patch,
+		Compression: buildtest.Compression,
+	}))
+	v1Sig := filepath.Join(dir, "v1.pws")
+	wtest.Must(t, sign.Do(v1, v1Sig, buildtest.Compression, false))
+	v2Sig := patch + ".sig"
+
+	readSig := func(path string) *pwr.SignatureInfo {
+		sigSource, err := filesource.Open(path)
+		wtest.Must(t, err)
+		defer sigSource.Close()
+		sig, err := pwr.ReadSignature(context.Background(), sigSource)
+		wtest.Must(t, err)
+		return sig
+	}
+	assertBuild := func(cave string, sigPath string) {
+		sig := readSig(sigPath)
+		wtest.Must(t, pwr.AssertValid(cave, sig))
+		wtest.Must(t, pwr.AssertNoGhosts(cave, sig))
+	}
+
+	cave := filepath.Join(dir, "cave")
+	staging := filepath.Join(dir, "staging")
+	makeCave := func() {
+		wtest.Must(t, os.RemoveAll(cave))
+		wtest.Must(t, os.RemoveAll(staging))
+		wtest.Must(t, ditto.Do(ditto.Params{Src: v1, Dst: cave, PreservePermissions: true}))
+	}
+	assertNoJournal := func() {
+		journal, err := apply.ReadJournal(staging)
+		wtest.Must(t, err)
+		assert.Nil(t, journal)
+	}
+
+	makeCave()
+
+	// interrupted right after committing: the journal says it's
+	// not done, so the commit gets rolled back
+	err := apply.Do(apply.Params{
+		Patch:         patch,
+		Old:           cave,
+		StagingDir:    staging,
+		Transactional: true,
+		StopInCommit:  true,
+	})
+	assert.Equal(t, patcher.ErrStop, errors.Cause(err))
+	assertBuild(cave, v2Sig)
+
+	journal, err := apply.ReadJournal(staging)
+	wtest.Must(t, err)
+	assert.EqualValues(t, apply.JournalCommitting, journal.Phase)
+	assert.Len(t, journal.BackedUp, 3)
+
+	wtest.Must(t, apply.Do(apply.Params{
+		Patch:      patch,
+		Old:        cave,
+		StagingDir: staging,
+		Rollback:   true,
+	}))
+	assertBuild(cave, v1Sig)
+	assertNoJournal()
+
+	// restarting after an interruption rolls back, then patches again
+	err = apply.Do(apply.Params{
+		Patch:         patch,
+		Old:           cave,
+		StagingDir:    staging,
+		Transactional: true,
+		StopInCommit:  true,
+	})
+	assert.Equal(t, patcher.ErrStop, errors.Cause(err))
+	wtest.Must(t, apply.Do(apply.Params{
+		Patch:         patch,
+		Old:           cave,
+		StagingDir:    staging,
+		Transactional: true,
+		Signature:     v2Sig,
+	}))
+	assertBuild(cave, v2Sig)
+	assertNoJournal()
+
+	// a result that doesn't match the signature gets rolled back
+	makeCave()
+	err = apply.Do(apply.Params{
+		Patch:         patch,
+		Old:           cave,
+		StagingDir:    staging,
+		Transactional: true,
+		Signature:     v1Sig,
+	})
+	assert.Error(t, err)
+	assertBuild(cave, v1Sig)
+	assertNoJournal()
+
+	// transactional applies are in-place only
+	err = apply.Do(apply.Params{
+		Patch:         patch,
+		Old:           cave,
+		Dir:           filepath.Join(dir, "fresh"),
+		StagingDir:    staging,
+		Transactional: true,
+	})
+	assert.Error(t, err)
+}
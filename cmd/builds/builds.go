@@ -0,0 +1,258 @@
+package builds
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/itchio/butler/comm"
+	"github.com/itchio/butler/localrepo"
+	"github.com/itchio/butler/mansion"
+	itchio "github.com/itchio/go-itchio"
+	"github.com/itchio/headway/united"
+	"github.com/olekukonko/tablewriter"
+	"github.com/pkg/errors"
+)
+
+// Params controls which builds are listed
+type Params struct {
+	// Limit is the maximum number of builds to list, 0 for no limit
+	Limit int
+	// UserVersion only lists builds whose userversion matches this
+	// pattern, like "1.2.*"
+	UserVersion string
+}
+
+var args = struct {
+	target *string
+	params Params
+}{}
+
+func Register(ctx *mansion.Context) {
+	cmd := ctx.App.Command("builds", "List the builds of a channel, newest first")
+	ctx.Register(cmd, do)
+
+	args.target = cmd.Arg("target", "Which user/project:channel to list builds of, for example 'leafo/x-moon:win-64', or a local build repository like ./repo:win-64").Required().String()
+	cmd.Flag("limit", "Maximum number of builds to list, 0 to list all of them").Default("20").IntVar(&args.params.Limit)
+	cmd.Flag("userversion", "Only list builds whose userversion matches this pattern, for example '1.2.*'").StringVar(&args.params.UserVersion)
+}
+
+func do(ctx *mansion.Context) {
+	go ctx.DoVersionCheck()
+	ctx.Must(Do(ctx, *args.target, args.params))
+}
+
+// Build is a single entry of the listing
+type Build struct {
+	ID int64 `json:"id"`
+	// ParentID is 0 for the first build of a channel
+	ParentID    int64             `json:"parentId"`
+	Version     int64             `json:"version"`
+	UserVersion string            `json:"userVersion"`
+	CreatedAt   *time.Time        `json:"createdAt"`
+	State       itchio.BuildState `json:"state"`
+	// FileSizes maps build file types (archive, patch, signature,
+	// unpacked) to their size. Missing types weren't generated,
+	// or are still processing.
+	FileSizes map[itchio.BuildFileType]int64 `json:"fileSizes"`
+}
+
+func Do(ctx *mansion.Context, specStr string, params Params) error {
+	if params.UserVersion != "" {
+		if _, err := path.Match(params.UserVersion, ""); err != nil {
+			return errors.Errorf("invalid userversion pattern: %s", params.UserVersion)
+		}
+	}
+
+	var builds []*Build
+	var err error
+	if localrepo.IsTarget(specStr) {
+		builds, err = listLocal(specStr)
+	} else {
+		builds, err = listRemote(ctx, specStr)
+	}
+	if err != nil {
+		return err
+	}
+
+	builds = Filter(builds, params)
+
+	comm.ResultOrPrint(builds, func() {
+		printBuilds(builds)
+	})
+	return nil
+}
+
+// Filter sorts builds newest first, then applies the userversion
+// pattern and the limit.
+func Filter(builds []*Build, params Params) []*Build {
+	sort.Slice(builds, func(i, j int) bool {
+		return builds[i].ID > builds[j].ID
+	})
+
+	var res []*Build
+	for _, b := range builds {
+		if params.Limit > 0 && len(res) >= params.Limit {
+			break
+		}
+		if params.UserVersion != "" {
+			if match, _ := path.Match(params.UserVersion, b.UserVersion); !match {
+				continue
+			}
+		}
+		res = append(res, b)
+	}
+	return res
+}
+
+func listRemote(ctx *mansion.Context, specStr string) ([]*Build, error) {
+	spec, err := itchio.ParseSpec(specStr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing spec %s", specStr)
+	}
+
+	err = spec.EnsureChannel()
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := ctx.AuthenticateViaOauth()
+	if err != nil {
+		return nil, errors.Wrap(err, "authenticating")
+	}
+
+	channelRes, err := client.GetChannel(ctx.DefaultCtx(), spec.Target, spec.Channel)
+	if err != nil {
+		return nil, errors.Wrap(err, "looking up channel")
+	}
+
+	buildsRes, err := client.ListUploadBuilds(ctx.DefaultCtx(), itchio.ListUploadBuildsParams{
+		UploadID: channelRes.Channel.Upload.ID,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "listing builds")
+	}
+
+	var builds []*Build
+	for _, b := range buildsRes.Builds {
+		parentID := b.ParentBuildID
+		if parentID < 0 {
+			parentID = 0
+		}
+
+		builds = append(builds, &Build{
+			ID:          b.ID,
+			ParentID:    parentID,
+			Version:     b.Version,
+			UserVersion: b.UserVersion,
+			CreatedAt:   b.CreatedAt,
+			State:       b.State,
+			FileSizes:   fileSizes(b.Files),
+		})
+	}
+	return builds, nil
+}
+
+// fileSizes returns the size of each type of build file, preferring
+// the default subtype when there's several of them.
+func fileSizes(files []*itchio.BuildFile) map[itchio.BuildFileType]int64 {
+	sizes := make(map[itchio.BuildFileType]int64)
+	for _, f := range files {
+		if f.State != itchio.BuildFileStateUploaded {
+			continue
+		}
+		if _, ok := sizes[f.Type]; ok && f.SubType != itchio.BuildFileSubTypeDefault {
+			continue
+		}
+		sizes[f.Type] = f.Size
+	}
+	return sizes
+}
+
+func listLocal(target string) ([]*Build, error) {
+	dir, channel, err := localrepo.ParseTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	if channel == "" {
+		return nil, errors.Errorf("target '%s' is missing a channel, expected something like ./repo:linux", target)
+	}
+
+	repo, err := localrepo.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	localBuilds, err := repo.Builds(channel)
+	if err != nil {
+		return nil, err
+	}
+
+	var builds []*Build
+	for _, b := range localBuilds {
+		createdAt := b.CreatedAt
+		builds = append(builds, &Build{
+			ID:          b.ID,
+			ParentID:    b.ParentID,
+			Version:     b.Version,
+			UserVersion: b.UserVersion,
+			CreatedAt:   &createdAt,
+			State:       itchio.BuildStateCompleted,
+			FileSizes: map[itchio.BuildFileType]int64{
+				itchio.BuildFileTypePatch:     b.PatchSize,
+				itchio.BuildFileTypeSignature: b.SignatureSize,
+				itchio.BuildFileTypeUnpacked:  b.Size,
+			},
+		})
+	}
+	return builds, nil
+}
+
+func printBuilds(builds []*Build) {
+	if len(builds) == 0 {
+		comm.Logf("No builds found")
+		return
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Build", "Parent", "Version", "Created", "State", "Archive", "Patch", "Signature", "Unpacked"})
+
+	formatSize := func(b *Build, fileType itchio.BuildFileType) string {
+		if size, ok := b.FileSizes[fileType]; ok {
+			return united.FormatBytes(size)
+		}
+		return "-"
+	}
+
+	for _, b := range builds {
+		parent := "-"
+		if b.ParentID > 0 {
+			parent = fmt.Sprintf("#%d", b.ParentID)
+		}
+
+		version := fmt.Sprintf("%d", b.Version)
+		if b.UserVersion != "" {
+			version = fmt.Sprintf("%s (%d)", b.UserVersion, b.Version)
+		}
+
+		created := "-"
+		if b.CreatedAt != nil {
+			created = b.CreatedAt.Local().Format("2006-01-02 15:04")
+		}
+
+		table.Append([]string{
+			fmt.Sprintf("#%d", b.ID),
+			parent,
+			version,
+			created,
+			string(b.State),
+			formatSize(b, itchio.BuildFileTypeArchive),
+			formatSize(b, itchio.BuildFileTypePatch),
+			formatSize(b, itchio.BuildFileTypeSignature),
+			formatSize(b, itchio.BuildFileTypeUnpacked),
+		})
+	}
+	table.Render()
+}
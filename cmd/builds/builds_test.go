@@ -0,0 +1,32 @@
+package builds_test
+
+import (
+	"testing"
+
+	"github.com/itchio/butler/cmd/builds"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilter(t *testing.T) {
+	list := func() []*builds.Build {
+		return []*builds.Build{
+			{ID: 10, UserVersion: "1.0.0"},
+			{ID: 12, UserVersion: "1.1.0"},
+			{ID: 11, UserVersion: "1.0.1"},
+			{ID: 13},
+		}
+	}
+	ids := func(bs []*builds.Build) []int64 {
+		var res []int64
+		for _, b := range bs {
+			res = append(res, b.ID)
+		}
+		return res
+	}
+
+	assert.EqualValues(t, []int64{13, 12, 11, 10}, ids(builds.Filter(list(), builds.Params{})))
+	assert.EqualValues(t, []int64{13, 12}, ids(builds.Filter(list(), builds.Params{Limit: 2})))
+	assert.EqualValues(t, []int64{11, 10}, ids(builds.Filter(list(), builds.Params{UserVersion: "1.0.*"})))
+	assert.EqualValues(t, []int64{11}, ids(builds.Filter(list(), builds.Params{UserVersion: "1.0.*", Limit: 1})))
+	assert.Empty(t, builds.Filter(list(), builds.Params{UserVersion: "2.*"}))
+}
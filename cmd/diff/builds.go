@@ -0,0 +1,315 @@
+package diff
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/itchio/butler/cmd/push"
+	"github.com/itchio/butler/comm"
+	"github.com/itchio/butler/localrepo"
+	"github.com/itchio/butler/mansion"
+	itchio "github.com/itchio/go-itchio"
+	"github.com/itchio/headway/united"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/wharf/pwr"
+	"github.com/pkg/errors"
+)
+
+// BuildRef designates a published build, like 'leafo/x-moon:win-64@1234'
+type BuildRef struct {
+	// Target is the project:channel part, or a local build repository
+	Target  string
+	BuildID int64
+}
+
+// ParseBuildRef returns a build reference if s looks like
+// 'project:channel@buildID' and isn't an existing file.
+func ParseBuildRef(s string) (*BuildRef, bool) {
+	i := strings.LastIndex(s, "@")
+	if i == -1 || !strings.Contains(s[:i], ":") {
+		return nil, false
+	}
+
+	id, err := strconv.ParseInt(s[i+1:], 10, 64)
+	if err != nil || id <= 0 {
+		return nil, false
+	}
+
+	if _, err := os.Stat(s); err == nil {
+		return nil, false
+	}
+
+	return &BuildRef{Target: s[:i], BuildID: id}, true
+}
+
+func (r *BuildRef) String() string {
+	return fmt.Sprintf("%s@%d", r.Target, r.BuildID)
+}
+
+// BuildDiff is how two published builds differ
+type BuildDiff struct {
+	Old *BuildRef `json:"old"`
+	New *BuildRef `json:"new"`
+
+	Files  []*push.PreviewFile                           `json:"files"`
+	Totals map[push.PreviewFileStatus]*push.PreviewTotal `json:"totals"`
+
+	// PatchSize is the total size of the patches needed to go from the
+	// old build to the new one, or -1 if there's no such patch chain.
+	PatchSize int64 `json:"patchSize"`
+}
+
+// buildSource looks up signatures and patch sizes of builds, either
+// on itch.io or in a local build repository
+type buildSource interface {
+	// check returns an error if a build isn't part of its target's channel
+	check(ref *BuildRef) error
+	signature(ref *BuildRef) (*pwr.SignatureInfo, error)
+	patchSize(oldRef *BuildRef, newRef *BuildRef) (int64, error)
+}
+
+// DoBuilds compares two published builds using only their signatures,
+// without downloading them.
+func DoBuilds(ctx *mansion.Context, oldRef *BuildRef, newRef *BuildRef) error {
+	var bs buildSource
+	if localrepo.IsTarget(oldRef.Target) {
+		if !localrepo.IsTarget(newRef.Target) {
+			return errors.New("diff: can't compare builds of a local repository with builds on itch.io")
+		}
+
+		dir, _, err := localrepo.ParseTarget(oldRef.Target)
+		if err != nil {
+			return err
+		}
+		repo, err := localrepo.Open(dir)
+		if err != nil {
+			return err
+		}
+		bs = &localBuildSource{repo: repo}
+	} else {
+		client, err := ctx.AuthenticateViaOauth()
+		if err != nil {
+			return errors.Wrap(err, "authenticating")
+		}
+		bs = &remoteBuildSource{ctx: ctx, client: client}
+	}
+
+	for _, ref := range []*BuildRef{oldRef, newRef} {
+		err := bs.check(ref)
+		if err != nil {
+			return err
+		}
+	}
+
+	comm.Opf("Comparing signatures of %s and %s", oldRef, newRef)
+
+	oldSignature, err := bs.signature(oldRef)
+	if err != nil {
+		return errors.Wrapf(err, "getting signature of %s", oldRef)
+	}
+	newSignature, err := bs.signature(newRef)
+	if err != nil {
+		return errors.Wrapf(err, "getting signature of %s", newRef)
+	}
+
+	preview, err := push.ComparePreview(newSignature, oldSignature)
+	if err != nil {
+		return err
+	}
+
+	patchSize, err := bs.patchSize(oldRef, newRef)
+	if err != nil {
+		return err
+	}
+
+	res := &BuildDiff{
+		Old:       oldRef,
+		New:       newRef,
+		Files:     preview.Files,
+		Totals:    preview.Totals,
+		PatchSize: patchSize,
+	}
+
+	comm.ResultOrPrint(res, func() {
+		printBuildDiff(res, oldSignature.Container, newSignature.Container)
+	})
+	return nil
+}
+
+func printBuildDiff(res *BuildDiff, oldContainer *tlc.Container, newContainer *tlc.Container) {
+	log := func(line string) {
+		comm.Logf(line)
+	}
+
+	// subset returns the files of container that have a given status,
+	// so they can be printed like `butler ls` does
+	subset := func(container *tlc.Container, status push.PreviewFileStatus) *tlc.Container {
+		paths := make(map[string]bool)
+		for _, f := range res.Files {
+			if f.Status == status {
+				paths[f.Path] = true
+			}
+		}
+
+		c := &tlc.Container{}
+		for _, f := range container.Files {
+			if paths[f.Path] {
+				c.Files = append(c.Files, f)
+				c.Size += f.Size
+			}
+		}
+		return c
+	}
+
+	sections := []struct {
+		title     string
+		status    push.PreviewFileStatus
+		container *tlc.Container
+	}{
+		{"Added", push.PreviewFileAdded, newContainer},
+		{"Removed", push.PreviewFileRemoved, oldContainer},
+		{"Changed", push.PreviewFileModified, newContainer},
+	}
+
+	for _, section := range sections {
+		c := subset(section.container, section.status)
+		if len(c.Files) == 0 {
+			continue
+		}
+		comm.Logf("")
+		comm.Logf("%s: %s", section.title, c)
+		c.Print(log)
+	}
+
+	comm.Logf("")
+	for _, status := range []push.PreviewFileStatus{push.PreviewFileAdded, push.PreviewFileRemoved, push.PreviewFileModified, push.PreviewFileUnchanged} {
+		total := res.Totals[status]
+		comm.Logf("%10s: %d files (%s)", status, total.Files, united.FormatBytes(total.Bytes))
+	}
+
+	if res.PatchSize >= 0 {
+		comm.Statf("Patch from build %d to build %d: %s", res.Old.BuildID, res.New.BuildID, united.FormatBytes(res.PatchSize))
+	} else {
+		comm.Logf("No patch from build %d to build %d (not on the same channel, or going back in time)", res.Old.BuildID, res.New.BuildID)
+	}
+}
+
+type remoteBuildSource struct {
+	ctx    *mansion.Context
+	client *itchio.Client
+}
+
+func (rbs *remoteBuildSource) check(ref *BuildRef) error {
+	spec, err := itchio.ParseSpec(ref.Target)
+	if err != nil {
+		return err
+	}
+	err = spec.EnsureChannel()
+	if err != nil {
+		return err
+	}
+
+	channelRes, err := rbs.client.GetChannel(rbs.ctx.DefaultCtx(), spec.Target, spec.Channel)
+	if err != nil {
+		return errors.Wrapf(err, "looking up channel %s", ref.Target)
+	}
+	if channelRes.Channel == nil || channelRes.Channel.Upload == nil {
+		return errors.Errorf("channel %s not found", ref.Target)
+	}
+
+	buildsRes, err := rbs.client.ListUploadBuilds(rbs.ctx.DefaultCtx(), itchio.ListUploadBuildsParams{
+		UploadID: channelRes.Channel.Upload.ID,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "listing builds of %s", ref.Target)
+	}
+	for _, b := range buildsRes.Builds {
+		if b.ID == ref.BuildID {
+			return nil
+		}
+	}
+	return errors.Errorf("build %d isn't a build of %s", ref.BuildID, ref.Target)
+}
+
+func (rbs *remoteBuildSource) signature(ref *BuildRef) (*pwr.SignatureInfo, error) {
+	return push.DownloadSignature(rbs.ctx, rbs.client, comm.NewStateConsumer(), ref.BuildID)
+}
+
+// patchSize sums the patches players download to upgrade
+// from the old build to the new one
+func (rbs *remoteBuildSource) patchSize(oldRef *BuildRef, newRef *BuildRef) (int64, error) {
+	if newRef.BuildID <= oldRef.BuildID {
+		return -1, nil
+	}
+
+	res, err := rbs.client.GetBuildUpgradePath(rbs.ctx.DefaultCtx(), itchio.GetBuildUpgradePathParams{
+		CurrentBuildID: oldRef.BuildID,
+		TargetBuildID:  newRef.BuildID,
+	})
+	if err != nil {
+		comm.Debugf("No upgrade path: %+v", err)
+		return -1, nil
+	}
+
+	var size int64
+	for _, b := range res.UpgradePath.Builds {
+		bf := itchio.FindBuildFileEx(itchio.BuildFileTypePatch, itchio.BuildFileSubTypeDefault, b.Files)
+		if bf == nil {
+			return -1, nil
+		}
+		size += bf.Size
+	}
+	return size, nil
+}
+
+type localBuildSource struct {
+	repo *localrepo.Repo
+}
+
+func (lbs *localBuildSource) check(ref *BuildRef) error {
+	dir, channel, err := localrepo.ParseTarget(ref.Target)
+	if err != nil {
+		return err
+	}
+	repo, err := localrepo.Open(dir)
+	if err != nil {
+		return err
+	}
+	if repo.Dir != lbs.repo.Dir {
+		return errors.New("diff: can't compare builds of different local repositories")
+	}
+
+	b, err := lbs.repo.Build(ref.BuildID)
+	if err != nil {
+		return err
+	}
+	if b.Channel != channel {
+		return errors.Errorf("build %d isn't a build of %s, it's on channel %s", ref.BuildID, ref.Target, b.Channel)
+	}
+	return nil
+}
+
+func (lbs *localBuildSource) signature(ref *BuildRef) (*pwr.SignatureInfo, error) {
+	return lbs.repo.ReadSignature(ref.BuildID)
+}
+
+// patchSize sums the patches from the new build back to the old one,
+// if the old one is one of its ancestors
+func (lbs *localBuildSource) patchSize(oldRef *BuildRef, newRef *BuildRef) (int64, error) {
+	chain, err := lbs.repo.Chain(newRef.BuildID)
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for i := len(chain) - 1; i >= 0; i-- {
+		b := chain[i]
+		if b.ID == oldRef.BuildID {
+			return size, nil
+		}
+		size += b.PatchSize
+	}
+	return -1, nil
+}
@@ -0,0 +1,68 @@
+package diff_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/itchio/butler/cmd/diff"
+	"github.com/itchio/butler/localrepo"
+	"github.com/itchio/wharf/wtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBuildRef(t *testing.T) {
+	ref, ok := diff.ParseBuildRef("leafo/x-moon:win-64@1234")
+	assert.True(t, ok)
+	assert.EqualValues(t, "leafo/x-moon:win-64", ref.Target)
+	assert.EqualValues(t, 1234, ref.BuildID)
+	assert.EqualValues(t, "leafo/x-moon:win-64@1234", ref.String())
+
+	ref, ok = diff.ParseBuildRef("./repo:linux@3")
+	assert.True(t, ok)
+	assert.EqualValues(t, "./repo:linux", ref.Target)
+
+	for _, s := range []string{
+		"leafo/x-moon:win-64",
+		"leafo/x-moon@1234",
+		"leafo/x-moon:win-64@latest",
+		"leafo/x-moon:win-64@0",
+		"builds/v1.zip",
+	} {
+		_, ok := diff.ParseBuildRef(s)
+		assert.False(t, ok, s)
+	}
+}
+
+func TestDoBuildsChecksChannels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diff-tests")
+	wtest.Must(t, err)
+	defer os.RemoveAll(dir)
+
+	repoDir := filepath.Join(dir, "repo")
+	repo, err := localrepo.Open(repoDir)
+	wtest.Must(t, err)
+
+	var ids []int64
+	for _, channel := range []string{"linux", "windows"} {
+		pending, err := repo.CreateBuild(channel, "")
+		wtest.Must(t, err)
+		wtest.Must(t, pending.Commit())
+		ids = append(ids, pending.Build.ID)
+	}
+
+	// build ids[1] is on the windows channel
+	err = diff.DoBuilds(nil,
+		&diff.BuildRef{Target: repoDir + ":linux", BuildID: ids[0]},
+		&diff.BuildRef{Target: repoDir + ":linux", BuildID: ids[1]},
+	)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "isn't a build of")
+
+	err = diff.DoBuilds(nil,
+		&diff.BuildRef{Target: repoDir + ":linux", BuildID: ids[0]},
+		&diff.BuildRef{Target: filepath.Join(dir, "other") + ":linux", BuildID: ids[0]},
+	)
+	assert.Error(t, err)
+}
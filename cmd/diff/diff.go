@@ -6,6 +6,7 @@ import (
 	"os"
 	"time"
 
+	"github.com/itchio/butler/archivesource"
 	"github.com/itchio/butler/comm"
 	"github.com/itchio/butler/filtering"
 	"github.com/itchio/butler/mansion"
@@ -42,20 +43,43 @@ type Params struct {
 	Compression pwr.CompressionSettings
 	// Verify enables dry-run apply patch validation (slow)
 	Verify bool
+	// Filter decides which files are compared, filtering.FilterPaths
+	// if nil. Signatures given as the target are only filtered when
+	// it's set.
+	Filter tlc.FilterFunc
 }
 
 var params Params
+var filterFlags filtering.Flags
 
 func Register(ctx *mansion.Context) {
 	cmd := ctx.App.Command("diff", "(Advanced) Compute the difference between two directories or .zip archives. Stores the patch in `patch.pwr`, and a signature in `patch.pwr.sig` for integrity checks and further diff.")
-	cmd.Arg("target", "Directory or .zip archive (slower) with older files, or signature file generated from old directory.").Required().StringVar(&params.Target)
-	cmd.Arg("source", "Directory or .zip archive (slower) with newer files").Required().StringVar(&params.Source)
+	ctx.AcceptStdin(cmd, "target", "source")
+	cmd.Arg("target", "Directory or archive (.zip, .tar, .tar.gz, .tar.xz, .tar.zst, .7z - slower) with older files, or signature file generated from old directory. Use - to read a tar stream from stdin, or user/game:channel@buildID to compare published builds without downloading them.").Required().StringVar(&params.Target)
+	cmd.Arg("source", "Directory or archive (.zip, .tar, .tar.gz, .tar.xz, .tar.zst, .7z - slower) with newer files. Use - to read a tar stream from stdin, or user/game:channel@buildID.").Required().StringVar(&params.Source)
 	cmd.Arg("patch", "Path to write the patch file (recommended extension is `.pwr`) The signature file will be written to the same path, with .sig added to the end.").Default("patch.pwr").StringVar(&params.Patch)
 	cmd.Flag("verify", "Make sure generated patch applies cleanly by applying it (slower)").BoolVar(&params.Verify)
+	filterFlags.Register(cmd)
 	ctx.Register(cmd, do)
 }
 
 func do(ctx *mansion.Context) {
+	oldRef, oldIsBuild := ParseBuildRef(params.Target)
+	newRef, newIsBuild := ParseBuildRef(params.Source)
+	if oldIsBuild && newIsBuild {
+		ctx.Must(DoBuilds(ctx, oldRef, newRef))
+		return
+	}
+	if oldIsBuild || newIsBuild {
+		ctx.Must(errors.New("diff: to compare published builds, both target and source must be like user/game:channel@buildID"))
+	}
+
+	if !filterFlags.IsEmpty() {
+		filter, err := filterFlags.Filter(filtering.FilterPaths)
+		ctx.Must(err)
+		params.Filter = filter
+	}
+
 	params.Compression = ctx.CompressionSettings()
 	ctx.Must(Do(params))
 }
@@ -76,6 +100,28 @@ func Do(params Params) error {
 	if params.Patch == "" {
 		return errors.New("diff: must specify Patch")
 	}
+	if archivesource.IsStdin(params.Target) && archivesource.IsStdin(params.Source) {
+		return errors.New("diff: only one of Target and Source can be read from stdin")
+	}
+	filter := params.Filter
+	if filter == nil {
+		filter = filtering.FilterPaths
+	}
+
+	// archives that can't be walked directly are extracted first
+	target, err := archivesource.Open(params.Target, comm.NewStateConsumer())
+	if err != nil {
+		return errors.Wrap(err, "opening target")
+	}
+	defer target.Close()
+	params.Target = target.Path
+
+	source, err := archivesource.Open(params.Source, comm.NewStateConsumer())
+	if err != nil {
+		return errors.Wrap(err, "opening source")
+	}
+	defer source.Close()
+	params.Source = source.Path
 
 	readAsSignature := func() error {
 		// Signature file perhaps?
@@ -101,6 +147,17 @@ func Do(params Params) error {
 			return errors.Wrap(err, "reading target as signature")
 		}
 
+		if params.Filter != nil {
+			var excluded []string
+			readSignature, excluded, err = filtering.FilterSignature(readSignature, params.Filter)
+			if err != nil {
+				return errors.Wrap(err, "filtering target signature")
+			}
+			if len(excluded) > 0 {
+				comm.Logf("Leaving out %d excluded files of the target signature", len(excluded))
+			}
+		}
+
 		targetSignature = readSignature
 
 		comm.Opf("Read signature from %s", params.Target)
@@ -113,7 +170,7 @@ func Do(params Params) error {
 	if err != nil {
 		if errors.Cause(err) == wire.ErrFormat || errors.Cause(err) == io.EOF {
 			// must be a container then
-			targetSignature.Container, err = tlc.WalkAny(params.Target, tlc.WalkOpts{Filter: filtering.FilterPaths})
+			targetSignature.Container, err = tlc.WalkAny(params.Target, tlc.WalkOpts{Filter: filter})
 			if err != nil {
 				return err
 			}
@@ -147,7 +204,7 @@ func Do(params Params) error {
 	startTime = time.Now()
 
 	var sourceContainer *tlc.Container
-	sourceContainer, err = tlc.WalkAny(params.Source, tlc.WalkOpts{Filter: filtering.FilterPaths})
+	sourceContainer, err = tlc.WalkAny(params.Source, tlc.WalkOpts{Filter: filter})
 	if err != nil {
 		return errors.Wrap(err, "walking source as directory")
 	}
@@ -4,35 +4,54 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 
 	"github.com/itchio/boar"
 
 	"github.com/itchio/butler/comm"
+	"github.com/itchio/butler/localrepo"
 	"github.com/itchio/butler/mansion"
 	itchio "github.com/itchio/go-itchio"
+	"github.com/itchio/hush/bfs"
 	"github.com/pkg/errors"
 )
 
+// Params selects which build of the channel is fetched. When both are
+// empty, the latest build is.
+type Params struct {
+	// BuildID is a specific build of the channel
+	BuildID int64
+	// UserVersion selects the newest build with that userversion
+	UserVersion string
+}
+
 var args = struct {
 	target *string
 	out    *string
+	params Params
 }{}
 
 func Register(ctx *mansion.Context) {
-	cmd := ctx.App.Command("fetch", "Download and extract the latest build of a channel from itch.io")
+	cmd := ctx.App.Command("fetch", "Download and extract a build of a channel from itch.io, or from a local build repository. If the directory holds an older build of the same channel, only patches are downloaded.")
 	ctx.Register(cmd, do)
 
-	args.target = cmd.Arg("target", "Which user/project:channel to fetch from, for example 'leafo/x-moon:win-64'. Targets are of the form project:channel where project is username/game or game_id.").Required().String()
+	args.target = cmd.Arg("target", "Which user/project:channel to fetch from, for example 'leafo/x-moon:win-64'. Targets are of the form project:channel where project is username/game or game_id, or a local build repository like ./repo:win-64.").Required().String()
 	args.out = cmd.Arg("out", "Directory to fetch and extract build to").Required().String()
+	cmd.Flag("build", "Fetch a specific build of the channel, by ID").Int64Var(&args.params.BuildID)
+	cmd.Flag("userversion", "Fetch the latest build of the channel with this userversion").StringVar(&args.params.UserVersion)
 }
 
 func do(ctx *mansion.Context) {
-	ctx.Must(Do(ctx, *args.target, *args.out))
+	ctx.Must(Do(ctx, *args.target, *args.out, args.params))
 }
 
-func Do(ctx *mansion.Context, specStr string, outPath string) error {
+func Do(ctx *mansion.Context, specStr string, outPath string, params Params) error {
 	consumer := comm.NewStateConsumer()
 
+	if params.BuildID != 0 && params.UserVersion != "" {
+		return errors.New("--build and --userversion can't be used together")
+	}
+
 	err := os.MkdirAll(outPath, os.FileMode(0o755))
 	if err != nil {
 		return errors.WithStack(err)
@@ -43,8 +62,8 @@ func Do(ctx *mansion.Context, specStr string, outPath string) error {
 		return errors.WithStack(err)
 	}
 
-	if len(outFiles) > 0 {
-		return fmt.Errorf("Destination directory %s exists and is not empty", outPath)
+	if localrepo.IsTarget(specStr) {
+		return doLocal(specStr, outPath, len(outFiles) > 0, params, consumer)
 	}
 
 	spec, err := itchio.ParseSpec(specStr)
@@ -62,18 +81,133 @@ func Do(ctx *mansion.Context, specStr string, outPath string) error {
 		return err
 	}
 
-	comm.Opf("Getting last build of channel %s", spec.Channel)
-
 	channelResponse, err := client.GetChannel(ctx.DefaultCtx(), spec.Target, spec.Channel)
 	if err != nil {
 		return err
 	}
+	channel := channelResponse.Channel
 
-	if channelResponse.Channel.Head == nil {
-		return fmt.Errorf("Channel %s doesn't have any builds yet", spec.Channel)
+	build, err := selectRemoteBuild(ctx, client, channel, params)
+	if err != nil {
+		return err
+	}
+
+	f := &fetcher{
+		ctx:      ctx,
+		client:   client,
+		consumer: consumer,
+		channel:  channel,
+		build:    build,
+		outPath:  outPath,
 	}
 
-	buildID := channelResponse.Channel.Head.ID
+	if len(outFiles) > 0 {
+		receipt, err := bfs.ReadReceipt(outPath)
+		if err != nil {
+			return err
+		}
+
+		if receipt == nil || receipt.Build == nil || receipt.Upload == nil || receipt.Upload.ID != channel.Upload.ID {
+			return fmt.Errorf("Destination directory %s is not empty, and wasn't fetched from channel %s", outPath, spec.Channel)
+		}
+
+		done, err := f.tryIncremental(receipt)
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+
+		comm.Opf("Wiping %s to fetch the full build", outPath)
+		err = wipeContents(outPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	return f.fetchArchive()
+}
+
+// selectRemoteBuild finds the build params asks for
+func selectRemoteBuild(ctx *mansion.Context, client *itchio.Client, channel *itchio.Channel, params Params) (*itchio.Build, error) {
+	if params.BuildID == 0 && params.UserVersion == "" {
+		comm.Opf("Getting last build of channel %s", channel.Name)
+		if channel.Head == nil {
+			return nil, fmt.Errorf("Channel %s doesn't have any builds yet", channel.Name)
+		}
+		return channel.Head, nil
+	}
+
+	buildsRes, err := client.ListUploadBuilds(ctx.DefaultCtx(), itchio.ListUploadBuildsParams{
+		UploadID: channel.Upload.ID,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "listing builds")
+	}
+
+	var builds []*Build
+	for _, b := range buildsRes.Builds {
+		builds = append(builds, &Build{
+			ID:          b.ID,
+			UserVersion: b.UserVersion,
+			Usable:      b.State == itchio.BuildStateCompleted,
+		})
+	}
+
+	selected, err := SelectBuild(builds, params)
+	if err != nil {
+		return nil, errors.Wrapf(err, "in channel %s", channel.Name)
+	}
+	for _, b := range buildsRes.Builds {
+		if b.ID == selected.ID {
+			return b, nil
+		}
+	}
+	return nil, errors.Errorf("build %d not found", selected.ID)
+}
+
+// Build is what SelectBuild needs to know about a build
+type Build struct {
+	ID          int64
+	UserVersion string
+	// Usable is false for builds that failed or are still processing
+	Usable bool
+}
+
+// SelectBuild returns the build with the given ID, or the newest usable
+// build with the given userversion.
+func SelectBuild(builds []*Build, params Params) (*Build, error) {
+	if params.BuildID != 0 {
+		for _, b := range builds {
+			if b.ID == params.BuildID {
+				if !b.Usable {
+					return nil, errors.Errorf("build %d is not available", b.ID)
+				}
+				return b, nil
+			}
+		}
+		return nil, errors.Errorf("no build %d", params.BuildID)
+	}
+
+	var res *Build
+	for _, b := range builds {
+		if b.UserVersion == params.UserVersion && b.Usable && (res == nil || b.ID > res.ID) {
+			res = b
+		}
+	}
+	if res == nil {
+		return nil, errors.Errorf("no build with userversion %s", params.UserVersion)
+	}
+	return res, nil
+}
+
+// fetchArchive downloads and extracts the build's archive into
+// an empty directory
+func (f *fetcher) fetchArchive() error {
+	ctx := f.ctx
+	client := f.client
+	buildID := f.build.ID
 
 	buildFilesRes, err := client.ListBuildFiles(ctx.DefaultCtx(), buildID)
 	if err != nil {
@@ -82,7 +216,7 @@ func Do(ctx *mansion.Context, specStr string, outPath string) error {
 
 	archiveFile := itchio.FindBuildFileEx(itchio.BuildFileTypeArchive, itchio.BuildFileSubTypeDefault, buildFilesRes.Files)
 	if archiveFile == nil {
-		return fmt.Errorf("Channel %s's latest build is still processing", spec.Channel)
+		return fmt.Errorf("Build %d of channel %s is still processing", buildID, f.channel.Name)
 	}
 
 	url := client.MakeBuildFileDownloadURL(itchio.MakeBuildFileDownloadURLParams{
@@ -90,13 +224,13 @@ func Do(ctx *mansion.Context, specStr string, outPath string) error {
 		FileID:  archiveFile.ID,
 	})
 
-	comm.Opf("Extracting into %s", outPath)
+	comm.Opf("Extracting build %d into %s", buildID, f.outPath)
 
 	comm.StartProgress()
 	extractRes, err := boar.SimpleExtract(&boar.SimpleExtractParams{
 		ArchivePath:       url,
-		Consumer:          consumer,
-		DestinationFolder: outPath,
+		Consumer:          f.consumer,
+		DestinationFolder: f.outPath,
 	})
 	comm.EndProgress()
 	if err != nil {
@@ -104,5 +238,20 @@ func Do(ctx *mansion.Context, specStr string, outPath string) error {
 	}
 	comm.Statf("Extracted %s", extractRes.Stats())
 
+	return f.writeReceipt()
+}
+
+// wipeContents removes everything inside dir, but not dir itself
+func wipeContents(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, entry := range entries {
+		err := os.RemoveAll(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
 	return nil
 }
@@ -0,0 +1,161 @@
+package fetch_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/itchio/butler/cmd/fetch"
+	"github.com/itchio/butler/localrepo"
+	"github.com/itchio/lake/pools"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/wsync"
+	"github.com/itchio/wharf/wtest"
+	"github.com/stretchr/testify/assert"
+
+	_ "github.com/itchio/wharf/compressors/cbrotli"
+	_ "github.com/itchio/wharf/decompressors/cbrotli"
+)
+
+func TestSelectBuild(t *testing.T) {
+	builds := []*fetch.Build{
+		{ID: 14, UserVersion: "1.1", Usable: false},
+		{ID: 13, UserVersion: "1.1", Usable: true},
+		{ID: 12, UserVersion: "1.1", Usable: true},
+		{ID: 11, UserVersion: "1.0", Usable: true},
+	}
+
+	b, err := fetch.SelectBuild(builds, fetch.Params{BuildID: 12})
+	wtest.Must(t, err)
+	assert.EqualValues(t, 12, b.ID)
+
+	_, err = fetch.SelectBuild(builds, fetch.Params{BuildID: 14})
+	assert.Error(t, err)
+	_, err = fetch.SelectBuild(builds, fetch.Params{BuildID: 99})
+	assert.Error(t, err)
+
+	// the newest usable build with that userversion wins
+	b, err = fetch.SelectBuild(builds, fetch.Params{UserVersion: "1.1"})
+	wtest.Must(t, err)
+	assert.EqualValues(t, 13, b.ID)
+
+	b, err = fetch.SelectBuild(builds, fetch.Params{UserVersion: "1.0"})
+	wtest.Must(t, err)
+	assert.EqualValues(t, 11, b.ID)
+
+	_, err = fetch.SelectBuild(builds, fetch.Params{UserVersion: "2.0"})
+	assert.Error(t, err)
+}
+
+func TestFetchLocalIncremental(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fetch-tests")
+	wtest.Must(t, err)
+	defer os.RemoveAll(dir)
+
+	repoDir := filepath.Join(dir, "repo")
+	repo, err := localrepo.Open(repoDir)
+	wtest.Must(t, err)
+
+	buildDir := filepath.Join(dir, "build")
+	writeFile := func(root string, name string, contents string) {
+		path := filepath.Join(root, name)
+		wtest.Must(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		wtest.Must(t, ioutil.WriteFile(path, []byte(contents), 0o644))
+	}
+	readFile := func(root string, name string) string {
+		contents, err := ioutil.ReadFile(filepath.Join(root, name))
+		wtest.Must(t, err)
+		return string(contents)
+	}
+
+	push := func() *localrepo.Build {
+		pending, err := repo.CreateBuild("linux", "")
+		wtest.Must(t, err)
+
+		targetSignature := &pwr.SignatureInfo{
+			Container: &tlc.Container{},
+			Hashes:    make([]wsync.BlockHash, 0),
+		}
+		if pending.Build.ParentID != 0 {
+			targetSignature, err = repo.ReadSignature(pending.Build.ParentID)
+			wtest.Must(t, err)
+		}
+
+		container, err := tlc.WalkAny(buildDir, tlc.WalkOpts{})
+		wtest.Must(t, err)
+		pool, err := pools.New(container, buildDir)
+		wtest.Must(t, err)
+		defer pool.Close()
+
+		patchFile, err := os.Create(pending.PatchPath())
+		wtest.Must(t, err)
+		signatureFile, err := os.Create(pending.SignaturePath())
+		wtest.Must(t, err)
+
+		dctx := &pwr.DiffContext{
+			Compression: &pwr.CompressionSettings{
+				Algorithm: pwr.CompressionAlgorithm_BROTLI,
+				Quality:   1,
+			},
+			SourceContainer: container,
+			Pool:            pool,
+			TargetContainer: targetSignature.Container,
+			TargetSignature: targetSignature.Hashes,
+		}
+		// WritePatch closes both files once it is done
+		wtest.Must(t, dctx.WritePatch(context.Background(), patchFile, signatureFile))
+
+		wtest.Must(t, pending.Commit())
+		return pending.Build
+	}
+
+	writeFile(buildDir, "game.sh", "#!/bin/sh\necho v1\n")
+	writeFile(buildDir, "data/level1.dat", "level one")
+	writeFile(buildDir, "data/common.dat", "common")
+	first := push()
+
+	writeFile(buildDir, "game.sh", "#!/bin/sh\necho v2\n")
+	writeFile(buildDir, "data/level2.dat", "level two")
+	push()
+
+	wtest.Must(t, os.Remove(filepath.Join(buildDir, "data", "level1.dat")))
+	third := push()
+
+	target := repoDir + ":linux"
+	outDir := filepath.Join(dir, "out")
+	wtest.Must(t, fetch.Do(nil, target, outDir, fetch.Params{BuildID: first.ID}))
+	assert.EqualValues(t, "level one", readFile(outDir, "data/level1.dat"))
+
+	// a full fetch would write every file again
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	commonPath := filepath.Join(outDir, "data", "common.dat")
+	wtest.Must(t, os.Chtimes(commonPath, old, old))
+
+	wtest.Must(t, fetch.Do(nil, target, outDir, fetch.Params{}))
+	assert.EqualValues(t, "#!/bin/sh\necho v2\n", readFile(outDir, "game.sh"))
+	assert.EqualValues(t, "level two", readFile(outDir, "data/level2.dat"))
+	_, err = os.Stat(filepath.Join(outDir, "data", "level1.dat"))
+	assert.True(t, os.IsNotExist(err))
+	stats, err := os.Stat(commonPath)
+	wtest.Must(t, err)
+	assert.True(t, stats.ModTime().Equal(old), "unchanged files should be left alone")
+
+	sig, err := repo.ReadSignature(third.ID)
+	wtest.Must(t, err)
+	wtest.Must(t, pwr.AssertValid(outDir, sig))
+
+	// modified directories are fetched from scratch
+	writeFile(outDir, "game.sh", "#!/bin/sh\necho modded\n")
+	wtest.Must(t, fetch.Do(nil, target, outDir, fetch.Params{BuildID: first.ID}))
+	assert.EqualValues(t, "#!/bin/sh\necho v1\n", readFile(outDir, "game.sh"))
+	assert.EqualValues(t, "level one", readFile(outDir, "data/level1.dat"))
+
+	// and so are directories fetched from elsewhere
+	otherDir := filepath.Join(dir, "other")
+	writeFile(otherDir, "readme.txt", "hi")
+	assert.Error(t, fetch.Do(nil, target, otherDir, fetch.Params{}))
+}
@@ -0,0 +1,233 @@
+package fetch
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+
+	"github.com/itchio/butler/comm"
+	"github.com/itchio/butler/mansion"
+	itchio "github.com/itchio/go-itchio"
+	"github.com/itchio/headway/state"
+	"github.com/itchio/headway/united"
+	"github.com/itchio/httpkit/eos/option"
+	"github.com/itchio/hush/bfs"
+	"github.com/itchio/lake/pools/fspool"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/savior"
+	"github.com/itchio/savior/filesource"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/pwr/bowl"
+	"github.com/itchio/wharf/pwr/patcher"
+	"github.com/pkg/errors"
+)
+
+// fetcher brings a directory to a given build of a channel
+type fetcher struct {
+	ctx      *mansion.Context
+	client   *itchio.Client
+	consumer *state.Consumer
+	channel  *itchio.Channel
+	build    *itchio.Build
+	outPath  string
+}
+
+// tryIncremental brings a directory that holds an older build of the
+// channel up to date by applying patches. It returns false if that's not
+// possible, because the directory was modified since it was fetched, or
+// because we're going back to an older build.
+func (f *fetcher) tryIncremental(receipt *bfs.Receipt) (bool, error) {
+	currentID := receipt.Build.ID
+	targetID := f.build.ID
+
+	if currentID > targetID {
+		comm.Logf("%s holds build %d, which is newer than build %d", f.outPath, currentID, targetID)
+		return false, nil
+	}
+
+	comm.Opf("%s holds build %d, checking it for modifications", f.outPath, currentID)
+	clean, err := f.isClean(currentID)
+	if err != nil {
+		return false, err
+	}
+	if !clean {
+		return false, nil
+	}
+
+	if currentID == targetID {
+		comm.Statf("Already up-to-date with build %d", targetID)
+		return true, nil
+	}
+
+	upgradeRes, err := f.client.GetBuildUpgradePath(f.ctx.DefaultCtx(), itchio.GetBuildUpgradePathParams{
+		CurrentBuildID: currentID,
+		TargetBuildID:  targetID,
+	})
+	if err != nil {
+		comm.Logf("No patch path from build %d to build %d: %s", currentID, targetID, err.Error())
+		return false, nil
+	}
+
+	builds := upgradeRes.UpgradePath.Builds
+	var patchesSize int64
+	for _, b := range builds {
+		if pf := itchio.FindBuildFileEx(itchio.BuildFileTypePatch, itchio.BuildFileSubTypeDefault, b.Files); pf != nil {
+			patchesSize += pf.Size
+		}
+	}
+	comm.Opf("Applying %d patches (%s)", len(builds), united.FormatBytes(patchesSize))
+
+	comm.StartProgress()
+	for i, b := range builds {
+		comm.Logf("Patching to build %d (%d/%d)", b.ID, i+1, len(builds))
+		err := f.applyPatch(b)
+		if err != nil {
+			comm.EndProgress()
+			return false, errors.Wrapf(err, "applying patch of build %d", b.ID)
+		}
+	}
+	comm.EndProgress()
+	comm.Statf("Patched to build %d", targetID)
+
+	return true, f.writeReceipt()
+}
+
+// isClean returns true if the directory holds exactly the given build,
+// according to its signature
+func (f *fetcher) isClean(buildID int64) (bool, error) {
+	sig, err := f.readSignature(buildID)
+	if err != nil {
+		return false, err
+	}
+	return isClean(f.outPath, buildID, sig)
+}
+
+// isClean returns true if dir holds exactly what sig describes, receipt aside
+func isClean(dir string, buildID int64, sig *pwr.SignatureInfo) (bool, error) {
+	container, err := tlc.WalkAny(dir, tlc.WalkOpts{
+		Filter: ignoreReceipt,
+	})
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	err = sig.Container.EnsureEqual(container)
+	if err != nil {
+		comm.Logf("Files were added or removed since build %d was fetched: %s", buildID, err.Error())
+		return false, nil
+	}
+
+	err = pwr.AssertValid(dir, sig)
+	if err != nil {
+		if _, ok := err.(*pwr.ErrHasWound); ok {
+			comm.Logf("Files were modified since build %d was fetched", buildID)
+			return false, nil
+		}
+		return false, errors.Wrap(err, "checking for modifications")
+	}
+	return true, nil
+}
+
+func ignoreReceipt(name string) tlc.FilterResult {
+	if name == ".itch" {
+		return tlc.FilterIgnore
+	}
+	return tlc.FilterKeep
+}
+
+func (f *fetcher) readSignature(buildID int64) (*pwr.SignatureInfo, error) {
+	url := f.client.MakeBuildDownloadURL(itchio.MakeBuildDownloadURLParams{
+		BuildID: buildID,
+		Type:    itchio.BuildFileTypeSignature,
+	})
+
+	source, err := filesource.Open(url, option.WithConsumer(f.consumer))
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening signature of build %d", buildID)
+	}
+	defer source.Close()
+
+	sig, err := pwr.ReadSignature(context.Background(), source)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading signature of build %d", buildID)
+	}
+	return sig, nil
+}
+
+// applyPatch patches the directory in place, from a build's
+// parent to the build itself
+func (f *fetcher) applyPatch(b *itchio.Build) error {
+	subType := itchio.BuildFileSubTypeDefault
+	if itchio.FindBuildFileEx(itchio.BuildFileTypePatch, itchio.BuildFileSubTypeOptimized, b.Files) != nil {
+		subType = itchio.BuildFileSubTypeOptimized
+	}
+
+	patchURL := f.client.MakeBuildDownloadURL(itchio.MakeBuildDownloadURLParams{
+		BuildID: b.ID,
+		Type:    itchio.BuildFileTypePatch,
+		SubType: subType,
+	})
+
+	patchSource, err := filesource.Open(patchURL, option.WithConsumer(f.consumer))
+	if err != nil {
+		return errors.Wrap(err, "opening patch")
+	}
+	defer patchSource.Close()
+
+	return patchInPlace(patchSource, f.outPath, f.consumer)
+}
+
+// patchInPlace applies a patch to dir, which must hold exactly the
+// patch's target build
+func patchInPlace(patchSource savior.SeekSource, dir string, consumer *state.Consumer) error {
+	p, err := patcher.New(patchSource, consumer)
+	if err != nil {
+		return errors.Wrap(err, "creating patcher")
+	}
+
+	stageFolder, err := ioutil.TempDir("", "butler-fetch")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.RemoveAll(stageFolder)
+
+	targetPool := fspool.New(p.GetTargetContainer(), dir)
+	patchBowl, err := bowl.NewOverlayBowl(bowl.OverlayBowlParams{
+		TargetContainer: p.GetTargetContainer(),
+		SourceContainer: p.GetSourceContainer(),
+		OutputFolder:    dir,
+		StageFolder:     stageFolder,
+		Consumer:        consumer,
+	})
+	if err != nil {
+		return errors.Wrap(err, "creating bowl")
+	}
+
+	err = p.Resume(nil, targetPool, patchBowl)
+	if err != nil {
+		return err
+	}
+
+	return patchBowl.Commit()
+}
+
+// writeReceipt records which build the directory holds, so the next
+// fetch can patch it instead of downloading everything again
+func (f *fetcher) writeReceipt() error {
+	container, err := tlc.WalkAny(f.outPath, tlc.WalkOpts{
+		Filter: ignoreReceipt,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	receipt := &bfs.Receipt{
+		Upload:        f.channel.Upload,
+		Build:         f.build,
+		InstallerName: "archive",
+	}
+	for _, file := range container.Files {
+		receipt.Files = append(receipt.Files, file.Path)
+	}
+	return receipt.WriteReceipt(f.outPath)
+}
@@ -0,0 +1,213 @@
+package fetch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/itchio/butler/comm"
+	"github.com/itchio/butler/localrepo"
+	"github.com/itchio/headway/state"
+	"github.com/itchio/savior/filesource"
+	"github.com/pkg/errors"
+)
+
+// localReceipt records which build of a local repository a directory
+// holds, like receipts do for builds fetched from itch.io
+type localReceipt struct {
+	Repo    string `json:"repo"`
+	Channel string `json:"channel"`
+	BuildID int64  `json:"buildId"`
+}
+
+func localReceiptPath(dir string) string {
+	return filepath.Join(dir, ".itch", "localrepo.json")
+}
+
+// readLocalReceipt returns nil if dir wasn't fetched from a local repository
+func readLocalReceipt(dir string) (*localReceipt, error) {
+	contents, err := ioutil.ReadFile(localReceiptPath(dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+
+	receipt := &localReceipt{}
+	err = json.Unmarshal(contents, receipt)
+	if err != nil {
+		return nil, errors.Wrapf(err, "decoding %s", localReceiptPath(dir))
+	}
+	return receipt, nil
+}
+
+func (r *localReceipt) write(dir string) error {
+	contents, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	path := localReceiptPath(dir)
+	err = os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(ioutil.WriteFile(path, contents, 0o644))
+}
+
+// doLocal rebuilds a build of a channel of a local build repository
+// by applying its chain of patches. If outPath holds an older build of
+// the channel, only the patches since that build are applied.
+func doLocal(target string, outPath string, hasFiles bool, params Params, consumer *state.Consumer) error {
+	dir, channel, err := localrepo.ParseTarget(target)
+	if err != nil {
+		return err
+	}
+	if channel == "" {
+		return errors.Errorf("fetch target '%s' is missing a channel, expected something like ./repo:linux", target)
+	}
+
+	repo, err := localrepo.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	build, err := repo.Head(channel)
+	if err != nil {
+		return err
+	}
+	if build == nil {
+		return fmt.Errorf("Channel %s doesn't have any builds yet", channel)
+	}
+
+	if params.BuildID != 0 || params.UserVersion != "" {
+		localBuilds, err := repo.Builds(channel)
+		if err != nil {
+			return err
+		}
+
+		var builds []*Build
+		for _, b := range localBuilds {
+			builds = append(builds, &Build{ID: b.ID, UserVersion: b.UserVersion, Usable: true})
+		}
+		selected, err := SelectBuild(builds, params)
+		if err != nil {
+			return errors.Wrapf(err, "in channel %s", channel)
+		}
+
+		build, err = repo.Build(selected.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	receipt := &localReceipt{
+		Repo:    repo.Dir,
+		Channel: channel,
+		BuildID: build.ID,
+	}
+
+	if hasFiles {
+		previous, err := readLocalReceipt(outPath)
+		if err != nil {
+			return err
+		}
+		if previous == nil || previous.Repo != repo.Dir || previous.Channel != channel {
+			return fmt.Errorf("Destination directory %s is not empty, and wasn't fetched from channel %s", outPath, channel)
+		}
+
+		done, err := tryLocalIncremental(repo, previous.BuildID, build, outPath, consumer)
+		if err != nil {
+			return err
+		}
+		if done {
+			return receipt.write(outPath)
+		}
+
+		comm.Opf("Wiping %s to fetch the full build", outPath)
+		err = wipeContents(outPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	comm.Opf("Rebuilding build %d of channel %s into %s", build.ID, channel, outPath)
+
+	comm.StartProgress()
+	err = repo.Materialize(build.ID, outPath, consumer)
+	comm.EndProgress()
+	if err != nil {
+		return err
+	}
+	comm.Statf("Fetched build %d (version %d)", build.ID, build.Version)
+
+	return receipt.write(outPath)
+}
+
+// tryLocalIncremental brings a directory that holds an older build of the
+// channel up to date by applying the patches of the builds since. It returns
+// false if that's not possible, because the directory was modified since it
+// was fetched, or because the build it holds isn't an ancestor of build.
+func tryLocalIncremental(repo *localrepo.Repo, currentID int64, build *localrepo.Build, outPath string, consumer *state.Consumer) (bool, error) {
+	chain, err := repo.Chain(build.ID)
+	if err != nil {
+		return false, err
+	}
+
+	start := -1
+	for i, b := range chain {
+		if b.ID == currentID {
+			start = i + 1
+			break
+		}
+	}
+	if start == -1 {
+		comm.Logf("%s holds build %d, which build %d wasn't patched from", outPath, currentID, build.ID)
+		return false, nil
+	}
+
+	comm.Opf("%s holds build %d, checking it for modifications", outPath, currentID)
+	sig, err := repo.ReadSignature(currentID)
+	if err != nil {
+		return false, err
+	}
+	clean, err := isClean(outPath, currentID, sig)
+	if err != nil {
+		return false, err
+	}
+	if !clean {
+		return false, nil
+	}
+
+	patches := chain[start:]
+	if len(patches) == 0 {
+		comm.Statf("Already up-to-date with build %d", build.ID)
+		return true, nil
+	}
+
+	comm.Opf("Applying %d patches", len(patches))
+	comm.StartProgress()
+	for i, b := range patches {
+		comm.Logf("Patching to build %d (%d/%d)", b.ID, i+1, len(patches))
+		err := func() error {
+			patchSource, err := filesource.Open(repo.PatchPath(b.ID))
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			defer patchSource.Close()
+
+			return patchInPlace(patchSource, outPath, consumer)
+		}()
+		if err != nil {
+			comm.EndProgress()
+			return false, errors.Wrapf(err, "applying patch of build %d", b.ID)
+		}
+	}
+	comm.EndProgress()
+	comm.Statf("Patched to build %d (version %d)", build.ID, build.Version)
+
+	return true, nil
+}
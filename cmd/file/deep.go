@@ -0,0 +1,336 @@
+package file
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/itchio/boar"
+	"github.com/itchio/butler/cmd/elfprops"
+	"github.com/itchio/butler/cmd/exeprops"
+	"github.com/itchio/butler/cmd/machoprops"
+	"github.com/itchio/headway/state"
+	"github.com/itchio/headway/united"
+	"github.com/itchio/httpkit/eos"
+	"github.com/itchio/httpkit/eos/option"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/savior"
+	"github.com/itchio/spellbook"
+	"github.com/itchio/wizardry/wizardry/wizutil"
+	"github.com/pkg/errors"
+)
+
+// DefaultMaxDepth is how many levels of nested archives --deep opens
+// when no --depth is given
+const DefaultMaxDepth = 4
+
+// Node is a file found by a deep inspection, along with what's
+// inside of it if it's an archive or an installer we can open.
+type Node struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	// Format is what the file was detected as: zip, tar.gz, 7-zip,
+	// msi, nsis, inno, pe, elf, mach-o, or empty if we don't know.
+	Format string `json:"format,omitempty"`
+	// Description is what spellbook says about the file, if anything
+	Description string `json:"description,omitempty"`
+	// Arch is set for PE, ELF and Mach-O executables, installers included.
+	// Universal Mach-O files have all their architectures, like x86_64+arm64.
+	Arch     string  `json:"arch,omitempty"`
+	Children []*Node `json:"children,omitempty"`
+	// Truncated is set for archives that weren't opened because
+	// of the depth limit
+	Truncated bool `json:"truncated,omitempty"`
+	// Error is set when the file couldn't be inspected or opened.
+	// It doesn't stop the inspection of the rest of the tree.
+	Error string `json:"error,omitempty"`
+}
+
+// Print writes the tree rooted at n, one file per line, with
+// the contents of archives indented under them.
+func (n *Node) Print(log func(line string)) {
+	n.print(log, "")
+}
+
+func (n *Node) print(log func(line string), indent string) {
+	var details []string
+	if n.Format != "" {
+		details = append(details, n.Format)
+	} else if n.Description != "" {
+		details = append(details, n.Description)
+	}
+	if n.Arch != "" {
+		details = append(details, n.Arch)
+	}
+	details = append(details, united.FormatBytes(n.Size))
+
+	line := fmt.Sprintf("%s%s (%s)", indent, n.Name, strings.Join(details, ", "))
+	if n.Truncated {
+		line += " [not opened: depth limit reached]"
+	}
+	if n.Error != "" {
+		line += fmt.Sprintf(" [error: %s]", n.Error)
+	}
+	log(line)
+
+	for _, child := range n.Children {
+		child.print(log, indent+"  ")
+	}
+}
+
+// DeepParams controls a deep inspection
+type DeepParams struct {
+	Consumer *state.Consumer
+	// MaxDepth is how many levels of nested archives are opened.
+	// Zero only identifies the file itself.
+	MaxDepth int
+}
+
+// Deep identifies the file at path, and, if it's an archive or an
+// installer we know how to open, everything inside of it, recursively.
+// Nested archives are extracted to a temporary folder, which is removed
+// once they've been inspected.
+func Deep(path string, params DeepParams) (*Node, error) {
+	f, err := eos.Open(path, option.WithConsumer(params.Consumer))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	stats, err := f.Stat()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if stats.IsDir() {
+		return nil, errors.Errorf("%s: is a directory", eos.Redact(path))
+	}
+
+	d := &deepInspector{
+		params: params,
+		// extractors narrate what they're doing, which would drown out the tree
+		extractConsumer: &state.Consumer{
+			OnMessage: func(level string, msg string) {
+				params.Consumer.Debugf("%s", msg)
+			},
+		},
+	}
+	return d.inspect(f, filepath.Base(eos.Redact(path)), stats.Size(), 0), nil
+}
+
+type deepInspector struct {
+	params          DeepParams
+	extractConsumer *state.Consumer
+}
+
+// format is what sniff found out about a file
+type format struct {
+	name        string
+	description string
+	// strategy is how to open the file, or boar.StrategyNone if we can't
+	strategy boar.Strategy
+}
+
+func (d *deepInspector) inspect(f eos.File, name string, size int64, depth int) *Node {
+	node := &Node{
+		Name: name,
+		Size: size,
+	}
+
+	fm, err := sniff(f, name, size)
+	if err != nil {
+		node.Error = err.Error()
+		return node
+	}
+	node.Format = fm.name
+	node.Description = fm.description
+
+	switch fm.name {
+	case "pe", "nsis", "inno":
+		info, err := exeprops.Do(f, d.params.Consumer)
+		if err != nil {
+			node.Error = errors.Wrap(err, "probing PE file").Error()
+		} else {
+			node.Arch = string(info.Arch)
+		}
+	case "elf":
+		info, err := elfprops.Do(f, d.params.Consumer)
+		if err != nil {
+			node.Error = errors.Wrap(err, "probing ELF file").Error()
+		} else {
+			node.Arch = string(info.Arch)
+		}
+	case "mach-o":
+		info, err := machoprops.Do(f, d.params.Consumer)
+		if err != nil {
+			node.Error = errors.Wrap(err, "probing Mach-O file").Error()
+		} else {
+			var archs []string
+			for _, arch := range info.Archs() {
+				archs = append(archs, string(arch))
+			}
+			node.Arch = strings.Join(archs, "+")
+		}
+	}
+
+	if fm.strategy == boar.StrategyNone {
+		return node
+	}
+	if depth >= d.params.MaxDepth {
+		node.Truncated = true
+		return node
+	}
+
+	children, err := d.open(f, fm.strategy, depth)
+	if err != nil {
+		node.Error = err.Error()
+	}
+	node.Children = children
+	return node
+}
+
+// open extracts an archive to a temporary folder and inspects
+// everything in it.
+func (d *deepInspector) open(f eos.File, strategy boar.Strategy, depth int) ([]*Node, error) {
+	_, err := f.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	info := &boar.Info{Strategy: strategy}
+	ex, err := info.GetExtractor(f, d.extractConsumer)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	ex.SetConsumer(d.extractConsumer)
+
+	dir, err := ioutil.TempDir("", "butler-file-deep")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sink := &savior.FolderSink{
+		Directory: dir,
+		Consumer:  d.extractConsumer,
+	}
+	_, err = ex.Resume(nil, sink)
+	sink.Close()
+	if err != nil {
+		return nil, errors.Wrapf(err, "extracting %s", strategy)
+	}
+
+	container, err := tlc.WalkDir(dir, tlc.WalkOpts{})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var children []*Node
+	for _, file := range container.Files {
+		child, err := func() (*Node, error) {
+			cf, err := os.Open(filepath.Join(dir, filepath.FromSlash(file.Path)))
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			defer cf.Close()
+			return d.inspect(cf, file.Path, file.Size, depth+1), nil
+		}()
+		if err != nil {
+			return children, err
+		}
+		children = append(children, child)
+	}
+	return children, nil
+}
+
+var (
+	zipMagic      = []byte("PK\x03\x04")
+	emptyZipMagic = []byte("PK\x05\x06")
+	sevenZipMagic = []byte("7z\xbc\xaf\x27\x1c")
+	gzipMagic     = []byte("\x1f\x8b")
+	bzip2Magic    = []byte("BZh")
+	xzMagic       = []byte("\xfd7zXZ\x00")
+	// MSI packages are OLE compound documents
+	oleMagic = []byte("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1")
+	elfMagic = []byte("\x7fELF")
+	mzMagic  = []byte("MZ")
+)
+
+// sniff detects the format of a file from its contents. spellbook
+// knows about executables and installers, but not about archives,
+// so those are recognized by their magic numbers.
+func sniff(f eos.File, name string, size int64) (*format, error) {
+	header := make([]byte, 512)
+	n, err := f.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return nil, errors.WithStack(err)
+	}
+	header = header[:n]
+
+	fm := &format{}
+	spell := spellbook.Identify(wizutil.NewSliceReader(f, 0, size), 0)
+	if len(spell) > 0 {
+		fm.description = wizutil.MergeStrings(spell)
+	}
+
+	lowerName := strings.ToLower(name)
+	switch {
+	case bytes.HasPrefix(header, zipMagic), bytes.HasPrefix(header, emptyZipMagic):
+		fm.name, fm.strategy = "zip", boar.StrategyZip
+	case bytes.HasPrefix(header, sevenZipMagic):
+		fm.name, fm.strategy = "7-zip", boar.StrategySevenZip
+	case isTar(header):
+		fm.name, fm.strategy = "tar", boar.StrategyTar
+	case bytes.HasPrefix(header, gzipMagic):
+		fm.name = "gzip"
+		if gr, err := gzip.NewReader(io.NewSectionReader(f, 0, size)); err == nil && containsTar(gr) {
+			fm.name, fm.strategy = "tar.gz", boar.StrategyTarGz
+		}
+	case bytes.HasPrefix(header, bzip2Magic):
+		fm.name = "bzip2"
+		if containsTar(bzip2.NewReader(io.NewSectionReader(f, 0, size))) {
+			fm.name, fm.strategy = "tar.bz2", boar.StrategyTarBz2
+		}
+	case bytes.HasPrefix(header, xzMagic):
+		// there's no pure Go xz decompressor to peek with
+		fm.name = "xz"
+		if strings.HasSuffix(lowerName, ".tar.xz") || strings.HasSuffix(lowerName, ".txz") {
+			fm.name, fm.strategy = "tar.xz", boar.StrategyTarXz
+		}
+	case bytes.HasPrefix(header, oleMagic):
+		if strings.HasSuffix(lowerName, ".msi") {
+			fm.name, fm.strategy = "msi", boar.StrategySevenZip
+		}
+	case bytes.HasPrefix(header, elfMagic):
+		fm.name = "elf"
+	case bytes.HasPrefix(header, mzMagic):
+		switch {
+		case strings.Contains(fm.description, "Nullsoft Installer"):
+			fm.name, fm.strategy = "nsis", boar.StrategySevenZip
+		case strings.Contains(fm.description, "InnoSetup"):
+			// 7-zip can't open those
+			fm.name = "inno"
+		default:
+			fm.name = "pe"
+		}
+	case strings.Contains(fm.description, "Mach-O"):
+		fm.name = "mach-o"
+	}
+	return fm, nil
+}
+
+// isTar looks for the ustar magic of POSIX and GNU tar headers
+func isTar(header []byte) bool {
+	return len(header) >= 262 && string(header[257:262]) == "ustar"
+}
+
+func containsTar(r io.Reader) bool {
+	header := make([]byte, 512)
+	n, _ := io.ReadFull(r, header)
+	return isTar(header[:n])
+}
@@ -0,0 +1,148 @@
+package file_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/itchio/butler/cmd/file"
+	"github.com/itchio/wharf/wtest"
+	"github.com/stretchr/testify/assert"
+)
+
+type entry struct {
+	name     string
+	contents []byte
+}
+
+func makeZip(t *testing.T, entries ...entry) []byte {
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	for _, e := range entries {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: e.name, Method: zip.Store})
+		wtest.Must(t, err)
+		_, err = w.Write(e.contents)
+		wtest.Must(t, err)
+	}
+	wtest.Must(t, zw.Close())
+	return buf.Bytes()
+}
+
+func makeTarGz(t *testing.T, entries ...entry) []byte {
+	buf := new(bytes.Buffer)
+	gw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gw)
+	for _, e := range entries {
+		wtest.Must(t, tw.WriteHeader(&tar.Header{
+			Name:     e.name,
+			Mode:     0o644,
+			Size:     int64(len(e.contents)),
+			Typeflag: tar.TypeReg,
+		}))
+		_, err := tw.Write(e.contents)
+		wtest.Must(t, err)
+	}
+	wtest.Must(t, tw.Close())
+	wtest.Must(t, gw.Close())
+	return buf.Bytes()
+}
+
+func TestDeep(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-deep")
+	wtest.Must(t, err)
+	defer os.RemoveAll(dir)
+
+	readme := []byte("hello")
+	inner := makeTarGz(t,
+		entry{"data/level1.pak", []byte("not much")},
+		entry{"README.txt", readme},
+	)
+	entries := []entry{
+		{"docs.tar.gz", inner},
+		{"nested.zip", makeZip(t, entry{"README.txt", readme})},
+		{"notes.txt.gz", func() []byte {
+			buf := new(bytes.Buffer)
+			gw := gzip.NewWriter(buf)
+			_, err := gw.Write(readme)
+			wtest.Must(t, err)
+			wtest.Must(t, gw.Close())
+			return buf.Bytes()
+		}()},
+	}
+
+	if runtime.GOOS == "linux" {
+		// the test binary makes for a fine ELF executable
+		exe, err := os.Executable()
+		wtest.Must(t, err)
+		contents, err := ioutil.ReadFile(exe)
+		wtest.Must(t, err)
+		entries = append(entries, entry{"bin/game", contents})
+	}
+
+	outer := filepath.Join(dir, "upload.zip")
+	wtest.Must(t, ioutil.WriteFile(outer, makeZip(t, entries...), 0o644))
+
+	root, err := file.Deep(outer, file.DeepParams{MaxDepth: file.DefaultMaxDepth})
+	wtest.Must(t, err)
+
+	assert.EqualValues(t, "upload.zip", root.Name)
+	assert.EqualValues(t, "zip", root.Format)
+	assert.Empty(t, root.Error)
+
+	byName := make(map[string]*file.Node)
+	for _, child := range root.Children {
+		byName[child.Name] = child
+	}
+
+	docs := byName["docs.tar.gz"]
+	if assert.NotNil(t, docs) {
+		assert.EqualValues(t, "tar.gz", docs.Format)
+		assert.EqualValues(t, len(inner), docs.Size)
+		if assert.Len(t, docs.Children, 2) {
+			assert.EqualValues(t, "README.txt", docs.Children[0].Name)
+			assert.EqualValues(t, len(readme), docs.Children[0].Size)
+			assert.EqualValues(t, "data/level1.pak", docs.Children[1].Name)
+		}
+	}
+
+	nested := byName["nested.zip"]
+	if assert.NotNil(t, nested) {
+		assert.EqualValues(t, "zip", nested.Format)
+		assert.Len(t, nested.Children, 1)
+	}
+
+	notes := byName["notes.txt.gz"]
+	if assert.NotNil(t, notes) {
+		assert.EqualValues(t, "gzip", notes.Format)
+		assert.Empty(t, notes.Children)
+	}
+
+	if runtime.GOOS == "linux" {
+		game := byName["bin/game"]
+		if assert.NotNil(t, game) {
+			assert.EqualValues(t, "elf", game.Format)
+			assert.NotEmpty(t, game.Arch)
+		}
+	}
+
+	root, err = file.Deep(outer, file.DeepParams{MaxDepth: 1})
+	wtest.Must(t, err)
+	for _, child := range root.Children {
+		assert.Empty(t, child.Children)
+		if child.Name == "nested.zip" {
+			assert.True(t, child.Truncated)
+		}
+	}
+
+	var lines []string
+	root.Print(func(line string) {
+		lines = append(lines, line)
+	})
+	assert.Contains(t, lines, "  nested.zip (zip, 139 B) [not opened: depth limit reached]")
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"io"
 	"os"
+	"strconv"
 
 	"github.com/itchio/arkive/zip"
 	"github.com/itchio/butler/comm"
@@ -28,19 +29,46 @@ import (
 )
 
 var args = struct {
-	file *string
+	file  *string
+	deep  *bool
+	depth *int
 }{}
 
 func Register(ctx *mansion.Context) {
 	cmd := ctx.App.Command("file", "Prints the type of a given file, and some stats about it")
 	args.file = cmd.Arg("file", "A file you'd like to identify").Required().String()
+	args.deep = cmd.Flag("deep", "Also identify everything inside archives and installers, recursively").Bool()
+	args.depth = cmd.Flag("depth", "How many levels of nested archives to open with --deep").Default(strconv.Itoa(DefaultMaxDepth)).Int()
 	ctx.Register(cmd, do)
 }
 
 func do(ctx *mansion.Context) {
+	if *args.deep {
+		ctx.Must(DoDeep(*args.file, *args.depth))
+		return
+	}
 	ctx.Must(Do(ctx, *args.file))
 }
 
+// DoDeep prints the tree of everything inside a file, or sends it
+// as a result in JSON mode.
+func DoDeep(inPath string, maxDepth int) error {
+	root, err := Deep(inPath, DeepParams{
+		Consumer: comm.NewStateConsumer(),
+		MaxDepth: maxDepth,
+	})
+	if err != nil {
+		return err
+	}
+
+	comm.ResultOrPrint(root, func() {
+		root.Print(func(line string) {
+			comm.Logf("%s", line)
+		})
+	})
+	return nil
+}
+
 func Do(ctx *mansion.Context, inPath string) error {
 	consumer := comm.NewStateConsumer()
 
@@ -6,46 +6,52 @@ import (
 	"os"
 
 	"github.com/itchio/butler/comm"
+	"github.com/itchio/butler/healing"
 	"github.com/itchio/butler/mansion"
+	"github.com/itchio/lake/tlc"
 	"github.com/itchio/savior/seeksource"
 	"github.com/itchio/wharf/pwr"
-	"github.com/itchio/lake/tlc"
 	"github.com/itchio/wharf/wire"
 	"github.com/pkg/errors"
 )
 
 var args = struct {
-	dir    *string
-	wounds *string
-	spec   *string
+	dir       *string
+	wounds    *string
+	specs     *[]string
+	signature *string
 }{}
 
 func Register(ctx *mansion.Context) {
 	cmd := ctx.App.Command("heal", "(Advanced) Heal a directory using a list of wounds and a heal spec")
 	args.dir = cmd.Arg("dir", "Path of directory to heal").Required().String()
 	args.wounds = cmd.Arg("wounds", "Path of wounds file").Required().String()
-	args.spec = cmd.Arg("spec", "Path of spec to heal with").Required().String()
+	args.specs = cmd.Arg("spec", "Heal specs to heal with, like archive,build.zip or dir,../other-install. Directories are tried first, then local archives, then remote ones.").Required().Strings()
+	args.signature = cmd.Flag("signature", "Signature of the build, required to heal from directories").String()
 	ctx.Register(cmd, do)
 }
 
 type Params struct {
 	Dir        string
 	WoundsPath string
-	HealSpec   string
+	HealSpecs  []string
+	// SignaturePath is only needed when healing from directories
+	SignaturePath string
 }
 
 func do(ctx *mansion.Context) {
 	ctx.Must(Do(&Params{
 		Dir:        *args.dir,
 		WoundsPath: *args.wounds,
-		HealSpec:   *args.spec,
+		HealSpecs:  *args.specs,
+
+		SignaturePath: *args.signature,
 	}))
 }
 
 func Do(params *Params) error {
 	dir := params.Dir
 	woundsPath := params.WoundsPath
-	spec := params.HealSpec
 
 	reader, err := os.Open(woundsPath)
 	if err != nil {
@@ -53,7 +59,15 @@ func Do(params *Params) error {
 	}
 	defer reader.Close()
 
-	healer, err := pwr.NewHealer(spec, dir)
+	var signature *pwr.SignatureInfo
+	if params.SignaturePath != "" {
+		signature, err = readSignature(params.SignaturePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	healer, err := healing.New(params.HealSpecs, dir, signature)
 	if err != nil {
 		return errors.Wrap(err, "creating healer")
 	}
@@ -97,15 +111,16 @@ func Do(params *Params) error {
 		errs <- healer.Do(context.Background(), container, wounds)
 	}()
 
-	wound := &pwr.Wound{}
 	for {
-		wound.Reset()
+		// healers may hold on to wounds, so each needs its own
+		wound := &pwr.Wound{}
 		err = rctx.ReadMessage(wound)
 		if err != nil {
-			if err == io.EOF {
+			if errors.Cause(err) == io.EOF {
 				// all good
 				break
 			}
+			return errors.Wrap(err, "reading wounds")
 		}
 
 		select {
@@ -128,3 +143,23 @@ func Do(params *Params) error {
 	comm.Opf("All healed!")
 	return nil
 }
+
+func readSignature(path string) (*pwr.SignatureInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening signature")
+	}
+	defer f.Close()
+
+	source := seeksource.FromFile(f)
+	_, err = source.Resume(nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening signature")
+	}
+
+	signature, err := pwr.ReadSignature(context.Background(), source)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading signature")
+	}
+	return signature, nil
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"io"
 	"os"
+	"strings"
 
 	"github.com/itchio/butler/comm"
 	"github.com/itchio/butler/filtering"
@@ -30,20 +31,31 @@ import (
 )
 
 var args = struct {
-	file *string
+	file   *string
+	filter filtering.Flags
 }{}
 
 func Register(ctx *mansion.Context) {
 	cmd := ctx.App.Command("ls", "Prints the list of files, dirs and symlinks contained in a patch file, signature file, or archive")
 	args.file = cmd.Arg("file", "A file you'd like to list the contents of").Required().String()
+	args.filter.Register(cmd)
 	ctx.Register(cmd, do)
 }
 
 func do(ctx *mansion.Context) {
-	ctx.Must(Do(ctx, *args.file))
+	var filter tlc.FilterFunc
+	if !args.filter.IsEmpty() {
+		var err error
+		filter, err = args.filter.Filter(filtering.FilterPaths)
+		ctx.Must(err)
+	}
+	ctx.Must(Do(ctx, *args.file, filter))
 }
 
-func Do(ctx *mansion.Context, inPath string) error {
+// Do lists the contents of inPath. When filter is set, entries it
+// ignores aren't listed. Directories are always walked with
+// filtering.FilterPaths at least.
+func Do(ctx *mansion.Context, inPath string, filter tlc.FilterFunc) error {
 	consumer := comm.NewStateConsumer()
 
 	reader, err := eos.Open(inPath, option.WithConsumer(consumer))
@@ -67,9 +79,24 @@ func Do(ctx *mansion.Context, inPath string) error {
 		comm.Logf(line)
 	}
 
+	ignored := func(entryPath string) bool {
+		return filter != nil && filtering.IsIgnored(filter, entryPath)
+	}
+
+	printContainer := func(container *tlc.Container) {
+		if filter != nil {
+			container = filtering.FilterContainer(container, filter)
+		}
+		container.Print(log)
+	}
+
 	if stats.IsDir() {
+		walkFilter := filter
+		if walkFilter == nil {
+			walkFilter = filtering.FilterPaths
+		}
 		walkOpts := tlc.WalkOpts{
-			Filter: filtering.FilterPaths,
+			Filter: walkFilter,
 		}
 		walkOpts.AutoWrap(&inPath, consumer)
 
@@ -122,7 +149,7 @@ func Do(ctx *mansion.Context, inPath string) error {
 			}
 
 			log("pre-patch container:")
-			container.Print(log)
+			printContainer(container)
 
 			container.Reset()
 			err = rctx.ReadMessage(container)
@@ -132,7 +159,7 @@ func Do(ctx *mansion.Context, inPath string) error {
 
 			log("================================")
 			log("post-patch container:")
-			container.Print(log)
+			printContainer(container)
 		}
 
 	case pwr.SignatureMagic:
@@ -153,7 +180,7 @@ func Do(ctx *mansion.Context, inPath string) error {
 			if err != nil {
 				return errors.WithStack(err)
 			}
-			container.Print(log)
+			printContainer(container)
 		}
 
 	case pwr.ManifestMagic:
@@ -175,36 +202,23 @@ func Do(ctx *mansion.Context, inPath string) error {
 			if err != nil {
 				return errors.WithStack(err)
 			}
-			container.Print(log)
+			printContainer(container)
 		}
 
 	case pwr.WoundsMagic:
 		{
-			wh := &pwr.WoundsHeader{}
-			rctx := wire.NewReadContext(source)
-			err := rctx.ReadMessage(wh)
-			if err != nil {
-				return errors.WithStack(err)
-			}
-
-			container := &tlc.Container{}
-			err = rctx.ReadMessage(container)
-			if err != nil {
-				return errors.WithStack(err)
-			}
-			container.Print(log)
-
-			for {
-				wound := &pwr.Wound{}
-				err = rctx.ReadMessage(wound)
-				if err != nil {
-					if errors.Cause(err) == io.EOF {
-						break
-					} else {
-						return errors.WithStack(err)
-					}
+			var container *tlc.Container
+			err := readWounds(wire.NewReadContext(source), func(c *tlc.Container) {
+				container = c
+				printContainer(container)
+			}, func(wound *pwr.Wound) {
+				if ignored(woundPath(wound, container)) {
+					return
 				}
 				comm.Logf(wound.PrettyString(container))
+			})
+			if err != nil {
+				return err
 			}
 		}
 
@@ -225,7 +239,7 @@ func Do(ctx *mansion.Context, inPath string) error {
 
 			container, err := tlc.WalkZip(zr, tlc.WalkOpts{})
 			ctx.Must(err)
-			container.Print(log)
+			printContainer(container)
 
 			err = container.Validate()
 			if err != nil {
@@ -257,6 +271,9 @@ func Do(ctx *mansion.Context, inPath string) error {
 					return false
 				}
 
+				if ignored(strings.TrimSuffix(hdr.Name, "/")) {
+					continue
+				}
 				comm.Logf("%s %10s %s", os.FileMode(hdr.Mode), united.FormatBytes(hdr.Size), hdr.Name)
 			}
 			return true
@@ -279,6 +296,9 @@ func Do(ctx *mansion.Context, inPath string) error {
 				OnEntries: func(entries []*savior.Entry) {
 					numEntries += len(entries)
 					for _, e := range entries {
+						if ignored(e.CanonicalPath) {
+							continue
+						}
 						comm.Logf("%s %10s %s", e.Mode, united.FormatBytes(e.UncompressedSize), e.CanonicalPath)
 					}
 				},
@@ -310,3 +330,16 @@ func Do(ctx *mansion.Context, inPath string) error {
 
 	return nil
 }
+
+// woundPath returns the path of the entry a wound is about
+func woundPath(wound *pwr.Wound, container *tlc.Container) string {
+	switch wound.Kind {
+	case pwr.WoundKind_DIR:
+		return container.Dirs[wound.Index].Path
+	case pwr.WoundKind_SYMLINK:
+		return container.Symlinks[wound.Index].Path
+	case pwr.WoundKind_FILE:
+		return container.Files[wound.Index].Path
+	}
+	return ""
+}
@@ -0,0 +1,81 @@
+package ls
+
+import (
+	"io"
+	"os"
+
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/savior/seeksource"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/wire"
+	"github.com/pkg/errors"
+)
+
+// Wounds is the contents of a wounds file, as written by
+// `butler verify --wounds`
+type Wounds struct {
+	// Container is the container the wounds' indices refer to
+	Container *tlc.Container
+	Wounds    []*pwr.Wound
+}
+
+// ReadWounds reads a whole wounds file
+func ReadWounds(path string) (*Wounds, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	source := seeksource.FromFile(f)
+	_, err = source.Resume(nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	rctx := wire.NewReadContext(source)
+	err = rctx.ExpectMagic(pwr.WoundsMagic)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading wounds magic")
+	}
+
+	res := &Wounds{}
+	err = readWounds(rctx, func(container *tlc.Container) {
+		res.Container = container
+	}, func(wound *pwr.Wound) {
+		res.Wounds = append(res.Wounds, wound)
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading wounds from %s", path)
+	}
+	return res, nil
+}
+
+// readWounds reads what follows the magic number of a wounds file,
+// calling onWound for each wound as soon as it's read
+func readWounds(rctx *wire.ReadContext, onContainer func(container *tlc.Container), onWound func(wound *pwr.Wound)) error {
+	wh := &pwr.WoundsHeader{}
+	err := rctx.ReadMessage(wh)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	container := &tlc.Container{}
+	err = rctx.ReadMessage(container)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	onContainer(container)
+
+	for {
+		wound := &pwr.Wound{}
+		err = rctx.ReadMessage(wound)
+		if err != nil {
+			if errors.Cause(err) == io.EOF {
+				return nil
+			}
+			return errors.WithStack(err)
+		}
+		onWound(wound)
+	}
+}
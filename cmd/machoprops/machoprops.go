@@ -0,0 +1,60 @@
+package machoprops
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/itchio/butler/comm"
+	"github.com/itchio/butler/machoinfo"
+	"github.com/itchio/butler/mansion"
+	"github.com/itchio/headway/state"
+	"github.com/itchio/httpkit/eos"
+	"github.com/itchio/httpkit/eos/option"
+)
+
+var args = struct {
+	path *string
+}{}
+
+func Register(ctx *mansion.Context) {
+	cmd := ctx.App.Command("machoprops", "(Advanced) Gives information about a Mach-O binary or a macOS app bundle").Hidden()
+	args.path = cmd.Arg("path", "The Mach-O binary or .app folder to analyze").Required().String()
+	ctx.Register(cmd, do)
+}
+
+func do(ctx *mansion.Context) {
+	consumer := comm.NewStateConsumer()
+
+	var props interface{}
+	stats, err := os.Stat(*args.path)
+	if err == nil && stats.IsDir() {
+		props, err = DoBundle(*args.path, consumer)
+		ctx.Must(err)
+	} else {
+		f, err := eos.Open(*args.path, option.WithConsumer(consumer))
+		ctx.Must(err)
+		defer f.Close()
+
+		props, err = Do(f, consumer)
+		ctx.Must(err)
+	}
+
+	comm.ResultOrPrint(props, func() {
+		js, err := json.MarshalIndent(props, "", "  ")
+		if err == nil {
+			comm.Logf(string(js))
+		}
+	})
+}
+
+func Do(f eos.File, consumer *state.Consumer) (*machoinfo.Info, error) {
+	return machoinfo.Probe(f, machoinfo.ProbeParams{
+		Consumer: consumer,
+	})
+}
+
+func DoBundle(bundlePath string, consumer *state.Consumer) (*machoinfo.Bundle, error) {
+	return machoinfo.ProbeBundle(bundlePath, machoinfo.ProbeParams{
+		Consumer: consumer,
+	})
+}
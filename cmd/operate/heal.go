@@ -2,10 +2,15 @@ package operate
 
 import (
 	"fmt"
+	"os"
 	"time"
 
+	"crawshaw.io/sqlite"
+
 	"github.com/itchio/butler/butlerd"
 	"github.com/itchio/butler/butlerd/messages"
+	"github.com/itchio/butler/database/models"
+	"github.com/itchio/butler/healing"
 	"github.com/itchio/hush"
 	"github.com/itchio/hush/bfs"
 
@@ -46,10 +51,8 @@ func heal(oc *OperationContext, meta *MetaSubcontext, isub *InstallSubcontext, r
 
 	healSpec := fmt.Sprintf("archive,%s", archiveURL)
 
-	vc := &pwr.ValidatorContext{
-		Consumer: consumer,
-		HealPath: healSpec,
-	}
+	// other installs of the same upload may have most of what's needed
+	localSpecs := otherInstallSpecs(oc, params)
 
 	signatureFile, err := eos.Open(signatureURL, option.WithConsumer(consumer))
 	if err != nil {
@@ -89,8 +92,29 @@ func heal(oc *OperationContext, meta *MetaSubcontext, isub *InstallSubcontext, r
 
 	timeBeforeHeal := time.Now()
 
+	var woundsConsumer pwr.WoundsConsumer
+	var appliedCaseFixes bool
+
 	oc.rc.StartProgress()
-	err = vc.Validate(oc.ctx, params.InstallFolder, sigInfo)
+	if len(localSpecs) > 0 {
+		consumer.Infof("Healing from %d other installs before downloading anything", len(localSpecs))
+		var healer *healing.Healer
+		healer, err = healing.New(append(localSpecs, healSpec), params.InstallFolder, sigInfo)
+		if err == nil {
+			healer.SetConsumer(consumer)
+			err = healer.Validate(oc.ctx, params.InstallFolder, sigInfo, consumer)
+			appliedCaseFixes = healer.CaseFixStats != nil && len(healer.CaseFixStats.Fixes) > 0
+		}
+		woundsConsumer = healer
+	} else {
+		vc := &pwr.ValidatorContext{
+			Consumer: consumer,
+			HealPath: healSpec,
+		}
+		err = vc.Validate(oc.ctx, params.InstallFolder, sigInfo)
+		woundsConsumer = vc.WoundsConsumer
+		appliedCaseFixes = vc.CaseFixStats != nil && len(vc.CaseFixStats.Fixes) > 0
+	}
 	oc.rc.EndProgress()
 	if err != nil {
 		return errors.WithStack(err)
@@ -99,21 +123,28 @@ func heal(oc *OperationContext, meta *MetaSubcontext, isub *InstallSubcontext, r
 	healDuration := time.Since(timeBeforeHeal)
 	containerSize := sigInfo.Container.Size
 
-	if vc.WoundsConsumer.HasWounds() {
-		if healer, ok := vc.WoundsConsumer.(pwr.Healer); ok {
+	if woundsConsumer.HasWounds() {
+		if healer, ok := woundsConsumer.(pwr.Healer); ok {
 			totalHealed := healer.TotalHealed()
 			perSec := united.FormatBPS(totalHealed, healDuration)
 
 			consumer.Infof("✓ %s corrupted data found (of %s total), %s healed @ %s/s, %s total",
-				united.FormatBytes(vc.WoundsConsumer.TotalCorrupted()),
+				united.FormatBytes(woundsConsumer.TotalCorrupted()),
 				united.FormatBytes(sigInfo.Container.Size),
 				united.FormatBytes(totalHealed),
 				perSec,
 				united.FormatDuration(healDuration),
 			)
+			if h, ok := healer.(*healing.Healer); ok {
+				for spec, size := range h.HealedFrom {
+					if spec != healSpec {
+						consumer.Infof("  %s healed from %s", united.FormatBytes(size), spec)
+					}
+				}
+			}
 		} else {
 			consumer.Warnf("%s corrupted data found (of %s total)",
-				united.FormatBytes(vc.WoundsConsumer.TotalCorrupted()),
+				united.FormatBytes(woundsConsumer.TotalCorrupted()),
 				united.FormatBytes(sigInfo.Container.Size),
 			)
 		}
@@ -129,8 +160,8 @@ func heal(oc *OperationContext, meta *MetaSubcontext, isub *InstallSubcontext, r
 
 	err = isub.EventSink(oc).PostEvent(hush.InstallEvent{
 		Heal: &hush.HealInstallEvent{
-			TotalCorrupted:   vc.WoundsConsumer.TotalCorrupted(),
-			AppliedCaseFixes: vc.CaseFixStats != nil && len(vc.CaseFixStats.Fixes) > 0,
+			TotalCorrupted:   woundsConsumer.TotalCorrupted(),
+			AppliedCaseFixes: appliedCaseFixes,
 		},
 	})
 	if err != nil {
@@ -186,3 +217,33 @@ func resultForContainer(c *tlc.Container) *hush.InstallResult {
 
 	return res
 }
+
+// otherInstallSpecs returns heal specs for the install folders of other
+// caves of the same upload. Whatever build they're on, blocks are only
+// used if they match the signature.
+func otherInstallSpecs(oc *OperationContext, params *InstallParams) []string {
+	if params.Upload == nil || params.Game == nil {
+		return nil
+	}
+
+	var folders []string
+	oc.rc.WithConn(func(conn *sqlite.Conn) {
+		for _, cave := range models.CavesByGameID(conn, params.Game.ID) {
+			if cave.ID == params.CaveID || cave.UploadID != params.Upload.ID {
+				continue
+			}
+			folders = append(folders, cave.GetInstallFolder(conn))
+		}
+	})
+
+	var specs []string
+	for _, folder := range folders {
+		if folder == params.InstallFolder {
+			continue
+		}
+		if stats, err := os.Stat(folder); err == nil && stats.IsDir() {
+			specs = append(specs, "dir,"+folder)
+		}
+	}
+	return specs
+}
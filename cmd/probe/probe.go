@@ -12,8 +12,8 @@ import (
 
 	"github.com/itchio/headway/united"
 
-	"github.com/itchio/savior/seeksource"
 	"github.com/itchio/savior/countingsource"
+	"github.com/itchio/savior/seeksource"
 
 	"github.com/itchio/httpkit/eos"
 	"github.com/itchio/httpkit/eos/option"
@@ -27,43 +27,85 @@ import (
 	"github.com/pkg/errors"
 )
 
-var args = struct {
-	patch    string
-	fullpath bool
-	deep     bool
-	dump     string
-}{}
+type Params struct {
+	Patch    string
+	Fullpath bool
+	Deep     bool
+	Dump     string
+
+	// ReportPath is where to write a JSON report of what each file
+	// and directory costs in the patch
+	ReportPath string
+	// HTMLPath is where to write the same report, as a treemap
+	HTMLPath string
+}
+
+var params Params
 
 func Register(ctx *mansion.Context) {
 	cmd := ctx.App.Command("probe", "(Advanced) Show statistics about a patch file").Hidden()
-	cmd.Arg("patch", "Path of the patch to analyze").Required().StringVar(&args.patch)
-	cmd.Flag("fullpath", "Display full path names").BoolVar(&args.fullpath)
-	cmd.Flag("deep", "Analyze the top N changed files further").BoolVar(&args.deep)
-	cmd.Flag("dump", "Dump ops for any path contain a substring of this").StringVar(&args.dump)
+	cmd.Arg("patch", "Path of the patch to analyze").Required().StringVar(&params.Patch)
+	cmd.Flag("fullpath", "Display full path names").BoolVar(&params.Fullpath)
+	cmd.Flag("deep", "Analyze the top N changed files further").BoolVar(&params.Deep)
+	cmd.Flag("dump", "Dump ops for any path contain a substring of this").StringVar(&params.Dump)
+	cmd.Flag("report", "Write a JSON report of the fresh and reused bytes of each file and directory to this path").StringVar(&params.ReportPath)
+	cmd.Flag("html", "Write the same report as a self-contained HTML treemap to this path").StringVar(&params.HTMLPath)
 	ctx.Register(cmd, do)
 }
 
 func do(ctx *mansion.Context) {
-	ctx.Must(Do(ctx, args.patch))
+	ctx.Must(Do(ctx, params))
 }
 
-func Do(ctx *mansion.Context, patch string) error {
-	patchStats, err := doPrimaryAnalysis(ctx, patch)
+func Do(ctx *mansion.Context, params Params) error {
+	a, err := doPrimaryAnalysis(ctx, params)
 	if err != nil {
 		return errors.WithStack(err)
 	}
 
-	if args.deep {
-		err = doDeepAnalysis(ctx, patch, patchStats)
+	if params.Deep {
+		err = doDeepAnalysis(ctx, params.Patch, a.stats)
 		if err != nil {
 			return errors.WithStack(err)
 		}
 	}
 
+	if params.ReportPath != "" || params.HTMLPath != "" {
+		report := BuildReport(params.Patch, a)
+
+		if params.ReportPath != "" {
+			err = writeReport(report, params.ReportPath)
+			if err != nil {
+				return err
+			}
+			comm.Statf("Wrote JSON report to %s", params.ReportPath)
+		}
+
+		if params.HTMLPath != "" {
+			err = writeHTML(report, params.HTMLPath)
+			if err != nil {
+				return err
+			}
+			comm.Statf("Wrote HTML report to %s", params.HTMLPath)
+		}
+	}
+
 	return nil
 }
 
-func doPrimaryAnalysis(ctx *mansion.Context, patch string) ([]patchStat, error) {
+// analysis is what the primary analysis learns about a patch
+type analysis struct {
+	patchSize   int64
+	compression *pwr.CompressionSettings
+	target      *tlc.Container
+	source      *tlc.Container
+	// stats are sorted by decreasing fresh data
+	stats []patchStat
+}
+
+func doPrimaryAnalysis(ctx *mansion.Context, params Params) (*analysis, error) {
+	patch := params.Patch
+
 	consumer := comm.NewStateConsumer()
 
 	patchReader, err := eos.Open(patch, option.WithConsumer(consumer))
@@ -148,7 +190,7 @@ func doPrimaryAnalysis(ctx *mansion.Context, patch string) ([]patchStat, error)
 		}
 
 		sourceFile := source.Files[sh.FileIndex]
-		doDump := args.dump != "" && strings.Contains(sourceFile.Path, args.dump)
+		doDump := params.Dump != "" && strings.Contains(sourceFile.Path, params.Dump)
 
 		if doDump {
 			consumer.Infof("========== Op Stream Start ===========")
@@ -178,9 +220,11 @@ func doPrimaryAnalysis(ctx *mansion.Context, patch string) ([]patchStat, error)
 						lastSize := pwr.ComputeBlockSize(tf.Size, lastIndex)
 						totalSize := (fixedSize + lastSize)
 						stat.freshData -= totalSize
+						stat.ops.BlockRange.add(totalSize)
 						pos += totalSize
 					case pwr.SyncOp_DATA:
 						totalSize := int64(len(rop.Data))
+						stat.ops.Data.add(totalSize)
 						if ctx.Verbose {
 							comm.Debugf("%s fresh data at %s (%d-%d)",
 								united.FormatBytes(totalSize),
@@ -242,6 +286,12 @@ func doPrimaryAnalysis(ctx *mansion.Context, patch string) ([]patchStat, error)
 
 					totalAddBytes += int64(len(bc.Add))
 					totalZeroAddBytes += zeroAddBytes
+					if len(bc.Add) > 0 {
+						stat.ops.BsdiffAdd.add(int64(len(bc.Add)))
+					}
+					if len(bc.Copy) > 0 {
+						stat.ops.BsdiffCopy.add(int64(len(bc.Copy)))
+					}
 
 					stat.freshData -= zeroAddBytes
 					if doDump {
@@ -320,7 +370,7 @@ func doPrimaryAnalysis(ctx *mansion.Context, patch string) ([]patchStat, error)
 	for i, stat := range patchStats {
 		f := source.Files[stat.fileIndex]
 		name := f.Path
-		if !args.fullpath {
+		if !params.Fullpath {
 			name = filepath.Base(name)
 		}
 
@@ -351,7 +401,13 @@ func doPrimaryAnalysis(ctx *mansion.Context, patch string) ([]patchStat, error)
 	)
 	comm.Logf(" (%d/%d files are changed by this patch, they weigh a total of %s)", numTouched, numTotal, united.FormatBytes(naivePatchSize))
 
-	return patchStats, nil
+	return &analysis{
+		patchSize:   cs.Size(),
+		compression: header.Compression,
+		target:      target,
+		source:      source,
+		stats:       patchStats,
+	}, nil
 }
 
 type deepDiveContext struct {
@@ -721,6 +777,7 @@ type patchStat struct {
 	fileIndex int64
 	freshData int64
 	algo      pwr.SyncHeader_Type
+	ops       OpStats
 }
 
 type byDecreasingFreshData []patchStat
@@ -0,0 +1,389 @@
+package probe
+
+import (
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// maxOffenders is how many files are listed in Report.TopOffenders
+const maxOffenders = 20
+
+// OpStat counts ops of one type, and how many bytes of the new build
+// they produce
+type OpStat struct {
+	Count int64 `json:"count"`
+	Bytes int64 `json:"bytes"`
+}
+
+func (s *OpStat) add(bytes int64) {
+	s.Count++
+	s.Bytes += bytes
+}
+
+// OpStats counts the ops of a patch by type. Block ranges reuse old
+// data, data ops are fresh data. bsdiff adds are old data with a
+// difference added, only their non-zero bytes count as fresh, and
+// bsdiff copies are fresh data.
+type OpStats struct {
+	BlockRange OpStat `json:"blockRange"`
+	Data       OpStat `json:"data"`
+	BsdiffAdd  OpStat `json:"bsdiffAdd"`
+	BsdiffCopy OpStat `json:"bsdiffCopy"`
+}
+
+func (o *OpStats) merge(other *OpStats) {
+	for _, pair := range [][2]*OpStat{
+		{&o.BlockRange, &other.BlockRange},
+		{&o.Data, &other.Data},
+		{&o.BsdiffAdd, &other.BsdiffAdd},
+		{&o.BsdiffCopy, &other.BsdiffCopy},
+	} {
+		pair[0].Count += pair[1].Count
+		pair[0].Bytes += pair[1].Bytes
+	}
+}
+
+// Report is what each file and directory of the new build costs in a patch
+type Report struct {
+	Patch       string `json:"patch"`
+	PatchSize   int64  `json:"patchSize"`
+	Compression string `json:"compression"`
+
+	OldSize int64 `json:"oldSize"`
+	NewSize int64 `json:"newSize"`
+	// FreshBytes have to be downloaded, ReusedBytes come from the old build
+	FreshBytes  int64 `json:"freshBytes"`
+	ReusedBytes int64 `json:"reusedBytes"`
+
+	Ops OpStats `json:"ops"`
+
+	// TopOffenders are the files with the most fresh data, most first
+	TopOffenders []*Node `json:"topOffenders"`
+	// Tree is the new build, with costs added up for each directory
+	Tree *Node `json:"tree"`
+}
+
+// Node is a file or directory of the new build
+type Node struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	Dir  bool   `json:"dir,omitempty"`
+
+	Size   int64 `json:"size"`
+	Fresh  int64 `json:"fresh"`
+	Reused int64 `json:"reused"`
+
+	// Algorithm is how a file was diffed: rsync or bsdiff
+	Algorithm string   `json:"algorithm,omitempty"`
+	Ops       *OpStats `json:"ops,omitempty"`
+
+	Children []*Node `json:"children,omitempty"`
+}
+
+// BuildReport sums up the primary analysis of a patch
+func BuildReport(patch string, a *analysis) *Report {
+	report := &Report{
+		Patch:     patch,
+		PatchSize: a.patchSize,
+		OldSize:   a.target.Size,
+		NewSize:   a.source.Size,
+		Tree: &Node{
+			Name: ".",
+			Path: ".",
+			Dir:  true,
+		},
+	}
+	if a.compression != nil {
+		report.Compression = a.compression.ToString()
+	}
+
+	dirs := map[string]*Node{".": report.Tree}
+	var getDir func(p string) *Node
+	getDir = func(p string) *Node {
+		if d, ok := dirs[p]; ok {
+			return d
+		}
+		d := &Node{
+			Name: path.Base(p),
+			Path: p,
+			Dir:  true,
+		}
+		dirs[p] = d
+		parent := getDir(path.Dir(p))
+		parent.Children = append(parent.Children, d)
+		return d
+	}
+	for _, d := range a.source.Dirs {
+		getDir(d.Path)
+	}
+
+	var files []*Node
+	for _, stat := range a.stats {
+		f := a.source.Files[stat.fileIndex]
+		ops := stat.ops
+		file := &Node{
+			Name:      path.Base(f.Path),
+			Path:      f.Path,
+			Size:      f.Size,
+			Fresh:     stat.freshData,
+			Reused:    f.Size - stat.freshData,
+			Algorithm: strings.ToLower(stat.algo.String()),
+			Ops:       &ops,
+		}
+		files = append(files, file)
+
+		parent := getDir(path.Dir(f.Path))
+		parent.Children = append(parent.Children, file)
+
+		report.Ops.merge(&ops)
+	}
+
+	sumUp(report.Tree)
+	report.FreshBytes = report.Tree.Fresh
+	report.ReusedBytes = report.Tree.Reused
+
+	// stats are already sorted by decreasing fresh data
+	for _, file := range files {
+		if len(report.TopOffenders) >= maxOffenders || file.Fresh <= 0 {
+			break
+		}
+		report.TopOffenders = append(report.TopOffenders, file)
+	}
+
+	return report
+}
+
+// sumUp adds up the costs of a directory's children, and sorts them
+// by decreasing fresh data, then size
+func sumUp(n *Node) {
+	if !n.Dir {
+		return
+	}
+
+	n.Size, n.Fresh, n.Reused = 0, 0, 0
+	for _, c := range n.Children {
+		sumUp(c)
+		n.Size += c.Size
+		n.Fresh += c.Fresh
+		n.Reused += c.Reused
+	}
+
+	sort.SliceStable(n.Children, func(i, j int) bool {
+		a, b := n.Children[i], n.Children[j]
+		if a.Fresh != b.Fresh {
+			return a.Fresh > b.Fresh
+		}
+		return a.Size > b.Size
+	})
+}
+
+func writeReport(report *Report, reportPath string) error {
+	contents, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = ioutil.WriteFile(reportPath, contents, 0o644)
+	if err != nil {
+		return errors.Wrap(err, "writing report")
+	}
+	return nil
+}
+
+func writeHTML(report *Report, htmlPath string) error {
+	f, err := os.Create(htmlPath)
+	if err != nil {
+		return errors.Wrap(err, "writing HTML report")
+	}
+	defer f.Close()
+
+	err = htmlTemplate.Execute(f, report)
+	if err != nil {
+		return errors.Wrap(err, "writing HTML report")
+	}
+	return nil
+}
+
+var htmlTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Patch cost: {{.Patch}}</title>
+<style>
+body { font-family: sans-serif; margin: 20px; color: #222; }
+h1 { font-size: 20px; }
+#crumbs a { cursor: pointer; color: #06c; }
+#controls { margin: 10px 0; }
+#map { position: relative; width: 100%; height: 600px; background: #eee; }
+.node { position: absolute; box-sizing: border-box; overflow: hidden; border: 1px solid #fff; font-size: 11px; padding: 2px; }
+.node.dir { cursor: zoom-in; background: rgba(0, 0, 0, 0.04); border-color: #999; }
+table { border-collapse: collapse; margin-top: 20px; }
+td, th { padding: 3px 10px; text-align: left; border-bottom: 1px solid #ddd; }
+td.num { text-align: right; }
+</style>
+</head>
+<body>
+<h1>{{.Patch}}</h1>
+<p id="summary"></p>
+<div id="controls">
+  Area:
+  <label><input type="radio" name="area" value="fresh" checked> fresh bytes</label>
+  <label><input type="radio" name="area" value="size"> file size</label>
+  &mdash; color goes from green (all reused) to red (all fresh)
+</div>
+<div id="crumbs"></div>
+<div id="map"></div>
+<h2>Top offenders</h2>
+<table id="offenders"><tr><th>File</th><th>Fresh</th><th>Size</th><th>Changed</th><th>Algorithm</th></tr></table>
+<h2>Ops</h2>
+<table id="ops"><tr><th>Type</th><th>Count</th><th>Bytes</th></tr></table>
+<script>
+var report = {{.}};
+
+function fmt(n) {
+  var units = ["B", "KiB", "MiB", "GiB", "TiB"];
+  var i = 0;
+  while (Math.abs(n) >= 1024 && i < units.length - 1) { n /= 1024; i++; }
+  return (i == 0 ? n : n.toFixed(2)) + " " + units[i];
+}
+
+function pct(part, total) {
+  return total > 0 ? (100 * part / total).toFixed(2) + "%" : "0%";
+}
+
+function color(n) {
+  var ratio = n.size > 0 ? n.fresh / n.size : 0;
+  var hue = 120 * (1 - Math.min(1, Math.max(0, ratio)));
+  return "hsl(" + hue + ", 60%, 60%)";
+}
+
+var areaKey = "fresh";
+var stack = [report.tree];
+
+function weight(n) {
+  return Math.max(0, n[areaKey]);
+}
+
+// squarified treemap layout, see Bruls, Huizing and van Wijk
+function squarify(nodes, x, y, w, h, out) {
+  var total = 0;
+  nodes.forEach(function (n) { total += weight(n); });
+  if (total <= 0 || w <= 0 || h <= 0) return;
+  var items = nodes.filter(function (n) { return weight(n) > 0; })
+    .map(function (n) { return { node: n, area: weight(n) * w * h / total }; })
+    .sort(function (a, b) { return b.area - a.area; });
+
+  function worst(row, side) {
+    var sum = 0, max = 0, min = Infinity;
+    row.forEach(function (r) { sum += r.area; max = Math.max(max, r.area); min = Math.min(min, r.area); });
+    return Math.max(side * side * max / (sum * sum), (sum * sum) / (side * side * min));
+  }
+
+  while (items.length > 0) {
+    var side = Math.min(w, h);
+    var row = [items.shift()];
+    while (items.length > 0 && worst(row.concat([items[0]]), side) <= worst(row, side)) {
+      row.push(items.shift());
+    }
+    var sum = 0;
+    row.forEach(function (r) { sum += r.area; });
+    var thickness = sum / side;
+    var offset = 0;
+    row.forEach(function (r) {
+      var length = r.area / thickness;
+      if (w >= h) {
+        out.push({ node: r.node, x: x, y: y + offset, w: thickness, h: length });
+      } else {
+        out.push({ node: r.node, x: x + offset, y: y, w: length, h: thickness });
+      }
+      offset += length;
+    });
+    if (w >= h) { x += thickness; w -= thickness; } else { y += thickness; h -= thickness; }
+  }
+}
+
+function render() {
+  var root = stack[stack.length - 1];
+  var map = document.getElementById("map");
+  map.innerHTML = "";
+
+  var crumbs = document.getElementById("crumbs");
+  crumbs.innerHTML = "";
+  stack.forEach(function (n, i) {
+    var a = document.createElement("a");
+    a.textContent = i == 0 ? "(root)" : n.name;
+    a.onclick = function () { stack = stack.slice(0, i + 1); render(); };
+    crumbs.appendChild(a);
+    if (i < stack.length - 1) crumbs.appendChild(document.createTextNode(" / "));
+  });
+
+  function draw(nodes, x, y, w, h, depth) {
+    var rects = [];
+    squarify(nodes, x, y, w, h, rects);
+    rects.forEach(function (r) {
+      var n = r.node;
+      var div = document.createElement("div");
+      div.className = "node" + (n.dir ? " dir" : "");
+      div.style.left = r.x + "px";
+      div.style.top = r.y + "px";
+      div.style.width = r.w + "px";
+      div.style.height = r.h + "px";
+      div.title = n.path + "\n" + fmt(n.fresh) + " fresh, " + fmt(n.reused) + " reused, " + fmt(n.size) + " total (" + pct(n.fresh, n.size) + " changed)";
+      if (!n.dir) div.style.background = color(n);
+      if (r.w > 40 && r.h > 14) div.textContent = n.name;
+      map.appendChild(div);
+      if (n.dir) {
+        div.onclick = function (e) { e.stopPropagation(); stack.push(n); render(); };
+        if (n.children && depth < 3 && r.w > 30 && r.h > 30) {
+          draw(n.children, r.x + 2, r.y + 16, r.w - 4, r.h - 18, depth + 1);
+        }
+      }
+    });
+  }
+  draw(root.children || [], 0, 0, map.clientWidth, map.clientHeight, 0);
+}
+
+document.getElementById("summary").textContent =
+  fmt(report.patchSize) + " patch (" + report.compression + "), " +
+  fmt(report.freshBytes) + " fresh and " + fmt(report.reusedBytes) + " reused, " +
+  "build went from " + fmt(report.oldSize) + " to " + fmt(report.newSize);
+
+(report.topOffenders || []).forEach(function (n) {
+  var tr = document.createElement("tr");
+  [n.path, fmt(n.fresh), fmt(n.size), pct(n.fresh, n.size), n.algorithm].forEach(function (v, i) {
+    var td = document.createElement("td");
+    td.textContent = v;
+    if (i > 0 && i < 4) td.className = "num";
+    tr.appendChild(td);
+  });
+  document.getElementById("offenders").appendChild(tr);
+});
+
+[["block range (reused)", report.ops.blockRange], ["data (fresh)", report.ops.data],
+ ["bsdiff add", report.ops.bsdiffAdd], ["bsdiff copy (fresh)", report.ops.bsdiffCopy]].forEach(function (op) {
+  var tr = document.createElement("tr");
+  [op[0], op[1].count, fmt(op[1].bytes)].forEach(function (v, i) {
+    var td = document.createElement("td");
+    td.textContent = v;
+    if (i > 0) td.className = "num";
+    tr.appendChild(td);
+  });
+  document.getElementById("ops").appendChild(tr);
+});
+
+Array.prototype.forEach.call(document.querySelectorAll("input[name=area]"), function (input) {
+  input.onchange = function () { areaKey = input.value; render(); };
+});
+window.onresize = render;
+render();
+</script>
+</body>
+</html>
+`))
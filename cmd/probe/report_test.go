@@ -0,0 +1,88 @@
+package probe_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/itchio/butler/buildtest"
+	"github.com/itchio/butler/cmd/diff"
+	"github.com/itchio/butler/cmd/probe"
+	"github.com/itchio/butler/mansion"
+	"github.com/itchio/wharf/wtest"
+	"github.com/stretchr/testify/assert"
+
+	_ "github.com/itchio/wharf/compressors/cbrotli"
+	_ "github.com/itchio/wharf/decompressors/cbrotli"
+)
+
+func TestReport(t *testing.T) {
+	dir := buildtest.TempDir(t, "probe-tests")
+
+	unchanged := strings.Repeat("same old data ", 10000)
+	v1 := buildtest.WriteDir(t, filepath.Join(dir, "v1"), map[string]string{
+		"game.exe":             "version one",
+		"data/level1.pak":      unchanged,
+		"art/textures/sky.png": "a blue sky",
+	})
+	v2 := buildtest.WriteDir(t, filepath.Join(dir, "v2"), map[string]string{
+		"game.exe":             "version two",
+		"data/level1.pak":      unchanged,
+		"art/textures/sky.png": "a stormy sky, much bigger than before",
+	})
+
+	patch := filepath.Join(dir, "patch.pwr")
+	wtest.Must(t, diff.Do(diff.Params{
+		Target:      v1,
+		Source:      v2,
+		Patch:       patch,
+		Compression: buildtest.Compression,
+	}))
+
+	reportPath := filepath.Join(dir, "report.json")
+	htmlPath := filepath.Join(dir, "report.html")
+	wtest.Must(t, probe.Do(&mansion.Context{}, probe.Params{
+		Patch:      patch,
+		ReportPath: reportPath,
+		HTMLPath:   htmlPath,
+	}))
+
+	contents, err := ioutil.ReadFile(reportPath)
+	wtest.Must(t, err)
+	report := &probe.Report{}
+	wtest.Must(t, json.Unmarshal(contents, report))
+
+	assert.EqualValues(t, len(unchanged), report.ReusedBytes)
+	assert.EqualValues(t, len("version two")+len("a stormy sky, much bigger than before"), report.FreshBytes)
+	assert.EqualValues(t, report.FreshBytes+report.ReusedBytes, report.NewSize)
+	assert.EqualValues(t, len(unchanged), report.Ops.BlockRange.Bytes)
+	assert.EqualValues(t, report.FreshBytes, report.Ops.Data.Bytes)
+
+	if assert.Len(t, report.TopOffenders, 2) {
+		assert.EqualValues(t, "art/textures/sky.png", report.TopOffenders[0].Path)
+		assert.EqualValues(t, "rsync", report.TopOffenders[0].Algorithm)
+		assert.EqualValues(t, "game.exe", report.TopOffenders[1].Path)
+	}
+
+	// directories add up their files, most fresh data first
+	tree := report.Tree
+	assert.EqualValues(t, report.FreshBytes, tree.Fresh)
+	if assert.Len(t, tree.Children, 3) {
+		art := tree.Children[0]
+		assert.EqualValues(t, "art", art.Path)
+		assert.True(t, art.Dir)
+		assert.EqualValues(t, len("a stormy sky, much bigger than before"), art.Fresh)
+		assert.EqualValues(t, "art/textures", art.Children[0].Path)
+
+		data := tree.Children[2]
+		assert.EqualValues(t, "data", data.Path)
+		assert.EqualValues(t, 0, data.Fresh)
+		assert.EqualValues(t, len(unchanged), data.Reused)
+	}
+
+	html, err := ioutil.ReadFile(htmlPath)
+	wtest.Must(t, err)
+	assert.Contains(t, string(html), `"path":"art/textures/sky.png"`)
+}
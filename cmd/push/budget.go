@@ -0,0 +1,231 @@
+package push
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/units"
+	"github.com/itchio/butler/comm"
+	"github.com/itchio/headway/united"
+	"github.com/itchio/lake/tlc"
+	"github.com/pkg/errors"
+)
+
+// Budget holds limits a build must stay within to be pushed. Zero
+// values mean there's no limit.
+type Budget struct {
+	// MaxSize is the maximum total size of the build
+	MaxSize int64
+	// MaxGrowth is how many bytes larger than the parent build
+	// the build may be
+	MaxGrowth int64
+	// MaxGrowthPercent is how much larger than the parent build the
+	// build may be, relative to the parent's size
+	MaxGrowthPercent float64
+	// MaxFileSize is the maximum size of any single file
+	MaxFileSize int64
+	// Forbid lists patterns no file may match. Patterns without a
+	// slash are matched against each path component, like ignore
+	// patterns, others are matched against the whole path.
+	Forbid []string
+}
+
+// BudgetConfig is the [push.budget] section of the config file. Sizes
+// are written like "500MB" or "1.5GB", growth may also be a percentage
+// like "10%".
+type BudgetConfig struct {
+	MaxSize     string   `toml:"max-size"`
+	MaxGrowth   string   `toml:"max-growth"`
+	MaxFileSize string   `toml:"max-file-size"`
+	Forbid      []string `toml:"forbid"`
+}
+
+// IsEmpty returns true if the budget doesn't limit anything
+func (b *Budget) IsEmpty() bool {
+	return b.MaxSize == 0 && !b.NeedsParent() && b.MaxFileSize == 0 && len(b.Forbid) == 0
+}
+
+// NeedsParent returns true if checking the budget requires knowing
+// what the parent build looks like
+func (b *Budget) NeedsParent() bool {
+	return b.MaxGrowth != 0 || b.MaxGrowthPercent != 0
+}
+
+// ParseSize parses sizes like "500MB" or "1.5GiB", which are both
+// powers of 1024, or a plain number of bytes.
+func ParseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, nil
+	}
+
+	n, err := units.ParseBase2Bytes(s)
+	if err != nil {
+		return 0, errors.Errorf("invalid size (%s), expected something like 500MB", s)
+	}
+	return int64(n), nil
+}
+
+// SetMaxGrowth parses growth limits, either sizes like "100MB",
+// or percentages like "10%".
+func (b *Budget) SetMaxGrowth(s string) error {
+	s = strings.TrimSpace(s)
+	if strings.HasSuffix(s, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		if err != nil || percent < 0 {
+			return errors.Errorf("invalid growth percentage (%s), expected something like 10%%", s)
+		}
+		b.MaxGrowth = 0
+		b.MaxGrowthPercent = percent
+		return nil
+	}
+
+	size, err := ParseSize(s)
+	if err != nil {
+		return err
+	}
+	b.MaxGrowth = size
+	b.MaxGrowthPercent = 0
+	return nil
+}
+
+// BudgetViolation is a single way in which a build exceeds its budget
+type BudgetViolation struct {
+	Message string
+	// Files lists offending files, if any
+	Files []string
+}
+
+// Check returns all the ways container exceeds the budget. parent is
+// the channel's current build, nil if there is none, in which case
+// growth isn't checked.
+func (b *Budget) Check(container *tlc.Container, parent *tlc.Container) []*BudgetViolation {
+	var violations []*BudgetViolation
+
+	if b.MaxSize > 0 && container.Size > b.MaxSize {
+		violations = append(violations, &BudgetViolation{
+			Message: fmt.Sprintf("total size is %s, over the %s limit",
+				united.FormatBytes(container.Size), united.FormatBytes(b.MaxSize)),
+		})
+	}
+
+	if parent != nil && b.NeedsParent() {
+		growth := container.Size - parent.Size
+		var growthPercent float64
+		if parent.Size > 0 {
+			growthPercent = 100.0 * float64(growth) / float64(parent.Size)
+		}
+
+		if b.MaxGrowth > 0 && growth > b.MaxGrowth {
+			violations = append(violations, &BudgetViolation{
+				Message: fmt.Sprintf("grows by %s compared to the current build, over the %s limit",
+					united.FormatBytes(growth), united.FormatBytes(b.MaxGrowth)),
+			})
+		}
+		if b.MaxGrowthPercent > 0 && growth > 0 && (parent.Size == 0 || growthPercent > b.MaxGrowthPercent) {
+			violations = append(violations, &BudgetViolation{
+				Message: fmt.Sprintf("grows by %s (+%.1f%%) compared to the current build, over the %g%% limit",
+					united.FormatBytes(growth), growthPercent, b.MaxGrowthPercent),
+			})
+		}
+	}
+
+	if b.MaxFileSize > 0 {
+		var files []string
+		for _, f := range container.Files {
+			if f.Size > b.MaxFileSize {
+				files = append(files, fmt.Sprintf("%s (%s)", f.Path, united.FormatBytes(f.Size)))
+			}
+		}
+		if len(files) > 0 {
+			violations = append(violations, &BudgetViolation{
+				Message: fmt.Sprintf("%d files are larger than %s", len(files), united.FormatBytes(b.MaxFileSize)),
+				Files:   files,
+			})
+		}
+	}
+
+	if len(b.Forbid) > 0 {
+		var files []string
+		for _, f := range container.Files {
+			if pattern := b.forbiddenBy(f.Path); pattern != "" {
+				files = append(files, fmt.Sprintf("%s (matches %s)", f.Path, pattern))
+			}
+		}
+		if len(files) > 0 {
+			violations = append(violations, &BudgetViolation{
+				Message: fmt.Sprintf("%d files match forbidden patterns", len(files)),
+				Files:   files,
+			})
+		}
+	}
+
+	return violations
+}
+
+// forbiddenBy returns the first forbidden pattern filePath matches,
+// or an empty string
+func (b *Budget) forbiddenBy(filePath string) string {
+	names := strings.Split(filePath, "/")
+	for _, pattern := range b.Forbid {
+		if strings.Contains(pattern, "/") {
+			if match, _ := path.Match(pattern, filePath); match {
+				return pattern
+			}
+			continue
+		}
+
+		for _, name := range names {
+			if match, _ := path.Match(pattern, name); match {
+				return pattern
+			}
+		}
+	}
+	return ""
+}
+
+// checkBudgets makes sure the build is within budget for every channel,
+// and reports everything that isn't, before anything is uploaded.
+func checkBudgets(s *session, budget *Budget, channels []*channelPush, container *tlc.Container) error {
+	var failed int
+	for _, cp := range channels {
+		var parent *tlc.Container
+		if budget.NeedsParent() {
+			_, sig, err := cp.fetchHead(s)
+			if err != nil {
+				return errors.Wrap(err, "looking up current build to check budget")
+			}
+			if sig != nil {
+				parent = sig.Container
+			}
+		}
+
+		violations := budget.Check(cp.filterContainer(container), parent)
+		if len(violations) == 0 {
+			continue
+		}
+		failed++
+
+		comm.Logf("")
+		comm.Logf("Build for %s exceeds its budget:", cp.specStr)
+		for _, v := range violations {
+			comm.Logf("  - %s", v.Message)
+			for _, f := range v.Files {
+				comm.Logf("      %s", f)
+			}
+		}
+	}
+
+	if failed > 0 {
+		comm.Logf("")
+		if len(channels) == 1 {
+			return errors.New("build exceeds its budget, not pushing anything")
+		}
+		return fmt.Errorf("build exceeds its budget for %d of %d channels, not pushing anything", failed, len(channels))
+	}
+
+	comm.Statf("Build is within budget")
+	return nil
+}
@@ -0,0 +1,75 @@
+package push_test
+
+import (
+	"testing"
+
+	"github.com/itchio/butler/cmd/push"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/wharf/wtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBudget(t *testing.T) {
+	size, err := push.ParseSize("1.5MB")
+	wtest.Must(t, err)
+	assert.EqualValues(t, 1536*1024, size)
+
+	size, err = push.ParseSize("4096")
+	wtest.Must(t, err)
+	assert.EqualValues(t, 4096, size)
+
+	_, err = push.ParseSize("lots")
+	assert.Error(t, err)
+
+	makeContainer := func(files ...*tlc.File) *tlc.Container {
+		c := &tlc.Container{Files: files}
+		for _, f := range files {
+			f.Offset = c.Size
+			c.Size += f.Size
+		}
+		return c
+	}
+
+	parent := makeContainer(
+		&tlc.File{Path: "game.exe", Size: 1000},
+		&tlc.File{Path: "data/main.pak", Size: 9000},
+	)
+	container := makeContainer(
+		&tlc.File{Path: "game.exe", Size: 1000},
+		&tlc.File{Path: "game.pdb", Size: 500},
+		&tlc.File{Path: "data/main.pak", Size: 9000},
+		&tlc.File{Path: "data/extra.pak", Size: 3000},
+		&tlc.File{Path: "Cache/shaders.bin", Size: 200},
+	)
+
+	empty := &push.Budget{}
+	assert.True(t, empty.IsEmpty())
+	assert.Empty(t, empty.Check(container, parent))
+
+	within := &push.Budget{MaxSize: 20000, MaxFileSize: 10000}
+	wtest.Must(t, within.SetMaxGrowth("50%"))
+	assert.False(t, within.IsEmpty())
+	assert.True(t, within.NeedsParent())
+	assert.Empty(t, within.Check(container, parent))
+
+	over := &push.Budget{
+		MaxSize:     10000,
+		MaxFileSize: 2000,
+		Forbid:      []string{"*.pdb", "Cache", "data/extra.*"},
+	}
+	wtest.Must(t, over.SetMaxGrowth("10%"))
+	violations := over.Check(container, parent)
+	assert.Len(t, violations, 4)
+	assert.Contains(t, violations[0].Message, "total size")
+	assert.Contains(t, violations[1].Message, "+37.0%")
+	assert.EqualValues(t, []string{"data/main.pak (8.79 KiB)", "data/extra.pak (2.93 KiB)"}, violations[2].Files)
+	assert.Len(t, violations[3].Files, 3)
+
+	// growth isn't checked for first builds
+	assert.Len(t, over.Check(container, nil), 3)
+
+	wtest.Must(t, over.SetMaxGrowth("5KB"))
+	assert.EqualValues(t, 5*1024, over.MaxGrowth)
+	assert.EqualValues(t, 0, over.MaxGrowthPercent)
+	assert.Error(t, over.SetMaxGrowth("ten%"))
+}
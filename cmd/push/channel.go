@@ -0,0 +1,533 @@
+package push
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/itchio/httpkit/eos"
+	"github.com/itchio/httpkit/eos/option"
+	"github.com/itchio/httpkit/uploader"
+
+	itchio "github.com/itchio/go-itchio"
+
+	"github.com/itchio/butler/comm"
+	"github.com/itchio/butler/filtering"
+	"github.com/itchio/butler/localrepo"
+	"github.com/itchio/butler/mansion"
+
+	"github.com/itchio/headway/counter"
+	"github.com/itchio/headway/state"
+	"github.com/itchio/headway/united"
+
+	"github.com/itchio/savior/seeksource"
+
+	"github.com/itchio/lake"
+	"github.com/itchio/lake/pools"
+	"github.com/itchio/lake/tlc"
+
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/wsync"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/semaphore"
+)
+
+// session holds everything that is shared by all the channels
+// we're pushing to.
+type session struct {
+	ctx      *mansion.Context
+	client   *itchio.Client
+	consumer *state.Consumer
+	// src is what was given on the command-line, buildPath is what
+	// we're actually walking: they differ for extracted archives
+	src       string
+	buildPath string
+	ifChanged bool
+	resumable bool
+	// journalDir is where resumable push sessions are journaled
+	journalDir string
+
+	// ready is closed once the source container has been walked
+	// and validated. If source is nil by then, walking failed.
+	ready  chan struct{}
+	source *walkResult
+
+	// uploadSlots limits how many build files are uploaded at once,
+	// across all channels. It's nil when there's no limit.
+	uploadSlots *semaphore.Weighted
+	// uploadRetries only applies to spooled build files: streamed ones
+	// are retried by httpkit's uploader
+	uploadRetries RetrySettings
+
+	progress *pushProgress
+}
+
+// compression returns the settings patches and signatures are written
+// with, from the global --compression and --quality flags
+func (s *session) compression() *pwr.CompressionSettings {
+	settings := s.ctx.CompressionSettings()
+	return &settings
+}
+
+// acquireUploads waits until n more build files may be uploaded, and
+// returns a func that gives their slots back. n must not be more than
+// the limit, or it waits forever.
+func (s *session) acquireUploads(n int64) func() {
+	if s.uploadSlots == nil {
+		return func() {}
+	}
+	// can't fail, the context is never cancelled
+	_ = s.uploadSlots.Acquire(context.Background(), n)
+	return func() {
+		s.uploadSlots.Release(n)
+	}
+}
+
+// channelPush is a single build being pushed to a single channel.
+type channelPush struct {
+	specStr  string
+	spec     *itchio.Spec
+	settings *channelSettings
+	// repo is set when pushing to a local repository instead of itch.io
+	repo *localrepo.Repo
+
+	buildID  int64
+	parentID int64
+
+	// the channel's current build, as looked up by fetchHead
+	headFetched   bool
+	headID        int64
+	headSignature *pwr.SignatureInfo
+	// skipped is set when nothing was pushed because of --if-changed
+	skipped bool
+
+	container    *tlc.Container
+	pool         lake.Pool
+	patchCounter *counter.Writer
+	freshBytes   int64
+	reusedBytes  int64
+
+	// progress, guarded by the session's pushProgress
+	readBytes          int64
+	patchUploadedBytes int64
+
+	err error
+}
+
+// filterContainer applies this channel's own ignore patterns,
+// if any, to the container that was walked.
+func (cp *channelPush) filterContainer(container *tlc.Container) *tlc.Container {
+	if len(cp.settings.ignore) == 0 {
+		return container
+	}
+	return filtering.FilterContainer(container, filtering.PatternFilter(cp.settings.ignore))
+}
+
+func (s *session) getSignature(ID int64) (*pwr.SignatureInfo, error) {
+	return DownloadSignature(s.ctx, s.client, s.consumer, ID)
+}
+
+// DownloadSignature downloads and reads the signature of a build
+func DownloadSignature(ctx *mansion.Context, client *itchio.Client, consumer *state.Consumer, ID int64) (*pwr.SignatureInfo, error) {
+	buildFiles, err := client.ListBuildFiles(ctx.DefaultCtx(), ID)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing build files")
+	}
+
+	signatureFile := itchio.FindBuildFile(itchio.BuildFileTypeSignature, buildFiles.Files)
+	if signatureFile == nil {
+		return nil, fmt.Errorf("Could not find signature for build %d, aborting", ID)
+	}
+
+	signatureURL := client.MakeBuildFileDownloadURL(itchio.MakeBuildFileDownloadURLParams{
+		BuildID: ID,
+		FileID:  signatureFile.ID,
+	})
+
+	signatureReader, err := eos.Open(signatureURL, option.WithConsumer(consumer))
+	if err != nil {
+		return nil, errors.Wrap(err, "opening signature")
+	}
+	defer signatureReader.Close()
+
+	signatureSource := seeksource.FromFile(signatureReader)
+
+	_, err = signatureSource.Resume(nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening signature")
+	}
+
+	signature, err := pwr.ReadSignature(context.Background(), signatureSource)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading signature")
+	}
+
+	return signature, nil
+}
+
+// fetchHead returns the channel's current build and its signature, or
+// zero and nil if the channel doesn't have any build yet. The result
+// is cached, so the signature is only downloaded once.
+func (cp *channelPush) fetchHead(s *session) (int64, *pwr.SignatureInfo, error) {
+	if cp.headFetched {
+		return cp.headID, cp.headSignature, nil
+	}
+
+	if cp.repo != nil {
+		err := cp.fetchLocalHead()
+		if err != nil {
+			return 0, nil, err
+		}
+		cp.headFetched = true
+		return cp.headID, cp.headSignature, nil
+	}
+
+	// channels that were never pushed to don't exist yet, which GetChannel
+	// can't tell apart from other errors, so look for it in the list instead.
+	// Failing to get that list is an error: budgets and --if-changed can't
+	// go on as if there was no current build.
+	channelsRes, err := s.client.ListChannels(s.ctx.DefaultCtx(), cp.spec.Target)
+	if err != nil {
+		return 0, nil, errors.Wrapf(err, "looking up channel %s", cp.spec.Channel)
+	}
+
+	var head *itchio.Build
+	for _, ch := range channelsRes.Channels {
+		if ch.Name == cp.spec.Channel {
+			head = ch.Head
+		}
+	}
+	if head != nil {
+		headID := head.ID
+		comm.Opf("For channel `%s`: current build is %d, downloading its signature", cp.spec.Channel, headID)
+		sig, err := s.getSignature(headID)
+		if err != nil {
+			return 0, nil, errors.Wrapf(err, "getting signature of build %d", headID)
+		}
+		cp.headID = headID
+		cp.headSignature = sig
+	}
+	cp.headFetched = true
+
+	return cp.headID, cp.headSignature, nil
+}
+
+func (cp *channelPush) run(s *session) error {
+	if s.ifChanged {
+		changed, err := cp.checkChanged(s)
+		if err != nil {
+			return err
+		}
+		if !changed {
+			cp.skipped = true
+			return nil
+		}
+	}
+
+	if cp.repo != nil {
+		// local builds are only committed once complete, there's
+		// nothing to resume
+		return cp.runLocal(s)
+	}
+
+	if s.resumable {
+		return cp.runResumable(s)
+	}
+
+	bothFiles, err := cp.createBuild(s)
+	if err != nil {
+		return err
+	}
+
+	targetSignature, err := cp.targetSignature(s)
+	if err != nil {
+		return err
+	}
+
+	newPatchRes := bothFiles.patchRes
+	newSignatureRes := bothFiles.signatureRes
+
+	// the patch and signature are uploaded as they're written, so they
+	// need to go at the same time, for as long as diffing takes. Pushes
+	// limited to a single file at a time are spooled instead, see Do.
+	release := s.acquireUploads(2)
+	defer release()
+
+	patchWriter := uploader.NewResumableUpload(newPatchRes.File.UploadURL)
+	patchWriter.SetConsumer(s.consumer)
+
+	signatureWriter := uploader.NewResumableUpload(newSignatureRes.File.UploadURL)
+	signatureWriter.SetConsumer(s.consumer)
+
+	comm.Debugf("Launching patch & signature channels")
+
+	cp.patchCounter = counter.NewWriter(patchWriter)
+	signatureCounter := counter.NewWriter(signatureWriter)
+
+	sourcePool, err := cp.prepareSource(s)
+	if err != nil {
+		return err
+	}
+
+	patchWriter.SetProgressListener(func(count int64) {
+		s.progress.setUploaded(cp, count)
+	})
+
+	err = cp.writePatch(s, sourcePool, targetSignature, signatureCounter)
+	if err != nil {
+		return err
+	}
+
+	// close both files concurrently
+	{
+		errs := make(chan error)
+
+		go func() {
+			errs <- patchWriter.Close()
+		}()
+		go func() {
+			errs <- signatureWriter.Close()
+		}()
+
+		// 2 close
+		for i := 0; i < 2; i++ {
+			err := <-errs
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+
+	// finalize both files concurrently
+	{
+		errs := make(chan error)
+
+		go func() {
+			errs <- cp.finalizeFile(s, newPatchRes.File.ID, cp.patchCounter.Count())
+		}()
+		go func() {
+			errs <- cp.finalizeFile(s, newSignatureRes.File.ID, signatureCounter.Count())
+		}()
+
+		// 2 finalize
+		for i := 0; i < 2; i++ {
+			err := <-errs
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+
+	s.progress.setDone(cp)
+	return nil
+}
+
+// checkChanged returns false if the channel's latest build has
+// exactly the contents we're about to push.
+func (cp *channelPush) checkChanged(s *session) (bool, error) {
+	spec := cp.spec
+
+	_, sig, err := cp.fetchHead(s)
+	if err != nil {
+		return false, errors.Wrap(err, "getting previous build signature")
+	}
+
+	if sig != nil {
+		comm.Opf("For channel `%s`: comparing against previous build...", spec.Channel)
+		<-s.ready
+		if s.source == nil {
+			return false, errors.New("walking source container failed")
+		}
+
+		// compare what this channel would push, its own ignore patterns
+		// included, rather than the whole build folder
+		err = sig.Container.EnsureEqual(cp.filterContainer(s.source.container))
+		if err != nil {
+			comm.Debugf("For channel `%s`: %s", spec.Channel, err.Error())
+			return true, nil
+		}
+
+		// the file list matches, so checking the files of the previous
+		// build's signature checks all the files we'd push
+		err = pwr.AssertValid(s.buildPath, sig)
+		if err == nil {
+			comm.Statf("For channel `%s`: no changes and --if-changed used, not pushing anything", spec.Channel)
+			return false, nil
+		}
+
+		if _, ok := err.(*pwr.ErrHasWound); ok {
+			// cool, that's what we expected
+		} else {
+			return false, errors.Wrap(err, "checking for differences")
+		}
+	} else {
+		comm.Opf("For channel `%s`: no previous build to compare against, pushing unconditionally", spec.Channel)
+	}
+	return true, nil
+}
+
+// createBuild creates a new build on the server, along with
+// its patch and signature files.
+func (cp *channelPush) createBuild(s *session) (*createBothFilesResponse, error) {
+	ctx := s.ctx
+	spec := cp.spec
+
+	newBuildRes, err := s.client.CreateBuild(ctx.DefaultCtx(), itchio.CreateBuildParams{
+		Target:      spec.Target,
+		Channel:     spec.Channel,
+		UserVersion: cp.settings.userVersion,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "creating build on remote server")
+	}
+
+	cp.buildID = newBuildRes.Build.ID
+	cp.parentID = newBuildRes.Build.ParentBuild.ID
+
+	bothFiles, err := createBothFiles(ctx, s.client, cp.buildID)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating remote patch and signature files")
+	}
+	return bothFiles, nil
+}
+
+// targetSignature returns the signature of the parent build, or
+// an empty signature if this is the first build of the channel.
+func (cp *channelPush) targetSignature(s *session) (*pwr.SignatureInfo, error) {
+	if cp.parentID == 0 {
+		comm.Opf("For channel `%s`: pushing first build", cp.spec.Channel)
+		return &pwr.SignatureInfo{
+			Container: &tlc.Container{},
+			Hashes:    make([]wsync.BlockHash, 0),
+		}, nil
+	}
+
+	if cp.headSignature != nil && cp.headID == cp.parentID {
+		// we already have it
+		return cp.headSignature, nil
+	}
+
+	if cp.repo != nil {
+		return cp.readLocalSignature()
+	}
+
+	comm.Opf("For channel `%s`: last build is %d, downloading its signature", cp.spec.Channel, cp.parentID)
+	targetSignature, err := s.getSignature(cp.parentID)
+	if err != nil {
+		return nil, errors.Wrap(err, "searching for parent build signature")
+	}
+	return targetSignature, nil
+}
+
+// prepareSource waits for the source container to be walked, and
+// returns a pool this channel can read from.
+func (cp *channelPush) prepareSource(s *session) (lake.Pool, error) {
+	<-s.ready
+	if s.source == nil {
+		return nil, errors.New("walking source container failed")
+	}
+	if cp.pool != nil {
+		return cp.pool, nil
+	}
+
+	var sourcePool lake.Pool
+	cp.container = cp.filterContainer(s.source.container)
+	if cp.container == s.source.container && len(s.progress.channels) == 1 {
+		sourcePool = s.source.pool
+	} else {
+		// pools aren't safe for concurrent use, so each channel needs its own
+		var err error
+		sourcePool, err = pools.New(cp.container, s.buildPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "opening source container")
+		}
+	}
+	s.progress.setSize(cp, cp.container.Size)
+	cp.pool = sourcePool
+	return sourcePool, nil
+}
+
+// writePatch diffs the source against the target signature, writing
+// the patch to cp.patchCounter and the new signature to signatureWriter.
+func (cp *channelPush) writePatch(s *session, sourcePool lake.Pool, targetSignature *pwr.SignatureInfo, signatureWriter io.Writer) error {
+	comm.Debugf("Building diff context")
+
+	stateConsumer := &state.Consumer{
+		OnProgress: func(progress float64) {
+			s.progress.setRead(cp, int64(float64(cp.container.Size)*progress))
+		},
+	}
+
+	dctx := &pwr.DiffContext{
+		Compression: s.compression(),
+
+		SourceContainer: cp.container,
+		Pool:            sourcePool,
+
+		TargetContainer: targetSignature.Container,
+		TargetSignature: targetSignature.Hashes,
+
+		Consumer: stateConsumer,
+	}
+
+	err := dctx.WritePatch(context.Background(), cp.patchCounter, signatureWriter)
+	if err != nil {
+		return errors.Wrap(err, "computing and writing patch")
+	}
+
+	cp.freshBytes = dctx.FreshBytes
+	cp.reusedBytes = dctx.ReusedBytes
+	return nil
+}
+
+func (cp *channelPush) finalizeFile(s *session, fileID int64, fileSize int64) error {
+	_, err := s.client.FinalizeBuildFile(s.ctx.DefaultCtx(), itchio.FinalizeBuildFileParams{
+		BuildID: cp.buildID,
+		FileID:  fileID,
+		Size:    fileSize,
+	})
+	return err
+}
+
+// printStats shows how much data was re-used and how large the
+// patch was. When pushing to several channels, each channel's
+// stats are prefixed with its name.
+func (cp *channelPush) printStats(multiple bool) {
+	if cp.skipped {
+		return
+	}
+
+	if multiple {
+		comm.Opf("For channel `%s`: build %d", cp.spec.Channel, cp.buildID)
+	}
+
+	prettyPatchSize := united.FormatBytes(cp.patchCounter.Count())
+	percReused := 100.0 * float64(cp.reusedBytes) / float64(cp.freshBytes+cp.reusedBytes)
+	relToNew := 100.0 * float64(cp.patchCounter.Count()) / float64(cp.container.Size)
+	prettyFreshSize := united.FormatBytes(cp.freshBytes)
+	savings := 100.0 - relToNew
+
+	if cp.reusedBytes > 0 {
+		comm.Statf("Re-used %.2f%% of old, added %s fresh data", percReused, prettyFreshSize)
+	} else {
+		comm.Statf("Added %s fresh data", prettyFreshSize)
+	}
+
+	if savings > 0 && !math.IsNaN(savings) {
+		comm.Statf("%s patch (%.2f%% savings)", prettyPatchSize, 100.0-relToNew)
+	} else {
+		comm.Statf("%s patch (no savings)", prettyPatchSize)
+	}
+
+	if cp.repo != nil {
+		comm.Opf("Build %d is now the latest build of `%s` in %s", cp.buildID, cp.spec.Channel, cp.repo.Dir)
+		comm.Logf("")
+		return
+	}
+
+	comm.Opf("Build is now processing, should be up in a bit.")
+	comm.Logf("")
+	comm.Logf("Use the `butler status %s` for more information.", cp.specStr)
+	comm.Logf("")
+}
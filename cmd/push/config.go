@@ -0,0 +1,344 @@
+package push
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/itchio/butler/comm"
+	"github.com/itchio/butler/filtering"
+	"github.com/itchio/lake/tlc"
+	"github.com/pkg/errors"
+)
+
+// ConfigFileName is the name of the per-project configuration file
+// that `butler push` looks for in the working directory and its parents.
+const ConfigFileName = ".butler.toml"
+
+// Config holds per-project push settings, so CI jobs don't have
+// to repeat the same flags over and over.
+type Config struct {
+	// Path is where the config was loaded from
+	Path string `toml:"-"`
+
+	Push PushConfig `toml:"push"`
+
+	// Targets maps short aliases (like 'win') to full targets
+	// (like 'studio/game:windows-64')
+	Targets map[string]string `toml:"targets"`
+
+	// Channels holds settings that only apply when pushing to
+	// a given channel
+	Channels map[string]*ChannelConfig `toml:"channels"`
+}
+
+// PushConfig holds defaults for `butler push` flags. Values
+// passed on the command-line always win.
+type PushConfig struct {
+	UserVersion     string   `toml:"userversion"`
+	UserVersionFile string   `toml:"userversion-file"`
+	FixPermissions  *bool    `toml:"fix-permissions"`
+	Dereference     *bool    `toml:"dereference"`
+	IfChanged       *bool    `toml:"if-changed"`
+	AutoWrap        *bool    `toml:"auto-wrap"`
+	Resumable       *bool    `toml:"resumable"`
+	Lint            *bool    `toml:"lint"`
+	LintStrict      *bool    `toml:"lint-strict"`
+	Ignore          []string `toml:"ignore"`
+
+	Budget BudgetConfig `toml:"budget"`
+}
+
+// ChannelConfig holds settings specific to a single channel.
+type ChannelConfig struct {
+	UserVersionFile string   `toml:"userversion-file"`
+	Ignore          []string `toml:"ignore"`
+}
+
+// FindConfig looks for a config file in dir, then in each of its
+// parents. It returns an empty string if none was found.
+func FindConfig(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	for {
+		candidate := filepath.Join(dir, ConfigFileName)
+		stats, err := os.Stat(candidate)
+		if err == nil && !stats.IsDir() {
+			return candidate, nil
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+// LoadConfig parses the config file at configPath. Unknown keys
+// are reported as warnings, so typos don't go unnoticed.
+func LoadConfig(configPath string) (*Config, error) {
+	cfg := &Config{}
+	md, err := toml.DecodeFile(configPath, cfg)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", configPath)
+	}
+	cfg.Path = configPath
+
+	for _, key := range md.Undecoded() {
+		comm.Warnf("%s: unknown key (%s), ignoring", configPath, key)
+	}
+
+	return cfg, nil
+}
+
+// ResolveTarget expands target if it's an alias listed in the
+// config's [targets] section, and returns it unchanged otherwise.
+func (cfg *Config) ResolveTarget(target string) string {
+	if cfg == nil {
+		return target
+	}
+	if resolved, ok := cfg.Targets[target]; ok {
+		return resolved
+	}
+	return target
+}
+
+// Channel returns the settings for a given channel, which may be nil.
+func (cfg *Config) Channel(channel string) *ChannelConfig {
+	if cfg == nil {
+		return nil
+	}
+	return cfg.Channels[channel]
+}
+
+// settingOrigin records where the value of a push setting came from,
+// so that --dry-run can show it.
+type settingOrigin struct {
+	name   string
+	value  string
+	source string
+}
+
+type settingOrigins []settingOrigin
+
+func (so *settingOrigins) add(name string, value interface{}, source string) {
+	*so = append(*so, settingOrigin{
+		name:   name,
+		value:  fmt.Sprintf("%v", value),
+		source: source,
+	})
+}
+
+func (so settingOrigins) Print(log func(line string)) {
+	sorted := append(settingOrigins{}, so...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].name < sorted[j].name
+	})
+
+	width := 0
+	for _, s := range sorted {
+		if len(s.name) > width {
+			width = len(s.name)
+		}
+	}
+
+	for _, s := range sorted {
+		pad := strings.Repeat(" ", width-len(s.name))
+		log(fmt.Sprintf("%s%s = %s (from %s)", s.name, pad, s.value, s.source))
+	}
+}
+
+// applyConfig fills in settings that weren't given explicitly from
+// the config file, and returns where each setting came from. Settings
+// that depend on the channel are handled by settingsForChannel.
+func (params *Params) applyConfig(cfg *Config) settingOrigins {
+	var origins settingOrigins
+
+	var pushCfg PushConfig
+	if cfg != nil {
+		pushCfg = cfg.Push
+	}
+
+	boolSetting := func(name string, value *bool, fromConfig *bool) {
+		src := params.source(name)
+		if !params.Explicit[name] && fromConfig != nil {
+			*value = *fromConfig
+			src = cfg.Path
+		}
+		origins.add(name, *value, src)
+	}
+	boolSetting("fix-permissions", &params.FixPerms, pushCfg.FixPermissions)
+	boolSetting("dereference", &params.Dereference, pushCfg.Dereference)
+	boolSetting("if-changed", &params.IfChanged, pushCfg.IfChanged)
+	boolSetting("auto-wrap", &params.AutoWrap, pushCfg.AutoWrap)
+	boolSetting("resumable", &params.Resumable, pushCfg.Resumable)
+	boolSetting("lint", &params.Lint, pushCfg.Lint)
+	boolSetting("lint-strict", &params.LintStrict, pushCfg.LintStrict)
+
+	for _, pattern := range filtering.CustomIgnorePatterns {
+		origins.add("ignore", pattern, "command-line")
+	}
+	for _, pattern := range pushCfg.Ignore {
+		params.Ignore = append(params.Ignore, pattern)
+		origins.add("ignore", pattern, cfg.Path)
+	}
+
+	return origins
+}
+
+// filter is what the build is walked with: the usual filter, plus
+// the ignore patterns from the config file
+func (params *Params) filter() tlc.FilterFunc {
+	if len(params.Ignore) == 0 {
+		return filtering.FilterPaths
+	}
+
+	ignore := filtering.PatternFilter(params.Ignore)
+	return func(name string) tlc.FilterResult {
+		if filtering.FilterPaths(name) == tlc.FilterIgnore {
+			return tlc.FilterIgnore
+		}
+		return ignore(name)
+	}
+}
+
+// resolveBudget builds the budget from flags and the config's [push.budget]
+// section. Flags win, except for forbidden patterns, which add up.
+func (params *Params) resolveBudget(cfg *Config, origins *settingOrigins) (*Budget, error) {
+	var budgetCfg BudgetConfig
+	if cfg != nil {
+		budgetCfg = cfg.Push.Budget
+	}
+	budget := &Budget{}
+
+	setting := func(name string, value string, fromConfig string, set func(value string) error) error {
+		src := params.source(name)
+		if !params.Explicit[name] && fromConfig != "" {
+			value = fromConfig
+			src = cfg.Path + " [push.budget]"
+		}
+		if value == "" {
+			return nil
+		}
+
+		err := set(value)
+		if err != nil {
+			return errors.Wrapf(err, "%s (from %s)", name, src)
+		}
+		origins.add(name, value, src)
+		return nil
+	}
+
+	setSize := func(dst *int64) func(value string) error {
+		return func(value string) error {
+			size, err := ParseSize(value)
+			*dst = size
+			return err
+		}
+	}
+
+	err := setting("max-size", params.MaxSize, budgetCfg.MaxSize, setSize(&budget.MaxSize))
+	if err != nil {
+		return nil, err
+	}
+	err = setting("max-growth", params.MaxGrowth, budgetCfg.MaxGrowth, budget.SetMaxGrowth)
+	if err != nil {
+		return nil, err
+	}
+	err = setting("max-file-size", params.MaxFileSize, budgetCfg.MaxFileSize, setSize(&budget.MaxFileSize))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pattern := range params.Forbid {
+		budget.Forbid = append(budget.Forbid, pattern)
+		origins.add("forbid", pattern, "command-line")
+	}
+	for _, pattern := range budgetCfg.Forbid {
+		budget.Forbid = append(budget.Forbid, pattern)
+		origins.add("forbid", pattern, cfg.Path+" [push.budget]")
+	}
+
+	return budget, nil
+}
+
+// channelSettings holds what may differ from one channel to the
+// next when pushing the same build to several channels.
+type channelSettings struct {
+	userVersion string
+	ignore      []string
+	origins     settingOrigins
+}
+
+// settingsForChannel determines the userversion and extra ignore patterns
+// for a given channel.
+func (params *Params) settingsForChannel(cfg *Config, channel string) (*channelSettings, error) {
+	cs := &channelSettings{}
+
+	var pushCfg PushConfig
+	if cfg != nil {
+		pushCfg = cfg.Push
+	}
+	channelCfg := cfg.Channel(channel)
+	channelSource := func() string {
+		return fmt.Sprintf("%s [channels.%s]", cfg.Path, channel)
+	}
+	// configRelative resolves paths in the config file relative to its folder
+	configRelative := func(p string) string {
+		if filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(filepath.Dir(cfg.Path), p)
+	}
+
+	userVersion := params.UserVersion
+	userVersionFile := params.UserVersionFile
+	switch {
+	case userVersion != "":
+		cs.origins.add("userversion", userVersion, params.source("userversion"))
+	case userVersionFile != "":
+		cs.origins.add("userversion-file", userVersionFile, params.source("userversion-file"))
+	case channelCfg != nil && channelCfg.UserVersionFile != "":
+		userVersionFile = configRelative(channelCfg.UserVersionFile)
+		cs.origins.add("userversion-file", userVersionFile, channelSource())
+	case pushCfg.UserVersion != "":
+		userVersion = pushCfg.UserVersion
+		cs.origins.add("userversion", userVersion, cfg.Path)
+	case pushCfg.UserVersionFile != "":
+		userVersionFile = configRelative(pushCfg.UserVersionFile)
+		cs.origins.add("userversion-file", userVersionFile, cfg.Path)
+	}
+
+	if userVersion == "" && userVersionFile != "" {
+		var err error
+		userVersion, err = readUserVersionFile(userVersionFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading userversion file")
+		}
+		cs.origins.add("userversion", userVersion, userVersionFile)
+	}
+	cs.userVersion = userVersion
+
+	if channelCfg != nil {
+		for _, pattern := range channelCfg.Ignore {
+			cs.ignore = append(cs.ignore, pattern)
+			cs.origins.add("ignore", pattern, channelSource())
+		}
+	}
+
+	return cs, nil
+}
+
+func (params *Params) source(name string) string {
+	if params.Explicit[name] {
+		return "command-line"
+	}
+	return "default"
+}
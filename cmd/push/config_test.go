@@ -0,0 +1,61 @@
+package push_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/itchio/butler/cmd/push"
+	"github.com/itchio/wharf/wtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "push-config-tests")
+	wtest.Must(t, err)
+	defer os.RemoveAll(dir)
+
+	configContents := `
+[push]
+fix-permissions = false
+ignore = ["*.pdb"]
+
+[targets]
+win = "studio/game:windows-64"
+
+[channels.windows-64]
+userversion-file = "VERSION"
+ignore = ["*.log"]
+`
+	configPath := filepath.Join(dir, push.ConfigFileName)
+	wtest.Must(t, ioutil.WriteFile(configPath, []byte(configContents), 0o644))
+
+	nested := filepath.Join(dir, "build", "win")
+	wtest.Must(t, os.MkdirAll(nested, 0o755))
+
+	found, err := push.FindConfig(nested)
+	wtest.Must(t, err)
+	assert.EqualValues(t, configPath, found)
+
+	cfg, err := push.LoadConfig(found)
+	wtest.Must(t, err)
+	assert.EqualValues(t, configPath, cfg.Path)
+	assert.NotNil(t, cfg.Push.FixPermissions)
+	assert.False(t, *cfg.Push.FixPermissions)
+	assert.Nil(t, cfg.Push.Dereference)
+	assert.EqualValues(t, []string{"*.pdb"}, cfg.Push.Ignore)
+
+	assert.EqualValues(t, "studio/game:windows-64", cfg.ResolveTarget("win"))
+	assert.EqualValues(t, "studio/game:linux", cfg.ResolveTarget("studio/game:linux"))
+
+	channel := cfg.Channel("windows-64")
+	assert.NotNil(t, channel)
+	assert.EqualValues(t, "VERSION", channel.UserVersionFile)
+	assert.EqualValues(t, []string{"*.log"}, channel.Ignore)
+	assert.Nil(t, cfg.Channel("linux"))
+
+	var noConfig *push.Config
+	assert.EqualValues(t, "win", noConfig.ResolveTarget("win"))
+	assert.Nil(t, noConfig.Channel("windows-64"))
+}
@@ -0,0 +1,135 @@
+package push
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dchest/safefile"
+	"github.com/pkg/errors"
+)
+
+// pendingBuildMaxAge is how long we try to resume a pending build for.
+// Upload sessions on storage expire after a week, so there's no point
+// trying past that.
+const pendingBuildMaxAge = 6 * 24 * time.Hour
+
+// journal records everything needed to resume a push that was
+// interrupted: which build was created, where its files are being
+// uploaded, and where the patch and signature were spooled to.
+type journal struct {
+	// Target is the user/game:channel being pushed to
+	Target string `json:"target"`
+	// Source is the absolute path of what's being pushed
+	Source      string    `json:"source"`
+	UserVersion string    `json:"userVersion"`
+	CreatedAt   time.Time `json:"createdAt"`
+
+	BuildID  int64 `json:"buildId"`
+	ParentID int64 `json:"parentId"`
+
+	// Spooled is set once the patch and signature have been
+	// completely written to disk
+	Spooled     bool  `json:"spooled"`
+	FreshBytes  int64 `json:"freshBytes"`
+	ReusedBytes int64 `json:"reusedBytes"`
+
+	Patch     *journalFile `json:"patch"`
+	Signature *journalFile `json:"signature"`
+
+	// dir is where the journal and spool files live
+	dir string
+}
+
+// journalFile is a build file being uploaded
+type journalFile struct {
+	ID        int64  `json:"id"`
+	UploadURL string `json:"uploadUrl"`
+	// Size is only known once the file is spooled
+	Size      int64 `json:"size"`
+	Finalized bool  `json:"finalized"`
+}
+
+// DefaultJournalDir returns where push sessions are journaled when
+// no directory was specified.
+func DefaultJournalDir() string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		cacheDir = os.TempDir()
+	}
+	return filepath.Join(cacheDir, "itch", "butler", "push-sessions")
+}
+
+// journalDirFor returns a folder unique to a (source, target) pair, so that
+// running the exact same push command again finds the same journal.
+func journalDirFor(baseDir string, source string, target string) string {
+	key := sha256.Sum256([]byte(source + "\n" + target))
+	return filepath.Join(baseDir, fmt.Sprintf("%x", key[:12]))
+}
+
+func (j *journal) journalPath() string {
+	return filepath.Join(j.dir, "journal.json")
+}
+
+func (j *journal) patchPath() string {
+	return filepath.Join(j.dir, "patch.pwr")
+}
+
+func (j *journal) signaturePath() string {
+	return filepath.Join(j.dir, "signature.pws")
+}
+
+// loadJournal returns the journal in dir, or nil if there is none
+func loadJournal(dir string) (*journal, error) {
+	j := &journal{dir: dir}
+
+	f, err := os.Open(j.journalPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	err = json.NewDecoder(f).Decode(j)
+	if err != nil {
+		return nil, errors.Wrapf(err, "decoding push journal %s", j.journalPath())
+	}
+	if j.Patch == nil || j.Signature == nil {
+		return nil, errors.Errorf("push journal %s is incomplete", j.journalPath())
+	}
+
+	return j, nil
+}
+
+// save atomically writes the journal to disk
+func (j *journal) save() error {
+	err := os.MkdirAll(j.dir, 0o755)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	f, err := safefile.Create(j.journalPath(), 0o644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(j)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return f.Commit()
+}
+
+// remove gets rid of the journal and spool files
+func (j *journal) remove() error {
+	return os.RemoveAll(j.dir)
+}
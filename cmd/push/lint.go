@@ -0,0 +1,82 @@
+package push
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/itchio/butler/comm"
+	"github.com/itchio/butler/portability"
+	"github.com/itchio/lake"
+	"github.com/itchio/lake/pools"
+	"github.com/itchio/ox"
+	"github.com/pkg/errors"
+)
+
+// ChannelPlatforms guesses which platforms a channel is for from its
+// name, the same way itch.io does: 'windows-beta' is for Windows,
+// 'osx-linux' for macOS and Linux. It returns nil if the name doesn't
+// say.
+func ChannelPlatforms(channel string) []ox.Platform {
+	channel = strings.ToLower(channel)
+	var platforms []ox.Platform
+	if strings.Contains(channel, "win") {
+		platforms = append(platforms, ox.PlatformWindows)
+	}
+	if strings.Contains(channel, "mac") || strings.Contains(channel, "osx") {
+		platforms = append(platforms, ox.PlatformOSX)
+	}
+	if strings.Contains(channel, "linux") {
+		platforms = append(platforms, ox.PlatformLinux)
+	}
+	return platforms
+}
+
+// checkPortability lints the build for the platforms of each channel.
+// Channels whose name doesn't tell are checked for all platforms.
+func checkPortability(channels []*channelPush, source *walkResult, buildPath string, strict bool) error {
+	var failed int
+	for _, cp := range channels {
+		container := cp.filterContainer(source.container)
+
+		var pool lake.Pool = source.pool
+		if container != source.container {
+			var err error
+			pool, err = pools.New(container, buildPath)
+			if err != nil {
+				return errors.Wrap(err, "opening source container")
+			}
+		}
+
+		report, err := portability.Lint(container, pool, ChannelPlatforms(cp.spec.Channel))
+		if pool != source.pool {
+			pool.Close()
+		}
+		if err != nil {
+			return errors.Wrap(err, "checking portability")
+		}
+
+		if len(report.Issues) == 0 {
+			continue
+		}
+
+		comm.Logf("")
+		comm.Logf("Build for %s has portability issues:", cp.specStr)
+		report.Print(func(line string) {
+			comm.Logf("  %s", line)
+		})
+		if report.Failed(strict) {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		comm.Logf("")
+		if len(channels) == 1 {
+			return errors.New("build has portability problems, not pushing anything")
+		}
+		return fmt.Errorf("build has portability problems for %d of %d channels, not pushing anything", failed, len(channels))
+	}
+
+	comm.Statf("Build passed portability checks")
+	return nil
+}
@@ -0,0 +1,16 @@
+package push_test
+
+import (
+	"testing"
+
+	"github.com/itchio/butler/cmd/push"
+	"github.com/itchio/ox"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChannelPlatforms(t *testing.T) {
+	assert.EqualValues(t, []ox.Platform{ox.PlatformWindows}, push.ChannelPlatforms("windows-beta"))
+	assert.EqualValues(t, []ox.Platform{ox.PlatformWindows, ox.PlatformOSX, ox.PlatformLinux}, push.ChannelPlatforms("win-linux-mac-stable"))
+	assert.EqualValues(t, []ox.Platform{ox.PlatformOSX}, push.ChannelPlatforms("OSX"))
+	assert.Empty(t, push.ChannelPlatforms("html5"))
+}
@@ -0,0 +1,134 @@
+package push
+
+import (
+	"os"
+
+	"github.com/itchio/butler/comm"
+	"github.com/itchio/butler/localrepo"
+	itchio "github.com/itchio/go-itchio"
+	"github.com/itchio/headway/counter"
+	"github.com/itchio/wharf/pwr"
+	"github.com/pkg/errors"
+)
+
+// parseLocalTarget turns a target like './repo:linux' into a spec whose
+// target is the repository's absolute path.
+func parseLocalTarget(target string) (*itchio.Spec, *localrepo.Repo, error) {
+	dir, channel, err := localrepo.ParseTarget(target)
+	if err != nil {
+		return nil, nil, err
+	}
+	if channel == "" {
+		return nil, nil, errors.Errorf("push target '%s' is missing a channel, expected something like ./repo:linux", target)
+	}
+
+	repo, err := localrepo.Open(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &itchio.Spec{Target: repo.Dir, Channel: channel}, repo, nil
+}
+
+// needsClient returns true if any of the channels is on itch.io
+func needsClient(channels []*channelPush) bool {
+	for _, cp := range channels {
+		if cp.repo == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchLocalHead is fetchHead for channels of a local repository
+func (cp *channelPush) fetchLocalHead() error {
+	head, err := cp.repo.Head(cp.spec.Channel)
+	if err != nil {
+		return err
+	}
+	if head == nil {
+		return nil
+	}
+
+	sig, err := cp.repo.ReadSignature(head.ID)
+	if err != nil {
+		return err
+	}
+	cp.headID = head.ID
+	cp.headSignature = sig
+	return nil
+}
+
+// runLocal pushes to a channel of a local repository: the patch and
+// signature are written straight to the repository, and the build only
+// becomes the channel's head once both are complete.
+func (cp *channelPush) runLocal(s *session) (err error) {
+	pending, err := cp.repo.CreateBuild(cp.spec.Channel, cp.settings.userVersion)
+	if err != nil {
+		return errors.Wrap(err, "creating build in local repository")
+	}
+	defer func() {
+		if err != nil {
+			pending.Abort()
+		}
+	}()
+
+	cp.buildID = pending.Build.ID
+	cp.parentID = pending.Build.ParentID
+
+	targetSignature, err := cp.targetSignature(s)
+	if err != nil {
+		return err
+	}
+
+	sourcePool, err := cp.prepareSource(s)
+	if err != nil {
+		return err
+	}
+
+	patchFile, err := os.Create(pending.PatchPath())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer patchFile.Close()
+
+	signatureFile, err := os.Create(pending.SignaturePath())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer signatureFile.Close()
+
+	cp.patchCounter = counter.NewWriterCallback(func(count int64) {
+		s.progress.setUploaded(cp, count)
+	}, patchFile)
+	signatureCounter := counter.NewWriter(signatureFile)
+
+	err = cp.writePatch(s, sourcePool, targetSignature, signatureCounter)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range []*os.File{patchFile, signatureFile} {
+		err = f.Close()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	pending.Build.Size = cp.container.Size
+	pending.Build.PatchSize = cp.patchCounter.Count()
+	pending.Build.SignatureSize = signatureCounter.Count()
+	err = pending.Commit()
+	if err != nil {
+		return errors.Wrap(err, "committing build to local repository")
+	}
+
+	s.progress.setDone(cp)
+	return nil
+}
+
+// readLocalSignature is targetSignature for channels of a local repository
+func (cp *channelPush) readLocalSignature() (*pwr.SignatureInfo, error) {
+	comm.Opf("For channel `%s`: last build is %d, reading its signature", cp.spec.Channel, cp.parentID)
+	return cp.repo.ReadSignature(cp.parentID)
+}
@@ -0,0 +1,318 @@
+package push
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	itchio "github.com/itchio/go-itchio"
+
+	"github.com/itchio/butler/comm"
+	"github.com/itchio/butler/mansion"
+
+	"github.com/itchio/headway/counter"
+	"github.com/itchio/headway/state"
+	"github.com/itchio/headway/united"
+
+	"github.com/itchio/lake/pools"
+	"github.com/itchio/lake/tlc"
+
+	"github.com/itchio/savior/seeksource"
+
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/wsync"
+	"github.com/pkg/errors"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// PreviewFileStatus is how a file would change if a build was pushed
+type PreviewFileStatus string
+
+const (
+	PreviewFileAdded     PreviewFileStatus = "added"
+	PreviewFileRemoved   PreviewFileStatus = "removed"
+	PreviewFileModified  PreviewFileStatus = "modified"
+	PreviewFileUnchanged PreviewFileStatus = "unchanged"
+)
+
+var previewFileStatuses = []PreviewFileStatus{
+	PreviewFileAdded,
+	PreviewFileRemoved,
+	PreviewFileModified,
+	PreviewFileUnchanged,
+}
+
+// PreviewFile is a single file of a push preview
+type PreviewFile struct {
+	Path   string            `json:"path"`
+	Status PreviewFileStatus `json:"status"`
+	// OldSize is the size of the file in the channel's head build,
+	// zero if it was added
+	OldSize int64 `json:"oldSize"`
+	// NewSize is the size of the file we would push, zero if it was removed
+	NewSize int64 `json:"newSize"`
+}
+
+// PreviewTotal counts files that have a given status
+type PreviewTotal struct {
+	Files int64 `json:"files"`
+	// Bytes is the new size of the files, or the old size for removed files
+	Bytes int64 `json:"bytes"`
+}
+
+// Preview describes what pushing a build to a channel would change
+type Preview struct {
+	Target string `json:"target"`
+	// HeadBuildID is the build we compared against, zero if the
+	// channel doesn't have any build yet
+	HeadBuildID int64 `json:"headBuildId"`
+
+	Files  []*PreviewFile                      `json:"files"`
+	Totals map[PreviewFileStatus]*PreviewTotal `json:"totals"`
+
+	// EstimatedPatchSize is the size of the patch we would upload
+	EstimatedPatchSize int64 `json:"estimatedPatchSize"`
+}
+
+// ComparePreview compares the signature of what we would push against
+// the signature of a channel's head build, file by file. Files are
+// considered modified if their size or any of their blocks changed.
+func ComparePreview(newSignature *pwr.SignatureInfo, oldSignature *pwr.SignatureInfo) (*Preview, error) {
+	newHashes, err := pwr.ComputeHashInfo(newSignature)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	oldHashes, err := pwr.ComputeHashInfo(oldSignature)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	oldIndices := make(map[string]int64)
+	for i, f := range oldSignature.Container.Files {
+		oldIndices[f.Path] = int64(i)
+	}
+
+	p := &Preview{
+		Totals: make(map[PreviewFileStatus]*PreviewTotal),
+	}
+	for _, status := range previewFileStatuses {
+		p.Totals[status] = &PreviewTotal{}
+	}
+
+	add := func(pf *PreviewFile) {
+		p.Files = append(p.Files, pf)
+		total := p.Totals[pf.Status]
+		total.Files++
+		if pf.Status == PreviewFileRemoved {
+			total.Bytes += pf.OldSize
+		} else {
+			total.Bytes += pf.NewSize
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i, f := range newSignature.Container.Files {
+		seen[f.Path] = true
+
+		oldIndex, ok := oldIndices[f.Path]
+		if !ok {
+			add(&PreviewFile{
+				Path:    f.Path,
+				Status:  PreviewFileAdded,
+				NewSize: f.Size,
+			})
+			continue
+		}
+
+		oldFile := oldSignature.Container.Files[oldIndex]
+		status := PreviewFileUnchanged
+		if oldFile.Size != f.Size || !sameBlocks(newHashes.Groups[int64(i)], oldHashes.Groups[oldIndex]) {
+			status = PreviewFileModified
+		}
+		add(&PreviewFile{
+			Path:    f.Path,
+			Status:  status,
+			OldSize: oldFile.Size,
+			NewSize: f.Size,
+		})
+	}
+
+	for _, f := range oldSignature.Container.Files {
+		if seen[f.Path] {
+			continue
+		}
+		add(&PreviewFile{
+			Path:    f.Path,
+			Status:  PreviewFileRemoved,
+			OldSize: f.Size,
+		})
+	}
+
+	sort.Slice(p.Files, func(i, j int) bool {
+		return p.Files[i].Path < p.Files[j].Path
+	})
+
+	return p, nil
+}
+
+func sameBlocks(a []wsync.BlockHash, b []wsync.BlockHash) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].WeakHash != b[i].WeakHash || !bytes.Equal(a[i].StrongHash, b[i].StrongHash) {
+			return false
+		}
+	}
+	return true
+}
+
+// preview diffs the source against the channel's head build without
+// uploading anything, and reports what would change.
+func (cp *channelPush) preview(s *session) (*Preview, error) {
+	headBuildID, oldSignature, err := cp.fetchHead(s)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting head build signature")
+	}
+	if oldSignature == nil {
+		comm.Opf("For channel `%s`: no previous build, every file would be added", cp.spec.Channel)
+		oldSignature = &pwr.SignatureInfo{
+			Container: &tlc.Container{},
+			Hashes:    make([]wsync.BlockHash, 0),
+		}
+	}
+
+	cp.container = cp.filterContainer(s.source.container)
+	sourcePool, err := pools.New(cp.container, s.buildPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening source container")
+	}
+	defer sourcePool.Close()
+
+	patchCounter := counter.NewWriter(ioutil.Discard)
+	signatureBuffer := new(bytes.Buffer)
+
+	dctx := &pwr.DiffContext{
+		Compression: s.compression(),
+
+		SourceContainer: cp.container,
+		Pool:            sourcePool,
+
+		TargetContainer: oldSignature.Container,
+		TargetSignature: oldSignature.Hashes,
+
+		Consumer: s.consumer,
+	}
+
+	comm.StartProgress()
+	err = dctx.WritePatch(context.Background(), patchCounter, signatureBuffer)
+	comm.EndProgress()
+	if err != nil {
+		return nil, errors.Wrap(err, "computing patch")
+	}
+
+	signatureSource := seeksource.FromBytes(signatureBuffer.Bytes())
+	_, err = signatureSource.Resume(nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading new signature")
+	}
+
+	newSignature, err := pwr.ReadSignature(context.Background(), signatureSource)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading new signature")
+	}
+
+	p, err := ComparePreview(newSignature, oldSignature)
+	if err != nil {
+		return nil, err
+	}
+	p.Target = cp.specStr
+	p.HeadBuildID = headBuildID
+	p.EstimatedPatchSize = patchCounter.Count()
+	return p, nil
+}
+
+// printPreviews shows changed files and totals for each channel
+func printPreviews(previews []*Preview) {
+	for _, p := range previews {
+		comm.Logf("")
+		if p.HeadBuildID == 0 {
+			comm.Opf("Pushing to %s would create its first build", p.Target)
+		} else {
+			comm.Opf("Pushing to %s, compared to build %d", p.Target, p.HeadBuildID)
+		}
+
+		var changed int
+		table := tablewriter.NewWriter(os.Stdout)
+		table.SetHeader([]string{"Status", "Path", "Old size", "New size"})
+		for _, f := range p.Files {
+			if f.Status == PreviewFileUnchanged {
+				continue
+			}
+			changed++
+
+			oldSize, newSize := "", ""
+			if f.Status != PreviewFileAdded {
+				oldSize = united.FormatBytes(f.OldSize)
+			}
+			if f.Status != PreviewFileRemoved {
+				newSize = united.FormatBytes(f.NewSize)
+			}
+			table.Append([]string{string(f.Status), f.Path, oldSize, newSize})
+		}
+		if changed > 0 {
+			table.Render()
+		} else {
+			comm.Logf("No file would change.")
+		}
+
+		totals := tablewriter.NewWriter(os.Stdout)
+		totals.SetHeader([]string{"", "Files", "Size"})
+		for _, status := range previewFileStatuses {
+			total := p.Totals[status]
+			totals.Append([]string{string(status), fmt.Sprintf("%d", total.Files), united.FormatBytes(total.Bytes)})
+		}
+		totals.Render()
+
+		comm.Statf("Estimated patch size: %s", united.FormatBytes(p.EstimatedPatchSize))
+	}
+}
+
+// doPreview waits for the source container, then compares it against
+// the head build of each channel, one channel at a time.
+func doPreview(ctx *mansion.Context, client *itchio.Client, consumer *state.Consumer, buildPath string, channels []*channelPush, sourceContainerChan chan walkResult, walkErrs chan error) error {
+	s := &session{
+		ctx:       ctx,
+		client:    client,
+		consumer:  consumer,
+		buildPath: buildPath,
+	}
+
+	select {
+	case walkErr := <-walkErrs:
+		return errors.Wrap(walkErr, "walking directory to push")
+	case walkies := <-sourceContainerChan:
+		s.source = &walkies
+	}
+	defer s.source.pool.Close()
+
+	var previews []*Preview
+	for _, cp := range channels {
+		p, err := cp.preview(s)
+		if err != nil {
+			return errors.Wrapf(err, "previewing push to %s", cp.specStr)
+		}
+		previews = append(previews, p)
+	}
+
+	comm.ResultOrPrint(previews, func() {
+		printPreviews(previews)
+	})
+	return nil
+}
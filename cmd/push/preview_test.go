@@ -0,0 +1,85 @@
+package push_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/itchio/butler/cmd/push"
+	"github.com/itchio/headway/state"
+	"github.com/itchio/lake/pools"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/wtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComparePreview(t *testing.T) {
+	dir, err := ioutil.TempDir("", "push-preview-tests")
+	wtest.Must(t, err)
+	defer os.RemoveAll(dir)
+
+	write := func(path string, contents string) {
+		path = filepath.Join(dir, path)
+		wtest.Must(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		wtest.Must(t, ioutil.WriteFile(path, []byte(contents), 0o644))
+	}
+
+	sign := func(path string) *pwr.SignatureInfo {
+		path = filepath.Join(dir, path)
+		container, err := tlc.WalkAny(path, tlc.WalkOpts{})
+		wtest.Must(t, err)
+
+		pool, err := pools.New(container, path)
+		wtest.Must(t, err)
+		defer pool.Close()
+
+		hashes, err := pwr.ComputeSignature(context.Background(), container, pool, &state.Consumer{})
+		wtest.Must(t, err)
+
+		return &pwr.SignatureInfo{
+			Container: container,
+			Hashes:    hashes,
+		}
+	}
+
+	write("old/same.txt", "unchanged contents")
+	write("old/edited.txt", "hello world")
+	write("old/resized.txt", "short")
+	write("old/gone.txt", "bye")
+	write("old/empty.txt", "")
+
+	write("new/same.txt", "unchanged contents")
+	write("new/edited.txt", "hello there")
+	write("new/resized.txt", "a lot longer")
+	write("new/data/fresh.txt", "brand new")
+	write("new/empty.txt", "")
+
+	p, err := push.ComparePreview(sign("new"), sign("old"))
+	wtest.Must(t, err)
+
+	statuses := make(map[string]push.PreviewFileStatus)
+	for _, f := range p.Files {
+		statuses[f.Path] = f.Status
+	}
+	assert.EqualValues(t, map[string]push.PreviewFileStatus{
+		"same.txt":       push.PreviewFileUnchanged,
+		"empty.txt":      push.PreviewFileUnchanged,
+		"edited.txt":     push.PreviewFileModified,
+		"resized.txt":    push.PreviewFileModified,
+		"gone.txt":       push.PreviewFileRemoved,
+		"data/fresh.txt": push.PreviewFileAdded,
+	}, statuses)
+
+	assert.EqualValues(t, &push.PreviewTotal{Files: 1, Bytes: 9}, p.Totals[push.PreviewFileAdded])
+	assert.EqualValues(t, &push.PreviewTotal{Files: 1, Bytes: 3}, p.Totals[push.PreviewFileRemoved])
+	assert.EqualValues(t, &push.PreviewTotal{Files: 2, Bytes: 23}, p.Totals[push.PreviewFileModified])
+	assert.EqualValues(t, &push.PreviewTotal{Files: 2, Bytes: 18}, p.Totals[push.PreviewFileUnchanged])
+
+	// comparing against an empty channel
+	p, err = push.ComparePreview(sign("new"), &pwr.SignatureInfo{Container: &tlc.Container{}})
+	wtest.Must(t, err)
+	assert.EqualValues(t, 5, p.Totals[push.PreviewFileAdded].Files)
+}
@@ -0,0 +1,171 @@
+package push
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/itchio/butler/comm"
+	"github.com/itchio/headway/united"
+)
+
+const (
+	// almostThereThreshold is the amount of data left where the progress indicator isn't indicative anymore.
+	// At this point, we're basically waiting for build files to be finalized.
+	almostThereThreshold int64 = 10 * 1024
+)
+
+// pushProgress combines the progress of all channels being pushed
+// into the single progress bar comm gives us.
+type pushProgress struct {
+	mu       sync.Mutex
+	channels []*channelPush
+
+	sizes map[*channelPush]int64
+	done  map[*channelPush]bool
+
+	bytesPerSec       float64
+	lastUploadedBytes int64
+}
+
+func (pp *pushProgress) setSize(cp *channelPush, size int64) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	if pp.sizes == nil {
+		pp.sizes = make(map[*channelPush]int64)
+	}
+	pp.sizes[cp] = size
+	pp.update()
+}
+
+func (pp *pushProgress) setRead(cp *channelPush, readBytes int64) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	cp.readBytes = readBytes
+	pp.update()
+}
+
+func (pp *pushProgress) setUploaded(cp *channelPush, uploadedBytes int64) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	cp.patchUploadedBytes = uploadedBytes
+	pp.update()
+}
+
+func (pp *pushProgress) setDone(cp *channelPush) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	if pp.done == nil {
+		pp.done = make(map[*channelPush]bool)
+	}
+	pp.done[cp] = true
+	pp.update()
+}
+
+// tick computes the upload speed every couple seconds, until stop is closed
+func (pp *pushProgress) tick(stop chan struct{}) {
+	ticker := time.NewTicker(time.Second * time.Duration(2))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			pp.mu.Lock()
+			uploadedBytes := pp.uploadedBytes()
+			pp.bytesPerSec = float64(uploadedBytes-pp.lastUploadedBytes) / 2.0
+			pp.lastUploadedBytes = uploadedBytes
+			pp.update()
+			pp.mu.Unlock()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (pp *pushProgress) uploadedBytes() int64 {
+	var res int64
+	for _, cp := range pp.channels {
+		res += cp.patchUploadedBytes
+	}
+	return res
+}
+
+// update must be called with mu held
+func (pp *pushProgress) update() {
+	var readBytes int64
+	var totalSize int64
+	var conservativeTotalBytes int64
+	var patchUploadedBytes int64
+
+	var channelStatuses []string
+
+	for _, cp := range pp.channels {
+		size, ok := pp.sizes[cp]
+		if !ok {
+			continue
+		}
+
+		// input bytes that aren't in output, for example:
+		//  - bytes that have been compressed away
+		//  - bytes that were in old build and were simply reused
+		var patchBytes int64
+		if cp.patchCounter != nil {
+			patchBytes = cp.patchCounter.Count()
+		}
+		goneBytes := cp.readBytes - patchBytes
+
+		channelTotalBytes := size - goneBytes
+		readBytes += cp.readBytes
+		totalSize += size
+		conservativeTotalBytes += channelTotalBytes
+		patchUploadedBytes += cp.patchUploadedBytes
+
+		if len(pp.channels) > 1 {
+			channelProgress := 1.0
+			if !pp.done[cp] && channelTotalBytes > 0 {
+				channelProgress = min(1.0, float64(cp.patchUploadedBytes)/float64(channelTotalBytes))
+			}
+			channelStatuses = append(channelStatuses, fmt.Sprintf("%s %.0f%%", cp.spec.Channel, channelProgress*100.0))
+		}
+	}
+
+	if totalSize == 0 {
+		return
+	}
+
+	var label string
+	leftBytes := conservativeTotalBytes - patchUploadedBytes
+	if len(pp.done) == len(pp.channels) {
+		label = "- finalizing build"
+	} else if leftBytes > almostThereThreshold {
+		netStatus := "- network idle"
+		if pp.bytesPerSec > 1 {
+			netStatus = fmt.Sprintf("@ %s/s", united.FormatBytes(int64(pp.bytesPerSec)))
+		}
+		label = fmt.Sprintf("%s, %s left", netStatus, united.FormatBytes(leftBytes))
+	} else {
+		label = "- almost there"
+	}
+	if len(channelStatuses) > 0 {
+		label = fmt.Sprintf("%s (%s)", label, strings.Join(channelStatuses, ", "))
+	}
+	comm.ProgressLabel(label)
+
+	conservativeProgress := float64(patchUploadedBytes) / float64(conservativeTotalBytes)
+	conservativeProgress = min(1.0, conservativeProgress)
+	comm.Progress(conservativeProgress)
+
+	comm.ProgressScale(float64(readBytes) / float64(totalSize))
+}
+
+func min(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
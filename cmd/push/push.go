@@ -1,41 +1,26 @@
 package push
 
 import (
-	"context"
 	"fmt"
 	"io/ioutil"
-	"math"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/itchio/httpkit/eos"
-	"github.com/itchio/httpkit/eos/option"
-	"github.com/itchio/httpkit/uploader"
-
 	itchio "github.com/itchio/go-itchio"
 
+	"github.com/itchio/butler/archivesource"
 	"github.com/itchio/butler/comm"
-	"github.com/itchio/butler/filtering"
+	"github.com/itchio/butler/localrepo"
 	"github.com/itchio/butler/mansion"
 
-	"github.com/itchio/headway/counter"
-	"github.com/itchio/headway/state"
-	"github.com/itchio/headway/united"
-
-	"github.com/itchio/savior/seeksource"
-
-	"github.com/itchio/lake"
 	"github.com/itchio/lake/tlc"
-
 	"github.com/itchio/wharf/pwr"
-	"github.com/itchio/wharf/wsync"
+
 	"github.com/pkg/errors"
-)
+	"golang.org/x/sync/semaphore"
 
-const (
-	// almostThereThreshold is the amount of data left where the progress indicator isn't indicative anymore.
-	// At this point, we're basically waiting for build files to be finalized.
-	almostThereThreshold int64 = 10 * 1024
+	"gopkg.in/alecthomas/kingpin.v2"
 )
 
 // pushing single files with any of these extensions
@@ -46,228 +31,445 @@ var singleFileWarningExtensionList = []string{
 	".pkg", // Apple installer
 }
 
-var args = struct {
-	src             string
-	target          string
-	userVersion     string
-	userVersionFile string
-	fixPerms        bool
-	dereference     bool
-	ifChanged       bool
-	dryRun          bool
-	autoWrap        bool
-}{}
+// Params controls how a build is pushed
+type Params struct {
+	// Src is the directory or archive to push, or "-" to read
+	// a tar stream from stdin
+	Src string
+	// Targets are where to push, for example 'leafo/x-moon:win-64',
+	// or aliases listed in the config file. The source is only walked
+	// once, and diffed against each channel's parent build in parallel.
+	Targets []string
+
+	UserVersion     string
+	UserVersionFile string
+	FixPerms        bool
+	Dereference     bool
+	IfChanged       bool
+	DryRun          bool
+	// Preview compares against each channel's head build and reports
+	// which files would change, without pushing anything
+	Preview  bool
+	AutoWrap bool
+	// Resumable spools the patch and signature to disk before uploading
+	// them, and journals progress so an interrupted push can be resumed
+	Resumable bool
+	// JournalDir is where resumable pushes are journaled
+	JournalDir string
+
+	// MaxFileUploads is how many build files may be uploaded at once,
+	// across all channels. Zero means no limit. It doesn't make single
+	// files go faster: storage only takes the chunks of a file in order.
+	MaxFileUploads int
+	// UploadRetries is how many times a chunk of a spooled build file
+	// is sent before giving up, and UploadBackoff how long to wait
+	// before the first retry. Zero values use the defaults, anything
+	// else spools build files, like Resumable.
+	UploadRetries int
+	UploadBackoff time.Duration
+
+	// MaxSize, MaxGrowth and MaxFileSize are budgets the build must
+	// stay within, like "500MB". MaxGrowth may also be a percentage.
+	MaxSize     string
+	MaxGrowth   string
+	MaxFileSize string
+	// Forbid lists patterns no file in the build may match
+	Forbid []string
+
+	// Lint checks the build for portability problems, like names
+	// Windows doesn't allow, before pushing it. LintStrict also
+	// refuses to push builds that only have warnings.
+	Lint       bool
+	LintStrict bool
+
+	// Zstd allows pushing zstd-compressed patches to itch.io. Local
+	// build repositories don't need it.
+	Zstd bool
+
+	// Ignore lists patterns from the config file's [push] section.
+	// Unlike --ignore, they only apply to the build being pushed.
+	Ignore []string
+
+	// ConfigPath is the config file to use. If empty, one is looked
+	// for in the working directory and its parents.
+	ConfigPath string
+	// NoConfig disables loading a config file altogether
+	NoConfig bool
+
+	// Explicit lists settings that were given explicitly, for example
+	// on the command-line: those take precedence over the config file.
+	Explicit map[string]bool
+}
+
+var params = Params{
+	Explicit: make(map[string]bool),
+}
 
 func Register(ctx *mansion.Context) {
 	cmd := ctx.App.Command("push", "Upload a new build to itch.io. See `butler help push`.")
-	cmd.Arg("src", "Directory to upload. May also be a zip archive (slower)").Required().StringVar(&args.src)
-	cmd.Arg("target", "Where to push, for example 'leafo/x-moon:win-64'. Targets are of the form project:channel, where project is username/game or game_id.").Required().StringVar(&args.target)
-	cmd.Flag("userversion", "A user-supplied version number that you can later query builds by").StringVar(&args.userVersion)
-	cmd.Flag("userversion-file", "A file containing a user-supplied version number that you can later query builds by").StringVar(&args.userVersionFile)
-	cmd.Flag("fix-permissions", "Detect Mac & Linux executables and adjust their permissions automatically").Default("true").BoolVar(&args.fixPerms)
-	cmd.Flag("dereference", "Dereference symlinks").Default("false").BoolVar(&args.dereference)
-	cmd.Flag("if-changed", "Don't push anything if it would be an empty patch").Default("false").BoolVar(&args.ifChanged)
-	cmd.Flag("dry-run", "Don't push anything, just show what would be pushed").Default("false").BoolVar(&args.dryRun)
-	cmd.Flag("auto-wrap", "Apply workaround for https://github.com/itchio/itch/issues/2147").Default("true").BoolVar(&args.autoWrap)
+	ctx.AcceptStdin(cmd, "src")
+	cmd.Arg("src", "Directory to upload. May also be a .zip, .tar (optionally .gz, .bz2, .xz or .zst compressed) or .7z archive (slower), or - to read a tar stream from stdin").Required().StringVar(&params.Src)
+	cmd.Arg("target", "Where to push, for example 'leafo/x-moon:win-64'. Targets are of the form project:channel, where project is username/game or game_id, or a local build repository like ./repo:win-64. Several targets may be given to push the same build to multiple channels.").Required().StringsVar(&params.Targets)
+
+	// flag registers a flag that records whether it was passed explicitly
+	flag := func(name string, help string) *kingpin.FlagClause {
+		return cmd.Flag(name, help).Action(func(*kingpin.ParseContext) error {
+			params.Explicit[name] = true
+			return nil
+		})
+	}
+	flag("userversion", "A user-supplied version number that you can later query builds by").StringVar(&params.UserVersion)
+	flag("userversion-file", "A file containing a user-supplied version number that you can later query builds by").StringVar(&params.UserVersionFile)
+	flag("fix-permissions", "Detect Mac & Linux executables and adjust their permissions automatically").Default("true").BoolVar(&params.FixPerms)
+	flag("dereference", "Dereference symlinks").Default("false").BoolVar(&params.Dereference)
+	flag("if-changed", "Don't push anything if it would be an empty patch").Default("false").BoolVar(&params.IfChanged)
+	flag("dry-run", "Don't push anything, just show what would be pushed").Default("false").BoolVar(&params.DryRun)
+	flag("preview", "Don't push anything, compare with the latest build of each channel and show which files would change").Default("false").BoolVar(&params.Preview)
+	flag("auto-wrap", "Apply workaround for https://github.com/itchio/itch/issues/2147").Default("true").BoolVar(&params.AutoWrap)
+	flag("resumable", "Write the patch to disk before uploading it, so that an interrupted push can be resumed by running the same command again").Default("false").BoolVar(&params.Resumable)
+	flag("max-size", "Refuse to push if the build is larger than this, for example 2GB").PlaceHolder("SIZE").StringVar(&params.MaxSize)
+	flag("max-growth", "Refuse to push if the build grew more than this compared to the channel's current build, for example 100MB or 10%").PlaceHolder("SIZE").StringVar(&params.MaxGrowth)
+	flag("max-file-size", "Refuse to push if any single file is larger than this, for example 500MB").PlaceHolder("SIZE").StringVar(&params.MaxFileSize)
+	flag("forbid", "Refuse to push if any file matches this pattern, for example *.pdb (may be specified multiple times)").PlaceHolder("PATTERN").StringsVar(&params.Forbid)
+	flag("lint", "Refuse to push if the build has portability problems, like file names that only differ in case, or that Windows doesn't allow").Default("false").BoolVar(&params.Lint)
+	flag("lint-strict", "Like --lint, but also refuse to push if there are portability warnings").Default("false").BoolVar(&params.LintStrict)
+	cmd.Flag("max-file-uploads", "How many build files (patches and signatures) may be uploaded at once, across all channels. This limits uploads, it doesn't parallelize them: storage only accepts the chunks of a file in order. With 1, build files are written to disk first, like with --resumable. 0 means no limit").Default("0").IntVar(&params.MaxFileUploads)
+	cmd.Flag("upload-retries", "How many times a chunk is sent before giving up (default "+strconv.Itoa(DefaultUploadRetries)+"). Build files are written to disk first, like with --resumable").IntVar(&params.UploadRetries)
+	cmd.Flag("upload-backoff", "How long to wait before sending a chunk again, doubling with each retry (default "+DefaultUploadBackoff.String()+"). Build files are written to disk first, like with --resumable").DurationVar(&params.UploadBackoff)
+	cmd.Flag("experimental-zstd", "Allow pushing to itch.io with --compression zstd. itch.io's build processing and older versions of the itch app may not be able to read zstd patches").BoolVar(&params.Zstd)
+	cmd.Flag("journal-dir", "Where to keep track of resumable pushes").Default(DefaultJournalDir()).Hidden().StringVar(&params.JournalDir)
+	cmd.Flag("config", "Path to a project config file (by default, "+ConfigFileName+" is looked for in the working directory and its parents)").StringVar(&params.ConfigPath)
+	cmd.Flag("no-config", "Don't load any project config file").BoolVar(&params.NoConfig)
 	ctx.Register(cmd, do)
 }
 
 func do(ctx *mansion.Context) {
 	go ctx.DoVersionCheck()
 
-	// if userVersionFile specified, read from the given file
-	// TODO: do utf-16 decoding here
-	userVersion := args.userVersion
-	if userVersion == "" && args.userVersionFile != "" {
-		buf, err := ioutil.ReadFile(args.userVersionFile)
-		ctx.Must(err)
-
-		userVersion = strings.TrimSpace(string(buf))
-		if strings.ContainsAny(userVersion, "\r\n") {
-			ctx.Must(fmt.Errorf("%s contains line breaks, refusing to use as userversion", args.userVersionFile))
-		}
-	}
-
-	ctx.Must(Do(ctx, args.src, args.target, userVersion, args.fixPerms, args.dereference, args.ifChanged, args.autoWrap))
+	ctx.Must(Do(ctx, params))
 }
 
-func Do(ctx *mansion.Context, buildPath string, specStr string, userVersion string, fixPerms bool, dereference bool, ifChanged bool, wrap bool) error {
-	consumer := comm.NewStateConsumer()
+// retrySettings returns how chunks of spooled build files are retried
+func (params *Params) retrySettings() RetrySettings {
+	rs := RetrySettings{
+		MaxTries: params.UploadRetries,
+		Backoff:  params.UploadBackoff,
+	}
+	if rs.MaxTries == 0 {
+		rs.MaxTries = DefaultUploadRetries
+	}
+	if rs.Backoff <= 0 {
+		rs.Backoff = DefaultUploadBackoff
+	}
+	return rs
+}
 
-	// start walking source container while waiting on auth flow
-	sourceContainerChan := make(chan walkResult)
-	walkErrs := make(chan error)
-	walkOpts := tlc.WalkOpts{
-		Filter:      filtering.FilterPaths,
-		Dereference: dereference,
+// readUserVersionFile reads a userversion from a file, which must
+// contain a single line.
+func readUserVersionFile(userVersionFile string) (string, error) {
+	// TODO: do utf-16 decoding here
+	buf, err := ioutil.ReadFile(userVersionFile)
+	if err != nil {
+		return "", errors.WithStack(err)
 	}
-	if wrap {
-		walkOpts.AutoWrap(&buildPath, consumer)
+
+	userVersion := strings.TrimSpace(string(buf))
+	if strings.ContainsAny(userVersion, "\r\n") {
+		return "", fmt.Errorf("%s contains line breaks, refusing to use as userversion", userVersionFile)
 	}
+	return userVersion, nil
+}
 
-	go doWalk(buildPath, sourceContainerChan, walkErrs, fixPerms, walkOpts)
+func Do(ctx *mansion.Context, params Params) error {
+	var cfg *Config
+	if !params.NoConfig {
+		configPath := params.ConfigPath
+		if configPath == "" {
+			var err error
+			configPath, err = FindConfig(".")
+			if err != nil {
+				return errors.Wrap(err, "looking for config file")
+			}
+		}
 
-	if args.dryRun {
-		comm.Opf("Dry run, listing files we would push...")
-		select {
-		case walkErr := <-walkErrs:
-			return errors.Wrap(walkErr, "walking directory to push")
-		case walkies := <-sourceContainerChan:
-			log := func(line string) {
-				comm.Logf(line)
+		if configPath != "" {
+			var err error
+			cfg, err = LoadConfig(configPath)
+			if err != nil {
+				return err
 			}
-			walkies.container.Print(log)
-			comm.Statf("Would push %s", walkies.container)
+			comm.Debugf("Using config file %s", cfg.Path)
 		}
-		return nil
 	}
 
-	spec, err := itchio.ParseSpec(specStr)
-	if err != nil {
-		return errors.Wrapf(err, "parsing push target '%s'", specStr)
+	if params.MaxFileUploads < 0 {
+		return errors.Errorf("--max-file-uploads must be positive, or 0 for no limit (got %d)", params.MaxFileUploads)
 	}
-
-	err = spec.EnsureChannel()
-	if err != nil {
-		return err
+	if params.UploadRetries < 0 {
+		return errors.Errorf("--upload-retries must be positive (got %d)", params.UploadRetries)
+	}
+	if params.UploadBackoff < 0 {
+		return errors.Errorf("--upload-backoff must be positive (got %s)", params.UploadBackoff)
 	}
 
-	client, err := ctx.AuthenticateViaOauth()
+	origins := params.applyConfig(cfg)
+	budget, err := params.resolveBudget(cfg, &origins)
 	if err != nil {
-		return errors.Wrap(err, "authenticating")
+		return err
 	}
 
-	getSignature := func(ID int64) (*pwr.SignatureInfo, error) {
-		buildFiles, err := client.ListBuildFiles(ctx.DefaultCtx(), ID)
-		if err != nil {
-			return nil, errors.Wrap(err, "listing build files")
-		}
-
-		signatureFile := itchio.FindBuildFile(itchio.BuildFileTypeSignature, buildFiles.Files)
-		if signatureFile == nil {
-			comm.Dief("Could not find signature for parent build %d, aborting", ID)
+	var channels []*channelPush
+	seenTargets := make(map[string]bool)
+	for _, target := range params.Targets {
+		specStr := cfg.ResolveTarget(target)
+		if specStr != target {
+			comm.Logf("Target alias (%s) resolves to (%s)", target, specStr)
 		}
 
-		signatureURL := client.MakeBuildFileDownloadURL(itchio.MakeBuildFileDownloadURLParams{
-			BuildID: ID,
-			FileID:  signatureFile.ID,
-		})
+		var spec *itchio.Spec
+		var repo *localrepo.Repo
+		if localrepo.IsTarget(specStr) {
+			spec, repo, err = parseLocalTarget(specStr)
+			if err != nil {
+				return err
+			}
+		} else {
+			spec, err = itchio.ParseSpec(specStr)
+			if err != nil {
+				return errors.Wrapf(err, "parsing push target '%s'", specStr)
+			}
 
-		signatureReader, err := eos.Open(signatureURL, option.WithConsumer(consumer))
-		if err != nil {
-			return nil, errors.Wrap(err, "opening signature")
+			err = spec.EnsureChannel()
+			if err != nil {
+				return err
+			}
 		}
-		defer signatureReader.Close()
-
-		signatureSource := seeksource.FromFile(signatureReader)
 
-		_, err = signatureSource.Resume(nil)
-		if err != nil {
-			return nil, errors.Wrap(err, "opening signature")
+		if seenTargets[spec.String()] {
+			return fmt.Errorf("Target %s specified more than once", spec)
 		}
+		seenTargets[spec.String()] = true
 
-		signature, err := pwr.ReadSignature(context.Background(), signatureSource)
+		settings, err := params.settingsForChannel(cfg, spec.Channel)
 		if err != nil {
-			return nil, errors.Wrap(err, "reading signature")
+			return err
 		}
 
-		return signature, nil
+		channels = append(channels, &channelPush{
+			specStr:  specStr,
+			spec:     spec,
+			settings: settings,
+			repo:     repo,
+		})
 	}
 
-	if ifChanged {
-		chanInfo, err := client.GetChannel(ctx.DefaultCtx(), spec.Target, spec.Channel)
-		if err == nil && chanInfo != nil && chanInfo.Channel != nil && chanInfo.Channel.Head != nil {
-			comm.Opf("Comparing against previous build...")
-			sig, err := getSignature(chanInfo.Channel.Head.ID)
-			if err != nil {
-				return errors.Wrap(err, "getting previous build signature")
-			}
+	if len(channels) == 0 {
+		return errors.New("push: must specify at least one target")
+	}
 
-			err = pwr.AssertValid(buildPath, sig)
-			if err == nil {
-				comm.Statf("No changes and --if-changed used, not pushing anything")
-				return nil
+	if ctx.CompressionSettings().Algorithm == pwr.CompressionAlgorithm_ZSTD {
+		for _, cp := range channels {
+			if cp.repo != nil {
+				continue
 			}
-
-			if _, ok := err.(*pwr.ErrHasWound); ok {
-				// cool, that's what we expected
-			} else {
-				return errors.Wrap(err, "checking for differences")
+			if !params.Zstd {
+				return errors.Errorf("push: zstd patches may not be readable by itch.io or the itch app yet. Pass --experimental-zstd to push %s with zstd anyway, or leave out --compression", cp.specStr)
 			}
-		} else {
-			comm.Opf("No previous build to compare against, pushing unconditionally")
+			comm.Warnf("Pushing zstd patches to itch.io is experimental: they may fail processing, or not be readable by older versions of the itch app")
+			break
 		}
 	}
 
-	newBuildRes, err := client.CreateBuild(ctx.DefaultCtx(), itchio.CreateBuildParams{
-		Target:      spec.Target,
-		Channel:     spec.Channel,
-		UserVersion: userVersion,
-	})
+	consumer := comm.NewStateConsumer()
+
+	source, err := archivesource.Open(params.Src, consumer)
 	if err != nil {
-		return errors.Wrap(err, "creating build on remote server")
+		return err
+	}
+	defer source.Close()
+	buildPath := source.Path
+
+	// start walking source container while waiting on auth flow
+	sourceContainerChan := make(chan walkResult)
+	walkErrs := make(chan error)
+	walkOpts := tlc.WalkOpts{
+		Filter:      params.filter(),
+		Dereference: params.Dereference,
 	}
+	if params.AutoWrap {
+		walkOpts.AutoWrap(&buildPath, consumer)
+	}
+
+	go doWalk(buildPath, sourceContainerChan, walkErrs, params.FixPerms, walkOpts)
+
+	if params.DryRun {
+		if cfg != nil {
+			comm.Opf("Using settings from %s", cfg.Path)
+		} else {
+			comm.Opf("No config file found, using command-line settings")
+		}
+		logSetting := func(line string) {
+			comm.Logf("  %s", line)
+		}
+		origins.Print(logSetting)
+		for _, cp := range channels {
+			if len(cp.settings.origins) > 0 {
+				comm.Logf("  For %s:", cp.specStr)
+				cp.settings.origins.Print(func(line string) {
+					comm.Logf("    %s", line)
+				})
+			}
+		}
+
+		comm.Opf("Dry run, listing files we would push...")
+		select {
+		case walkErr := <-walkErrs:
+			return errors.Wrap(walkErr, "walking directory to push")
+		case walkies := <-sourceContainerChan:
+			log := func(line string) {
+				comm.Logf(line)
+			}
+			walkies.container.Print(log)
+			for _, cp := range channels {
+				comm.Statf("Would push %s to %s", cp.filterContainer(walkies.container), cp.specStr)
+			}
 
-	buildID := newBuildRes.Build.ID
-	parentID := newBuildRes.Build.ParentBuild.ID
+			if params.Lint || params.LintStrict {
+				err := checkPortability(channels, &walkies, buildPath, params.LintStrict)
+				if err != nil {
+					return err
+				}
+			}
 
-	var targetSignature *pwr.SignatureInfo
+			if budget.IsEmpty() {
+				return nil
+			}
 
-	if parentID == 0 {
-		comm.Opf("For channel `%s`: pushing first build", spec.Channel)
-		targetSignature = &pwr.SignatureInfo{
-			Container: &tlc.Container{},
-			Hashes:    make([]wsync.BlockHash, 0),
+			s := &session{
+				ctx:      ctx,
+				consumer: consumer,
+			}
+			if budget.NeedsParent() && needsClient(channels) {
+				// growth budgets need the current build of each channel
+				client, err := ctx.AuthenticateViaOauth()
+				if err != nil {
+					return errors.Wrap(err, "authenticating")
+				}
+				s.client = client
+			}
+			return checkBudgets(s, budget, channels, walkies.container)
 		}
-	} else {
-		comm.Opf("For channel `%s`: last build is %d, downloading its signature", spec.Channel, parentID)
-		var err error
-		targetSignature, err = getSignature(parentID)
+	}
+
+	// pushing only to local repositories doesn't require logging in
+	var client *itchio.Client
+	if needsClient(channels) {
+		client, err = ctx.AuthenticateViaOauth()
 		if err != nil {
-			return errors.Wrap(err, "searching for parent build signature")
+			return errors.Wrap(err, "authenticating")
 		}
 	}
 
-	bothFiles, err := createBothFiles(ctx, client, buildID)
-	if err != nil {
-		return errors.Wrap(err, "creating remote patch and signature files")
+	if params.Preview {
+		return doPreview(ctx, client, consumer, buildPath, channels, sourceContainerChan, walkErrs)
 	}
 
-	newPatchRes := bothFiles.patchRes
-	newSignatureRes := bothFiles.signatureRes
+	s := &session{
+		ctx:       ctx,
+		client:    client,
+		consumer:  consumer,
+		src:       params.Src,
+		buildPath: buildPath,
+		ifChanged: params.IfChanged,
 
-	patchWriter := uploader.NewResumableUpload(newPatchRes.File.UploadURL)
-	patchWriter.SetConsumer(consumer)
+		resumable:  params.Resumable,
+		journalDir: params.JournalDir,
 
-	signatureWriter := uploader.NewResumableUpload(newSignatureRes.File.UploadURL)
-	signatureWriter.SetConsumer(consumer)
+		uploadRetries: params.retrySettings(),
 
-	comm.Debugf("Launching patch & signature channels")
+		ready:    make(chan struct{}),
+		progress: &pushProgress{channels: channels},
+	}
 
-	patchCounter := counter.NewWriter(patchWriter)
-	signatureCounter := counter.NewWriter(signatureWriter)
+	if params.MaxFileUploads > 0 {
+		s.uploadSlots = semaphore.NewWeighted(int64(params.MaxFileUploads))
+	}
+
+	// streamed pushes upload their patch and signature at once, and have
+	// httpkit's uploader retry them, so some settings need spooled files
+	if !s.resumable {
+		switch {
+		case params.MaxFileUploads == 1:
+			comm.Logf("Writing build files to disk before uploading them one at a time, as asked by --max-file-uploads")
+			s.resumable = true
+		case params.UploadRetries != 0 || params.UploadBackoff != 0:
+			comm.Logf("Writing build files to disk before uploading them, so --upload-retries and --upload-backoff apply")
+			s.resumable = true
+		}
+	}
 
 	// we started walking the source container in the beginning,
-	// we actually need it now.
-	// note that we could actually start diffing before all the file
-	// creation & upload setup is done
+	// waitForSource returns once it's done.
+	waitForSource := func() error {
+		if s.source != nil {
+			return nil
+		}
 
-	var sourceContainer *tlc.Container
-	var sourcePool lake.Pool
+		comm.Debugf("Waiting for source container")
+		select {
+		case walkErr := <-walkErrs:
+			return errors.Wrap(walkErr, "walking directory to push")
+		case walkies := <-sourceContainerChan:
+			s.source = &walkies
+			return nil
+		}
+	}
+
+	if !budget.IsEmpty() {
+		// no build may be created if we're over budget
+		err = waitForSource()
+		if err != nil {
+			return err
+		}
+
+		err = checkBudgets(s, budget, channels, s.source.container)
+		if err != nil {
+			return err
+		}
+	}
+
+	if params.Lint || params.LintStrict {
+		err = waitForSource()
+		if err != nil {
+			return err
+		}
+
+		err = checkPortability(channels, s.source, buildPath, params.LintStrict)
+		if err != nil {
+			return err
+		}
+	}
+
+	// each channel creates its build and fetches its parent's signature
+	// while we're still walking the source container
+	done := make(chan struct{}, len(channels))
+	for _, cp := range channels {
+		go func(cp *channelPush) {
+			cp.err = cp.run(s)
+			done <- struct{}{}
+		}(cp)
+	}
 
-	comm.Debugf("Waiting for source container")
-	select {
-	case walkErr := <-walkErrs:
-		return errors.Wrap(walkErr, "walking directory to push")
-	case walkies := <-sourceContainerChan:
-		sourceContainer = walkies.container
-		sourcePool = walkies.pool
-		break
+	// we actually need the source container now.
+	err = waitForSource()
+	if err != nil {
+		close(s.ready)
+		return err
 	}
 
-	showSingleFileWarningIfNecessary(sourceContainer)
+	showSingleFileWarningIfNecessary(s.source.container)
 
-	err = sourceContainer.Validate()
+	err = s.source.container.Validate()
 	if err != nil {
 		comm.Notice("Validation failed", []string{
 			fmt.Sprintf("(%s) cannot be pushed, because it is invalid.", buildPath),
@@ -280,174 +482,45 @@ func Do(ctx *mansion.Context, buildPath string, specStr string, userVersion stri
 		comm.Die("Refusing to push invalid container (see above)")
 	}
 
-	comm.Opf("Pushing %s", sourceContainer)
-
-	comm.Debugf("Building diff context")
-	var readBytes int64
-
-	var bytesPerSec float64
-	var lastUploadedBytes int64
-	var patchUploadedBytes int64
+	comm.Opf("Pushing %s", s.source.container)
 
 	stopTicking := make(chan struct{})
-	updateProgress := func() {
-		// input bytes that aren't in output, for example:
-		//  - bytes that have been compressed away
-		//  - bytes that were in old build and were simply reused
-		goneBytes := readBytes - patchCounter.Count()
-
-		conservativeTotalBytes := sourceContainer.Size - goneBytes
-
-		leftBytes := conservativeTotalBytes - patchUploadedBytes
-		if leftBytes > almostThereThreshold {
-			netStatus := "- network idle"
-			if bytesPerSec > 1 {
-				netStatus = fmt.Sprintf("@ %s/s", united.FormatBytes(int64(bytesPerSec)))
-			}
-			comm.ProgressLabel(fmt.Sprintf("%s, %s left", netStatus, united.FormatBytes(leftBytes)))
-		} else {
-			comm.ProgressLabel(fmt.Sprintf("- almost there"))
-		}
-
-		conservativeProgress := float64(patchUploadedBytes) / float64(conservativeTotalBytes)
-		conservativeProgress = min(1.0, conservativeProgress)
-		comm.Progress(conservativeProgress)
-
-		comm.ProgressScale(float64(readBytes) / float64(sourceContainer.Size))
-	}
-
-	patchWriter.SetProgressListener(func(count int64) {
-		patchUploadedBytes = count
-		updateProgress()
-	})
-
-	go func() {
-		ticker := time.NewTicker(time.Second * time.Duration(2))
-		for {
-			select {
-			case <-ticker.C:
-				bytesPerSec = float64(patchUploadedBytes-lastUploadedBytes) / 2.0
-				lastUploadedBytes = patchUploadedBytes
-				updateProgress()
-			case <-stopTicking:
-				return
-			}
-		}
-	}()
-
-	stateConsumer := &state.Consumer{
-		OnProgress: func(progress float64) {
-			readBytes = int64(float64(sourceContainer.Size) * progress)
-			updateProgress()
-		},
-	}
-
-	dctx := &pwr.DiffContext{
-		Compression: &pwr.CompressionSettings{
-			Algorithm: pwr.CompressionAlgorithm_BROTLI,
-			Quality:   1,
-		},
-
-		SourceContainer: sourceContainer,
-		Pool:            sourcePool,
-
-		TargetContainer: targetSignature.Container,
-		TargetSignature: targetSignature.Hashes,
-
-		Consumer: stateConsumer,
-	}
+	go s.progress.tick(stopTicking)
 
 	comm.StartProgress()
 	comm.ProgressScale(0.0)
-	err = dctx.WritePatch(context.Background(), patchCounter, signatureCounter)
-	if err != nil {
-		return errors.Wrap(err, "computing and writing patch")
-	}
-
-	// close both files concurrently
-	{
-		errs := make(chan error)
-
-		go func() {
-			errs <- patchWriter.Close()
-		}()
-		go func() {
-			errs <- signatureWriter.Close()
-		}()
+	close(s.ready)
 
-		// 2 close
-		for i := 0; i < 2; i++ {
-			err := <-errs
-			if err != nil {
-				return errors.WithStack(err)
-			}
-		}
+	for range channels {
+		<-done
 	}
-
 	close(stopTicking)
-	comm.ProgressLabel("finalizing build")
-
-	// finalize both files concurrently
-	{
-		errs := make(chan error)
-
-		doFinalize := func(fileID int64, fileSize int64, done chan error) {
-			_, err = client.FinalizeBuildFile(ctx.DefaultCtx(), itchio.FinalizeBuildFileParams{
-				BuildID: buildID,
-				FileID:  fileID,
-				Size:    fileSize,
-			})
-			done <- err
-		}
-
-		go doFinalize(newPatchRes.File.ID, patchCounter.Count(), errs)
-		go doFinalize(newSignatureRes.File.ID, signatureCounter.Count(), errs)
+	comm.EndProgress()
 
-		// 2 doFinalize
-		for i := 0; i < 2; i++ {
-			err := <-errs
-			if err != nil {
-				return errors.WithStack(err)
-			}
+	var failed []*channelPush
+	for _, cp := range channels {
+		if cp.err != nil {
+			failed = append(failed, cp)
+			continue
 		}
+		cp.printStats(len(channels) > 1)
 	}
 
-	comm.EndProgress()
-
-	{
-		prettyPatchSize := united.FormatBytes(patchCounter.Count())
-		percReused := 100.0 * float64(dctx.ReusedBytes) / float64(dctx.FreshBytes+dctx.ReusedBytes)
-		relToNew := 100.0 * float64(patchCounter.Count()) / float64(sourceContainer.Size)
-		prettyFreshSize := united.FormatBytes(dctx.FreshBytes)
-		savings := 100.0 - relToNew
-
-		if dctx.ReusedBytes > 0 {
-			comm.Statf("Re-used %.2f%% of old, added %s fresh data", percReused, prettyFreshSize)
-		} else {
-			comm.Statf("Added %s fresh data", prettyFreshSize)
-		}
+	if len(channels) == 1 {
+		return channels[0].err
+	}
 
-		if savings > 0 && !math.IsNaN(savings) {
-			comm.Statf("%s patch (%.2f%% savings)", prettyPatchSize, 100.0-relToNew)
-		} else {
-			comm.Statf("%s patch (no savings)", prettyPatchSize)
+	if len(failed) > 0 {
+		for _, cp := range failed {
+			comm.Logf("")
+			comm.Logf("Pushing to %s failed: %v", cp.specStr, cp.err)
 		}
+		return fmt.Errorf("%d of %d channels failed to push", len(failed), len(channels))
 	}
-	comm.Opf("Build is now processing, should be up in a bit.")
-	comm.Logf("")
-	comm.Logf("Use the `butler status %s` for more information.", specStr)
-	comm.Logf("")
 
 	return nil
 }
 
-func min(a, b float64) float64 {
-	if a < b {
-		return a
-	}
-	return b
-}
-
 func showSingleFileWarningIfNecessary(sourceContainer *tlc.Container) {
 	if !sourceContainer.IsSingleFile() {
 		return
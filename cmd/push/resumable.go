@@ -0,0 +1,298 @@
+package push
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	itchio "github.com/itchio/go-itchio"
+
+	"github.com/itchio/butler/comm"
+
+	"github.com/itchio/headway/counter"
+
+	"github.com/itchio/savior/filesource"
+
+	"github.com/itchio/wharf/pwr"
+	"github.com/pkg/errors"
+)
+
+// runResumable pushes a build by first spooling the patch and signature
+// to disk, then uploading them. Progress is recorded in a journal, so that
+// running the same push again picks up where it left off instead of
+// creating a new build.
+func (cp *channelPush) runResumable(s *session) error {
+	source, err := filepath.Abs(s.src)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	journalDir := journalDirFor(s.journalDir, source, cp.spec.String())
+
+	// the build could expire while we're resuming it, in which case we
+	// start over once, with a brand new build.
+	for attempt := 0; attempt < 2; attempt++ {
+		j, err := cp.openJournal(s, journalDir, source)
+		if err != nil {
+			return err
+		}
+
+		err = cp.pushJournaled(s, j)
+		if err != nil {
+			if errors.Cause(err) == errUploadSessionExpired {
+				comm.Warnf("For channel `%s`: upload session for build %d expired, starting over", cp.spec.Channel, j.BuildID)
+				err = j.remove()
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				continue
+			}
+			comm.Logf("For channel `%s`: push interrupted, run the same command again to resume it", cp.spec.Channel)
+			return err
+		}
+
+		return j.remove()
+	}
+
+	return errors.Wrap(errUploadSessionExpired, "pushing build")
+}
+
+// openJournal returns a journal for a build we can resume, creating
+// a new build if there's nothing to resume.
+func (cp *channelPush) openJournal(s *session, journalDir string, source string) (*journal, error) {
+	// we need the source container to tell whether the content changed
+	_, err := cp.prepareSource(s)
+	if err != nil {
+		return nil, err
+	}
+
+	j, err := loadJournal(journalDir)
+	if err != nil {
+		comm.Warnf("%v", err)
+		j = nil
+	}
+
+	if j != nil {
+		reason := cp.cantResumeReason(s, j)
+		if reason == "" {
+			comm.Opf("For channel `%s`: resuming pending build %d", cp.spec.Channel, j.BuildID)
+			cp.buildID = j.BuildID
+			cp.parentID = j.ParentID
+			return j, nil
+		}
+
+		comm.Logf("For channel `%s`: not resuming build %d: %s", cp.spec.Channel, j.BuildID, reason)
+		err = j.remove()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	bothFiles, err := cp.createBuild(s)
+	if err != nil {
+		return nil, err
+	}
+
+	j = &journal{
+		Target:      cp.spec.String(),
+		Source:      source,
+		UserVersion: cp.settings.userVersion,
+		CreatedAt:   time.Now().UTC(),
+		BuildID:     cp.buildID,
+		ParentID:    cp.parentID,
+		Patch: &journalFile{
+			ID:        bothFiles.patchRes.File.ID,
+			UploadURL: bothFiles.patchRes.File.UploadURL,
+		},
+		Signature: &journalFile{
+			ID:        bothFiles.signatureRes.File.ID,
+			UploadURL: bothFiles.signatureRes.File.UploadURL,
+		},
+		dir: journalDir,
+	}
+	err = j.save()
+	if err != nil {
+		return nil, errors.Wrap(err, "saving push journal")
+	}
+	comm.Debugf("Journaling push to %s", j.dir)
+
+	return j, nil
+}
+
+// cantResumeReason returns why a journaled build can't be resumed,
+// or an empty string if it can.
+func (cp *channelPush) cantResumeReason(s *session, j *journal) string {
+	if j.UserVersion != cp.settings.userVersion {
+		return fmt.Sprintf("userversion changed from (%s) to (%s)", j.UserVersion, cp.settings.userVersion)
+	}
+
+	if time.Since(j.CreatedAt) > pendingBuildMaxAge {
+		return "pending build expired"
+	}
+
+	buildRes, err := s.client.GetBuild(s.ctx.DefaultCtx(), itchio.GetBuildParams{
+		BuildID: j.BuildID,
+	})
+	if err != nil {
+		return fmt.Sprintf("could not look up pending build: %v", err)
+	}
+	if buildRes.Build.State != itchio.BuildStateStarted {
+		return fmt.Sprintf("build is now %s", buildRes.Build.State)
+	}
+
+	if j.Spooled {
+		// make sure what we spooled is still what we're pushing
+		sig, err := readSpooledSignature(j.signaturePath())
+		if err != nil {
+			return fmt.Sprintf("could not read spooled signature: %v", err)
+		}
+
+		err = sig.Container.EnsureEqual(cp.container)
+		if err != nil {
+			return "content changed"
+		}
+
+		err = pwr.AssertValid(s.buildPath, sig)
+		if err != nil {
+			return "content changed"
+		}
+	}
+
+	return ""
+}
+
+// pushJournaled spools the patch and signature if needed, then
+// uploads and finalizes whatever hasn't been yet.
+func (cp *channelPush) pushJournaled(s *session, j *journal) error {
+	if j.Spooled {
+		cp.patchCounter = counter.NewWriter(nil)
+		cp.patchCounter.SetCount(j.Patch.Size)
+		cp.freshBytes = j.FreshBytes
+		cp.reusedBytes = j.ReusedBytes
+		s.progress.setRead(cp, cp.container.Size)
+	} else {
+		err := cp.spool(s, j)
+		if err != nil {
+			return err
+		}
+	}
+
+	errs := make(chan error, 2)
+	pushFile := func(file *journalFile, path string, onProgress func(count int64)) {
+		errs <- func() error {
+			if file.Finalized {
+				return nil
+			}
+
+			release := s.acquireUploads(1)
+			defer release()
+
+			su := newSpoolUpload(file.UploadURL, path, file.Size, s.consumer, s.uploadRetries)
+			su.onProgress = onProgress
+			err := su.upload()
+			if err != nil {
+				return err
+			}
+
+			err = cp.finalizeFile(s, file.ID, file.Size)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			file.Finalized = true
+			return nil
+		}()
+	}
+
+	go pushFile(j.Patch, j.patchPath(), func(count int64) {
+		s.progress.setUploaded(cp, count)
+	})
+	go pushFile(j.Signature, j.signaturePath(), nil)
+
+	var firstErr error
+	for i := 0; i < 2; i++ {
+		err := <-errs
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	// record which files were finalized, even if the other one failed
+	err := j.save()
+	if err != nil {
+		return errors.Wrap(err, "saving push journal")
+	}
+
+	if firstErr != nil {
+		return firstErr
+	}
+
+	s.progress.setDone(cp)
+	return nil
+}
+
+// spool diffs the source against the parent build, writing the patch
+// and signature next to the journal.
+func (cp *channelPush) spool(s *session, j *journal) error {
+	sourcePool, err := cp.prepareSource(s)
+	if err != nil {
+		return err
+	}
+
+	targetSignature, err := cp.targetSignature(s)
+	if err != nil {
+		return err
+	}
+
+	patchFile, err := os.Create(j.patchPath())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer patchFile.Close()
+
+	signatureFile, err := os.Create(j.signaturePath())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer signatureFile.Close()
+
+	cp.patchCounter = counter.NewWriter(patchFile)
+	signatureCounter := counter.NewWriter(signatureFile)
+
+	err = cp.writePatch(s, sourcePool, targetSignature, signatureCounter)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range []*os.File{patchFile, signatureFile} {
+		err = f.Sync()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	j.Patch.Size = cp.patchCounter.Count()
+	j.Signature.Size = signatureCounter.Count()
+	j.FreshBytes = cp.freshBytes
+	j.ReusedBytes = cp.reusedBytes
+	j.Spooled = true
+	err = j.save()
+	if err != nil {
+		return errors.Wrap(err, "saving push journal")
+	}
+	return nil
+}
+
+func readSpooledSignature(signaturePath string) (*pwr.SignatureInfo, error) {
+	signatureSource, err := filesource.Open(signaturePath)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer signatureSource.Close()
+
+	sig, err := pwr.ReadSignature(context.Background(), signatureSource)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return sig, nil
+}
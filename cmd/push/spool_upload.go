@@ -0,0 +1,262 @@
+package push
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/itchio/headway/counter"
+	"github.com/itchio/headway/state"
+	"github.com/itchio/httpkit/neterr"
+	"github.com/itchio/httpkit/timeout"
+	"github.com/itchio/httpkit/uploader"
+	"github.com/pkg/errors"
+)
+
+const (
+	// storage expects all chunks but the last one to be
+	// a multiple of this size
+	spoolChunkAlign = 256 * 1024
+	// how much we send in a single request
+	spoolChunkSize = 64 * spoolChunkAlign
+
+	// DefaultUploadRetries is how many times a chunk is sent before giving up
+	DefaultUploadRetries = 15
+	// DefaultUploadBackoff is how long to wait before sending a chunk again
+	// the first time. The delay doubles with each retry.
+	DefaultUploadBackoff = time.Second
+	// maxUploadBackoff caps the delay between two retries
+	maxUploadBackoff = 2 * time.Minute
+)
+
+// RetrySettings controls how chunks of spooled build files are retried
+type RetrySettings struct {
+	// MaxTries is how many times a chunk is sent before giving up
+	MaxTries int
+	// Backoff is the delay before the first retry. It doubles with each
+	// retry, plus up to a second of jitter.
+	Backoff time.Duration
+}
+
+// retryContext counts the tries of a single operation, like sending
+// a chunk, and sleeps between them.
+type retryContext struct {
+	settings RetrySettings
+	consumer *state.Consumer
+	tries    int
+}
+
+func (rc *retryContext) shouldTry() bool {
+	return rc.tries < rc.settings.MaxTries
+}
+
+func (rc *retryContext) retry(err error) {
+	rc.consumer.PauseProgress()
+	defer rc.consumer.ResumeProgress()
+
+	if neterr.IsNetworkError(err) {
+		rc.consumer.Infof("having network troubles...")
+	} else {
+		rc.consumer.Infof("%v", err)
+	}
+
+	delay := rc.settings.Backoff << uint(rc.tries)
+	if delay > maxUploadBackoff || delay <= 0 {
+		delay = maxUploadBackoff
+	}
+	delay += time.Duration(rand.Int63n(int64(time.Second)))
+	rc.consumer.Infof("Sleeping %s then retrying", delay.Round(time.Millisecond))
+
+	time.Sleep(delay)
+	rc.tries++
+}
+
+// errUploadSessionExpired is returned when the storage upload session
+// for a build file doesn't exist anymore, and the build must be recreated.
+var errUploadSessionExpired = errors.New("upload session expired")
+
+// spoolUpload uploads a file that's already fully written to disk to
+// a resumable upload session, picking up wherever a previous attempt
+// left off. It speaks the same protocol as httpkit's uploader, which we
+// can't use here since it always starts from the beginning.
+type spoolUpload struct {
+	uploadURL  string
+	path       string
+	size       int64
+	httpClient *http.Client
+	consumer   *state.Consumer
+	retry      RetrySettings
+
+	onProgress uploader.ProgressListenerFunc
+}
+
+func newSpoolUpload(uploadURL string, path string, size int64, consumer *state.Consumer, retry RetrySettings) *spoolUpload {
+	return &spoolUpload{
+		uploadURL:  uploadURL,
+		path:       path,
+		size:       size,
+		httpClient: timeout.NewClient(30*time.Second, 60*time.Second),
+		consumer:   consumer,
+		retry:      retry,
+	}
+}
+
+func (su *spoolUpload) newRetryContext() *retryContext {
+	return &retryContext{
+		settings: su.retry,
+		consumer: su.consumer,
+	}
+}
+
+// upload sends whatever storage doesn't have yet
+func (su *spoolUpload) upload() error {
+	f, err := os.Open(su.path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	offset, err := su.committedBytes()
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		su.consumer.Debugf("Resuming upload of %s at byte %d of %d", su.path, offset, su.size)
+	}
+
+	// each chunk gets its own tries
+	retryCtx := su.newRetryContext()
+	for offset < su.size {
+		if !retryCtx.shouldTry() {
+			return errors.Errorf("Too many errors, stopping upload")
+		}
+
+		chunkSize := su.size - offset
+		if chunkSize > spoolChunkSize {
+			chunkSize = spoolChunkSize
+		}
+		last := offset+chunkSize == su.size
+		if !last {
+			chunkSize -= chunkSize % spoolChunkAlign
+		}
+
+		newOffset, err := su.put(f, offset, chunkSize)
+		if err != nil {
+			if errors.Cause(err) == errUploadSessionExpired {
+				return err
+			}
+			retryCtx.retry(err)
+
+			// find out what storage actually got
+			committed, err := su.committedBytes()
+			if err != nil {
+				return err
+			}
+			if committed > offset {
+				retryCtx = su.newRetryContext()
+			}
+			offset = committed
+			continue
+		}
+		offset = newOffset
+		retryCtx = su.newRetryContext()
+	}
+
+	if su.onProgress != nil {
+		su.onProgress(su.size)
+	}
+	return nil
+}
+
+// put sends a single chunk and returns the new committed offset
+func (su *spoolUpload) put(f *os.File, offset int64, chunkSize int64) (int64, error) {
+	body := counter.NewReaderCallback(func(count int64) {
+		if su.onProgress != nil {
+			su.onProgress(offset + count)
+		}
+	}, io.NewSectionReader(f, offset, chunkSize))
+
+	req, err := http.NewRequest("PUT", su.uploadURL, body)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	req.ContentLength = chunkSize
+	req.Header.Set("content-range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+chunkSize-1, su.size))
+
+	res, err := su.httpClient.Do(req)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	res.Body.Close()
+
+	return su.interpret(res)
+}
+
+// committedBytes asks storage how much of the file it has
+func (su *spoolUpload) committedBytes() (int64, error) {
+	retryCtx := su.newRetryContext()
+	for retryCtx.shouldTry() {
+		req, err := http.NewRequest("PUT", su.uploadURL, nil)
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		req.ContentLength = 0
+		req.Header.Set("content-range", fmt.Sprintf("bytes */%d", su.size))
+
+		res, err := su.httpClient.Do(req)
+		if err != nil {
+			retryCtx.retry(err)
+			continue
+		}
+		res.Body.Close()
+
+		committed, err := su.interpret(res)
+		if err != nil {
+			if errors.Cause(err) == errUploadSessionExpired {
+				return 0, err
+			}
+			retryCtx.retry(err)
+			continue
+		}
+		return committed, nil
+	}
+
+	return 0, errors.Errorf("gave up on trying to get upload status")
+}
+
+func (su *spoolUpload) interpret(res *http.Response) (int64, error) {
+	switch res.StatusCode {
+	case 200, 201:
+		return su.size, nil
+	case 308:
+		return parseCommittedRange(res.Header.Get("Range"))
+	case 404, 410:
+		return 0, errUploadSessionExpired
+	default:
+		return 0, errors.Errorf("got HTTP %s", res.Status)
+	}
+}
+
+// parseCommittedRange parses headers like `bytes=0-1023`, which mean
+// storage has the first 1024 bytes. No header means nothing was committed.
+func parseCommittedRange(rangeHeader string) (int64, error) {
+	if rangeHeader == "" {
+		return 0, nil
+	}
+
+	tokens := strings.SplitN(strings.TrimPrefix(rangeHeader, "bytes="), "-", 2)
+	if len(tokens) != 2 || tokens[0] != "0" {
+		return 0, errors.Errorf("invalid range header: %s", rangeHeader)
+	}
+
+	end, err := strconv.ParseInt(tokens[1], 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "parsing range header %s", rangeHeader)
+	}
+	return end + 1, nil
+}
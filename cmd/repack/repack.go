@@ -5,6 +5,7 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -32,7 +33,7 @@ var args = struct {
 }{}
 
 func Register(ctx *mansion.Context) {
-	cmd := ctx.App.Command("repack", "Recompress a wharf patch using a different compression algorithm/format").Hidden()
+	cmd := ctx.App.Command("repack", "Recompress a wharf patch using a different compression algorithm/format. Without --outpath, compares all algorithms and levels.").Hidden()
 	args.inPath = cmd.Arg("inpath", "Path of patch to recompress").Required().String()
 	args.outPath = cmd.Flag("outpath", "Path of patch to recompress").Short('o').String()
 	ctx.Register(cmd, do)
@@ -44,172 +45,257 @@ type Params struct {
 	Compression *pwr.CompressionSettings
 }
 
+// Result compares a patch before and after repacking
+type Result struct {
+	From *pwr.CompressionSettings
+	To   *pwr.CompressionSettings
+
+	InSize  int64
+	OutSize int64
+	// DataSize is the size of the patch's data once decompressed
+	DataSize int64
+
+	// CompressDuration is how long it took to decompress the input
+	// and compress it again
+	CompressDuration time.Duration
+	// InDecompressDuration and OutDecompressDuration are how long it
+	// takes to decompress the input and output, which is what players wait for
+	InDecompressDuration  time.Duration
+	OutDecompressDuration time.Duration
+}
+
+// benchmarks are the algorithms and levels compared when no output is given
+var benchmarks = []*pwr.CompressionSettings{
+	{Algorithm: pwr.CompressionAlgorithm_BROTLI, Quality: 1},
+	{Algorithm: pwr.CompressionAlgorithm_BROTLI, Quality: 3},
+	{Algorithm: pwr.CompressionAlgorithm_BROTLI, Quality: 6},
+	{Algorithm: pwr.CompressionAlgorithm_BROTLI, Quality: 9},
+	{Algorithm: pwr.CompressionAlgorithm_ZSTD, Quality: 1},
+	{Algorithm: pwr.CompressionAlgorithm_ZSTD, Quality: 3},
+	{Algorithm: pwr.CompressionAlgorithm_ZSTD, Quality: 9},
+	{Algorithm: pwr.CompressionAlgorithm_GZIP, Quality: 1},
+	{Algorithm: pwr.CompressionAlgorithm_GZIP, Quality: 6},
+	{Algorithm: pwr.CompressionAlgorithm_GZIP, Quality: 9},
+}
+
 func do(ctx *mansion.Context) {
 	if *args.outPath == "" {
 		// benchmark!
 		headers := []string{
-			"algorithm", "relative size", "compression speed",
+			"algorithm", "relative size", "compression speed", "decompression speed",
 		}
 		fmt.Printf("%s\n", strings.Join(headers, ","))
 
-		algos := []pwr.CompressionAlgorithm{
-			pwr.CompressionAlgorithm_BROTLI,
-		}
-		qualities := []int32{
-			1,
-			3,
-			6,
-			9,
-		}
-		for _, algo := range algos {
-			for _, quality := range qualities {
-				comp := &pwr.CompressionSettings{
-					Algorithm: algo,
-					Quality:   quality,
-				}
-
-				ctx.Must(Do(&Params{
-					InPath:      *args.inPath,
-					Compression: comp,
-				}))
+		for _, comp := range benchmarks {
+			res, err := Do(&Params{
+				InPath:      *args.inPath,
+				Compression: comp,
+			})
+			ctx.Must(err)
+
+			columns := []string{
+				fmt.Sprintf("%s-q%d", comp.Algorithm, comp.Quality),
+				fmt.Sprintf("%f", float64(res.OutSize)/float64(res.InSize)),
+				fmt.Sprintf("%f", megaBytesPerSec(res.DataSize, res.CompressDuration)),
+				fmt.Sprintf("%f", megaBytesPerSec(res.DataSize, res.OutDecompressDuration)),
 			}
+			fmt.Printf("%s\n", strings.Join(columns, ","))
 		}
 	} else {
 		// output!
 		comp := ctx.CompressionSettings()
-		ctx.Must(Do(&Params{
+		res, err := Do(&Params{
 			InPath:      *args.inPath,
 			OutPath:     *args.outPath,
 			Compression: &comp,
-		}))
+		})
+		ctx.Must(err)
+		printResult(res)
 	}
 }
 
-func Do(params *Params) error {
-	bench := params.OutPath == ""
-	consumer := comm.NewStateConsumer()
-
-	dr, err := eos.Open(params.InPath, option.WithConsumer(consumer))
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	defer dr.Close()
-
-	stats, err := dr.Stat()
-	if err != nil {
-		return errors.WithStack(err)
-	}
+func megaBytesPerSec(numBytes int64, duration time.Duration) float64 {
+	return float64(numBytes) / 1024.0 / 1024.0 / duration.Seconds()
+}
 
-	source := seeksource.FromFile(dr)
+func printResult(res *Result) {
+	comm.Statf("%s (%s) => %s (%s), %.3f as large as the input",
+		united.FormatBytes(res.InSize), res.From.ToString(),
+		united.FormatBytes(res.OutSize), res.To.ToString(),
+		float64(res.OutSize)/float64(res.InSize),
+	)
+	comm.Statf("Compressed %s in %s (%s)",
+		united.FormatBytes(res.DataSize),
+		formatDuration(res.CompressDuration),
+		united.FormatBPS(res.DataSize, res.CompressDuration),
+	)
+	comm.Statf("Decompressing takes %s (%s) with %s, was %s (%s) with %s",
+		formatDuration(res.OutDecompressDuration),
+		united.FormatBPS(res.DataSize, res.OutDecompressDuration), res.To.ToString(),
+		formatDuration(res.InDecompressDuration),
+		united.FormatBPS(res.DataSize, res.InDecompressDuration), res.From.ToString(),
+	)
+}
 
-	cs := countingsource.New(source, func(count int64) {
-		comm.Progress(source.Progress())
-	})
+// formatDuration is more precise than united.FormatDuration, since
+// decompressing a patch usually takes less than a second
+func formatDuration(d time.Duration) string {
+	return d.Round(time.Millisecond).String()
+}
 
-	_, err = cs.Resume(nil)
-	if err != nil {
-		return errors.WithStack(err)
-	}
+// Do recompresses a patch, and measures how long compressing and
+// decompressing takes. Without an OutPath, the output is written
+// to a temporary file and discarded.
+func Do(params *Params) (*Result, error) {
+	bench := params.OutPath == ""
+	consumer := comm.NewStateConsumer()
 
-	var dw io.Writer
+	outPath := params.OutPath
 	if bench {
-		dw = ioutil.Discard
-	} else {
-		dw, err = os.Create(params.OutPath)
+		f, err := ioutil.TempFile("", "butler-repack")
 		if err != nil {
-			return errors.WithStack(err)
+			return nil, errors.WithStack(err)
 		}
+		outPath = f.Name()
+		f.Close()
+		defer os.Remove(outPath)
 	}
-	w := counter.NewWriter(dw)
-
-	rawInWire := wire.NewReadContext(source)
 
-	err = rawInWire.ExpectMagic(pwr.PatchMagic)
-	if err != nil {
-		return errors.WithStack(err)
+	res := &Result{
+		To: params.Compression,
 	}
 
-	header := &pwr.PatchHeader{}
-	err = rawInWire.ReadMessage(header)
-	if err != nil {
-		return errors.WithStack(err)
-	}
+	// first pass: how long does decompressing the input take?
+	err := decompress(params.InPath, func(header *pwr.PatchHeader, inWire *wire.ReadContext, size int64) error {
+		res.From = header.Compression
+		res.InSize = size
 
-	inWire, err := pwr.DecompressWire(rawInWire, header.Compression)
+		startTime := time.Now()
+		numBytes, err := io.Copy(ioutil.Discard, inWire.GetSource())
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		res.InDecompressDuration = time.Since(startTime)
+		res.DataSize = numBytes
+		return nil
+	})
 	if err != nil {
-		return errors.WithStack(err)
+		return nil, errors.Wrap(err, "decompressing input")
 	}
 
-	rawOutWire := wire.NewWriteContext(w)
+	err = decompress(params.InPath, func(header *pwr.PatchHeader, inWire *wire.ReadContext, size int64) error {
+		dw, err := os.Create(outPath)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer dw.Close()
+		w := counter.NewWriter(dw)
 
-	err = rawOutWire.WriteMagic(pwr.PatchMagic)
-	if err != nil {
-		return errors.WithStack(err)
-	}
+		rawOutWire := wire.NewWriteContext(w)
 
-	if !bench {
-		consumer.Opf("Repacking %s (%s) from %s to %s", stats.Name(), united.FormatBytes(source.Size()), header.Compression, params.Compression)
-		comm.StartProgressWithTotalBytes(source.Size())
-	}
+		err = rawOutWire.WriteMagic(pwr.PatchMagic)
+		if err != nil {
+			return errors.WithStack(err)
+		}
 
-	header.Compression = params.Compression
+		if !bench {
+			consumer.Opf("Repacking %s (%s) from %s to %s", filepath.Base(params.InPath), united.FormatBytes(res.DataSize), header.Compression.ToString(), params.Compression.ToString())
+			comm.StartProgressWithTotalBytes(res.DataSize)
+		}
 
-	err = rawOutWire.WriteMessage(header)
-	if err != nil {
-		return errors.WithStack(err)
-	}
+		header.Compression = params.Compression
 
-	var megaBytesPerSec float64
+		err = rawOutWire.WriteMessage(header)
+		if err != nil {
+			return errors.WithStack(err)
+		}
 
-	err = func() error {
 		outWire, err := pwr.CompressWire(rawOutWire, header.Compression)
 		if err != nil {
 			return errors.WithStack(err)
 		}
-		defer outWire.Close()
 
 		startTime := time.Now()
-		rd := inWire.GetSource()
-		wr := outWire.Writer()
-		numBytes, err := io.Copy(wr, rd)
+		_, err = io.Copy(outWire.Writer(), inWire.GetSource())
 		if err != nil {
 			return errors.WithStack(err)
 		}
-		duration := time.Since(startTime)
 
-		megaBytesPerSec = float64(numBytes) / 1024.0 / 1024.0 / duration.Seconds()
+		err = outWire.Close()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		res.CompressDuration = time.Since(startTime)
+		res.OutSize = w.Count()
 
 		if !bench {
 			comm.EndProgress()
-			consumer.Statf("Repacked %s @ %s/s", united.FormatBytes(numBytes), united.FormatBPS(numBytes, duration))
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
+	// last pass: how long does decompressing the output take?
+	err = decompress(outPath, func(header *pwr.PatchHeader, outWire *wire.ReadContext, size int64) error {
+		startTime := time.Now()
+		_, err := io.Copy(ioutil.Discard, outWire.GetSource())
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		res.OutDecompressDuration = time.Since(startTime)
 		return nil
-	}()
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "decompressing output")
+	}
+
+	if !bench {
+		consumer.Statf("Wrote to %s", params.OutPath)
+	}
+	return res, nil
+}
+
+// decompress reads the header of a patch, and calls f with a wire that
+// reads the rest of it, decompressed, and the size of the patch
+func decompress(patchPath string, f func(header *pwr.PatchHeader, rc *wire.ReadContext, size int64) error) error {
+	consumer := comm.NewStateConsumer()
+
+	dr, err := eos.Open(patchPath, option.WithConsumer(consumer))
 	if err != nil {
 		return errors.WithStack(err)
 	}
+	defer dr.Close()
 
-	inSize := source.Size()
+	source := seeksource.FromFile(dr)
 
-	outSize := w.Count()
+	cs := countingsource.New(source, func(count int64) {
+		comm.Progress(source.Progress())
+	})
 
-	if bench {
-		columns := []string{
-			fmt.Sprintf("%s-q%d", header.Compression.Algorithm, header.Compression.Quality),
-			fmt.Sprintf("%f", float64(outSize)/float64(inSize)),
-			fmt.Sprintf("%f", megaBytesPerSec),
-		}
+	_, err = cs.Resume(nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
 
-		fmt.Printf("%s\n", strings.Join(columns, ","))
-	} else {
-		consumer.Statf("%s => %s (%.3f as large as the input)",
-			united.FormatBytes(inSize),
-			united.FormatBytes(outSize),
-			float64(outSize)/float64(inSize),
-		)
-		consumer.Statf("Wrote to %s", params.OutPath)
+	rawInWire := wire.NewReadContext(source)
+
+	err = rawInWire.ExpectMagic(pwr.PatchMagic)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	header := &pwr.PatchHeader{}
+	err = rawInWire.ReadMessage(header)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	inWire, err := pwr.DecompressWire(rawInWire, header.Compression)
+	if err != nil {
+		return errors.WithStack(err)
 	}
 
-	return nil
+	return f(header, inWire, source.Size())
 }
@@ -0,0 +1,203 @@
+package rollback
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/itchio/butler/cmd/fetch"
+	"github.com/itchio/butler/cmd/push"
+	"github.com/itchio/butler/comm"
+	"github.com/itchio/butler/localrepo"
+	"github.com/itchio/butler/mansion"
+	itchio "github.com/itchio/go-itchio"
+	"github.com/pkg/errors"
+)
+
+// Params controls how a channel is rolled back
+type Params struct {
+	// To is the build to go back to: a build ID, or a userversion
+	To string
+	// UserVersion is the userversion of the new build. By default,
+	// it's the old build's, with a note about the rollback.
+	UserVersion string
+	DryRun      bool
+}
+
+var args = struct {
+	target *string
+	params Params
+}{}
+
+func Register(ctx *mansion.Context) {
+	cmd := ctx.App.Command("rollback", "Make a previous build the latest build of a channel again, by pushing it as a new build")
+	ctx.Register(cmd, do)
+
+	args.target = cmd.Arg("target", "Which user/project:channel to roll back, for example 'leafo/x-moon:win-64', or a local build repository like ./repo:win-64").Required().String()
+	cmd.Flag("to", "Build to roll back to: a build ID, or a userversion (the newest build with it is used)").Required().StringVar(&args.params.To)
+	cmd.Flag("userversion", "Userversion of the new build (by default, the old build's, noting the rollback)").StringVar(&args.params.UserVersion)
+	cmd.Flag("dry-run", "Don't push anything, just show what would be rolled back").BoolVar(&args.params.DryRun)
+}
+
+func do(ctx *mansion.Context) {
+	go ctx.DoVersionCheck()
+	ctx.Must(Do(ctx, *args.target, args.params))
+}
+
+// ParseTo turns what was given to --to into fetch parameters. Numbers
+// are build IDs, anything else is a userversion.
+func ParseTo(to string) fetch.Params {
+	if id, err := strconv.ParseInt(to, 10, 64); err == nil && id > 0 {
+		return fetch.Params{BuildID: id}
+	}
+	return fetch.Params{UserVersion: to}
+}
+
+// RollbackUserVersion is the default userversion of a build that
+// rolls back to an older one
+func RollbackUserVersion(b *fetch.Build) string {
+	if b.UserVersion != "" {
+		return fmt.Sprintf("%s (rollback to build %d)", b.UserVersion, b.ID)
+	}
+	return fmt.Sprintf("rollback to build %d", b.ID)
+}
+
+func Do(ctx *mansion.Context, specStr string, params Params) error {
+	fetchParams := ParseTo(params.To)
+
+	builds, headID, err := listBuilds(ctx, specStr)
+	if err != nil {
+		return err
+	}
+
+	build, err := fetch.SelectBuild(builds, fetchParams)
+	if err != nil {
+		return err
+	}
+	if build.ID == headID {
+		return fmt.Errorf("Build %d is already the latest build of %s", build.ID, specStr)
+	}
+
+	userVersion := params.UserVersion
+	if userVersion == "" {
+		userVersion = RollbackUserVersion(build)
+	}
+
+	comm.Opf("Rolling back %s from build %d to build %d", specStr, headID, build.ID)
+	if params.DryRun {
+		comm.Logf("Would fetch build %d, then push it to %s with userversion '%s'", build.ID, specStr, userVersion)
+		return nil
+	}
+
+	tempDir, err := ioutil.TempDir("", "butler-rollback")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.RemoveAll(tempDir)
+	buildDir := filepath.Join(tempDir, "build")
+
+	err = fetch.Do(ctx, specStr, buildDir, fetch.Params{BuildID: build.ID})
+	if err != nil {
+		return errors.Wrapf(err, "fetching build %d", build.ID)
+	}
+
+	// the receipt fetch writes isn't part of the build
+	err = os.RemoveAll(filepath.Join(buildDir, ".itch"))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return push.Do(ctx, push.Params{
+		Src:         buildDir,
+		Targets:     []string{specStr},
+		UserVersion: userVersion,
+		FixPerms:    true,
+		// the config file's settings, like ignore patterns,
+		// were already applied when the build was first pushed
+		NoConfig:   true,
+		JournalDir: push.DefaultJournalDir(),
+		Explicit:   map[string]bool{"userversion": true},
+	})
+}
+
+// listBuilds returns the builds of the channel, along with the ID
+// of its latest build
+func listBuilds(ctx *mansion.Context, specStr string) ([]*fetch.Build, int64, error) {
+	if localrepo.IsTarget(specStr) {
+		return listLocalBuilds(specStr)
+	}
+
+	spec, err := itchio.ParseSpec(specStr)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	err = spec.EnsureChannel()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	client, err := ctx.AuthenticateViaOauth()
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "authenticating")
+	}
+
+	channelRes, err := client.GetChannel(ctx.DefaultCtx(), spec.Target, spec.Channel)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "looking up channel")
+	}
+	channel := channelRes.Channel
+	if channel.Head == nil {
+		return nil, 0, fmt.Errorf("Channel %s doesn't have any builds yet", spec.Channel)
+	}
+
+	buildsRes, err := client.ListUploadBuilds(ctx.DefaultCtx(), itchio.ListUploadBuildsParams{
+		UploadID: channel.Upload.ID,
+	})
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "listing builds")
+	}
+
+	var builds []*fetch.Build
+	for _, b := range buildsRes.Builds {
+		builds = append(builds, &fetch.Build{
+			ID:          b.ID,
+			UserVersion: b.UserVersion,
+			Usable:      b.State == itchio.BuildStateCompleted,
+		})
+	}
+	return builds, channel.Head.ID, nil
+}
+
+func listLocalBuilds(target string) ([]*fetch.Build, int64, error) {
+	dir, channel, err := localrepo.ParseTarget(target)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	repo, err := localrepo.Open(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	head, err := repo.Head(channel)
+	if err != nil {
+		return nil, 0, err
+	}
+	if head == nil {
+		return nil, 0, fmt.Errorf("Channel %s doesn't have any builds yet", channel)
+	}
+
+	localBuilds, err := repo.Builds(channel)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var builds []*fetch.Build
+	for _, b := range localBuilds {
+		builds = append(builds, &fetch.Build{ID: b.ID, UserVersion: b.UserVersion, Usable: true})
+	}
+	return builds, head.ID, nil
+}
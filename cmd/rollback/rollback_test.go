@@ -0,0 +1,18 @@
+package rollback_test
+
+import (
+	"testing"
+
+	"github.com/itchio/butler/cmd/fetch"
+	"github.com/itchio/butler/cmd/rollback"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRollback(t *testing.T) {
+	assert.EqualValues(t, fetch.Params{BuildID: 1234}, rollback.ParseTo("1234"))
+	assert.EqualValues(t, fetch.Params{UserVersion: "1.2.0"}, rollback.ParseTo("1.2.0"))
+	assert.EqualValues(t, fetch.Params{UserVersion: "v12"}, rollback.ParseTo("v12"))
+
+	assert.EqualValues(t, "1.2.0 (rollback to build 1234)", rollback.RollbackUserVersion(&fetch.Build{ID: 1234, UserVersion: "1.2.0"}))
+	assert.EqualValues(t, "rollback to build 1234", rollback.RollbackUserVersion(&fetch.Build{ID: 1234}))
+}
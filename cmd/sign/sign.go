@@ -5,6 +5,7 @@ import (
 	"os"
 	"time"
 
+	"github.com/itchio/butler/archivesource"
 	"github.com/itchio/butler/comm"
 	"github.com/itchio/butler/filtering"
 	"github.com/itchio/butler/mansion"
@@ -25,25 +26,43 @@ var args = struct {
 	output    *string
 	signature *string
 	fixPerms  *bool
+	filter    filtering.Flags
 }{}
 
 func Register(ctx *mansion.Context) {
 	cmd := ctx.App.Command("sign", "(Advanced) Generate a signature file for a given directory. Useful for integrity checks and remote diff generation.")
-	args.output = cmd.Arg("dir", "Path of directory to sign").Required().String()
+	ctx.AcceptStdin(cmd, "dir")
+	args.output = cmd.Arg("dir", "Path of directory to sign. May also be an archive (.zip, .tar, .tar.gz, .tar.xz, .tar.zst, .7z), or - to read a tar stream from stdin").Required().String()
 	args.signature = cmd.Arg("signature", "Path to write signature to").Required().String()
 	args.fixPerms = cmd.Flag("fix-permissions", "Detect Mac & Linux executables and adjust their permissions automatically").Default("true").Bool()
+	args.filter.Register(cmd)
 	ctx.Register(cmd, do)
 }
 
 func do(ctx *mansion.Context) {
-	ctx.Must(Do(*args.output, *args.signature, ctx.CompressionSettings(), *args.fixPerms))
+	filter, err := args.filter.Filter(filtering.FilterPaths)
+	ctx.Must(err)
+
+	ctx.Must(DoFiltered(*args.output, *args.signature, ctx.CompressionSettings(), *args.fixPerms, filter))
 }
 
 func Do(output string, signature string, compression pwr.CompressionSettings, fixPerms bool) error {
+	return DoFiltered(output, signature, compression, fixPerms, filtering.FilterPaths)
+}
+
+// DoFiltered signs only the files that filter keeps
+func DoFiltered(output string, signature string, compression pwr.CompressionSettings, fixPerms bool, filter tlc.FilterFunc) error {
 	comm.Opf("Creating signature for %s", output)
 	startTime := time.Now()
 
-	container, err := tlc.WalkAny(output, tlc.WalkOpts{Filter: filtering.FilterPaths})
+	source, err := archivesource.Open(output, comm.NewStateConsumer())
+	if err != nil {
+		return errors.Wrap(err, "opening directory to sign")
+	}
+	defer source.Close()
+	output = source.Path
+
+	container, err := tlc.WalkAny(output, tlc.WalkOpts{Filter: filter})
 	if err != nil {
 		return errors.Wrap(err, "walking directory to sign")
 	}
@@ -0,0 +1,387 @@
+package squash
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/itchio/butler/archivesource"
+	"github.com/itchio/butler/comm"
+	"github.com/itchio/butler/filtering"
+	"github.com/itchio/butler/mansion"
+
+	"github.com/itchio/headway/counter"
+	"github.com/itchio/headway/state"
+	"github.com/itchio/headway/united"
+
+	"github.com/itchio/lake/pools/fspool"
+	"github.com/itchio/lake/tlc"
+
+	"github.com/itchio/savior/filesource"
+
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/pwr/patcher"
+	"github.com/itchio/wharf/pwr/rediff"
+	"github.com/itchio/wharf/wire"
+	"github.com/itchio/wharf/wsync"
+
+	"github.com/pkg/errors"
+)
+
+type Params struct {
+	// Patches are applied in order, each to the output of the previous one
+	Patches []string
+	// Old is the build the first patch applies to, as a directory
+	// or archive. A signature isn't enough: patches copy data from
+	// the old build, so its files are needed to apply them.
+	Old string
+	// OldSignature is the signature of Old, if available. Its hashes
+	// are used instead of hashing Old again.
+	OldSignature string
+	// Output is where to write the combined patch. Its signature is
+	// written next to it, with .sig added to the end.
+	Output      string
+	Compression pwr.CompressionSettings
+
+	// Optimize runs the combined patch through bsdiff, like rediff does
+	Optimize   bool
+	Partitions int
+}
+
+var params Params
+
+func Register(ctx *mansion.Context) {
+	cmd := ctx.App.Command("squash", "(Advanced) Combine a chain of patches into a single patch, which takes the first patch's old build straight to the last patch's new build.")
+	cmd.Arg("patches", "Patch files (.pwr), in the order they're applied").Required().StringsVar(&params.Patches)
+	cmd.Flag("output", "Path to write the combined patch to. Its signature is written to the same path, with .sig added to the end.").Short('o').Required().StringVar(&params.Output)
+	cmd.Flag("old", "Directory with the build the first patch applies to. May also be a .tar, .tar.gz, .tar.xz, .tar.zst or .7z archive. Its signature isn't enough, since patches copy data from the old build: pass it to --old-signature to skip hashing the old build instead").Required().StringVar(&params.Old)
+	cmd.Flag("old-signature", "Signature of the old build (.pws), whose hashes are used instead of hashing the old build").StringVar(&params.OldSignature)
+	cmd.Flag("optimize", "Optimize the combined patch with bsdiff (slower, smaller patches)").BoolVar(&params.Optimize)
+	cmd.Flag("partitions", "Number of partitions to use when optimizing").Default(strconv.Itoa(defaultPartitions())).IntVar(&params.Partitions)
+	ctx.Register(cmd, do)
+}
+
+func defaultPartitions() int {
+	if n := runtime.NumCPU() / 2; n > 1 {
+		return n
+	}
+	return 1
+}
+
+func do(ctx *mansion.Context) {
+	params.Compression = ctx.CompressionSettings()
+	ctx.Must(Do(params))
+}
+
+// link is a patch of the chain
+type link struct {
+	path            string
+	size            int64
+	targetContainer *tlc.Container
+	sourceContainer *tlc.Container
+}
+
+func Do(params Params) error {
+	if len(params.Patches) == 0 {
+		return errors.New("squash: must specify at least one patch")
+	}
+	if params.Output == "" {
+		return errors.New("squash: must specify Output")
+	}
+	startTime := time.Now()
+	consumer := comm.NewStateConsumer()
+
+	chain, err := readChain(params.Patches)
+	if err != nil {
+		return err
+	}
+
+	if isSignature(params.Old) {
+		return errors.Errorf("squash: %s is a signature, but --old must be the old build itself, since patches copy data from it. Pass the signature to --old-signature to skip hashing the old build", params.Old)
+	}
+
+	old, err := archivesource.Open(params.Old, consumer)
+	if err != nil {
+		return errors.Wrap(err, "opening old build")
+	}
+	defer old.Close()
+
+	if stats, err := os.Stat(old.Path); err != nil || !stats.IsDir() {
+		return errors.Errorf("squash: old build must be a directory or an archive butler can extract (.zip archives must be extracted first)")
+	}
+
+	oldContainer := chain[0].targetContainer
+	err = checkOld(old.Path, oldContainer)
+	if err != nil {
+		return err
+	}
+
+	scratchDir, err := ioutil.TempDir("", "butler-squash")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.RemoveAll(scratchDir)
+
+	newDir, err := applyChain(chain, old.Path, scratchDir)
+	if err != nil {
+		return err
+	}
+	newContainer := chain[len(chain)-1].sourceContainer
+
+	oldHashes, err := oldSignature(params, oldContainer, old.Path, consumer)
+	if err != nil {
+		return err
+	}
+
+	patchPath := params.Output
+	if params.Optimize {
+		patchPath = filepath.Join(scratchDir, "unoptimized.pwr")
+	}
+
+	patchWriter, err := os.Create(patchPath)
+	if err != nil {
+		return errors.Wrap(err, "creating patch file")
+	}
+	defer patchWriter.Close()
+
+	signatureWriter, err := os.Create(params.Output + ".sig")
+	if err != nil {
+		return errors.Wrap(err, "creating signature file")
+	}
+	defer signatureWriter.Close()
+
+	patchCounter := counter.NewWriter(patchWriter)
+
+	dctx := &pwr.DiffContext{
+		SourceContainer: newContainer,
+		Pool:            fspool.New(newContainer, newDir),
+
+		TargetContainer: oldContainer,
+		TargetSignature: oldHashes,
+
+		Consumer:    consumer,
+		Compression: &params.Compression,
+	}
+
+	comm.Opf("Diffing old build against result of %d patches", len(chain))
+	comm.StartProgress()
+	err = dctx.WritePatch(context.Background(), patchCounter, signatureWriter)
+	comm.EndProgress()
+	if err != nil {
+		return errors.Wrap(err, "computing and writing combined patch")
+	}
+
+	patchSize := patchCounter.Count()
+	if params.Optimize {
+		patchSize, err = optimize(params, patchPath, old.Path, newDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	var chainSize int64
+	for _, l := range chain {
+		chainSize += l.size
+	}
+	comm.Statf("Squashed %d patches (%s) into a %s patch in %s",
+		len(chain), united.FormatBytes(chainSize), united.FormatBytes(patchSize),
+		united.FormatDuration(time.Since(startTime)))
+	comm.Logf("Verify it with: butler apply %s <old> --signature %s.sig --staging-dir <staging>", params.Output, params.Output)
+	return nil
+}
+
+// readChain reads the containers of all patches, and makes sure each
+// patch applies to the output of the previous one
+func readChain(paths []string) ([]*link, error) {
+	var chain []*link
+	for i, path := range paths {
+		l, err := readLink(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if i > 0 {
+			previous := chain[i-1]
+			err = l.targetContainer.EnsureEqual(previous.sourceContainer)
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s doesn't apply to the output of %s", path, previous.path)
+			}
+		}
+		chain = append(chain, l)
+	}
+	return chain, nil
+}
+
+func readLink(path string) (*link, error) {
+	patchSource, err := filesource.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer patchSource.Close()
+
+	p, err := patcher.New(patchSource, comm.NewStateConsumer())
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading patch %s", path)
+	}
+
+	return &link{
+		path:            path,
+		size:            patchSource.Size(),
+		targetContainer: p.GetTargetContainer(),
+		sourceContainer: p.GetSourceContainer(),
+	}, nil
+}
+
+// isSignature returns true if path is a wharf signature file
+func isSignature(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	var magic int32
+	err = binary.Read(f, wire.Endianness, &magic)
+	return err == nil && magic == pwr.SignatureMagic
+}
+
+// oldSignature returns the hashes of the old build, from --old-signature
+// if given, or by hashing oldDir otherwise
+func oldSignature(params Params, oldContainer *tlc.Container, oldDir string, consumer *state.Consumer) ([]wsync.BlockHash, error) {
+	if params.OldSignature != "" {
+		signatureSource, err := filesource.Open(params.OldSignature)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		defer signatureSource.Close()
+
+		sig, err := pwr.ReadSignature(context.Background(), signatureSource)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading signature %s", params.OldSignature)
+		}
+
+		err = oldContainer.EnsureEqual(sig.Container)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s isn't the signature of the build the first patch applies to", params.OldSignature)
+		}
+		return sig.Hashes, nil
+	}
+
+	comm.Opf("Hashing old build")
+	comm.StartProgress()
+	oldHashes, err := pwr.ComputeSignature(context.Background(), oldContainer, fspool.New(oldContainer, oldDir), consumer)
+	comm.EndProgress()
+	if err != nil {
+		return nil, errors.Wrap(err, "computing signature of old build")
+	}
+	return oldHashes, nil
+}
+
+// checkOld makes sure dir has what the first patch expects
+func checkOld(dir string, container *tlc.Container) error {
+	actual, err := tlc.WalkAny(dir, tlc.WalkOpts{Filter: filtering.FilterPaths})
+	if err != nil {
+		return errors.Wrap(err, "walking old build")
+	}
+
+	err = container.EnsureEqual(actual)
+	if err != nil {
+		return errors.Wrap(err, "old build isn't what the first patch applies to")
+	}
+	return nil
+}
+
+// applyChain applies all patches in turn, starting from oldDir, and
+// returns where the last patch's output is
+func applyChain(chain []*link, oldDir string, scratchDir string) (string, error) {
+	previousDir := oldDir
+	for i, l := range chain {
+		stepDir := filepath.Join(scratchDir, fmt.Sprintf("step-%d", i+1))
+
+		comm.Opf("Applying %s (%d/%d)", l.path, i+1, len(chain))
+		err := applyPatch(l.path, previousDir, stepDir)
+		if err != nil {
+			return "", errors.Wrapf(err, "applying %s", l.path)
+		}
+
+		if previousDir != oldDir {
+			err = os.RemoveAll(previousDir)
+			if err != nil {
+				return "", errors.WithStack(err)
+			}
+		}
+		previousDir = stepDir
+	}
+	return previousDir, nil
+}
+
+func applyPatch(patchPath string, targetDir string, outputDir string) error {
+	patchSource, err := filesource.Open(patchPath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer patchSource.Close()
+
+	comm.StartProgress()
+	defer comm.EndProgress()
+	return patcher.PatchFresh(patcher.PatchFreshParams{
+		PatchReader: patchSource,
+		TargetDir:   targetDir,
+		OutputDir:   outputDir,
+		Consumer:    comm.NewStateConsumer(),
+	})
+}
+
+// optimize rewrites the patch at patchPath to the output with bsdiff,
+// and returns the size of the optimized patch
+func optimize(params Params, patchPath string, oldDir string, newDir string) (int64, error) {
+	comm.Opf("Optimizing combined patch")
+
+	patchSource, err := filesource.Open(patchPath)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer patchSource.Close()
+
+	rc, err := rediff.NewContext(rediff.Params{
+		Consumer:    comm.NewStateConsumer(),
+		PatchReader: patchSource,
+
+		SuffixSortConcurrency: -1,
+		Partitions:            params.Partitions,
+		Compression:           &params.Compression,
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "analyzing combined patch")
+	}
+
+	patchWriter, err := os.Create(params.Output)
+	if err != nil {
+		return 0, errors.Wrap(err, "creating patch file")
+	}
+	defer patchWriter.Close()
+
+	comm.StartProgress()
+	err = rc.Optimize(rediff.OptimizeParams{
+		TargetPool:  fspool.New(rc.GetTargetContainer(), oldDir),
+		SourcePool:  fspool.New(rc.GetSourceContainer(), newDir),
+		PatchWriter: patchWriter,
+	})
+	comm.EndProgress()
+	if err != nil {
+		return 0, errors.Wrap(err, "optimizing combined patch")
+	}
+
+	// Optimize closes the patch writer
+	stats, err := os.Stat(params.Output)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return stats.Size(), nil
+}
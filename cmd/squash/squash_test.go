@@ -0,0 +1,144 @@
+package squash_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/itchio/butler/buildtest"
+	"github.com/itchio/butler/cmd/diff"
+	"github.com/itchio/butler/cmd/sign"
+	"github.com/itchio/butler/cmd/squash"
+	"github.com/itchio/headway/state"
+	"github.com/itchio/savior/filesource"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/pwr/patcher"
+	"github.com/itchio/wharf/wtest"
+	"github.com/stretchr/testify/assert"
+
+	_ "github.com/itchio/wharf/compressors/cbrotli"
+	_ "github.com/itchio/wharf/decompressors/cbrotli"
+)
+
+func TestSquash(t *testing.T) {
+	dir := buildtest.TempDir(t, "squash-tests")
+
+	v1 := buildtest.WriteDir(t, filepath.Join(dir, "v1"), map[string]string{
+		"game.exe":      "version one",
+		"data/old.dat":  "going away",
+		"data/keep.dat": "always there",
+	})
+	v2 := buildtest.WriteDir(t, filepath.Join(dir, "v2"), map[string]string{
+		"game.exe":      "version two",
+		"data/keep.dat": "always there",
+		"data/new.dat":  "brand new",
+	})
+	v3 := buildtest.WriteDir(t, filepath.Join(dir, "v3"), map[string]string{
+		"game.exe":      "version three",
+		"data/keep.dat": "always there",
+		"data/new.dat":  "brand new, improved",
+	})
+
+	makePatch := func(name string, target string, source string) string {
+		patchPath := filepath.Join(dir, name)
+		wtest.Must(t, diff.Do(diff.Params{
+			Target:      target,
+			Source:      source,
+			Patch:       patchPath,
+			Compression: buildtest.Compression,
+		}))
+		return patchPath
+	}
+	p1 := makePatch("p1.pwr", v1, v2)
+	p2 := makePatch("p2.pwr", v2, v3)
+
+	for _, optimize := range []bool{false, true} {
+		output := filepath.Join(dir, "combined.pwr")
+		wtest.Must(t, squash.Do(squash.Params{
+			Patches:     []string{p1, p2},
+			Old:         v1,
+			Output:      output,
+			Compression: buildtest.Compression,
+			Optimize:    optimize,
+			Partitions:  1,
+		}))
+
+		outDir := filepath.Join(dir, "out")
+		wtest.Must(t, os.RemoveAll(outDir))
+
+		patchSource, err := filesource.Open(output)
+		wtest.Must(t, err)
+		wtest.Must(t, patcher.PatchFresh(patcher.PatchFreshParams{
+			PatchReader: patchSource,
+			TargetDir:   v1,
+			OutputDir:   outDir,
+			Consumer:    &state.Consumer{},
+		}))
+		wtest.Must(t, patchSource.Close())
+
+		sigSource, err := filesource.Open(output + ".sig")
+		wtest.Must(t, err)
+		sig, err := pwr.ReadSignature(context.Background(), sigSource)
+		wtest.Must(t, err)
+		wtest.Must(t, sigSource.Close())
+
+		wtest.Must(t, pwr.AssertValid(outDir, sig))
+		wtest.Must(t, pwr.AssertNoGhosts(outDir, sig))
+
+		contents, err := ioutil.ReadFile(filepath.Join(outDir, "game.exe"))
+		wtest.Must(t, err)
+		assert.EqualValues(t, "version three", string(contents))
+	}
+
+	// patches have to be given in order
+	err := squash.Do(squash.Params{
+		Patches:     []string{p2, p1},
+		Old:         v1,
+		Output:      filepath.Join(dir, "wrong.pwr"),
+		Compression: buildtest.Compression,
+	})
+	assert.Error(t, err)
+
+	// the old build's signature can save hashing it again, but can't stand in for it
+	v1Sig := filepath.Join(dir, "v1.pws")
+	wtest.Must(t, sign.Do(v1, v1Sig, buildtest.Compression, false))
+
+	err = squash.Do(squash.Params{
+		Patches:     []string{p1, p2},
+		Old:         v1Sig,
+		Output:      filepath.Join(dir, "wrong.pwr"),
+		Compression: buildtest.Compression,
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "--old-signature")
+
+	wtest.Must(t, squash.Do(squash.Params{
+		Patches:      []string{p1, p2},
+		Old:          v1,
+		OldSignature: v1Sig,
+		Output:       filepath.Join(dir, "signed.pwr"),
+		Compression:  buildtest.Compression,
+	}))
+
+	v2Sig := filepath.Join(dir, "v2.pws")
+	wtest.Must(t, sign.Do(v2, v2Sig, buildtest.Compression, false))
+	err = squash.Do(squash.Params{
+		Patches:      []string{p1, p2},
+		Old:          v1,
+		OldSignature: v2Sig,
+		Output:       filepath.Join(dir, "wrong.pwr"),
+		Compression:  buildtest.Compression,
+	})
+	assert.Error(t, err)
+
+	// and the old build has to be what the first patch applies to
+	err = squash.Do(squash.Params{
+		Patches:     []string{p1, p2},
+		Old:         v2,
+		Output:      filepath.Join(dir, "wrong.pwr"),
+		Compression: buildtest.Compression,
+	})
+	assert.Error(t, err)
+}
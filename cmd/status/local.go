@@ -0,0 +1,76 @@
+package status
+
+import (
+	"os"
+
+	"github.com/itchio/butler/comm"
+	"github.com/itchio/butler/localrepo"
+	itchio "github.com/itchio/go-itchio"
+	"github.com/olekukonko/tablewriter"
+)
+
+// doLocal shows the channels of a local build repository. Local builds
+// are only recorded once complete, so there's never a pending build.
+func doLocal(target string) error {
+	dir, channelName, err := localrepo.ParseTarget(target)
+	if err != nil {
+		return err
+	}
+
+	repo, err := localrepo.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	channels, err := repo.Channels()
+	if err != nil {
+		return err
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Channel", "Upload", "Build", "Version"})
+
+	found := false
+	for _, ch := range channels {
+		if channelName != "" && ch.Name != channelName {
+			continue
+		}
+		found = true
+
+		head, err := repo.Head(ch.Name)
+		if err != nil {
+			return err
+		}
+
+		if head != nil {
+			build := localBuild(head)
+			table.Append([]string{ch.Name, "local", buildState(build), versionState(build)})
+		} else {
+			table.Append([]string{ch.Name, "local", "No builds yet"})
+		}
+	}
+
+	if found {
+		table.Render()
+	} else {
+		comm.Logf("No channel %s found in %s", channelName, repo.Dir)
+	}
+
+	return nil
+}
+
+// localBuild converts a local build so it can be shown like remote ones
+func localBuild(b *localrepo.Build) *itchio.Build {
+	parentID := b.ParentID
+	if parentID == 0 {
+		parentID = -1
+	}
+
+	return &itchio.Build{
+		ID:            b.ID,
+		ParentBuildID: parentID,
+		State:         itchio.BuildStateCompleted,
+		Version:       b.Version,
+		UserVersion:   b.UserVersion,
+	}
+}
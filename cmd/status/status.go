@@ -4,8 +4,10 @@ import (
 	"fmt"
 	"os"
 	"sort"
+	"time"
 
 	"github.com/itchio/butler/comm"
+	"github.com/itchio/butler/localrepo"
 	"github.com/itchio/butler/mansion"
 	itchio "github.com/itchio/go-itchio"
 	"github.com/itchio/headway/state"
@@ -16,22 +18,43 @@ import (
 var args = struct {
 	target       *string
 	showAllFiles *bool
+	wait         *bool
+	timeout      *time.Duration
+	pollInterval *time.Duration
 }{}
 
 func Register(ctx *mansion.Context) {
 	cmd := ctx.App.Command("status", "Show a list of channels and the status of their latest and pending builds.")
 	ctx.Register(cmd, do)
 
-	args.target = cmd.Arg("target", "Which user/project to show the status of, for example 'leafo/x-moon'").Required().String()
+	args.target = cmd.Arg("target", "Which user/project to show the status of, for example 'leafo/x-moon', or a local build repository like ./repo").Required().String()
 	args.showAllFiles = cmd.Flag("show-all-files", "Show status of all files, not just archive").Bool()
+	args.wait = cmd.Flag("wait", "Wait until pending builds are processed. Exits with 0 if they went live, 2 if one failed, 3 on timeout").Bool()
+	args.timeout = cmd.Flag("timeout", "How long to wait for with --wait").Default("30m").Duration()
+	args.pollInterval = cmd.Flag("poll-interval", "How often to check build status with --wait").Default("10s").Hidden().Duration()
 }
 
 func do(ctx *mansion.Context) {
 	go ctx.DoVersionCheck()
+	if *args.wait {
+		if localrepo.IsTarget(*args.target) {
+			// builds in local repositories have no processing step to wait for
+			ctx.Must(errors.New("--wait isn't supported for local build repositories"))
+		}
+		doWait(ctx, *args.target, WaitParams{
+			Timeout:      *args.timeout,
+			PollInterval: *args.pollInterval,
+		})
+		return
+	}
 	ctx.Must(Do(ctx, *args.target, *args.showAllFiles))
 }
 
 func Do(ctx *mansion.Context, specStr string, showAllFiles bool) error {
+	if localrepo.IsTarget(specStr) {
+		return doLocal(specStr)
+	}
+
 	spec, err := itchio.ParseSpec(specStr)
 	if err != nil {
 		return errors.Wrapf(err, "parsing spec %s", spec)
@@ -52,13 +75,7 @@ func Do(ctx *mansion.Context, specStr string, showAllFiles bool) error {
 
 	found := false
 
-	sortedChannelNames := []string{}
-	for name := range listChannelsResp.Channels {
-		sortedChannelNames = append(sortedChannelNames, name)
-	}
-	sort.Strings(sortedChannelNames)
-
-	for _, channelName := range sortedChannelNames {
+	for _, channelName := range sortedNames(listChannelsResp.Channels) {
 		ch := listChannelsResp.Channels[channelName]
 		if spec.Channel != "" && ch.Name != spec.Channel {
 			continue
@@ -88,6 +105,15 @@ func Do(ctx *mansion.Context, specStr string, showAllFiles bool) error {
 	return nil
 }
 
+func sortedNames(channels map[string]*itchio.Channel) []string {
+	names := []string{}
+	for name := range channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func buildState(build *itchio.Build) string {
 	theme := state.GetTheme()
 	var s string
@@ -0,0 +1,258 @@
+package status
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/itchio/butler/comm"
+	"github.com/itchio/butler/mansion"
+	itchio "github.com/itchio/go-itchio"
+	"github.com/olekukonko/tablewriter"
+	"github.com/pkg/errors"
+)
+
+// WaitOutcome is how waiting for builds ended
+type WaitOutcome string
+
+const (
+	// WaitOutcomeLive means all builds were processed successfully
+	WaitOutcomeLive WaitOutcome = "live"
+	// WaitOutcomeFailed means at least one build failed processing
+	WaitOutcomeFailed WaitOutcome = "failed"
+	// WaitOutcomeTimeout means at least one build was still processing
+	// when we gave up waiting
+	WaitOutcomeTimeout WaitOutcome = "timeout"
+)
+
+// Exit codes of `status --wait`, so CI can tell outcomes apart.
+// Other errors exit with 1, like everywhere else.
+const (
+	ExitCodeLive    = 0
+	ExitCodeFailed  = 2
+	ExitCodeTimeout = 3
+)
+
+// ExitCode returns the process exit code for an outcome
+func (o WaitOutcome) ExitCode() int {
+	switch o {
+	case WaitOutcomeFailed:
+		return ExitCodeFailed
+	case WaitOutcomeTimeout:
+		return ExitCodeTimeout
+	default:
+		return ExitCodeLive
+	}
+}
+
+// WaitedBuild is the last known state of a build we waited for
+type WaitedBuild struct {
+	Channel     string              `json:"channel"`
+	BuildID     int64               `json:"buildId"`
+	UserVersion string              `json:"userVersion"`
+	Version     string              `json:"version"`
+	State       itchio.BuildState   `json:"state"`
+	Files       []*itchio.BuildFile `json:"files"`
+
+	build *itchio.Build
+}
+
+// WaitResult is what `status --wait` prints as JSON
+type WaitResult struct {
+	Outcome WaitOutcome    `json:"outcome"`
+	Builds  []*WaitedBuild `json:"builds"`
+}
+
+// WaitParams controls how long `status --wait` waits
+type WaitParams struct {
+	// Timeout is how long to wait for all builds to be processed
+	Timeout time.Duration
+	// PollInterval is how often the channels are listed
+	PollInterval time.Duration
+}
+
+// IsTerminal returns true if a build won't change state anymore
+func IsTerminal(state itchio.BuildState) bool {
+	return state == itchio.BuildStateCompleted || state == itchio.BuildStateFailed
+}
+
+// FindBuild returns the build with the given ID in a channel, if it's
+// still its pending build or its head, or nil otherwise.
+func FindBuild(ch *itchio.Channel, buildID int64) *itchio.Build {
+	for _, b := range []*itchio.Build{ch.Pending, ch.Head} {
+		if b != nil && b.ID == buildID {
+			return b
+		}
+	}
+	return nil
+}
+
+// FinalOutcome sums up the state of all builds
+func (r *WaitResult) FinalOutcome() WaitOutcome {
+	outcome := WaitOutcomeLive
+	for _, wb := range r.Builds {
+		switch {
+		case wb.State == itchio.BuildStateFailed:
+			return WaitOutcomeFailed
+		case !IsTerminal(wb.State):
+			outcome = WaitOutcomeTimeout
+		}
+	}
+	return outcome
+}
+
+func doWait(ctx *mansion.Context, specStr string, params WaitParams) {
+	res, err := Wait(ctx, specStr, params)
+	ctx.Must(err)
+
+	comm.ResultOrPrint(res, func() {
+		printWaitResult(res)
+	})
+	os.Exit(res.Outcome.ExitCode())
+}
+
+// Wait watches the pending builds of a project's channels, or of a single
+// channel, until they're all processed or the timeout expires. When a single
+// channel is given and it has no pending build, its head is reported.
+func Wait(ctx *mansion.Context, specStr string, params WaitParams) (*WaitResult, error) {
+	spec, err := itchio.ParseSpec(specStr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing spec %s", specStr)
+	}
+
+	client, err := ctx.AuthenticateViaOauth()
+	if err != nil {
+		return nil, errors.Wrap(err, "authenticating")
+	}
+
+	listChannels := func() (map[string]*itchio.Channel, error) {
+		res, err := client.ListChannels(ctx.DefaultCtx(), spec.Target)
+		if err != nil {
+			return nil, errors.Wrap(err, "listing channels")
+		}
+		return res.Channels, nil
+	}
+
+	channels, err := listChannels()
+	if err != nil {
+		return nil, err
+	}
+
+	res := &WaitResult{}
+	for _, name := range sortedNames(channels) {
+		ch := channels[name]
+		if spec.Channel != "" && ch.Name != spec.Channel {
+			continue
+		}
+
+		b := ch.Pending
+		if b == nil && spec.Channel != "" {
+			b = ch.Head
+		}
+		if b == nil {
+			continue
+		}
+		res.Builds = append(res.Builds, &WaitedBuild{
+			Channel: ch.Name,
+			BuildID: b.ID,
+			build:   b,
+		})
+	}
+
+	if len(res.Builds) == 0 {
+		if spec.Channel != "" {
+			return nil, fmt.Errorf("No builds found for channel %s of %s", spec.Channel, spec.Target)
+		}
+		return nil, fmt.Errorf("No pending builds for %s", spec.Target)
+	}
+
+	deadline := time.Now().Add(params.Timeout)
+	for {
+		pending := 0
+		for _, wb := range res.Builds {
+			if !IsTerminal(wb.build.State) {
+				pending++
+			}
+		}
+		if pending == 0 || !time.Now().Before(deadline) {
+			break
+		}
+
+		comm.Logf("Waiting for %d build(s) to be processed...", pending)
+		sleep := params.PollInterval
+		if left := time.Until(deadline); left < sleep {
+			sleep = left
+		}
+		time.Sleep(sleep)
+
+		channels, err = listChannels()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, wb := range res.Builds {
+			if IsTerminal(wb.build.State) {
+				continue
+			}
+
+			var b *itchio.Build
+			if ch, ok := channels[wb.Channel]; ok {
+				b = FindBuild(ch, wb.BuildID)
+			}
+			if b == nil {
+				// the build isn't on the channel anymore, which doesn't mean it
+				// failed: it may have gone live, then been replaced by a newer one
+				buildRes, err := client.GetBuild(ctx.DefaultCtx(), itchio.GetBuildParams{
+					BuildID: wb.BuildID,
+				})
+				if err != nil {
+					return nil, errors.Wrapf(err, "looking up build %d", wb.BuildID)
+				}
+				b = buildRes.Build
+			}
+			if b.State != wb.build.State {
+				comm.Logf("%s: %s", wb.Channel, buildState(b))
+			}
+			wb.build = b
+		}
+	}
+
+	for _, wb := range res.Builds {
+		b := wb.build
+		wb.State = b.State
+		wb.UserVersion = b.UserVersion
+		wb.Version = versionState(b)
+
+		filesRes, err := client.ListBuildFiles(ctx.DefaultCtx(), wb.BuildID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "listing files of build %d", wb.BuildID)
+		}
+		wb.Files = filesRes.Files
+	}
+	res.Outcome = res.FinalOutcome()
+
+	return res, nil
+}
+
+func printWaitResult(res *WaitResult) {
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Channel", "Build", "Version", "Files"})
+	for _, wb := range res.Builds {
+		var files []string
+		for _, f := range wb.Files {
+			files = append(files, fmt.Sprintf("%s (%s): %s", f.Type, f.SubType, f.State))
+		}
+		table.Append([]string{wb.Channel, buildState(wb.build), wb.Version, strings.Join(files, "\n")})
+	}
+	table.Render()
+
+	switch res.Outcome {
+	case WaitOutcomeLive:
+		comm.Statf("All builds are live")
+	case WaitOutcomeFailed:
+		comm.Logf("Some builds failed processing")
+	case WaitOutcomeTimeout:
+		comm.Logf("Timed out waiting for builds to be processed")
+	}
+}
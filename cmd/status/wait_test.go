@@ -0,0 +1,45 @@
+package status_test
+
+import (
+	"testing"
+
+	"github.com/itchio/butler/cmd/status"
+	itchio "github.com/itchio/go-itchio"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWait(t *testing.T) {
+	ch := &itchio.Channel{
+		Name:    "windows",
+		Head:    &itchio.Build{ID: 10, State: itchio.BuildStateCompleted},
+		Pending: &itchio.Build{ID: 11, State: itchio.BuildStateProcessing},
+	}
+
+	assert.EqualValues(t, itchio.BuildStateProcessing, status.FindBuild(ch, 11).State)
+	assert.EqualValues(t, itchio.BuildStateCompleted, status.FindBuild(ch, 10).State)
+	// builds that aren't on the channel anymore have to be looked up
+	assert.Nil(t, status.FindBuild(ch, 9))
+
+	assert.False(t, status.IsTerminal(itchio.BuildStateStarted))
+	assert.False(t, status.IsTerminal(itchio.BuildStateProcessing))
+	assert.True(t, status.IsTerminal(itchio.BuildStateCompleted))
+	assert.True(t, status.IsTerminal(itchio.BuildStateFailed))
+
+	res := &status.WaitResult{
+		Builds: []*status.WaitedBuild{
+			{Channel: "windows", State: itchio.BuildStateCompleted},
+			{Channel: "linux", State: itchio.BuildStateCompleted},
+		},
+	}
+	assert.EqualValues(t, status.WaitOutcomeLive, res.FinalOutcome())
+	assert.EqualValues(t, 0, res.FinalOutcome().ExitCode())
+
+	res.Builds[1].State = itchio.BuildStateProcessing
+	assert.EqualValues(t, status.WaitOutcomeTimeout, res.FinalOutcome())
+	assert.EqualValues(t, status.ExitCodeTimeout, res.FinalOutcome().ExitCode())
+
+	// failures win over timeouts
+	res.Builds[0].State = itchio.BuildStateFailed
+	assert.EqualValues(t, status.WaitOutcomeFailed, res.FinalOutcome())
+	assert.EqualValues(t, status.ExitCodeFailed, res.FinalOutcome().ExitCode())
+}
@@ -0,0 +1,68 @@
+package validate
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+
+	"github.com/itchio/butler/html5"
+	"github.com/itchio/butler/portability"
+	"github.com/itchio/headway/state"
+	"github.com/itchio/lake/pools/fspool"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/ox"
+	"github.com/pkg/errors"
+)
+
+// lintBuild checks that the build in dir works on platforms, not
+// just on the machine it was made on.
+func lintBuild(consumer *state.Consumer, dir string, container *tlc.Container, platforms []ox.Platform) (*portability.Report, error) {
+	if len(platforms) == 0 {
+		platforms = portability.AllPlatforms
+	}
+
+	var names []string
+	for _, platform := range platforms {
+		names = append(names, string(platform))
+	}
+	consumer.Infof("")
+	consumer.Statf("Checking portability of %s for %s...", container, strings.Join(names, ", "))
+	report, err := portability.Lint(container, fspool.New(container, dir), platforms)
+	if err != nil {
+		return nil, err
+	}
+
+	report.Print(func(line string) {
+		consumer.Infof("    %s", line)
+	})
+	consumer.Infof("")
+	return report, nil
+}
+
+// checkWeb checks that the build in dir works in the web player
+func checkWeb(consumer *state.Consumer, dir string, container *tlc.Container) (*html5.Report, error) {
+	consumer.Statf("Checking %s as an HTML5 game...", container)
+	report, err := html5.Check(container, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	report.Print(func(line string) {
+		consumer.Infof("    %s", line)
+	})
+	consumer.Infof("")
+	return report, nil
+}
+
+func writeReport(report *Report, path string) error {
+	contents, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = ioutil.WriteFile(path, contents, 0o644)
+	if err != nil {
+		return errors.Wrap(err, "writing report")
+	}
+	return nil
+}
@@ -0,0 +1,417 @@
+package validate
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/itchio/butler/redist"
+	"github.com/itchio/hush/manifest"
+	"github.com/itchio/ox"
+	"github.com/mitchellh/mapstructure"
+)
+
+// Severity is how bad a manifest diagnostic is
+type Severity string
+
+const (
+	// SeverityError diagnostics break the manifest
+	SeverityError Severity = "error"
+	// SeverityWarning diagnostics are most likely mistakes, but
+	// the manifest still works
+	SeverityWarning Severity = "warning"
+)
+
+// Diagnostic is a problem found in a manifest
+type Diagnostic struct {
+	Severity Severity
+	// Line and Column start at 1, and are zero if unknown
+	Line    int
+	Column  int
+	Message string
+}
+
+// Format returns the diagnostic like compilers do, prefixed with
+// path:line:column
+func (d *Diagnostic) Format(path string) string {
+	where := path
+	if d.Line > 0 {
+		where = fmt.Sprintf("%s:%d:%d", path, d.Line, d.Column)
+	}
+	return fmt.Sprintf("%s: %s: %s", where, d.Severity, d.Message)
+}
+
+// ManifestFile is an app manifest, along with any problems found in it
+type ManifestFile struct {
+	Path string
+	// Manifest is nil if the manifest couldn't be decoded at all
+	Manifest    *manifest.Manifest
+	Diagnostics []*Diagnostic
+
+	positions positions
+	// missing lists the indices of actions whose path doesn't exist
+	missing map[int]bool
+}
+
+var nearLineRegexp = regexp.MustCompile(`^Near line (\d+) \(last key parsed '[^']*'\): (.*)$`)
+
+// ParseManifest decodes the manifest at path and checks it against
+// the manifest schema: unknown keys, wrong types, missing names and
+// paths, unknown platforms and duplicate actions.
+func ParseManifest(path string, contents []byte) *ManifestFile {
+	mf := &ManifestFile{
+		Path:      path,
+		positions: scanPositions(string(contents)),
+		missing:   make(map[int]bool),
+	}
+
+	var intermediate map[string]interface{}
+	_, err := toml.Decode(string(contents), &intermediate)
+	if err != nil {
+		d := &Diagnostic{
+			Severity: SeverityError,
+			Message:  err.Error(),
+		}
+		if matches := nearLineRegexp.FindStringSubmatch(err.Error()); matches != nil {
+			d.Line, _ = strconv.Atoi(matches[1])
+			d.Column = 1
+			d.Message = matches[2]
+		}
+		mf.Diagnostics = append(mf.Diagnostics, d)
+		return mf
+	}
+
+	mf.checkSchema(intermediate, reflect.TypeOf(manifest.Manifest{}), "")
+	mf.sortDiagnostics()
+	if mf.Errors() > 0 {
+		return mf
+	}
+
+	m := &manifest.Manifest{}
+	err = mapstructure.Decode(intermediate, m)
+	if err != nil {
+		// checkSchema should have caught it
+		mf.addf(SeverityError, "", "%s", err.Error())
+		return mf
+	}
+	mf.Manifest = m
+
+	mf.checkActions()
+	for i, p := range m.Prereqs {
+		if p.Name == "" {
+			mf.addf(SeverityError, fmt.Sprintf("prereqs[%d]", i), "prereq is missing a name")
+		}
+	}
+	mf.sortDiagnostics()
+	return mf
+}
+
+// Errors returns the number of error diagnostics
+func (mf *ManifestFile) Errors() int {
+	count := 0
+	for _, d := range mf.Diagnostics {
+		if d.Severity == SeverityError {
+			count++
+		}
+	}
+	return count
+}
+
+// PathMissing returns true if CheckPaths found the path of the i-th
+// action to be missing
+func (mf *ManifestFile) PathMissing(i int) bool {
+	return mf.missing[i]
+}
+
+func (mf *ManifestFile) addf(severity Severity, path string, format string, args ...interface{}) {
+	pos := mf.positions.lookup(path)
+	mf.Diagnostics = append(mf.Diagnostics, &Diagnostic{
+		Severity: severity,
+		Line:     pos.Line,
+		Column:   pos.Column,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// sortDiagnostics orders diagnostics by position, unknown positions last
+func (mf *ManifestFile) sortDiagnostics() {
+	sort.SliceStable(mf.Diagnostics, func(i, j int) bool {
+		a, b := mf.Diagnostics[i], mf.Diagnostics[j]
+		if (a.Line == 0) != (b.Line == 0) {
+			return b.Line == 0
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+}
+
+// checkSchema walks the decoded TOML document alongside the type it'll
+// be decoded into, flagging unknown keys and mismatched types.
+func (mf *ManifestFile) checkSchema(value interface{}, typ reflect.Type, path string) {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	switch typ.Kind() {
+	case reflect.Struct:
+		table, ok := value.(map[string]interface{})
+		if !ok {
+			mf.wrongType(path, "a table", value)
+			return
+		}
+
+		fields := make(map[string]reflect.StructField)
+		var names []string
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			if name == "" {
+				name = strings.ToLower(field.Name)
+			}
+			fields[name] = field
+			names = append(names, name)
+		}
+
+		for _, key := range sortedKeys(table) {
+			// keys are matched case-insensitively when decoding
+			field, ok := fields[strings.ToLower(key)]
+			if !ok {
+				msg := fmt.Sprintf("unknown key (%s)", key)
+				if suggestion := suggest(key, names); suggestion != "" {
+					msg += fmt.Sprintf(", did you mean (%s)?", suggestion)
+				}
+				mf.addf(SeverityWarning, join(path, key), "%s", msg)
+				continue
+			}
+			mf.checkSchema(table[key], field.Type, join(path, key))
+		}
+	case reflect.Slice:
+		var entries []interface{}
+		switch v := value.(type) {
+		case []interface{}:
+			entries = v
+		case []map[string]interface{}:
+			for _, entry := range v {
+				entries = append(entries, entry)
+			}
+		default:
+			mf.wrongType(path, "an array", value)
+			return
+		}
+		for i, entry := range entries {
+			mf.checkSchema(entry, typ.Elem(), fmt.Sprintf("%s[%d]", path, i))
+		}
+	case reflect.Map:
+		table, ok := value.(map[string]interface{})
+		if !ok {
+			mf.wrongType(path, "a table", value)
+			return
+		}
+		for _, key := range sortedKeys(table) {
+			mf.checkSchema(table[key], typ.Elem(), join(path, key))
+		}
+	case reflect.String:
+		if _, ok := value.(string); !ok {
+			mf.wrongType(path, "a string", value)
+		}
+	case reflect.Bool:
+		if _, ok := value.(bool); !ok {
+			mf.wrongType(path, "a boolean", value)
+		}
+	}
+}
+
+func (mf *ManifestFile) wrongType(path string, expected string, value interface{}) {
+	mf.addf(SeverityError, path, "(%s) should be %s, not %s", path, expected, describeType(value))
+}
+
+func describeType(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return "a string"
+	case int64:
+		return "an integer"
+	case float64:
+		return "a float"
+	case bool:
+		return "a boolean"
+	case time.Time:
+		return "a date"
+	case []interface{}, []map[string]interface{}:
+		return "an array"
+	case map[string]interface{}:
+		return "a table"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func sortedKeys(table map[string]interface{}) []string {
+	var keys []string
+	for key := range table {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var platformAliases = map[string]ox.Platform{
+	"win":    ox.PlatformWindows,
+	"win32":  ox.PlatformWindows,
+	"win64":  ox.PlatformWindows,
+	"mac":    ox.PlatformOSX,
+	"macos":  ox.PlatformOSX,
+	"darwin": ox.PlatformOSX,
+}
+
+func (mf *ManifestFile) checkActions() {
+	type seenAction struct {
+		platform ox.Platform
+		path     string
+	}
+	seen := make(map[string][]seenAction)
+
+	for i, action := range mf.Manifest.Actions {
+		actionPath := fmt.Sprintf("actions[%d]", i)
+
+		if action.Name == "" {
+			mf.addf(SeverityError, actionPath, "action is missing a name")
+		}
+		if action.Path == "" {
+			mf.addf(SeverityError, actionPath, "action (%s) is missing a path", action.Name)
+		}
+
+		switch action.Platform {
+		case "", ox.PlatformLinux, ox.PlatformOSX, ox.PlatformWindows:
+		default:
+			msg := fmt.Sprintf("unknown platform (%s), expected one of linux, osx or windows", action.Platform)
+			if alias, ok := platformAliases[strings.ToLower(string(action.Platform))]; ok {
+				msg += fmt.Sprintf(", did you mean (%s)?", alias)
+			}
+			mf.addf(SeverityError, actionPath+".platform", "%s", msg)
+		}
+
+		if action.Name == "" {
+			continue
+		}
+		// the same name may be used once per platform
+		for _, other := range seen[action.Name] {
+			if other.platform == "" || action.Platform == "" || other.platform == action.Platform {
+				pos := mf.positions.lookup(other.path)
+				mf.addf(SeverityError, actionPath+".name", "duplicate action (%s), also defined at line %d", action.Name, pos.Line)
+				break
+			}
+		}
+		seen[action.Name] = append(seen[action.Name], seenAction{
+			platform: action.Platform,
+			path:     actionPath + ".name",
+		})
+	}
+}
+
+// CheckPaths flags actions that run on platform whose path doesn't
+// exist in the build at dir. URLs and absolute paths aren't checked.
+func (mf *ManifestFile) CheckPaths(dir string, platform ox.Platform) {
+	if mf.Manifest == nil {
+		return
+	}
+
+	for i, action := range mf.Manifest.Actions {
+		if !action.RunsOn(platform) || action.Path == "" {
+			continue
+		}
+		if strings.Contains(action.Path, "://") || filepath.IsAbs(action.Path) {
+			continue
+		}
+
+		fullPath := action.ExpandPath(platform, dir)
+		_, err := os.Stat(fullPath)
+		if err != nil && os.IsNotExist(err) {
+			mf.missing[i] = true
+			mf.addf(SeverityError, fmt.Sprintf("actions[%d].path", i), "(%s) doesn't exist in the build for %s", action.Path, platform)
+		}
+	}
+	mf.sortDiagnostics()
+}
+
+// CheckPrereqs flags prereqs that aren't in registry
+func (mf *ManifestFile) CheckPrereqs(registry *redist.RedistRegistry) {
+	if mf.Manifest == nil {
+		return
+	}
+
+	var names []string
+	for name := range registry.Entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for i, p := range mf.Manifest.Prereqs {
+		if p.Name == "" || registry.Entries[p.Name] != nil {
+			continue
+		}
+		msg := fmt.Sprintf("unknown prereq (%s)", p.Name)
+		if suggestion := suggest(p.Name, names); suggestion != "" {
+			msg += fmt.Sprintf(", did you mean (%s)?", suggestion)
+		}
+		mf.addf(SeverityError, fmt.Sprintf("prereqs[%d].name", i), "%s", msg)
+	}
+	mf.sortDiagnostics()
+}
+
+// suggest returns the candidate closest to s, if it's close enough to
+// be a typo, or an empty string.
+func suggest(s string, candidates []string) string {
+	maxDistance := 2
+	if len(s) <= 3 {
+		maxDistance = 1
+	}
+
+	best := ""
+	for _, candidate := range candidates {
+		d := levenshtein(strings.ToLower(s), strings.ToLower(candidate))
+		if d <= maxDistance && d < len(candidate) {
+			best = candidate
+			maxDistance = d - 1
+		}
+	}
+	return best
+}
+
+func levenshtein(a string, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(values ...int) int {
+	res := values[0]
+	for _, v := range values[1:] {
+		if v < res {
+			res = v
+		}
+	}
+	return res
+}
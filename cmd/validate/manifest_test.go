@@ -0,0 +1,135 @@
+package validate_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/itchio/butler/cmd/validate"
+	"github.com/itchio/butler/redist"
+	"github.com/itchio/ox"
+	"github.com/itchio/wharf/wtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func formatAll(mf *validate.ManifestFile) []string {
+	var res []string
+	for _, d := range mf.Diagnostics {
+		res = append(res, d.Format(".itch.toml"))
+	}
+	return res
+}
+
+func TestManifestSchema(t *testing.T) {
+	mf := validate.ParseManifest(".itch.toml", []byte(`# a manifest
+[[actions]]
+name = "play"
+path = "game.exe"
+sandbox = "yes"
+argz = ["--fullscreen"]
+
+[[actions]]
+name = "editor"
+path = "editor.exe"
+args = "--edit"
+
+  [actions.locales.fr]
+  nmae = "Éditeur"
+
+[[prereqs]]
+name = "vcredist-2015-x64"
+`))
+
+	assert.Nil(t, mf.Manifest)
+	assert.EqualValues(t, []string{
+		`.itch.toml:5:1: error: (actions[0].sandbox) should be a boolean, not a string`,
+		`.itch.toml:6:1: warning: unknown key (argz), did you mean (args)?`,
+		`.itch.toml:11:1: error: (actions[1].args) should be an array, not a string`,
+		`.itch.toml:14:3: warning: unknown key (nmae), did you mean (name)?`,
+	}, formatAll(mf))
+	assert.EqualValues(t, 2, mf.Errors())
+
+	mf = validate.ParseManifest(".itch.toml", []byte(`[[actions]]
+name = "play"
+path = "game.exe"
+
+[[actions]
+name = "oops"
+`))
+	assert.Nil(t, mf.Manifest)
+	if assert.Len(t, mf.Diagnostics, 1) {
+		assert.EqualValues(t, 5, mf.Diagnostics[0].Line)
+	}
+}
+
+func TestManifestActions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "validate-tests")
+	wtest.Must(t, err)
+	defer os.RemoveAll(dir)
+	wtest.Must(t, ioutil.WriteFile(filepath.Join(dir, "game.exe"), []byte("MZ"), 0o755))
+
+	mf := validate.ParseManifest(".itch.toml", []byte(`[[actions]]
+name = "play"
+path = "game.exe"
+platform = "windows"
+
+[[actions]]
+name = "play"
+path = "game.x86_64"
+platform = "linux"
+
+[[actions]]
+name = "play"
+pth = "game.exe"
+platform = "macos"
+
+[[actions]]
+name = "manual"
+path = "docs/manual.pdf"
+
+[[actions]]
+name = "website"
+path = "https://example.org"
+
+[[actions]]
+name = "manual"
+path = "MANUAL.txt"
+
+[[prereqs]]
+name = "vcredist-2015-x64"
+
+[[prereqs]]
+name = "dx-june-2010"
+`))
+	if !assert.NotNil(t, mf.Manifest) {
+		return
+	}
+
+	mf.CheckPaths(dir, ox.PlatformWindows)
+	mf.CheckPrereqs(&redist.RedistRegistry{
+		Entries: map[string]*redist.RedistEntry{
+			"vcredist-2015-x64": {},
+			"dx-june-2010":      {},
+			"xna-4.0":           {},
+		},
+	})
+
+	assert.EqualValues(t, []string{
+		`.itch.toml:11:1: error: action (play) is missing a path`,
+		`.itch.toml:13:1: warning: unknown key (pth), did you mean (path)?`,
+		`.itch.toml:14:1: error: unknown platform (macos), expected one of linux, osx or windows, did you mean (osx)?`,
+		`.itch.toml:18:1: error: (docs/manual.pdf) doesn't exist in the build for windows`,
+		`.itch.toml:25:1: error: duplicate action (manual), also defined at line 17`,
+		`.itch.toml:26:1: error: (MANUAL.txt) doesn't exist in the build for windows`,
+	}, formatAll(mf))
+	assert.False(t, mf.PathMissing(0))
+	assert.True(t, mf.PathMissing(3))
+
+	mf.CheckPrereqs(&redist.RedistRegistry{
+		Entries: map[string]*redist.RedistEntry{
+			"vcredist-2015-x64": {},
+		},
+	})
+	assert.Contains(t, formatAll(mf), `.itch.toml:32:1: error: unknown prereq (dx-june-2010)`)
+}
@@ -0,0 +1,317 @@
+package validate
+
+import (
+	"fmt"
+	"strings"
+)
+
+// position is where something is in a manifest, starting at line 1,
+// column 1. A zero line means the position is unknown.
+type position struct {
+	Line   int
+	Column int
+}
+
+// positions maps paths like 'actions[1].locales.fr.name' to where they
+// are defined in a manifest. Tables are in there too.
+type positions map[string]position
+
+// lookup returns the position of path, or of its closest parent
+// if path itself isn't known, for example because it wasn't set.
+func (ps positions) lookup(path string) position {
+	for path != "" {
+		if pos, ok := ps[path]; ok {
+			return pos
+		}
+		cut := strings.LastIndexAny(path, ".[")
+		if cut < 0 {
+			break
+		}
+		path = path[:cut]
+	}
+	return position{}
+}
+
+// scanPositions finds where each key and table of a TOML document is
+// defined. It's not a validating parser: it's only ever run on
+// documents BurntSushi/toml accepted, and gives up quietly otherwise.
+func scanPositions(src string) positions {
+	s := &scanner{
+		src:       src,
+		line:      1,
+		col:       1,
+		ps:        make(positions),
+		arraySize: make(map[string]int),
+	}
+	s.scan()
+	return s.ps
+}
+
+type scanner struct {
+	src  string
+	off  int
+	line int
+	col  int
+
+	ps positions
+	// arraySize counts the entries of each array of tables seen so far
+	arraySize map[string]int
+}
+
+func (s *scanner) eof() bool {
+	return s.off >= len(s.src)
+}
+
+func (s *scanner) peek() byte {
+	if s.eof() {
+		return 0
+	}
+	return s.src[s.off]
+}
+
+func (s *scanner) next() {
+	if s.eof() {
+		return
+	}
+	if s.src[s.off] == '\n' {
+		s.line++
+		s.col = 1
+	} else {
+		s.col++
+	}
+	s.off++
+}
+
+func (s *scanner) pos() position {
+	return position{Line: s.line, Column: s.col}
+}
+
+func (s *scanner) hasPrefix(prefix string) bool {
+	return strings.HasPrefix(s.src[s.off:], prefix)
+}
+
+func (s *scanner) skipSpaces() {
+	for c := s.peek(); c == ' ' || c == '\t'; c = s.peek() {
+		s.next()
+	}
+}
+
+// skipBlank skips whitespace, newlines and comments
+func (s *scanner) skipBlank() {
+	for !s.eof() {
+		switch s.peek() {
+		case ' ', '\t', '\r', '\n':
+			s.next()
+		case '#':
+			s.skipLine()
+		default:
+			return
+		}
+	}
+}
+
+func (s *scanner) skipLine() {
+	for !s.eof() && s.peek() != '\n' {
+		s.next()
+	}
+}
+
+func (s *scanner) scan() {
+	table := ""
+	for {
+		s.skipBlank()
+		if s.eof() {
+			return
+		}
+		start := s.off
+		pos := s.pos()
+
+		switch {
+		case s.hasPrefix("[["):
+			s.next()
+			s.next()
+			path := s.resolve(s.readDottedKey())
+			index := s.arraySize[path]
+			s.arraySize[path]++
+			table = fmt.Sprintf("%s[%d]", path, index)
+			s.ps[table] = pos
+		case s.peek() == '[':
+			s.next()
+			table = s.resolve(s.readDottedKey())
+			s.ps[table] = pos
+		default:
+			key := join(table, s.readDottedKey()...)
+			s.ps[key] = pos
+			s.skipSpaces()
+			if s.peek() == '=' {
+				s.next()
+				s.skipValue(key)
+			}
+		}
+		s.skipLine()
+
+		if s.off == start {
+			// not something we understand, move on
+			s.next()
+		}
+	}
+}
+
+// resolve turns a table header into a path, adding the index of the
+// last entry of any array of tables along the way, so that
+// [actions.locales.fr] becomes actions[2].locales.fr
+func (s *scanner) resolve(keys []string) string {
+	path := ""
+	for i, key := range keys {
+		path = join(path, key)
+		if i < len(keys)-1 {
+			if size := s.arraySize[path]; size > 0 {
+				path = fmt.Sprintf("%s[%d]", path, size-1)
+			}
+		}
+	}
+	return path
+}
+
+func join(prefix string, keys ...string) string {
+	for _, key := range keys {
+		if prefix == "" {
+			prefix = key
+		} else {
+			prefix = prefix + "." + key
+		}
+	}
+	return prefix
+}
+
+func (s *scanner) readDottedKey() []string {
+	var keys []string
+	for {
+		s.skipSpaces()
+		keys = append(keys, s.readKey())
+		s.skipSpaces()
+		if s.peek() != '.' {
+			return keys
+		}
+		s.next()
+	}
+}
+
+func (s *scanner) readKey() string {
+	switch s.peek() {
+	case '"', '\'':
+		start := s.off
+		s.skipString()
+		raw := s.src[start:s.off]
+		if len(raw) >= 2 {
+			// escapes in keys are rare enough not to bother
+			return raw[1 : len(raw)-1]
+		}
+		return raw
+	}
+
+	start := s.off
+	for !s.eof() {
+		c := s.peek()
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' {
+			s.next()
+			continue
+		}
+		break
+	}
+	return s.src[start:s.off]
+}
+
+// skipString skips a basic, literal, or multi-line string
+func (s *scanner) skipString() {
+	quote := s.peek()
+	triple := strings.Repeat(string(quote), 3)
+	if s.hasPrefix(triple) {
+		for i := 0; i < 3; i++ {
+			s.next()
+		}
+		for !s.eof() && !s.hasPrefix(triple) {
+			if quote == '"' && s.peek() == '\\' {
+				s.next()
+			}
+			s.next()
+		}
+		for i := 0; i < 3; i++ {
+			s.next()
+		}
+		// up to two more quotes may be part of the string
+		for s.peek() == quote {
+			s.next()
+		}
+		return
+	}
+
+	s.next()
+	for !s.eof() && s.peek() != quote && s.peek() != '\n' {
+		if quote == '"' && s.peek() == '\\' {
+			s.next()
+		}
+		s.next()
+	}
+	s.next()
+}
+
+// skipValue skips the value of path, recording where the keys of
+// inline tables and the entries of arrays are.
+func (s *scanner) skipValue(path string) {
+	s.skipSpaces()
+	switch s.peek() {
+	case '"', '\'':
+		s.skipString()
+	case '[':
+		s.next()
+		for index := 0; ; index++ {
+			s.skipBlank()
+			if s.eof() || s.peek() == ']' {
+				break
+			}
+			entry := fmt.Sprintf("%s[%d]", path, index)
+			s.ps[entry] = s.pos()
+			before := s.off
+			s.skipValue(entry)
+			s.skipBlank()
+			if s.peek() == ',' {
+				s.next()
+			} else if s.off == before {
+				return
+			}
+		}
+		s.next()
+	case '{':
+		s.next()
+		for {
+			s.skipSpaces()
+			if s.eof() || s.peek() == '}' || s.peek() == '\n' {
+				break
+			}
+			pos := s.pos()
+			key := join(path, s.readDottedKey()...)
+			s.ps[key] = pos
+			s.skipSpaces()
+			if s.peek() != '=' {
+				return
+			}
+			s.next()
+			s.skipValue(key)
+			s.skipSpaces()
+			if s.peek() == ',' {
+				s.next()
+			}
+		}
+		s.next()
+	default:
+		// numbers, booleans and dates end at a separator
+		for !s.eof() {
+			switch s.peek() {
+			case ',', ']', '}', '\n', '#':
+				return
+			}
+			s.next()
+		}
+	}
+}
@@ -3,6 +3,7 @@ package validate
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"strings"
 
@@ -12,14 +13,13 @@ import (
 
 	"github.com/itchio/dash"
 
-	"github.com/mitchellh/mapstructure"
-
-	"github.com/BurntSushi/toml"
-
 	"github.com/itchio/butler/butlerd"
 	"github.com/itchio/butler/comm"
 	"github.com/itchio/butler/endpoints/launch"
+	"github.com/itchio/butler/filtering"
+	"github.com/itchio/butler/html5"
 	"github.com/itchio/butler/mansion"
+	"github.com/itchio/butler/portability"
 	"github.com/itchio/butler/redist"
 	"github.com/itchio/hush/manifest"
 
@@ -28,6 +28,7 @@ import (
 
 	"github.com/itchio/headway/state"
 	"github.com/itchio/headway/united"
+	"github.com/itchio/lake/tlc"
 
 	"github.com/pkg/errors"
 )
@@ -36,13 +37,32 @@ var args = struct {
 	dir      *string
 	platform *string
 	arch     *string
+	strict   *bool
+	report   *string
+	profile  *string
 }{}
 
+// Profiles change which checks are run on the build folder
+const (
+	ProfileDefault = "default"
+	// ProfileHTML5 also checks that the build works in the web player
+	ProfileHTML5 = "html5"
+)
+
+// Report is what --report writes
+type Report struct {
+	Portability *portability.Report `json:"portability"`
+	HTML5       *html5.Report       `json:"html5,omitempty"`
+}
+
 func Register(ctx *mansion.Context) {
 	cmd := ctx.App.Command("validate", "Validate a build folder, including its maniest if any")
 	args.dir = cmd.Arg("dir", "Path of build folder to validate").Required().String()
-	args.platform = cmd.Flag("platform", "Platform to validate for").Enum(string(ox.PlatformLinux), string(ox.PlatformOSX), string(ox.PlatformWindows))
+	args.platform = cmd.Flag("platform", "Platform to validate for. Portability is checked for all platforms if not given").Enum(string(ox.PlatformLinux), string(ox.PlatformOSX), string(ox.PlatformWindows))
 	args.arch = cmd.Flag("arch", "Architecture to validate for").Enum(string(dash.Arch386), string(dash.ArchAmd64))
+	args.strict = cmd.Flag("strict", "Fail on portability warnings, not just errors").Bool()
+	args.report = cmd.Flag("report", "When given, writes a JSON report of portability issues, and HTML5 findings if any, to this path").String()
+	args.profile = cmd.Flag("profile", "Extra checks to run on the build folder: html5 checks that it works in the web player").Default(ProfileDefault).Enum(ProfileDefault, ProfileHTML5)
 	ctx.Register(cmd, doValidate)
 }
 
@@ -104,6 +124,58 @@ func Validate(consumer *state.Consumer) error {
 		showWarning("In manifest-only validation mode. Pass a valid build directory to perform further checks.")
 	}
 
+	finish := func() error {
+		if errorCount > 0 {
+			return fmt.Errorf("Found %d errors.", errorCount)
+		}
+		return nil
+	}
+
+	// problems with the build itself make validate fail even when there's
+	// no manifest, unlike problems found by launch heuristics
+	buildErrorCount := 0
+	if hasDir {
+		container, err := tlc.WalkDir(dir, tlc.WalkOpts{Filter: filtering.FilterPaths})
+		if err != nil {
+			return errors.Wrapf(err, "walking %s", dir)
+		}
+
+		// without --platform, builds are checked for every platform players
+		// may run them on, not just the one validate runs on
+		var platforms []ox.Platform
+		if *args.platform != "" {
+			platforms = []ox.Platform{runtime.Platform}
+		}
+
+		report := &Report{}
+		report.Portability, err = lintBuild(consumer, dir, container, platforms)
+		if err != nil {
+			return err
+		}
+		if report.Portability.Failed(*args.strict) {
+			showError("The build has portability problems (see above)")
+			buildErrorCount++
+		}
+
+		if *args.profile == ProfileHTML5 {
+			report.HTML5, err = checkWeb(consumer, dir, container)
+			if err != nil {
+				return err
+			}
+			if report.HTML5.Failed() {
+				showError("The build won't work in the web player (see above)")
+				buildErrorCount++
+			}
+		}
+
+		if *args.report != "" {
+			err = writeReport(report, *args.report)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
 	printStrategyResult := func(sr *butlerd.StrategyResult) {
 		for _, line := range strings.Split(sr.String(), "\n") {
 			consumer.Infof("    %s", line)
@@ -146,6 +218,9 @@ func Validate(consumer *state.Consumer) error {
 			if err != nil {
 				return errors.Wrap(err, "showing heuristics")
 			}
+			if buildErrorCount > 0 {
+				return fmt.Errorf("Found %d errors.", buildErrorCount)
+			}
 			return nil
 		}
 		return errors.Wrap(err, "stat'ing manifest file")
@@ -153,55 +228,35 @@ func Validate(consumer *state.Consumer) error {
 
 	consumer.Opf("Validating %s manifest at (%s)", united.FormatBytes(stats.Size()), manifestPath)
 
-	var intermediate map[string]interface{}
-	_, err = toml.DecodeFile(manifestPath, &intermediate)
+	contents, err := ioutil.ReadFile(manifestPath)
 	if err != nil {
-		consumer.Errorf("Parse error:")
-		return errors.Wrap(err, "parsing manifest")
+		return errors.Wrap(err, "reading manifest")
 	}
 
-	jsonIntermediate, err := json.MarshalIndent(intermediate, "", "  ")
-	if err != nil {
-		return errors.Wrap(err, "marshalling manifest as json")
+	mf := ParseManifest(manifestPath, contents)
+	if hasDir {
+		mf.CheckPaths(dir, runtime.Platform)
 	}
-	consumer.Debugf("Intermediate:\n%s", string(jsonIntermediate))
 
-	appManifest := &manifest.Manifest{}
-	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
-		Result:      appManifest,
-		ErrorUnused: true,
-	})
-	if err != nil {
-		consumer.Errorf("Internal error:")
-		return errors.Wrap(err, "decoding manifest from json form")
+	var registry *redist.RedistRegistry
+	if mf.Manifest != nil && len(mf.Manifest.Prereqs) > 0 {
+		registry, err = fetchRegistry(consumer)
+		if err != nil {
+			return err
+		}
+		mf.CheckPrereqs(registry)
 	}
 
-	err = decoder.Decode(intermediate)
-	if err != nil {
-		warnOnly := false
-		if mse, ok := err.(*mapstructure.Error); ok {
-			warnOnly = true
-			for _, e := range mse.Errors {
-				if strings.Contains(e, "has invalid keys") {
-					// cool!
-				} else {
-					warnOnly = false
-					break
-				}
-			}
-		}
-
-		if warnOnly {
-			showWarning("%s", err.Error())
-		} else {
-			consumer.Errorf("Decoding error:")
-			return errors.Wrap(err, "decoding manifest")
+	for _, d := range mf.Diagnostics {
+		if d.Severity == SeverityError {
+			errorCount++
 		}
+		consumer.Infof("%s", d.Format(manifestPath))
 	}
 
-	_, err = toml.DecodeFile(manifestPath, appManifest)
-	if err != nil {
-		return errors.Wrap(err, "parsing toml manifest")
+	appManifest := mf.Manifest
+	if appManifest == nil {
+		return finish()
 	}
 
 	jsonManifest, err := json.MarshalIndent(appManifest, "", "  ")
@@ -214,7 +269,7 @@ func Validate(consumer *state.Consumer) error {
 	consumer.Infof("")
 	if len(appManifest.Actions) > 0 {
 		consumer.Statf("Validating %d actions...", len(appManifest.Actions))
-		for _, action := range appManifest.Actions {
+		for i, action := range appManifest.Actions {
 			consumer.Infof("")
 			consumer.Infof("  → Action '%s' (%s)", action.Name, action.Path)
 			if action.Platform != "" {
@@ -225,8 +280,6 @@ func Validate(consumer *state.Consumer) error {
 					consumer.Infof("    Only for macOS")
 				case ox.PlatformWindows:
 					consumer.Infof("    Only for Windows")
-				default:
-					showError("Unknown platform specified: (%s)", action.Platform)
 				}
 			}
 			if action.Scope != "" {
@@ -241,7 +294,7 @@ func Validate(consumer *state.Consumer) error {
 			if len(action.Args) > 0 {
 				consumer.Infof("    Passes arguments: %s", strings.Join(action.Args, " ::: "))
 			}
-			if hasDir {
+			if hasDir && !mf.PathMissing(i) {
 				target, err := launch.ActionToLaunchTarget(consumer, host, dir, action)
 				if err != nil {
 					showError(err.Error())
@@ -263,21 +316,10 @@ func Validate(consumer *state.Consumer) error {
 		consumer.Statf("Validating %d prereqs...", len(appManifest.Prereqs))
 		consumer.Infof("")
 
-		regFile, err := eos.Open("https://broth.itch.ovh/itch-redists/info/LATEST/unpacked", option.WithConsumer(consumer))
-		if err != nil {
-			return errors.Wrap(err, "opening prereqs registry")
-		}
-
-		reg := &redist.RedistRegistry{}
-		err = json.NewDecoder(regFile).Decode(reg)
-		if err != nil {
-			return errors.Wrap(err, "decoding prereqs registry")
-		}
-
 		for _, p := range appManifest.Prereqs {
-			entry := reg.Entries[p.Name]
+			entry := registry.Entries[p.Name]
 			if entry == nil {
-				showError("Unknown prerequisite listed: %s", p.Name)
+				// already reported above
 				continue
 			}
 			consumer.Infof("  → %s (%s)", entry.FullName, p.Name)
@@ -303,9 +345,20 @@ func Validate(consumer *state.Consumer) error {
 		consumer.Infof("Visit https://itch.io/docs/itch/integrating/manifest.html for more information.")
 	}
 
-	if errorCount > 0 {
-		return fmt.Errorf("Found %d errors.", errorCount)
+	return finish()
+}
+
+func fetchRegistry(consumer *state.Consumer) (*redist.RedistRegistry, error) {
+	regFile, err := eos.Open("https://broth.itch.ovh/itch-redists/info/LATEST/unpacked", option.WithConsumer(consumer))
+	if err != nil {
+		return nil, errors.Wrap(err, "opening prereqs registry")
 	}
+	defer regFile.Close()
 
-	return nil
+	reg := &redist.RedistRegistry{}
+	err = json.NewDecoder(regFile).Decode(reg)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding prereqs registry")
+	}
+	return reg, nil
 }
@@ -0,0 +1,412 @@
+package verify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/itchio/butler/cmd/ls"
+	"github.com/itchio/butler/comm"
+	"github.com/itchio/butler/filtering"
+	"github.com/itchio/butler/healing"
+	"github.com/itchio/headway/united"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/wharf/pwr"
+	"github.com/pkg/errors"
+)
+
+// EntryStatus is what's wrong with an entry of the verified directory
+type EntryStatus string
+
+const (
+	// EntryDamaged entries exist, but don't match the signature
+	EntryDamaged EntryStatus = "damaged"
+	// EntryMissing entries are in the signature, but not on disk
+	EntryMissing EntryStatus = "missing"
+	// EntryExtra entries are on disk, but not in the signature
+	EntryExtra EntryStatus = "extra"
+)
+
+// HealStatus is what healing did to an entry
+type HealStatus string
+
+const (
+	// HealHealed entries matched the signature after healing
+	HealHealed HealStatus = "healed"
+	// HealFailed entries still didn't match the signature after healing
+	HealFailed HealStatus = "failed"
+)
+
+// Report lists everything that's wrong with a directory, compared to
+// a signature, and what healing did about it
+type Report struct {
+	Dir string `json:"dir"`
+	// OK is true if nothing is damaged or missing, or if healing
+	// fixed all of it. Extra files don't count.
+	OK bool `json:"ok"`
+
+	TotalCorrupted int64 `json:"totalCorrupted"`
+	TotalHealed    int64 `json:"totalHealed"`
+	// HealedFrom is how many bytes were healed from each heal source
+	HealedFrom map[string]int64 `json:"healedFrom,omitempty"`
+
+	Entries []*EntryReport `json:"entries"`
+	// Excluded lists files left out of the verification
+	Excluded []string `json:"excluded,omitempty"`
+}
+
+// EntryReport is a single damaged, missing or extra file, directory
+// or symlink
+type EntryReport struct {
+	Path string `json:"path"`
+	// Type is one of "file", "dir" or "symlink"
+	Type   string      `json:"type"`
+	Status EntryStatus `json:"status"`
+
+	// ExpectedSize is the size of the file in the signature
+	ExpectedSize int64 `json:"expectedSize"`
+	// ActualSize is the size of the file on disk, before healing
+	ActualSize int64 `json:"actualSize"`
+	// Wounds are the byte ranges of the file that don't match
+	Wounds []*WoundedRange `json:"wounds,omitempty"`
+
+	// Heal is only set if healing was attempted
+	Heal HealStatus `json:"heal,omitempty"`
+}
+
+// WoundedRange is a range of bytes of a file that doesn't match
+// the signature
+type WoundedRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// BuildReport describes the wounds found when verifying dir, and looks
+// for extra files, which are walked with filter.
+func BuildReport(dir string, wounds *ls.Wounds, container *tlc.Container, filter tlc.FilterFunc) (*Report, error) {
+	report := &Report{
+		Dir:     dir,
+		Entries: []*EntryReport{},
+	}
+
+	if wounds != nil {
+		entries := make(map[string]*EntryReport)
+		for _, wound := range wounds.Wounds {
+			if wound.Healthy() {
+				continue
+			}
+			report.TotalCorrupted += wound.Size()
+
+			entry, err := woundedEntry(wound, wounds.Container)
+			if err != nil {
+				return nil, err
+			}
+			if existing, ok := entries[entry.Path]; ok {
+				entry = existing
+			} else {
+				entries[entry.Path] = entry
+				report.Entries = append(report.Entries, entry)
+				entry.ActualSize, entry.Status = inspect(filepath.Join(dir, filepath.FromSlash(entry.Path)))
+			}
+
+			if wound.Kind == pwr.WoundKind_FILE {
+				entry.Wounds = append(entry.Wounds, &WoundedRange{
+					Start: wound.Start,
+					End:   wound.End,
+				})
+			}
+		}
+	}
+
+	extras, err := findExtras(dir, container, filter)
+	if err != nil {
+		return nil, err
+	}
+	report.Entries = append(report.Entries, extras...)
+
+	sort.SliceStable(report.Entries, func(i, j int) bool {
+		return report.Entries[i].Path < report.Entries[j].Path
+	})
+	report.OK = !report.hasDamage()
+	return report, nil
+}
+
+func woundedEntry(wound *pwr.Wound, container *tlc.Container) (*EntryReport, error) {
+	switch wound.Kind {
+	case pwr.WoundKind_FILE:
+		if wound.Index < int64(len(container.Files)) {
+			f := container.Files[wound.Index]
+			return &EntryReport{Path: f.Path, Type: "file", ExpectedSize: f.Size}, nil
+		}
+	case pwr.WoundKind_DIR:
+		if wound.Index < int64(len(container.Dirs)) {
+			return &EntryReport{Path: container.Dirs[wound.Index].Path, Type: "dir"}, nil
+		}
+	case pwr.WoundKind_SYMLINK:
+		if wound.Index < int64(len(container.Symlinks)) {
+			return &EntryReport{Path: container.Symlinks[wound.Index].Path, Type: "symlink"}, nil
+		}
+	}
+	return nil, errors.Errorf("invalid wound (kind %d, index %d)", wound.Kind, wound.Index)
+}
+
+// inspect tells apart entries that are missing from those that are
+// there, but damaged
+func inspect(path string) (int64, EntryStatus) {
+	stats, err := os.Lstat(path)
+	if err != nil {
+		return 0, EntryMissing
+	}
+	if stats.Mode().IsRegular() {
+		return stats.Size(), EntryDamaged
+	}
+	return 0, EntryDamaged
+}
+
+// findExtras lists files and symlinks that are on disk, but not in
+// the container
+func findExtras(dir string, container *tlc.Container, filter tlc.FilterFunc) ([]*EntryReport, error) {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	actual, err := tlc.WalkDir(dir, tlc.WalkOpts{Filter: filter})
+	if err != nil {
+		return nil, errors.Wrap(err, "walking directory to find extra files")
+	}
+
+	expected := make(map[string]bool)
+	for _, f := range container.Files {
+		expected[f.Path] = true
+	}
+	for _, s := range container.Symlinks {
+		expected[s.Path] = true
+	}
+
+	var extras []*EntryReport
+	for _, f := range actual.Files {
+		if !expected[f.Path] {
+			extras = append(extras, &EntryReport{
+				Path:       f.Path,
+				Type:       "file",
+				Status:     EntryExtra,
+				ActualSize: f.Size,
+			})
+		}
+	}
+	for _, s := range actual.Symlinks {
+		if !expected[s.Path] {
+			extras = append(extras, &EntryReport{
+				Path:   s.Path,
+				Type:   "symlink",
+				Status: EntryExtra,
+			})
+		}
+	}
+	return extras, nil
+}
+
+func (r *Report) hasDamage() bool {
+	for _, entry := range r.Entries {
+		if entry.Status != EntryExtra && entry.Heal != HealHealed {
+			return true
+		}
+	}
+	return false
+}
+
+// doReport verifies through a wounds file, so it can be turned into a
+// report, then heals from that same wounds file if asked to.
+func doReport(args Args, signature *pwr.SignatureInfo, excluded []string) (*Report, error) {
+	tempDir, err := ioutil.TempDir("", "butler-verify")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	woundsPath := args.WoundsPath
+	if woundsPath == "" {
+		woundsPath = filepath.Join(tempDir, "wounds.pww")
+	}
+
+	if len(args.HealSpecs) > 0 {
+		// healers can deal with "everything missing"
+		err = os.MkdirAll(args.Dir, 0o755)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	comm.StartProgressWithTotalBytes(signature.Container.Size)
+	wounds, err := validate(args.Dir, signature, woundsPath)
+	comm.EndProgress()
+	if err != nil {
+		return nil, err
+	}
+
+	filter := filtering.FilterPaths
+	if args.Filter != nil {
+		filter = func(name string) tlc.FilterResult {
+			if args.Filter(name) == tlc.FilterIgnore {
+				return tlc.FilterIgnore
+			}
+			return filtering.FilterPaths(name)
+		}
+	}
+
+	report, err := BuildReport(args.Dir, wounds, signature.Container, filter)
+	if err != nil {
+		return nil, err
+	}
+	report.Excluded = excluded
+
+	if len(args.HealSpecs) > 0 && wounds != nil {
+		err = heal(args, signature, wounds, report, filepath.Join(tempDir, "remaining.pww"))
+		if err != nil {
+			return nil, err
+		}
+		report.OK = !report.hasDamage()
+	}
+
+	return report, nil
+}
+
+// validate checks dir against signature, and returns the wounds found,
+// or nil if there were none
+func validate(dir string, signature *pwr.SignatureInfo, woundsPath string) (*ls.Wounds, error) {
+	// wounds files are only created when there's a wound
+	os.Remove(woundsPath)
+
+	vc := &pwr.ValidatorContext{
+		Consumer:   comm.NewStateConsumer(),
+		WoundsPath: woundsPath,
+	}
+	err := vc.Validate(context.Background(), dir, signature)
+	if err != nil {
+		return nil, errors.Wrap(err, "while validating")
+	}
+
+	if !vc.WoundsConsumer.HasWounds() {
+		return nil, nil
+	}
+	return ls.ReadWounds(woundsPath)
+}
+
+// heal repairs the wounded entries of the report, then checks them
+// again to find out which ones were actually healed
+func heal(args Args, signature *pwr.SignatureInfo, wounds *ls.Wounds, report *Report, remainingPath string) error {
+	wounded := make(map[string]*EntryReport)
+	for _, entry := range report.Entries {
+		if entry.Status != EntryExtra {
+			wounded[entry.Path] = entry
+		}
+	}
+	comm.Opf("Healing %d entries", len(wounded))
+
+	healer, err := healing.New(args.HealSpecs, args.Dir, signature)
+	if err != nil {
+		return errors.Wrap(err, "creating healer")
+	}
+	healer.SetConsumer(comm.NewStateConsumer())
+
+	woundsChan := make(chan *pwr.Wound, len(wounds.Wounds))
+	for _, wound := range wounds.Wounds {
+		woundsChan <- wound
+	}
+	close(woundsChan)
+
+	comm.StartProgress()
+	err = healer.Do(context.Background(), wounds.Container, woundsChan)
+	comm.EndProgress()
+	if err != nil {
+		return errors.Wrap(err, "healing")
+	}
+	report.TotalHealed = healer.TotalHealed()
+	report.HealedFrom = healer.HealedFrom
+
+	healedSignature, _, err := filtering.SelectSignature(signature, func(entryPath string) bool {
+		return wounded[entryPath] != nil
+	})
+	if err != nil {
+		return err
+	}
+
+	remaining, err := validate(args.Dir, healedSignature, remainingPath)
+	if err != nil {
+		return errors.Wrap(err, "checking healed files")
+	}
+
+	stillWounded := make(map[string]bool)
+	if remaining != nil {
+		for _, wound := range remaining.Wounds {
+			if wound.Healthy() {
+				continue
+			}
+			entry, err := woundedEntry(wound, remaining.Container)
+			if err != nil {
+				return err
+			}
+			stillWounded[entry.Path] = true
+		}
+	}
+
+	for path, entry := range wounded {
+		if stillWounded[path] {
+			entry.Heal = HealFailed
+		} else {
+			entry.Heal = HealHealed
+		}
+	}
+	return nil
+}
+
+// writeReport writes the report as JSON to path
+func writeReport(report *Report, path string) error {
+	contents, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = ioutil.WriteFile(path, contents, 0o644)
+	if err != nil {
+		return errors.Wrap(err, "writing report")
+	}
+	return nil
+}
+
+func printReport(report *Report) {
+	if len(report.Entries) == 0 {
+		return
+	}
+
+	for _, entry := range report.Entries {
+		details := ""
+		if entry.Type == "file" {
+			switch entry.Status {
+			case EntryDamaged:
+				details = fmt.Sprintf(" (%s on disk, expected %s, %d wounds)",
+					united.FormatBytes(entry.ActualSize), united.FormatBytes(entry.ExpectedSize), len(entry.Wounds))
+			case EntryExtra:
+				details = fmt.Sprintf(" (%s)", united.FormatBytes(entry.ActualSize))
+			}
+		}
+		if entry.Heal != "" {
+			details += ", " + string(entry.Heal)
+		}
+		comm.Logf("  %-8s %s%s", entry.Status, entry.Path, details)
+	}
+
+	var specs []string
+	for spec := range report.HealedFrom {
+		specs = append(specs, spec)
+	}
+	sort.Strings(specs)
+	for _, spec := range specs {
+		comm.Logf("%s healed from %s", united.FormatBytes(report.HealedFrom[spec]), spec)
+	}
+	comm.Logf("")
+}
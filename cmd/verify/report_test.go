@@ -0,0 +1,79 @@
+package verify_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/itchio/butler/cmd/ls"
+	"github.com/itchio/butler/cmd/verify"
+	"github.com/itchio/butler/filtering"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/wtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify-tests")
+	wtest.Must(t, err)
+	defer os.RemoveAll(dir)
+
+	wtest.Must(t, os.MkdirAll(filepath.Join(dir, ".itch"), 0o755))
+	wtest.Must(t, ioutil.WriteFile(filepath.Join(dir, "game.exe"), []byte("truncated"), 0o644))
+	wtest.Must(t, ioutil.WriteFile(filepath.Join(dir, "extra.txt"), []byte("surprise"), 0o644))
+	wtest.Must(t, ioutil.WriteFile(filepath.Join(dir, ".itch", "receipt.json.gz"), []byte("ignored"), 0o644))
+
+	container := &tlc.Container{
+		Files: []*tlc.File{
+			{Path: "game.exe", Size: 100},
+			{Path: "data.pak", Size: 50, Offset: 100},
+		},
+		Size: 150,
+	}
+
+	wounds := &ls.Wounds{
+		Container: container,
+		Wounds: []*pwr.Wound{
+			{Kind: pwr.WoundKind_FILE, Index: 0, Start: 9, End: 64},
+			{Kind: pwr.WoundKind_FILE, Index: 0, Start: 64, End: 100},
+			{Kind: pwr.WoundKind_FILE, Index: 1, Start: 0, End: 50},
+		},
+	}
+
+	report, err := verify.BuildReport(dir, wounds, container, filtering.FilterPaths)
+	wtest.Must(t, err)
+	assert.False(t, report.OK)
+	assert.EqualValues(t, 141, report.TotalCorrupted)
+	assert.Len(t, report.Entries, 3)
+
+	missing := report.Entries[0]
+	assert.EqualValues(t, "data.pak", missing.Path)
+	assert.EqualValues(t, verify.EntryMissing, missing.Status)
+	assert.EqualValues(t, 50, missing.ExpectedSize)
+
+	extra := report.Entries[1]
+	assert.EqualValues(t, "extra.txt", extra.Path)
+	assert.EqualValues(t, verify.EntryExtra, extra.Status)
+	assert.EqualValues(t, 8, extra.ActualSize)
+
+	damaged := report.Entries[2]
+	assert.EqualValues(t, "game.exe", damaged.Path)
+	assert.EqualValues(t, verify.EntryDamaged, damaged.Status)
+	assert.EqualValues(t, 100, damaged.ExpectedSize)
+	assert.EqualValues(t, 9, damaged.ActualSize)
+	assert.EqualValues(t, []*verify.WoundedRange{{Start: 9, End: 64}, {Start: 64, End: 100}}, damaged.Wounds)
+
+	// extra files alone don't make a directory damaged
+	report, err = verify.BuildReport(dir, nil, container, filtering.FilterPaths)
+	wtest.Must(t, err)
+	assert.True(t, report.OK)
+	assert.Len(t, report.Entries, 1)
+
+	_, err = verify.BuildReport(dir, &ls.Wounds{
+		Container: container,
+		Wounds:    []*pwr.Wound{{Kind: pwr.WoundKind_FILE, Index: 7}},
+	}, container, filtering.FilterPaths)
+	assert.Error(t, err)
+}
@@ -2,14 +2,17 @@ package verify
 
 import (
 	"context"
+	"strings"
 	"time"
 
 	"github.com/itchio/butler/comm"
+	"github.com/itchio/butler/filtering"
 	"github.com/itchio/butler/mansion"
 
 	"github.com/itchio/headway/united"
 
 	"github.com/itchio/httpkit/eos"
+	"github.com/itchio/lake/tlc"
 	"github.com/itchio/savior/seeksource"
 
 	"github.com/itchio/wharf/pwr"
@@ -20,33 +23,50 @@ type Args struct {
 	SignaturePath string
 	Dir           string
 	WoundsPath    string
-	HealPath      string
+	// HealSpecs are where to heal wounds from, like "archive,build.zip"
+	// or "dir,../old-install". See the healing package.
+	HealSpecs []string
+	// Filter leaves files out of the verification when set. Excluded
+	// files are reported separately instead of as wounds.
+	Filter tlc.FilterFunc
+	// ReportPath is where to write a JSON report of damaged, missing
+	// and extra files, if set. The report is also printed as a result
+	// when --json is given.
+	ReportPath string
 }
 
 var args = Args{}
+var filterFlags filtering.Flags
 
 func Register(ctx *mansion.Context) {
 	cmd := ctx.App.Command("verify", "(Advanced) Use a signature to verify the integrity of a directory")
 	cmd.Arg("signature", "Path to read signature file from").Required().StringVar(&args.SignaturePath)
 	cmd.Arg("dir", "Path of directory to verify").Required().StringVar(&args.Dir)
 	cmd.Flag("wounds", "When given, writes wounds to this path").StringVar(&args.WoundsPath)
-	cmd.Flag("heal", "When given, heal wounds using this path").StringVar(&args.HealPath)
+	cmd.Flag("heal", "When given, heal wounds from this source, like archive,build.zip or dir,../other-install (may be specified multiple times)").StringsVar(&args.HealSpecs)
+	cmd.Flag("report", "When given, writes a JSON report of damaged, missing and extra files to this path").StringVar(&args.ReportPath)
+	filterFlags.Register(cmd)
 	ctx.Register(cmd, do)
 }
 
 func do(ctx *mansion.Context) {
+	if !filterFlags.IsEmpty() {
+		filter, err := filterFlags.Filter(nil)
+		ctx.Must(err)
+		args.Filter = filter
+	}
 	ctx.Must(Do(args))
 }
 
 func Do(args Args) error {
 	if args.WoundsPath == "" {
-		if args.HealPath == "" {
+		if len(args.HealSpecs) == 0 {
 			comm.Opf("Verifying %s", args.Dir)
 		} else {
 			comm.Opf("Verifying %s, healing as we go", args.Dir)
 		}
 	} else {
-		if args.HealPath == "" {
+		if len(args.HealSpecs) == 0 {
 			comm.Opf("Verifying %s, writing wounds to %s", args.Dir, args.WoundsPath)
 		} else {
 			comm.Dief("Options --wounds and --heal cannot be used at the same time")
@@ -72,10 +92,22 @@ func Do(args Args) error {
 		return errors.Wrap(err, "reading signature file")
 	}
 
+	var excluded []string
+	if args.Filter != nil {
+		signature, excluded, err = filtering.FilterSignature(signature, args.Filter)
+		if err != nil {
+			return errors.Wrap(err, "filtering signature")
+		}
+	}
+
+	if args.ReportPath != "" || comm.JsonEnabled() || needsHealer(args.HealSpecs) {
+		return doWithReport(args, signature, excluded, startTime)
+	}
+
 	vc := &pwr.ValidatorContext{
 		Consumer:   comm.NewStateConsumer(),
 		WoundsPath: args.WoundsPath,
-		HealPath:   args.HealPath,
+		HealPath:   healPath(args.HealSpecs),
 	}
 
 	comm.StartProgressWithTotalBytes(signature.Container.Size)
@@ -90,6 +122,13 @@ func Do(args Args) error {
 	perSecond := united.FormatBPS(signature.Container.Size, time.Since(startTime))
 	comm.Statf("%s @ %s\n", signature.Container, perSecond)
 
+	if len(excluded) > 0 {
+		comm.Logf("%d files excluded from verification:", len(excluded))
+		for _, path := range excluded {
+			comm.Logf("  - %s", path)
+		}
+	}
+
 	if vc.WoundsConsumer.HasWounds() {
 		if healer, ok := vc.WoundsConsumer.(pwr.Healer); ok {
 			comm.Statf("%s corrupted data found, %s healed", united.FormatBytes(vc.WoundsConsumer.TotalCorrupted()), united.FormatBytes(healer.TotalHealed()))
@@ -100,3 +139,47 @@ func Do(args Args) error {
 
 	return nil
 }
+
+func doWithReport(args Args, signature *pwr.SignatureInfo, excluded []string, startTime time.Time) error {
+	report, err := doReport(args, signature, excluded)
+	if err != nil {
+		return err
+	}
+
+	if args.ReportPath != "" {
+		err = writeReport(report, args.ReportPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	comm.ResultOrPrint(report, func() {
+		perSecond := united.FormatBPS(signature.Container.Size, time.Since(startTime))
+		comm.Statf("%s @ %s\n", signature.Container, perSecond)
+		printReport(report)
+		if args.ReportPath != "" {
+			comm.Logf("Report written to %s", args.ReportPath)
+		}
+	})
+
+	if !report.OK {
+		if len(args.HealSpecs) > 0 {
+			return errors.Errorf("%s corrupted data found, some of it couldn't be healed", united.FormatBytes(report.TotalCorrupted))
+		}
+		return errors.Errorf("%s corrupted data found", united.FormatBytes(report.TotalCorrupted))
+	}
+	return nil
+}
+
+// needsHealer returns true if healing from specs takes more than
+// wharf's healers, which only heal from a single archive
+func needsHealer(specs []string) bool {
+	return len(specs) > 1 || (len(specs) == 1 && !strings.HasPrefix(specs[0], "archive,"))
+}
+
+func healPath(specs []string) string {
+	if len(specs) == 0 {
+		return ""
+	}
+	return specs[0]
+}
@@ -4,6 +4,7 @@ import (
 	"time"
 
 	"github.com/itchio/butler/comm"
+	"github.com/itchio/butler/filtering"
 	"github.com/itchio/butler/mansion"
 	"github.com/itchio/headway/united"
 	"github.com/itchio/lake/tlc"
@@ -13,24 +14,31 @@ import (
 var args = struct {
 	dir         *string
 	dereference *bool
+	filter      filtering.Flags
 }{}
 
 func Register(ctx *mansion.Context) {
 	cmd := ctx.App.Command("walk", "Finds all files in a directory").Hidden()
 	args.dir = cmd.Arg("dir", "A dir you want to walk").Required().String()
 	args.dereference = cmd.Flag("dereference", "Follow symlinks").Default("false").Bool()
+	args.filter.Register(cmd)
 	ctx.Register(cmd, do)
 }
 
 func do(ctx *mansion.Context) {
-	ctx.Must(Do(*args.dir, *args.dereference))
+	// walk doesn't leave anything out unless asked to
+	filter, err := args.filter.Filter(nil)
+	ctx.Must(err)
+
+	ctx.Must(Do(*args.dir, *args.dereference, filter))
 }
 
-func Do(dir string, dereference bool) error {
+func Do(dir string, dereference bool, filter tlc.FilterFunc) error {
 	startTime := time.Now()
 
 	container, err := tlc.WalkDir(dir, tlc.WalkOpts{
 		Dereference: dereference,
+		Filter:      filter,
 	})
 	if err != nil {
 		return errors.Wrap(err, "walking")
@@ -3,6 +3,7 @@ package main
 import (
 	"github.com/itchio/butler/cmd/apply"
 	"github.com/itchio/butler/cmd/auditzip"
+	"github.com/itchio/butler/cmd/builds"
 	"github.com/itchio/butler/cmd/clean"
 	"github.com/itchio/butler/cmd/configure"
 	"github.com/itchio/butler/cmd/cp"
@@ -22,6 +23,7 @@ import (
 	"github.com/itchio/butler/cmd/login"
 	"github.com/itchio/butler/cmd/logout"
 	"github.com/itchio/butler/cmd/ls"
+	"github.com/itchio/butler/cmd/machoprops"
 	"github.com/itchio/butler/cmd/mkdir"
 	"github.com/itchio/butler/cmd/mkzip"
 	"github.com/itchio/butler/cmd/msi"
@@ -32,10 +34,12 @@ import (
 	"github.com/itchio/butler/cmd/ratetest"
 	"github.com/itchio/butler/cmd/rediff"
 	"github.com/itchio/butler/cmd/repack"
+	"github.com/itchio/butler/cmd/rollback"
 	"github.com/itchio/butler/cmd/run"
 	"github.com/itchio/butler/cmd/sign"
 	"github.com/itchio/butler/cmd/singlediff"
 	"github.com/itchio/butler/cmd/sizeof"
+	"github.com/itchio/butler/cmd/squash"
 	"github.com/itchio/butler/cmd/status"
 	"github.com/itchio/butler/cmd/unsz"
 	"github.com/itchio/butler/cmd/untar"
@@ -61,6 +65,8 @@ func registerCommands(ctx *mansion.Context) {
 	push.Register(ctx)
 	fetch.Register(ctx)
 	status.Register(ctx)
+	builds.Register(ctx)
+	rollback.Register(ctx)
 
 	file.Register(ctx)
 	ls.Register(ctx)
@@ -105,6 +111,7 @@ func registerCommands(ctx *mansion.Context) {
 
 	exeprops.Register(ctx)
 	elfprops.Register(ctx)
+	machoprops.Register(ctx)
 
 	configure.Register(ctx)
 
@@ -115,6 +122,7 @@ func registerCommands(ctx *mansion.Context) {
 
 	singlediff.Register(ctx)
 	rediff.Register(ctx)
+	squash.Register(ctx)
 	mkzip.Register(ctx)
 
 	ratetest.Register(ctx)
@@ -4,5 +4,10 @@ import (
 	_ "github.com/itchio/wharf/compressors/cbrotli"
 	_ "github.com/itchio/wharf/decompressors/cbrotli"
 
+	_ "github.com/itchio/wharf/compressors/gzip"
+	_ "github.com/itchio/wharf/decompressors/gzip"
+
+	_ "github.com/itchio/butler/zstdsupport"
+
 	_ "github.com/itchio/boar/lzmasupport"
 )
@@ -9,6 +9,7 @@ import (
 
 	"github.com/itchio/butler/butlerd"
 	"github.com/itchio/butler/filtering"
+	"github.com/itchio/butler/machoinfo"
 	"github.com/itchio/butler/manager"
 	"github.com/itchio/dash"
 	"github.com/itchio/headway/state"
@@ -61,6 +62,14 @@ func ActionToLaunchTarget(consumer *state.Consumer, host manager.Host, installFo
 		// is it an app bundle?
 		if host.Runtime.Platform == ox.PlatformOSX && strings.HasSuffix(strings.ToLower(fullPath), ".app") {
 			consumer.Infof("(%s) is an app bundle, picking native strategy", fullPath)
+			bundle, err := machoinfo.ProbeBundle(fullPath, machoinfo.ProbeParams{Consumer: consumer})
+			if err != nil {
+				consumer.Warnf("Could not inspect app bundle: %v", err)
+			} else if bundle.ExecutableInfo != nil {
+				consumer.Infof("Its main executable (%s) is for %v", bundle.Executable, bundle.ExecutableInfo.Archs())
+			} else {
+				consumer.Warnf("Its main executable (%s) can't be inspected: %s", bundle.Executable, bundle.ExecutableError)
+			}
 			target.Strategy = &butlerd.StrategyResult{
 				Strategy:       butlerd.LaunchStrategyNative,
 				FullTargetPath: fullPath,
@@ -2,8 +2,12 @@ package filtering
 
 import (
 	"path/filepath"
+	"strings"
 
 	"github.com/itchio/lake/tlc"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/wsync"
+	"github.com/pkg/errors"
 )
 
 var CustomIgnorePatterns = []string{}
@@ -25,3 +29,121 @@ var FilterPaths tlc.FilterFunc = func(name string) tlc.FilterResult {
 	return tlc.FilterKeep
 }
 
+// PatternFilter returns a filter that ignores any entry whose name
+// matches one of the given glob patterns
+func PatternFilter(patterns []string) tlc.FilterFunc {
+	return func(name string) tlc.FilterResult {
+		for _, pattern := range patterns {
+			match, _ := filepath.Match(pattern, name)
+			if match {
+				return tlc.FilterIgnore
+			}
+		}
+		return tlc.FilterKeep
+	}
+}
+
+// FilterContainer returns a copy of container without the entries that
+// filter ignores. Just like when walking, when a directory is ignored,
+// all its children are, too.
+func FilterContainer(container *tlc.Container, filter tlc.FilterFunc) *tlc.Container {
+	return SelectContainer(container, func(entryPath string) bool {
+		return !IsIgnored(filter, entryPath)
+	})
+}
+
+// SelectContainer returns a copy of container with only the entries
+// whose path keep returns true for
+func SelectContainer(container *tlc.Container, keep func(entryPath string) bool) *tlc.Container {
+	res := &tlc.Container{}
+	for _, d := range container.Dirs {
+		if keep(d.Path) {
+			res.Dirs = append(res.Dirs, d)
+		}
+	}
+	for _, s := range container.Symlinks {
+		if keep(s.Path) {
+			res.Symlinks = append(res.Symlinks, s)
+		}
+	}
+	for _, f := range container.Files {
+		if keep(f.Path) {
+			res.Files = append(res.Files, &tlc.File{
+				Path:   f.Path,
+				Mode:   f.Mode,
+				Size:   f.Size,
+				Offset: res.Size,
+			})
+			res.Size += f.Size
+		}
+	}
+	return res
+}
+
+// IsIgnored returns true if filter ignores any component of a
+// slash-separated path
+func IsIgnored(filter tlc.FilterFunc, entryPath string) bool {
+	for _, name := range strings.Split(entryPath, "/") {
+		if filter(name) == tlc.FilterIgnore {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterSignature returns a copy of sig without the entries that filter
+// ignores, along with the paths of the files and symlinks that were
+// left out.
+func FilterSignature(sig *pwr.SignatureInfo, filter tlc.FilterFunc) (*pwr.SignatureInfo, []string, error) {
+	return SelectSignature(sig, func(entryPath string) bool {
+		return !IsIgnored(filter, entryPath)
+	})
+}
+
+// SelectSignature returns a copy of sig with only the entries whose path
+// keep returns true for, along with the paths of the files and symlinks
+// that were left out.
+func SelectSignature(sig *pwr.SignatureInfo, keep func(entryPath string) bool) (*pwr.SignatureInfo, []string, error) {
+	res := &pwr.SignatureInfo{
+		Container: SelectContainer(sig.Container, keep),
+	}
+
+	var excluded []string
+	var hashIndex int64
+	var fileIndex int64
+	for _, f := range sig.Container.Files {
+		// empty files still have one (empty) hash
+		numBlocks := pwr.ComputeNumBlocks(f.Size)
+		if numBlocks == 0 {
+			numBlocks = 1
+		}
+		if hashIndex+numBlocks > int64(len(sig.Hashes)) {
+			return nil, nil, errors.Errorf("signature is missing hashes for %s", f.Path)
+		}
+		hashes := sig.Hashes[hashIndex : hashIndex+numBlocks]
+		hashIndex += numBlocks
+
+		if !keep(f.Path) {
+			excluded = append(excluded, f.Path)
+			continue
+		}
+
+		for _, h := range hashes {
+			res.Hashes = append(res.Hashes, wsync.BlockHash{
+				FileIndex:  fileIndex,
+				BlockIndex: h.BlockIndex,
+				WeakHash:   h.WeakHash,
+				ShortSize:  h.ShortSize,
+				StrongHash: h.StrongHash,
+			})
+		}
+		fileIndex++
+	}
+
+	for _, s := range sig.Container.Symlinks {
+		if !keep(s.Path) {
+			excluded = append(excluded, s.Path)
+		}
+	}
+	return res, excluded, nil
+}
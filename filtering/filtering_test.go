@@ -0,0 +1,141 @@
+package filtering_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/itchio/butler/filtering"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/wsync"
+	"github.com/itchio/wharf/wtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterContainer(t *testing.T) {
+	container := &tlc.Container{
+		Dirs: []*tlc.Dir{
+			{Path: "data"},
+			{Path: "symbols"},
+		},
+		Files: []*tlc.File{
+			{Path: "game.exe", Size: 10, Offset: 0},
+			{Path: "game.pdb", Size: 20, Offset: 10},
+			{Path: "symbols/game.sym", Size: 30, Offset: 30},
+			{Path: "data/level1.dat", Size: 40, Offset: 60},
+		},
+		Size: 100,
+	}
+
+	filtered := filtering.FilterContainer(container, filtering.PatternFilter([]string{"*.pdb", "symbols"}))
+
+	assert.EqualValues(t, 1, len(filtered.Dirs))
+	assert.EqualValues(t, "data", filtered.Dirs[0].Path)
+
+	assert.EqualValues(t, 2, len(filtered.Files))
+	assert.EqualValues(t, "game.exe", filtered.Files[0].Path)
+	assert.EqualValues(t, 0, filtered.Files[0].Offset)
+	assert.EqualValues(t, "data/level1.dat", filtered.Files[1].Path)
+	assert.EqualValues(t, 10, filtered.Files[1].Offset)
+	assert.EqualValues(t, 50, filtered.Size)
+
+	// the original container is left untouched
+	assert.EqualValues(t, 4, len(container.Files))
+	assert.EqualValues(t, 60, container.Files[3].Offset)
+}
+
+func TestFlags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filtering-tests")
+	wtest.Must(t, err)
+	defer os.RemoveAll(dir)
+
+	ignoreFile := filepath.Join(dir, ".butlerignore")
+	wtest.Must(t, ioutil.WriteFile(ignoreFile, []byte("# debug symbols\n*.pdb\n\n!keep.pdb\n"), 0o644))
+
+	flags := &filtering.Flags{
+		Exclude:    []string{"*.log"},
+		Include:    []string{"important.log"},
+		IgnoreFile: ignoreFile,
+	}
+	assert.False(t, flags.IsEmpty())
+
+	filter, err := flags.Filter(filtering.PatternFilter([]string{".git"}))
+	wtest.Must(t, err)
+
+	assert.EqualValues(t, tlc.FilterIgnore, filter("debug.log"))
+	assert.EqualValues(t, tlc.FilterKeep, filter("important.log"))
+	assert.EqualValues(t, tlc.FilterIgnore, filter("game.pdb"))
+	assert.EqualValues(t, tlc.FilterKeep, filter("keep.pdb"))
+	assert.EqualValues(t, tlc.FilterIgnore, filter(".git"))
+	assert.EqualValues(t, tlc.FilterKeep, filter("game.exe"))
+
+	assert.True(t, filtering.IsIgnored(filter, "logs/debug.log"))
+	assert.True(t, filtering.IsIgnored(filter, ".git/config"))
+	assert.False(t, filtering.IsIgnored(filter, "data/level1.dat"))
+
+	// includes can't bring back what the base filter leaves out
+	filter, err = (&filtering.Flags{Include: []string{".git", "*.itch*"}}).Filter(filtering.FilterPaths)
+	wtest.Must(t, err)
+	assert.EqualValues(t, tlc.FilterIgnore, filter(".git"))
+	assert.EqualValues(t, tlc.FilterIgnore, filter(".itch"))
+
+	_, err = (&filtering.Flags{Exclude: []string{"[oops"}}).Filter(nil)
+	assert.Error(t, err)
+
+	_, err = (&filtering.Flags{IgnoreFile: filepath.Join(dir, "missing")}).Filter(nil)
+	assert.Error(t, err)
+}
+
+func TestFilterSignature(t *testing.T) {
+	bigSize := pwr.BlockSize*2 + 10
+	sig := &pwr.SignatureInfo{
+		Container: &tlc.Container{
+			Files: []*tlc.File{
+				{Path: "game.exe", Size: 10, Offset: 0},
+				{Path: "empty.txt", Size: 0, Offset: 10},
+				{Path: "game.pdb", Size: bigSize, Offset: 10},
+				{Path: "data/level1.dat", Size: bigSize, Offset: 10 + bigSize},
+			},
+			Symlinks: []*tlc.Symlink{
+				{Path: "debug.pdb", Dest: "game.pdb"},
+			},
+			Size: 10 + bigSize*2,
+		},
+	}
+	for fileIndex, f := range sig.Container.Files {
+		numBlocks := pwr.ComputeNumBlocks(f.Size)
+		if numBlocks == 0 {
+			numBlocks = 1
+		}
+		for blockIndex := int64(0); blockIndex < numBlocks; blockIndex++ {
+			sig.Hashes = append(sig.Hashes, wsync.BlockHash{
+				FileIndex:  int64(fileIndex),
+				BlockIndex: blockIndex,
+				WeakHash:   uint32(fileIndex*100) + uint32(blockIndex),
+			})
+		}
+	}
+
+	filtered, excluded, err := filtering.FilterSignature(sig, filtering.PatternFilter([]string{"*.pdb"}))
+	wtest.Must(t, err)
+	assert.EqualValues(t, []string{"game.pdb", "debug.pdb"}, excluded)
+
+	assert.EqualValues(t, 3, len(filtered.Container.Files))
+	assert.EqualValues(t, 0, len(filtered.Container.Symlinks))
+	assert.EqualValues(t, 5, len(filtered.Hashes))
+
+	// hashes of later files are renumbered
+	last := filtered.Hashes[4]
+	assert.EqualValues(t, 2, last.FileIndex)
+	assert.EqualValues(t, 2, last.BlockIndex)
+	assert.EqualValues(t, 302, last.WeakHash)
+
+	_, err = pwr.ComputeHashInfo(filtered)
+	wtest.Must(t, err)
+
+	sig.Hashes = sig.Hashes[:3]
+	_, _, err = filtering.FilterSignature(sig, filtering.PatternFilter(nil))
+	assert.Error(t, err)
+}
@@ -0,0 +1,101 @@
+package filtering
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/itchio/lake/tlc"
+	"github.com/pkg/errors"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// Flags are the --exclude, --include and --ignore-file flags shared by
+// commands that walk directories or read containers.
+type Flags struct {
+	// Exclude lists patterns of names to leave out
+	Exclude []string
+	// Include lists patterns of names to keep, even if they
+	// match an exclude pattern
+	Include []string
+	// IgnoreFile is a file with one exclude pattern per line. Lines
+	// starting with '#' are comments, lines starting with '!' are
+	// include patterns.
+	IgnoreFile string
+}
+
+// Register adds the filtering flags to a command
+func (f *Flags) Register(cmd *kingpin.CmdClause) {
+	cmd.Flag("exclude", "Leave out files and directories whose name matches this pattern, for example *.log (may be specified multiple times)").PlaceHolder("PATTERN").StringsVar(&f.Exclude)
+	cmd.Flag("include", "Keep files and directories whose name matches this pattern, even if they're excluded (may be specified multiple times)").PlaceHolder("PATTERN").StringsVar(&f.Include)
+	cmd.Flag("ignore-file", "A file listing patterns to exclude, one per line, or to include if they start with !").PlaceHolder("PATH").StringVar(&f.IgnoreFile)
+}
+
+// IsEmpty returns true if no filtering flag was given
+func (f *Flags) IsEmpty() bool {
+	return len(f.Exclude) == 0 && len(f.Include) == 0 && f.IgnoreFile == ""
+}
+
+// Filter returns a filter that applies base first, if it's not nil,
+// then the exclude and include patterns. Include patterns only override
+// exclude patterns: what base leaves out stays out.
+func (f *Flags) Filter(base tlc.FilterFunc) (tlc.FilterFunc, error) {
+	exclude := append([]string{}, f.Exclude...)
+	include := append([]string{}, f.Include...)
+
+	if f.IgnoreFile != "" {
+		fileExclude, fileInclude, err := ReadIgnoreFile(f.IgnoreFile)
+		if err != nil {
+			return nil, err
+		}
+		exclude = append(exclude, fileExclude...)
+		include = append(include, fileInclude...)
+	}
+
+	for _, pattern := range append(append([]string{}, exclude...), include...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, errors.Errorf("invalid pattern: %s", pattern)
+		}
+	}
+
+	excludeFilter := PatternFilter(exclude)
+	includeFilter := PatternFilter(include)
+
+	return func(name string) tlc.FilterResult {
+		if base != nil && base(name) == tlc.FilterIgnore {
+			return tlc.FilterIgnore
+		}
+		if includeFilter(name) == tlc.FilterIgnore {
+			// matches an include pattern
+			return tlc.FilterKeep
+		}
+		return excludeFilter(name)
+	}, nil
+}
+
+// ReadIgnoreFile reads exclude and include patterns from a file
+func ReadIgnoreFile(path string) (exclude []string, include []string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "reading ignore file")
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "!"):
+			include = append(include, strings.TrimPrefix(line, "!"))
+		default:
+			exclude = append(exclude, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, errors.Wrap(err, "reading ignore file")
+	}
+	return exclude, include, nil
+}
@@ -0,0 +1,662 @@
+// Package healing repairs directories from several sources at once. Heal
+// specs look like "type,path" and are tried from the cheapest to the most
+// expensive:
+//
+//	dir,<path>        a local directory with another copy of the build, or
+//	                  an older or newer build of it. Only blocks that match
+//	                  the signature are taken from it.
+//	archive,<path>    a local archive of the build
+//	archive,<url>     a remote archive of the build
+//
+// Archives are only used for what directories couldn't heal, so the
+// network is only used as a last resort. Files that are completely
+// missing or damaged are healed whole, other files only get the blocks
+// directories didn't have from archives.
+package healing
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/itchio/arkive/zip"
+	"github.com/itchio/butler/cmd/ls"
+	"github.com/itchio/headway/state"
+	"github.com/itchio/httpkit/eos"
+	"github.com/itchio/httpkit/eos/option"
+	"github.com/itchio/lake"
+	"github.com/itchio/lake/pools"
+	"github.com/itchio/lake/pools/zippool"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/screw"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/wsync"
+	"github.com/pkg/errors"
+)
+
+// SourceType is the kind of a heal source
+type SourceType string
+
+const (
+	// SourceDir is a local directory, used block by block
+	SourceDir SourceType = "dir"
+	// SourceArchive is a local or remote archive of the build, used
+	// file by file
+	SourceArchive SourceType = "archive"
+)
+
+// Source is something wounds can be healed from
+type Source struct {
+	Type SourceType
+	Path string
+}
+
+// ParseSource parses a heal spec like "dir,../old-install" or
+// "archive,https://example.org/build.zip"
+func ParseSource(spec string) (*Source, error) {
+	tokens := strings.SplitN(spec, ",", 2)
+	if len(tokens) != 2 || tokens[1] == "" {
+		return nil, errors.Errorf("invalid heal spec: expected 'type,path' but got '%s'", spec)
+	}
+
+	s := &Source{Type: SourceType(tokens[0]), Path: tokens[1]}
+	switch s.Type {
+	case SourceDir, SourceArchive:
+		return s, nil
+	}
+	return nil, errors.Errorf("unknown heal source type '%s', expected 'dir' or 'archive'", tokens[0])
+}
+
+// IsRemote returns true if the source has to be downloaded
+func (s *Source) IsRemote() bool {
+	return strings.HasPrefix(s.Path, "http://") || strings.HasPrefix(s.Path, "https://")
+}
+
+func (s *Source) cost() int {
+	switch {
+	case s.Type == SourceDir:
+		return 0
+	case !s.IsRemote():
+		return 1
+	default:
+		return 2
+	}
+}
+
+// String returns the source as a heal spec
+func (s *Source) String() string {
+	return string(s.Type) + "," + s.Path
+}
+
+// Healer heals wounds from a list of sources. It implements pwr.Healer,
+// so it can be fed wounds the same way.
+type Healer struct {
+	Target  string
+	Sources []*Source
+
+	// Signature is what blocks found in directory sources are checked
+	// against. It's required if there are any.
+	Signature *pwr.SignatureInfo
+
+	// HealedFrom is how many bytes were healed from each source,
+	// keyed by heal spec
+	HealedFrom map[string]int64
+
+	// CaseFixStats lists the files and folders Validate renamed to
+	// match the case of the signature, on case-insensitive filesystems.
+	// It's nil if no case fixing was done.
+	CaseFixStats *lake.CaseFixStats
+
+	consumer *state.Consumer
+	lockMap  pwr.LockMap
+
+	totalCorrupted int64
+	totalHealed    int64
+	hasWounds      bool
+}
+
+var _ pwr.Healer = (*Healer)(nil)
+
+// New returns a healer for target that tries specs from the cheapest to
+// the most expensive. signature may only be nil if there are no
+// directory sources.
+func New(specs []string, target string, signature *pwr.SignatureInfo) (*Healer, error) {
+	if len(specs) == 0 {
+		return nil, errors.New("no heal sources given")
+	}
+
+	h := &Healer{
+		Target:     target,
+		Signature:  signature,
+		HealedFrom: make(map[string]int64),
+		consumer:   &state.Consumer{},
+	}
+	for _, spec := range specs {
+		s, err := ParseSource(spec)
+		if err != nil {
+			return nil, err
+		}
+		if s.Type == SourceDir && signature == nil {
+			return nil, errors.Errorf("healing from a directory (%s) requires a signature", s.Path)
+		}
+		h.Sources = append(h.Sources, s)
+	}
+
+	sort.SliceStable(h.Sources, func(i, j int) bool {
+		return h.Sources[i].cost() < h.Sources[j].cost()
+	})
+	return h, nil
+}
+
+// Do receives all wounds, heals what it can from directory sources,
+// then the rest from the first archive source that works.
+func (h *Healer) Do(ctx context.Context, container *tlc.Container, wounds chan *pwr.Wound) error {
+	var all []*pwr.Wound
+	for wound := range wounds {
+		if wound.Healthy() {
+			continue
+		}
+		h.hasWounds = true
+		h.totalCorrupted += wound.Size()
+		all = append(all, wound)
+	}
+	if len(all) == 0 {
+		return nil
+	}
+
+	remaining, partial, err := h.healFromDirs(container, all)
+	if err != nil {
+		return err
+	}
+
+	if len(partial) > 0 {
+		err = h.healBlocksFromArchives(container, partial)
+		if err != nil {
+			return err
+		}
+	}
+	if len(remaining) > 0 {
+		return h.healFromArchives(ctx, container, remaining)
+	}
+	return nil
+}
+
+// partialFile is a file that's partly healthy, or was partly healed
+// from directories, and whose other blocks have to come from an archive
+type partialFile struct {
+	fileIndex int64
+	blocks    []int64
+}
+
+// healFromDirs heals file wounds block by block. It returns the wounds
+// of files it found nothing of, and the files it could only partly heal.
+func (h *Healer) healFromDirs(container *tlc.Container, wounds []*pwr.Wound) ([]*pwr.Wound, []*partialFile, error) {
+	var dirs []*Source
+	for _, s := range h.Sources {
+		if s.Type == SourceDir {
+			dirs = append(dirs, s)
+		}
+	}
+	if len(dirs) == 0 {
+		return wounds, nil, nil
+	}
+
+	hashes, err := hashesByPath(h.Signature)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var remaining []*pwr.Wound
+	var partial []*partialFile
+	byFile := make(map[int64][]*pwr.Wound)
+	var fileIndices []int64
+	for _, wound := range wounds {
+		if wound.Kind != pwr.WoundKind_FILE {
+			remaining = append(remaining, wound)
+			continue
+		}
+		if _, ok := byFile[wound.Index]; !ok {
+			fileIndices = append(fileIndices, wound.Index)
+		}
+		byFile[wound.Index] = append(byFile[wound.Index], wound)
+	}
+
+	for _, fileIndex := range fileIndices {
+		f := container.Files[fileIndex]
+		fileWounds := byFile[fileIndex]
+
+		missing, err := h.healFileFromDirs(f, fileWounds, hashes[f.Path], dirs)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "healing %s", f.Path)
+		}
+		switch {
+		case missing == nil:
+			// fully healed
+		case int64(len(missing)) == numBlocks(f):
+			// nothing of the file is usable, it's healed whole
+			remaining = append(remaining, fileWounds...)
+		default:
+			partial = append(partial, &partialFile{fileIndex: fileIndex, blocks: missing})
+		}
+	}
+	return remaining, partial, nil
+}
+
+// healFileFromDirs heals the wounded blocks of a file, taking each block
+// from the first directory that has a matching one. It returns the blocks
+// that weren't found anywhere, or nil if all of them were.
+func (h *Healer) healFileFromDirs(f *tlc.File, wounds []*pwr.Wound, hashes []wsync.BlockHash, dirs []*Source) ([]int64, error) {
+	blocks := woundedBlocks(f, wounds)
+	if hashes == nil {
+		// not in the signature, nothing to check blocks against
+		return blocks, nil
+	}
+
+	healedFrom := make(map[*Source]int64)
+	found := make(map[int64][]byte)
+	var missing []int64
+
+	var sources []*os.File
+	defer func() {
+		for _, sf := range sources {
+			if sf != nil {
+				sf.Close()
+			}
+		}
+	}()
+	for _, dir := range dirs {
+		sf, err := os.Open(filepath.Join(dir.Path, filepath.FromSlash(f.Path)))
+		if err != nil {
+			sf = nil
+		}
+		sources = append(sources, sf)
+	}
+
+	for _, blockIndex := range blocks {
+		if blockIndex >= int64(len(hashes)) {
+			missing = append(missing, blockIndex)
+			continue
+		}
+		expected := hashes[blockIndex]
+		size := pwr.ComputeBlockSize(f.Size, blockIndex)
+
+		for i, sf := range sources {
+			if sf == nil {
+				continue
+			}
+			buf := make([]byte, size)
+			n, err := sf.ReadAt(buf, blockIndex*pwr.BlockSize)
+			if err != nil && err != io.EOF {
+				continue
+			}
+			if int64(n) != size {
+				continue
+			}
+			sum := md5.Sum(buf)
+			if bytes.Equal(sum[:], expected.StrongHash) {
+				found[blockIndex] = buf
+				healedFrom[dirs[i]] += size
+				break
+			}
+		}
+
+		if _, ok := found[blockIndex]; !ok {
+			missing = append(missing, blockIndex)
+		}
+	}
+
+	if len(found) == 0 {
+		return missing, nil
+	}
+
+	err := h.writeBlocks(f, found)
+	if err != nil {
+		return nil, err
+	}
+
+	for dir, size := range healedFrom {
+		h.HealedFrom[dir.String()] += size
+		h.totalHealed += size
+	}
+	if len(missing) > 0 {
+		h.consumer.Debugf("Healed %d of %d blocks of %s from local directories", len(found), len(blocks), f.Path)
+	} else {
+		h.consumer.Debugf("Healed %s from local directories", f.Path)
+	}
+	return missing, nil
+}
+
+// openTarget opens the target's copy of f for healing, creating it
+// if needed
+func (h *Healer) openTarget(f *tlc.File) (*os.File, error) {
+	path := filepath.Join(h.Target, filepath.FromSlash(f.Path))
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if stats, err := os.Lstat(path); err == nil && !stats.Mode().IsRegular() {
+		// a directory or symlink where the file should be
+		err = os.RemoveAll(path)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	w, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, os.FileMode(f.Mode)|0o600)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	err = w.Truncate(f.Size)
+	if err != nil {
+		w.Close()
+		return nil, errors.WithStack(err)
+	}
+	return w, nil
+}
+
+// writeBlocks writes healed blocks into the target's copy of f
+func (h *Healer) writeBlocks(f *tlc.File, blocks map[int64][]byte) error {
+	w, err := h.openTarget(f)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	for blockIndex, buf := range blocks {
+		_, err = w.WriteAt(buf, blockIndex*pwr.BlockSize)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return w.Close()
+}
+
+// healBlocksFromArchives heals the blocks of partly healed files
+// from the first archive source that works
+func (h *Healer) healBlocksFromArchives(container *tlc.Container, partial []*partialFile) error {
+	var lastErr error
+	for _, s := range h.Sources {
+		if s.Type != SourceArchive {
+			continue
+		}
+
+		err := h.healBlocksFromArchive(s, container, partial)
+		if err == nil {
+			return nil
+		}
+
+		lastErr = err
+		h.consumer.Warnf("Couldn't heal from %s: %v", s.Path, err)
+	}
+
+	if lastErr != nil {
+		return errors.Wrap(lastErr, "healing from archives")
+	}
+	return errors.Errorf("%d files couldn't be fully healed from local directories, and no archive was given", len(partial))
+}
+
+// healBlocksFromArchive writes only the given blocks of each file from
+// an archive. Entries are compressed, so they can't be read from the
+// middle: each is read up to its last missing block, and the blocks we
+// already have are skipped.
+func (h *Healer) healBlocksFromArchive(s *Source, container *tlc.Container, partial []*partialFile) error {
+	file, err := eos.Open(s.Path, option.WithConsumer(h.consumer))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+
+	stats, err := file.Stat()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	zipReader, err := zip.NewReader(file, stats.Size())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	pool := zippool.New(container, zipReader)
+	defer pool.Close()
+
+	for _, pf := range partial {
+		f := container.Files[pf.fileIndex]
+		healed, err := h.healBlocksFromPool(pool, f, pf)
+		h.HealedFrom[s.String()] += healed
+		h.totalHealed += healed
+		if err != nil {
+			return errors.Wrapf(err, "healing %s", f.Path)
+		}
+		h.consumer.Debugf("Healed %d blocks of %s from %s", len(pf.blocks), f.Path, s.Path)
+	}
+	return nil
+}
+
+func (h *Healer) healBlocksFromPool(pool *zippool.ZipPool, f *tlc.File, pf *partialFile) (int64, error) {
+	r, err := pool.GetReader(pf.fileIndex)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	w, err := h.openTarget(f)
+	if err != nil {
+		return 0, err
+	}
+	defer w.Close()
+
+	var offset int64
+	var healed int64
+	for _, blockIndex := range pf.blocks {
+		start := blockIndex * pwr.BlockSize
+		_, err = io.CopyN(ioutil.Discard, r, start-offset)
+		if err != nil {
+			return healed, errors.WithStack(err)
+		}
+
+		buf := make([]byte, pwr.ComputeBlockSize(f.Size, blockIndex))
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return healed, errors.WithStack(err)
+		}
+		offset = start + int64(len(buf))
+
+		_, err = w.WriteAt(buf, start)
+		if err != nil {
+			return healed, errors.WithStack(err)
+		}
+		healed += int64(len(buf))
+	}
+	return healed, w.Close()
+}
+
+// numBlocks returns how many blocks f has. Empty files have a
+// single, empty block.
+func numBlocks(f *tlc.File) int64 {
+	if f.Size == 0 {
+		return 1
+	}
+	return (f.Size + pwr.BlockSize - 1) / pwr.BlockSize
+}
+
+// woundedBlocks returns the indices of all blocks of f the wounds
+// touch. Empty files have a single, empty block.
+func woundedBlocks(f *tlc.File, wounds []*pwr.Wound) []int64 {
+	if f.Size == 0 {
+		return []int64{0}
+	}
+
+	seen := make(map[int64]bool)
+	var blocks []int64
+	for _, wound := range wounds {
+		end := wound.End
+		if end > f.Size {
+			end = f.Size
+		}
+		for offset := wound.Start - wound.Start%pwr.BlockSize; offset < end; offset += pwr.BlockSize {
+			blockIndex := offset / pwr.BlockSize
+			if !seen[blockIndex] {
+				seen[blockIndex] = true
+				blocks = append(blocks, blockIndex)
+			}
+		}
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i] < blocks[j] })
+	return blocks
+}
+
+func hashesByPath(sig *pwr.SignatureInfo) (map[string][]wsync.BlockHash, error) {
+	hashInfo, err := pwr.ComputeHashInfo(sig)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading signature hashes")
+	}
+
+	res := make(map[string][]wsync.BlockHash)
+	for fileIndex, f := range sig.Container.Files {
+		if f.Size == 0 {
+			// hash of an empty block
+			sum := md5.Sum(nil)
+			res[f.Path] = []wsync.BlockHash{{StrongHash: sum[:]}}
+			continue
+		}
+		res[f.Path] = hashInfo.Groups[int64(fileIndex)]
+	}
+	return res, nil
+}
+
+// healFromArchives sends the remaining wounds to each archive source in
+// turn, until one of them heals everything
+func (h *Healer) healFromArchives(ctx context.Context, container *tlc.Container, wounds []*pwr.Wound) error {
+	var lastErr error
+	for _, s := range h.Sources {
+		if s.Type != SourceArchive {
+			continue
+		}
+
+		healer, err := pwr.NewHealer(s.String(), h.Target)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		healer.SetConsumer(h.consumer)
+		if h.lockMap != nil {
+			healer.SetLockMap(h.lockMap)
+		}
+
+		woundsChan := make(chan *pwr.Wound, len(wounds))
+		for _, wound := range wounds {
+			woundsChan <- wound
+		}
+		close(woundsChan)
+
+		err = healer.Do(ctx, container, woundsChan)
+		h.HealedFrom[s.String()] += healer.TotalHealed()
+		h.totalHealed += healer.TotalHealed()
+		if err == nil {
+			return nil
+		}
+
+		lastErr = err
+		h.consumer.Warnf("Couldn't heal from %s: %v", s.Path, err)
+	}
+
+	if lastErr != nil {
+		return errors.Wrap(lastErr, "healing from archives")
+	}
+	return errors.Errorf("%d wounds couldn't be healed from local directories, and no archive was given", len(wounds))
+}
+
+// Validate checks dir against signature, then heals the wounds it found.
+// Unlike pwr.ValidatorContext, which heals as it goes, it has to know
+// about all wounds before healing, to take as much as possible from
+// directories before using archives.
+func (h *Healer) Validate(ctx context.Context, dir string, signature *pwr.SignatureInfo, consumer *state.Consumer) error {
+	tempDir, err := ioutil.TempDir("", "butler-heal")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// healers can deal with "everything missing"
+	err = os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// like pwr.ValidatorContext does when healing, fix case first, so
+	// that wrongly-cased files aren't considered missing
+	if screw.IsCaseInsensitiveFS() {
+		targetPool, err := pools.New(signature.Container, dir)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer targetPool.Close()
+
+		if cfp, ok := targetPool.(lake.CaseFixerPool); ok {
+			h.CaseFixStats = &lake.CaseFixStats{}
+			err = cfp.FixExistingCase(lake.CaseFixParams{
+				Consumer: consumer,
+				Stats:    h.CaseFixStats,
+			})
+			if err != nil {
+				return errors.Wrap(err, "fixing case")
+			}
+		}
+	}
+
+	vc := &pwr.ValidatorContext{
+		Consumer:   consumer,
+		WoundsPath: filepath.Join(tempDir, "wounds.pww"),
+	}
+	err = vc.Validate(ctx, dir, signature)
+	if err != nil {
+		return errors.Wrap(err, "validating")
+	}
+	if !vc.WoundsConsumer.HasWounds() {
+		return nil
+	}
+
+	wounds, err := ls.ReadWounds(vc.WoundsPath)
+	if err != nil {
+		return err
+	}
+
+	woundsChan := make(chan *pwr.Wound, len(wounds.Wounds))
+	for _, wound := range wounds.Wounds {
+		woundsChan <- wound
+	}
+	close(woundsChan)
+
+	return h.Do(ctx, wounds.Container, woundsChan)
+}
+
+// TotalCorrupted returns the total size of the wounds received
+func (h *Healer) TotalCorrupted() int64 {
+	return h.totalCorrupted
+}
+
+// HasWounds returns true if any wounds were received
+func (h *Healer) HasWounds() bool {
+	return h.hasWounds
+}
+
+// TotalHealed returns how many bytes were healed, from all sources
+func (h *Healer) TotalHealed() int64 {
+	return h.totalHealed
+}
+
+// SetConsumer sets where progress and messages are reported
+func (h *Healer) SetConsumer(consumer *state.Consumer) {
+	h.consumer = consumer
+}
+
+// SetLockMap is passed on to archive healers
+func (h *Healer) SetLockMap(lockMap pwr.LockMap) {
+	h.lockMap = lockMap
+}
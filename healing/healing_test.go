@@ -0,0 +1,128 @@
+package healing_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/itchio/butler/buildtest"
+	"github.com/itchio/butler/healing"
+	"github.com/itchio/headway/state"
+	"github.com/itchio/lake/pools/fspool"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/wtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSource(t *testing.T) {
+	s, err := healing.ParseSource("dir,../old")
+	wtest.Must(t, err)
+	assert.EqualValues(t, healing.SourceDir, s.Type)
+	assert.EqualValues(t, "../old", s.Path)
+	assert.False(t, s.IsRemote())
+
+	s, err = healing.ParseSource("archive,https://example.org/build.zip")
+	wtest.Must(t, err)
+	assert.True(t, s.IsRemote())
+
+	_, err = healing.ParseSource("manifest,foo")
+	assert.Error(t, err)
+	_, err = healing.ParseSource("archive")
+	assert.Error(t, err)
+
+	// directories need a signature to check blocks against
+	_, err = healing.New([]string{"dir,../old"}, "target", nil)
+	assert.Error(t, err)
+
+	h, err := healing.New([]string{"archive,https://example.org/build.zip", "archive,build.zip", "dir,../old"}, "target", &pwr.SignatureInfo{})
+	wtest.Must(t, err)
+	var order []string
+	for _, s := range h.Sources {
+		order = append(order, s.String())
+	}
+	assert.EqualValues(t, []string{"dir,../old", "archive,build.zip", "archive,https://example.org/build.zip"}, order)
+}
+
+func TestHeal(t *testing.T) {
+	dir := buildtest.TempDir(t, "healing-tests")
+
+	rng := rand.New(rand.NewSource(0xf00d))
+	random := func(size int) []byte {
+		buf := make([]byte, size)
+		rng.Read(buf)
+		return buf
+	}
+
+	build := map[string]string{
+		"big.dat":      string(random(int(pwr.BlockSize*3 + 100))),
+		"data/new.dat": string(random(1000)),
+		"empty.txt":    "",
+	}
+
+	reference := buildtest.WriteDir(t, filepath.Join(dir, "reference"), build)
+	container, err := tlc.WalkDir(reference, tlc.WalkOpts{})
+	wtest.Must(t, err)
+	hashes, err := pwr.ComputeSignature(context.Background(), container, fspool.New(container, reference), &state.Consumer{})
+	wtest.Must(t, err)
+	signature := &pwr.SignatureInfo{Container: container, Hashes: hashes}
+
+	// an older build: big.dat only differs in its second block,
+	// and new.dat doesn't exist yet
+	oldBig := append([]byte{}, build["big.dat"]...)
+	copy(oldBig[pwr.BlockSize:], random(10))
+	old := buildtest.WriteDir(t, filepath.Join(dir, "old"), map[string]string{
+		"big.dat":   string(oldBig),
+		"empty.txt": "",
+	})
+
+	// the install: the first two blocks of big.dat are damaged, empty.txt
+	// and data/new.dat are missing
+	damagedBig := append([]byte{}, build["big.dat"]...)
+	copy(damagedBig, random(10))
+	copy(damagedBig[pwr.BlockSize:], random(10))
+	install := buildtest.WriteDir(t, filepath.Join(dir, "install"), map[string]string{
+		"big.dat": string(damagedBig),
+	})
+
+	// directories alone can heal the first block of big.dat, but not
+	// its second block or new.dat
+	h, err := healing.New([]string{"dir," + old}, install, signature)
+	wtest.Must(t, err)
+	assert.Error(t, h.Validate(context.Background(), install, signature, &state.Consumer{}))
+	assert.EqualValues(t, pwr.BlockSize, h.HealedFrom["dir,"+old])
+
+	// so those have to come from the archive
+	archivePath := filepath.Join(dir, "build.zip")
+	archiveBuf := new(bytes.Buffer)
+	zw := zip.NewWriter(archiveBuf)
+	for path, contents := range build {
+		w, err := zw.Create(path)
+		wtest.Must(t, err)
+		_, err = w.Write([]byte(contents))
+		wtest.Must(t, err)
+	}
+	wtest.Must(t, zw.Close())
+	wtest.Must(t, ioutil.WriteFile(archivePath, archiveBuf.Bytes(), 0o644))
+
+	h, err = healing.New([]string{"archive," + archivePath, "dir," + old}, install, signature)
+	wtest.Must(t, err)
+	wtest.Must(t, h.Validate(context.Background(), install, signature, &state.Consumer{}))
+	assert.True(t, h.HasWounds())
+	assert.EqualValues(t, 0, h.HealedFrom["dir,"+old])
+	// only the missing block of big.dat is taken from the archive
+	assert.EqualValues(t, pwr.BlockSize+1000, h.HealedFrom["archive,"+archivePath])
+
+	for path, contents := range build {
+		actual, err := ioutil.ReadFile(filepath.Join(install, filepath.FromSlash(path)))
+		wtest.Must(t, err)
+		assert.True(t, bytes.Equal([]byte(contents), actual), "%s should be healed", path)
+	}
+
+	vc := &pwr.ValidatorContext{FailFast: true}
+	wtest.Must(t, vc.Validate(context.Background(), install, signature))
+}
@@ -0,0 +1,414 @@
+// Package html5 checks that a build can be played in a browser: that
+// the web player can find its index.html, that it doesn't reference files
+// by absolute path, and that it stays within itch.io's limits for HTML5
+// games.
+package html5
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/itchio/headway/united"
+	"github.com/itchio/lake/tlc"
+	"github.com/pkg/errors"
+)
+
+// Limits itch.io puts on HTML5 games
+const (
+	MaxFiles     = 1000
+	MaxTotalSize = 500 * 1024 * 1024
+	MaxFileSize  = 200 * 1024 * 1024
+)
+
+// IndexName is what the web player opens
+const IndexName = "index.html"
+
+// Severity is how bad a finding is
+type Severity string
+
+const (
+	// SeverityError findings break the game in the web player
+	SeverityError Severity = "error"
+	// SeverityWarning findings might, depending on how it's served
+	SeverityWarning Severity = "warning"
+)
+
+// Finding is a single problem found in a web build
+type Finding struct {
+	// Check is the name of the check that found it, like "index"
+	// or "file-url"
+	Check    string   `json:"check"`
+	Severity Severity `json:"severity"`
+	Path     string   `json:"path,omitempty"`
+	// Line starts at 1, and is zero if the finding isn't about
+	// a specific line
+	Line    int    `json:"line,omitempty"`
+	Message string `json:"message"`
+}
+
+// FileSize is a file and its size
+type FileSize struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// Report holds everything Check found about a web build
+type Report struct {
+	// IndexPath is where the index.html the web player opens is, empty
+	// if there isn't one
+	IndexPath string `json:"indexPath,omitempty"`
+
+	FileCount    int64       `json:"fileCount"`
+	TotalSize    int64       `json:"totalSize"`
+	LargestFiles []*FileSize `json:"largestFiles"`
+	// CompressedAssets lists files that must be served with
+	// a Content-Encoding header
+	CompressedAssets []*CompressedAsset `json:"compressedAssets,omitempty"`
+
+	Errors   int        `json:"errors"`
+	Warnings int        `json:"warnings"`
+	Findings []*Finding `json:"findings"`
+	// Truncated counts findings left out, for files that had
+	// too many of them
+	Truncated map[string]int `json:"truncated,omitempty"`
+}
+
+// CompressedAsset is a pre-compressed file, like the .gz or .br
+// files Unity WebGL builds are made of
+type CompressedAsset struct {
+	Path            string `json:"path"`
+	ContentEncoding string `json:"contentEncoding"`
+}
+
+// Failed returns true if the build has errors
+func (r *Report) Failed() bool {
+	return r.Errors > 0
+}
+
+func (r *Report) add(f *Finding) {
+	r.Findings = append(r.Findings, f)
+	switch f.Severity {
+	case SeverityError:
+		r.Errors++
+	case SeverityWarning:
+		r.Warnings++
+	}
+}
+
+// Print calls log with a summary of the report, then one line per finding
+func (r *Report) Print(log func(line string)) {
+	if r.IndexPath != "" {
+		log(fmt.Sprintf("Web player opens (%s)", r.IndexPath))
+	}
+	log(fmt.Sprintf("%d files, %s total", r.FileCount, united.FormatBytes(r.TotalSize)))
+	if len(r.LargestFiles) > 0 {
+		log("Largest files:")
+		for _, f := range r.LargestFiles {
+			log(fmt.Sprintf("  %10s  %s", united.FormatBytes(f.Size), f.Path))
+		}
+	}
+	if len(r.CompressedAssets) > 0 {
+		log("Must be served with a Content-Encoding header:")
+		for _, a := range r.CompressedAssets {
+			log(fmt.Sprintf("  %-4s  %s", a.ContentEncoding, a.Path))
+		}
+	}
+	for _, f := range r.Findings {
+		where := f.Path
+		if f.Line > 0 {
+			where = fmt.Sprintf("%s:%d", f.Path, f.Line)
+		}
+		if where != "" {
+			where += ": "
+		}
+		log(fmt.Sprintf("%-7s [%s] %s%s", f.Severity, f.Check, where, f.Message))
+	}
+	var truncated []string
+	for path := range r.Truncated {
+		truncated = append(truncated, path)
+	}
+	sort.Strings(truncated)
+	for _, path := range truncated {
+		log(fmt.Sprintf("...and %d more in %s", r.Truncated[path], path))
+	}
+	log(fmt.Sprintf("%d errors, %d warnings", r.Errors, r.Warnings))
+}
+
+// largestFilesCount is how many files Report.LargestFiles lists
+const largestFilesCount = 10
+
+// maxScannedSize is the size above which text files aren't scanned
+// for references
+const maxScannedSize = 64 * 1024 * 1024
+
+// maxFindingsPerFile keeps minified files full of the same mistake
+// from drowning out everything else
+const maxFindingsPerFile = 10
+
+// Check runs all the HTML5 checks on container, whose files are in dir.
+func Check(container *tlc.Container, dir string) (*Report, error) {
+	r := &Report{
+		FileCount:    int64(len(container.Files)),
+		TotalSize:    container.Size,
+		LargestFiles: []*FileSize{},
+		Findings:     []*Finding{},
+	}
+
+	checkIndex(r, container)
+	checkLimits(r, container)
+
+	for _, f := range container.Files {
+		err := checkCompressed(r, f, dir)
+		if err != nil {
+			return nil, err
+		}
+
+		err = checkReferences(r, f, dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// checkIndex looks for index.html where the web player looks for it: at
+// the root of the build, or in its only top-level folder.
+func checkIndex(r *Report, container *tlc.Container) {
+	topLevel := make(map[string]bool)
+	container.ForEachEntry(func(e tlc.Entry) tlc.ForEachOutcome {
+		topLevel[strings.SplitN(e.GetPath(), "/", 2)[0]] = true
+		return tlc.ForEachContinue
+	})
+
+	candidates := []string{IndexName}
+	if len(topLevel) == 1 {
+		for name := range topLevel {
+			candidates = append(candidates, path.Join(name, IndexName))
+		}
+	}
+
+	files := make(map[string]bool)
+	lowerFiles := make(map[string]string)
+	for _, f := range container.Files {
+		files[f.Path] = true
+		lowerFiles[strings.ToLower(f.Path)] = f.Path
+	}
+
+	for _, candidate := range candidates {
+		if files[candidate] {
+			r.IndexPath = candidate
+			return
+		}
+	}
+
+	for _, candidate := range candidates {
+		if actual, ok := lowerFiles[candidate]; ok {
+			r.add(&Finding{
+				Check:    "index",
+				Severity: SeverityError,
+				Path:     actual,
+				Message:  fmt.Sprintf("web servers are case-sensitive, rename it to %s", IndexName),
+			})
+			return
+		}
+	}
+
+	msg := fmt.Sprintf("no %s at the root of the build", IndexName)
+	for _, f := range container.Files {
+		if path.Base(f.Path) == IndexName {
+			msg = fmt.Sprintf("%s must be at the root of the build, or in its only top-level folder, found (%s) instead", IndexName, f.Path)
+			break
+		}
+	}
+	r.add(&Finding{
+		Check:    "index",
+		Severity: SeverityError,
+		Message:  msg,
+	})
+}
+
+func checkLimits(r *Report, container *tlc.Container) {
+	files := make([]*FileSize, 0, len(container.Files))
+	for _, f := range container.Files {
+		files = append(files, &FileSize{Path: f.Path, Size: f.Size})
+		if f.Size > MaxFileSize {
+			r.add(&Finding{
+				Check:    "limits",
+				Severity: SeverityWarning,
+				Path:     f.Path,
+				Message:  fmt.Sprintf("%s is over the %s limit for a single file", united.FormatBytes(f.Size), united.FormatBytes(MaxFileSize)),
+			})
+		}
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].Size > files[j].Size
+	})
+	if len(files) > largestFilesCount {
+		files = files[:largestFilesCount]
+	}
+	r.LargestFiles = files
+
+	if r.FileCount > MaxFiles {
+		r.add(&Finding{
+			Check:    "limits",
+			Severity: SeverityWarning,
+			Message:  fmt.Sprintf("%d files, over the limit of %d", r.FileCount, MaxFiles),
+		})
+	}
+	if r.TotalSize > MaxTotalSize {
+		r.add(&Finding{
+			Check:    "limits",
+			Severity: SeverityWarning,
+			Message:  fmt.Sprintf("%s in total, over the %s limit", united.FormatBytes(r.TotalSize), united.FormatBytes(MaxTotalSize)),
+		})
+	}
+}
+
+// contentEncodings maps extensions of pre-compressed files to the
+// Content-Encoding they must be served with
+var contentEncodings = map[string]string{
+	".gz": "gzip",
+	".br": "br",
+}
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+func checkCompressed(r *Report, f *tlc.File, dir string) error {
+	encoding, ok := contentEncodings[strings.ToLower(path.Ext(f.Path))]
+	if !ok {
+		return nil
+	}
+
+	r.CompressedAssets = append(r.CompressedAssets, &CompressedAsset{
+		Path:            f.Path,
+		ContentEncoding: encoding,
+	})
+
+	// brotli streams don't have a magic number
+	if encoding != "gzip" {
+		return nil
+	}
+
+	file, err := os.Open(filepath.Join(dir, filepath.FromSlash(f.Path)))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+
+	magic := make([]byte, len(gzipMagic))
+	_, err = io.ReadFull(file, magic)
+	if err != nil || string(magic) != string(gzipMagic) {
+		r.add(&Finding{
+			Check:    "compressed-asset",
+			Severity: SeverityError,
+			Path:     f.Path,
+			Message:  "isn't gzip data, but would be served with Content-Encoding: gzip",
+		})
+	}
+	return nil
+}
+
+var (
+	attributeRegexp = regexp.MustCompile(`(?i)\b(?:src|href|action|poster)\s*=\s*["']([^"']*)["']`)
+	cssURLRegexp    = regexp.MustCompile(`(?i)url\(\s*["']?([^"')\s]*)`)
+	fileURLRegexp   = regexp.MustCompile(`(?i)file:/{2,3}[^"'\s)]*`)
+	localPathRegexp = regexp.MustCompile(`["']((?:[a-zA-Z]:(?:\\\\|\\|/)|/(?:Users|home)/)[^"']*)["']`)
+)
+
+// checkReferences looks for references to files that won't resolve
+// once the game is served from itch.io: file:// URLs anywhere, and
+// absolute paths in HTML attributes and CSS. Strings in scripts are
+// only checked for paths on the developer's machine, since they're
+// often not paths at all.
+func checkReferences(r *Report, f *tlc.File, dir string) error {
+	ext := strings.ToLower(path.Ext(f.Path))
+	var markup bool
+	switch ext {
+	case ".html", ".htm", ".css":
+		markup = true
+	case ".js", ".mjs":
+	default:
+		return nil
+	}
+	if f.Size > maxScannedSize {
+		return nil
+	}
+
+	file, err := os.Open(filepath.Join(dir, filepath.FromSlash(f.Path)))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+
+	findings := 0
+	add := func(line int, severity Severity, check string, format string, args ...interface{}) {
+		findings++
+		if findings > maxFindingsPerFile {
+			return
+		}
+		r.add(&Finding{
+			Check:    check,
+			Severity: severity,
+			Path:     f.Path,
+			Line:     line,
+			Message:  fmt.Sprintf(format, args...),
+		})
+	}
+
+	br := bufio.NewReader(file)
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return errors.WithStack(err)
+		}
+
+		reported := make(map[string]bool)
+		for _, match := range fileURLRegexp.FindAllString(line, -1) {
+			add(lineNumber, SeverityError, "file-url", "references (%s), which only exists on the machine the game was made on", match)
+		}
+
+		if markup {
+			var refs []string
+			for _, m := range attributeRegexp.FindAllStringSubmatch(line, -1) {
+				refs = append(refs, m[1])
+			}
+			for _, m := range cssURLRegexp.FindAllStringSubmatch(line, -1) {
+				refs = append(refs, m[1])
+			}
+			for _, ref := range refs {
+				if strings.HasPrefix(ref, "/") && !strings.HasPrefix(ref, "//") {
+					reported[ref] = true
+					add(lineNumber, SeverityError, "absolute-path", "references (%s) by absolute path, use a path relative to the page instead", ref)
+				}
+			}
+		}
+
+		for _, m := range localPathRegexp.FindAllStringSubmatch(line, -1) {
+			if reported[m[1]] {
+				continue
+			}
+			add(lineNumber, SeverityWarning, "absolute-path", "references (%s), which looks like a path on the machine the game was made on", m[1])
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	if findings > maxFindingsPerFile {
+		if r.Truncated == nil {
+			r.Truncated = make(map[string]int)
+		}
+		r.Truncated[f.Path] = findings - maxFindingsPerFile
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package html5_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/itchio/butler/html5"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/wharf/wtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func makeBuild(t *testing.T, files map[string]string) (string, *tlc.Container) {
+	dir, err := ioutil.TempDir("", "html5-tests")
+	wtest.Must(t, err)
+
+	for path, contents := range files {
+		full := filepath.Join(dir, filepath.FromSlash(path))
+		wtest.Must(t, os.MkdirAll(filepath.Dir(full), 0o755))
+		wtest.Must(t, ioutil.WriteFile(full, []byte(contents), 0o644))
+	}
+
+	container, err := tlc.WalkDir(dir, tlc.WalkOpts{})
+	wtest.Must(t, err)
+	return dir, container
+}
+
+func summarize(report *html5.Report) []string {
+	var res []string
+	for _, f := range report.Findings {
+		res = append(res, strings.Join([]string{string(f.Severity), f.Check, f.Path}, " "))
+	}
+	return res
+}
+
+func TestCheck(t *testing.T) {
+	dir, container := makeBuild(t, map[string]string{
+		"game/index.html": `<html>
+<head><link rel="stylesheet" href="style.css"></head>
+<body>
+<script src="/Build/loader.js"></script>
+<script src="//cdn.example.org/lib.js"></script>
+<img src="file:///C:/Users/dev/splash.png">
+</body>
+</html>`,
+		"game/style.css":           `body { background: url("/img/bg.png"); }`,
+		"game/Build/loader.js":     `var data = "Build/game.data.gz"; var dev = "C:\\Users\\dev\\game";`,
+		"game/Build/game.data.gz":  "\x1f\x8bnot really",
+		"game/Build/game.wasm.br":  "whatever",
+		"game/Build/broken.js.gz":  "plain text",
+		"game/TemplateData/bg.png": strings.Repeat("x", 1000),
+	})
+	defer os.RemoveAll(dir)
+
+	report, err := html5.Check(container, dir)
+	wtest.Must(t, err)
+
+	assert.EqualValues(t, "game/index.html", report.IndexPath)
+	assert.EqualValues(t, 7, report.FileCount)
+	assert.EqualValues(t, "game/TemplateData/bg.png", report.LargestFiles[0].Path)
+	assert.EqualValues(t, []*html5.CompressedAsset{
+		{Path: "game/Build/broken.js.gz", ContentEncoding: "gzip"},
+		{Path: "game/Build/game.data.gz", ContentEncoding: "gzip"},
+		{Path: "game/Build/game.wasm.br", ContentEncoding: "br"},
+	}, report.CompressedAssets)
+
+	assert.EqualValues(t, []string{
+		"error compressed-asset game/Build/broken.js.gz",
+		"warning absolute-path game/Build/loader.js",
+		"error absolute-path game/index.html",
+		"error file-url game/index.html",
+		"error absolute-path game/style.css",
+	}, summarize(report))
+	assert.EqualValues(t, 4, report.Findings[2].Line)
+	assert.EqualValues(t, 6, report.Findings[3].Line)
+	assert.True(t, report.Failed())
+}
+
+func TestCheckIndex(t *testing.T) {
+	check := func(files map[string]string) *html5.Report {
+		dir, container := makeBuild(t, files)
+		defer os.RemoveAll(dir)
+
+		report, err := html5.Check(container, dir)
+		wtest.Must(t, err)
+		return report
+	}
+
+	report := check(map[string]string{"index.html": "", "game.js": ""})
+	assert.EqualValues(t, "index.html", report.IndexPath)
+	assert.Empty(t, report.Findings)
+
+	report = check(map[string]string{"Index.html": ""})
+	assert.EqualValues(t, []string{"error index Index.html"}, summarize(report))
+
+	report = check(map[string]string{"game/index.html": "", "README.txt": ""})
+	assert.EqualValues(t, []string{"error index "}, summarize(report))
+	assert.Contains(t, report.Findings[0].Message, "(game/index.html)")
+}
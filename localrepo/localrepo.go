@@ -0,0 +1,402 @@
+// Package localrepo implements a build repository that lives in a local
+// folder instead of on itch.io. It stores channels, builds, patches and
+// signatures in the same formats as wharf, so pushing to it and fetching
+// from it goes through the real diff and patch code paths.
+//
+// A repository looks like this:
+//
+//	channels/<channel>.json     which build is the head of the channel
+//	builds/<id>/build.json      build metadata, only written once complete
+//	builds/<id>/patch.pwr       patch from the parent build (or from nothing)
+//	builds/<id>/signature.pws   signature of the build's contents
+package localrepo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dchest/safefile"
+	"github.com/itchio/savior/filesource"
+	"github.com/itchio/wharf/pwr"
+	"github.com/pkg/errors"
+)
+
+// URLPrefix may be used to explicitly mark a target as local
+const URLPrefix = "file://"
+
+// Repo is a build repository in a local folder
+type Repo struct {
+	Dir string
+}
+
+// Channel is a named series of builds
+type Channel struct {
+	Name string `json:"name"`
+	// Head is the ID of the latest build of the channel
+	Head int64 `json:"head"`
+}
+
+// Build is a single version of the contents of a channel
+type Build struct {
+	ID int64 `json:"id"`
+	// ParentID is the build this one was diffed against, 0 for
+	// the first build of a channel
+	ParentID    int64     `json:"parentId"`
+	Channel     string    `json:"channel"`
+	Version     int64     `json:"version"`
+	UserVersion string    `json:"userVersion"`
+	CreatedAt   time.Time `json:"createdAt"`
+
+	// Size is the total size of the build's files
+	Size          int64 `json:"size"`
+	PatchSize     int64 `json:"patchSize"`
+	SignatureSize int64 `json:"signatureSize"`
+}
+
+// IsTarget returns true if target designates a local repository rather
+// than an itch.io project: file:// URLs, and paths starting with
+// '.', '/' or a drive letter.
+func IsTarget(target string) bool {
+	if strings.HasPrefix(target, URLPrefix) {
+		return true
+	}
+	if strings.HasPrefix(target, ".") || strings.HasPrefix(target, "/") || strings.HasPrefix(target, `\`) {
+		return true
+	}
+	return len(target) >= 3 && target[1] == ':' && (target[2] == '\\' || target[2] == '/')
+}
+
+// ParseTarget splits a target of the form 'path/to/repo:channel' into
+// the repository's folder and the channel, which may be empty.
+func ParseTarget(target string) (dir string, channel string, err error) {
+	target = strings.TrimPrefix(target, URLPrefix)
+
+	dir = target
+	if i := strings.LastIndex(target, ":"); i != -1 {
+		candidate := target[i+1:]
+		// a drive letter's colon isn't a channel separator
+		if !strings.ContainsAny(candidate, `/\`) {
+			dir = target[:i]
+			channel = candidate
+		}
+	}
+
+	if dir == "" || channel == "." || channel == ".." {
+		return "", "", errors.Errorf("invalid local target: %s, expected something like ./repo:channel", target)
+	}
+	return dir, channel, nil
+}
+
+// Open returns the repository in dir. Nothing is created on
+// disk until the first build is pushed.
+func Open(dir string) (*Repo, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	stats, err := os.Stat(absDir)
+	if err == nil && !stats.IsDir() {
+		return nil, errors.Errorf("%s is not a directory, can't use it as a build repository", dir)
+	}
+
+	return &Repo{Dir: absDir}, nil
+}
+
+func (r *Repo) channelsDir() string {
+	return filepath.Join(r.Dir, "channels")
+}
+
+func (r *Repo) channelPath(name string) string {
+	return filepath.Join(r.channelsDir(), name+".json")
+}
+
+func (r *Repo) buildsDir() string {
+	return filepath.Join(r.Dir, "builds")
+}
+
+func (r *Repo) buildDir(id int64) string {
+	return filepath.Join(r.buildsDir(), strconv.FormatInt(id, 10))
+}
+
+// PatchPath returns where the patch of a build is stored
+func (r *Repo) PatchPath(id int64) string {
+	return filepath.Join(r.buildDir(id), "patch.pwr")
+}
+
+// SignaturePath returns where the signature of a build is stored
+func (r *Repo) SignaturePath(id int64) string {
+	return filepath.Join(r.buildDir(id), "signature.pws")
+}
+
+func (r *Repo) buildPath(id int64) string {
+	return filepath.Join(r.buildDir(id), "build.json")
+}
+
+// Channels returns all channels of the repository, sorted by name
+func (r *Repo) Channels() ([]*Channel, error) {
+	entries, err := ioutil.ReadDir(r.channelsDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+
+	var channels []*Channel
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		ch, err := r.Channel(strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			return nil, err
+		}
+		channels = append(channels, ch)
+	}
+
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].Name < channels[j].Name
+	})
+	return channels, nil
+}
+
+// Channel returns a channel, or nil if nothing was ever pushed to it
+func (r *Repo) Channel(name string) (*Channel, error) {
+	ch := &Channel{}
+	err := readJSON(r.channelPath(name), ch)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return ch, nil
+}
+
+// Build returns a build by ID. It errors out if the build doesn't
+// exist or was never completed.
+func (r *Repo) Build(id int64) (*Build, error) {
+	b := &Build{}
+	err := readJSON(r.buildPath(id), b)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			return nil, errors.Errorf("build %d not found in %s", id, r.Dir)
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+// Head returns the latest build of a channel, or nil if it doesn't
+// have any builds yet
+func (r *Repo) Head(channel string) (*Build, error) {
+	ch, err := r.Channel(channel)
+	if err != nil {
+		return nil, err
+	}
+	if ch == nil || ch.Head == 0 {
+		return nil, nil
+	}
+	return r.Build(ch.Head)
+}
+
+// Builds returns all complete builds of a channel, newest first
+func (r *Repo) Builds(channel string) ([]*Build, error) {
+	entries, err := ioutil.ReadDir(r.buildsDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+
+	var builds []*Build
+	for _, entry := range entries {
+		id, err := strconv.ParseInt(entry.Name(), 10, 64)
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+
+		b := &Build{}
+		err = readJSON(r.buildPath(id), b)
+		if err != nil {
+			if os.IsNotExist(errors.Cause(err)) {
+				// still being pushed, or aborted
+				continue
+			}
+			return nil, err
+		}
+		if b.Channel == channel {
+			builds = append(builds, b)
+		}
+	}
+
+	sort.Slice(builds, func(i, j int) bool {
+		return builds[i].ID > builds[j].ID
+	})
+	return builds, nil
+}
+
+// ReadSignature reads the signature of a build
+func (r *Repo) ReadSignature(id int64) (*pwr.SignatureInfo, error) {
+	signatureSource, err := filesource.Open(r.SignaturePath(id))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer signatureSource.Close()
+
+	sig, err := pwr.ReadSignature(context.Background(), signatureSource)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading signature of build %d", id)
+	}
+	return sig, nil
+}
+
+// PendingBuild is a build whose patch and signature are being written.
+// It only shows up in the repository once it's committed.
+type PendingBuild struct {
+	Build *Build
+	repo  *Repo
+}
+
+// CreateBuild allocates a new build on a channel, whose parent is the
+// channel's current head.
+func (r *Repo) CreateBuild(channel string, userVersion string) (*PendingBuild, error) {
+	head, err := r.Head(channel)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Build{
+		Channel:     channel,
+		UserVersion: userVersion,
+		Version:     1,
+		CreatedAt:   time.Now().UTC(),
+	}
+	if head != nil {
+		b.ParentID = head.ID
+		b.Version = head.Version + 1
+	}
+
+	err = os.MkdirAll(r.buildsDir(), 0o755)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	b.ID, err = r.allocateID()
+	if err != nil {
+		return nil, err
+	}
+
+	return &PendingBuild{Build: b, repo: r}, nil
+}
+
+// allocateID creates the folder of a new build and returns its ID.
+// Creating a folder is atomic, so concurrent pushes can't get the same ID.
+func (r *Repo) allocateID() (int64, error) {
+	entries, err := ioutil.ReadDir(r.buildsDir())
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	var id int64
+	for _, entry := range entries {
+		if n, err := strconv.ParseInt(entry.Name(), 10, 64); err == nil && n > id {
+			id = n
+		}
+	}
+
+	for {
+		id++
+		err := os.Mkdir(r.buildDir(id), 0o755)
+		if err == nil {
+			return id, nil
+		}
+		if !os.IsExist(err) {
+			return 0, errors.WithStack(err)
+		}
+	}
+}
+
+// PatchPath is where the patch should be written
+func (pb *PendingBuild) PatchPath() string {
+	return pb.repo.PatchPath(pb.Build.ID)
+}
+
+// SignaturePath is where the signature should be written
+func (pb *PendingBuild) SignaturePath() string {
+	return pb.repo.SignaturePath(pb.Build.ID)
+}
+
+// Commit records the build as complete and makes it the head of its channel
+func (pb *PendingBuild) Commit() error {
+	r := pb.repo
+	b := pb.Build
+
+	err := writeJSON(r.buildPath(b.ID), b)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(r.channelsDir(), 0o755)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return writeJSON(r.channelPath(b.Channel), &Channel{
+		Name: b.Channel,
+		Head: b.ID,
+	})
+}
+
+// Abort removes everything that was written for the build
+func (pb *PendingBuild) Abort() error {
+	return os.RemoveAll(pb.repo.buildDir(pb.Build.ID))
+}
+
+// String returns a human-readable description of the repository
+func (r *Repo) String() string {
+	return fmt.Sprintf("local repository %s", r.Dir)
+}
+
+func readJSON(path string, v interface{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	err = json.NewDecoder(f).Decode(v)
+	if err != nil {
+		return errors.Wrapf(err, "decoding %s", path)
+	}
+	return nil
+}
+
+func writeJSON(path string, v interface{}) error {
+	f, err := safefile.Create(path, 0o644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(v)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return f.Commit()
+}
@@ -0,0 +1,154 @@
+package localrepo_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/itchio/butler/localrepo"
+	"github.com/itchio/headway/state"
+	"github.com/itchio/lake/pools"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/wsync"
+	"github.com/itchio/wharf/wtest"
+	"github.com/stretchr/testify/assert"
+
+	_ "github.com/itchio/wharf/compressors/cbrotli"
+	_ "github.com/itchio/wharf/decompressors/cbrotli"
+)
+
+func TestParseTarget(t *testing.T) {
+	assert.True(t, localrepo.IsTarget("./repo:linux"))
+	assert.True(t, localrepo.IsTarget("/srv/builds:linux"))
+	assert.True(t, localrepo.IsTarget("file://repo:linux"))
+	assert.True(t, localrepo.IsTarget(`C:\builds:windows`))
+	assert.False(t, localrepo.IsTarget("leafo/x-moon:win-64"))
+
+	dir, channel, err := localrepo.ParseTarget("./repo:linux")
+	wtest.Must(t, err)
+	assert.EqualValues(t, "./repo", dir)
+	assert.EqualValues(t, "linux", channel)
+
+	dir, channel, err = localrepo.ParseTarget(`C:\builds`)
+	wtest.Must(t, err)
+	assert.EqualValues(t, `C:\builds`, dir)
+	assert.EqualValues(t, "", channel)
+
+	_, _, err = localrepo.ParseTarget("file://:linux")
+	assert.Error(t, err)
+	_, _, err = localrepo.ParseTarget("./repo:..")
+	assert.Error(t, err)
+}
+
+func TestPushAndMaterialize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "localrepo-tests")
+	wtest.Must(t, err)
+	defer os.RemoveAll(dir)
+
+	consumer := &state.Consumer{}
+	repo, err := localrepo.Open(filepath.Join(dir, "repo"))
+	wtest.Must(t, err)
+
+	head, err := repo.Head("linux")
+	wtest.Must(t, err)
+	assert.Nil(t, head)
+
+	buildDir := filepath.Join(dir, "build")
+	writeFile := func(name string, contents string) {
+		path := filepath.Join(buildDir, name)
+		wtest.Must(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		wtest.Must(t, ioutil.WriteFile(path, []byte(contents), 0o644))
+	}
+
+	push := func(userVersion string) *localrepo.Build {
+		pending, err := repo.CreateBuild("linux", userVersion)
+		wtest.Must(t, err)
+
+		targetSignature := &pwr.SignatureInfo{
+			Container: &tlc.Container{},
+			Hashes:    make([]wsync.BlockHash, 0),
+		}
+		if pending.Build.ParentID != 0 {
+			targetSignature, err = repo.ReadSignature(pending.Build.ParentID)
+			wtest.Must(t, err)
+		}
+
+		container, err := tlc.WalkAny(buildDir, tlc.WalkOpts{})
+		wtest.Must(t, err)
+		pool, err := pools.New(container, buildDir)
+		wtest.Must(t, err)
+		defer pool.Close()
+
+		patchFile, err := os.Create(pending.PatchPath())
+		wtest.Must(t, err)
+		defer patchFile.Close()
+		signatureFile, err := os.Create(pending.SignaturePath())
+		wtest.Must(t, err)
+		defer signatureFile.Close()
+
+		dctx := &pwr.DiffContext{
+			Compression: &pwr.CompressionSettings{
+				Algorithm: pwr.CompressionAlgorithm_BROTLI,
+				Quality:   1,
+			},
+			SourceContainer: container,
+			Pool:            pool,
+			TargetContainer: targetSignature.Container,
+			TargetSignature: targetSignature.Hashes,
+			Consumer:        consumer,
+		}
+		// WritePatch closes both files once it is done
+		wtest.Must(t, dctx.WritePatch(context.Background(), patchFile, signatureFile))
+
+		pending.Build.Size = container.Size
+		wtest.Must(t, pending.Commit())
+		return pending.Build
+	}
+
+	writeFile("game.sh", "#!/bin/sh\necho v1\n")
+	writeFile("data/level1.dat", "level one")
+	first := push("1.0")
+	assert.EqualValues(t, 0, first.ParentID)
+	assert.EqualValues(t, 1, first.Version)
+
+	writeFile("game.sh", "#!/bin/sh\necho v2\n")
+	wtest.Must(t, os.Remove(filepath.Join(buildDir, "data", "level1.dat")))
+	writeFile("data/level2.dat", "level two")
+	second := push("1.1")
+	assert.EqualValues(t, first.ID, second.ParentID)
+	assert.EqualValues(t, 2, second.Version)
+
+	head, err = repo.Head("linux")
+	wtest.Must(t, err)
+	assert.EqualValues(t, second.ID, head.ID)
+	assert.EqualValues(t, "1.1", head.UserVersion)
+
+	channels, err := repo.Channels()
+	wtest.Must(t, err)
+	assert.Len(t, channels, 1)
+
+	// pending builds don't show up until they're committed
+	pending, err := repo.CreateBuild("linux", "")
+	wtest.Must(t, err)
+	_, err = repo.Build(pending.Build.ID)
+	assert.Error(t, err)
+	wtest.Must(t, pending.Abort())
+
+	outDir := filepath.Join(dir, "out")
+	wtest.Must(t, repo.Materialize(second.ID, outDir, consumer))
+
+	contents, err := ioutil.ReadFile(filepath.Join(outDir, "game.sh"))
+	wtest.Must(t, err)
+	assert.EqualValues(t, "#!/bin/sh\necho v2\n", string(contents))
+	_, err = os.Stat(filepath.Join(outDir, "data", "level1.dat"))
+	assert.True(t, os.IsNotExist(err))
+
+	oldDir := filepath.Join(dir, "old")
+	wtest.Must(t, repo.Materialize(first.ID, oldDir, consumer))
+	contents, err = ioutil.ReadFile(filepath.Join(oldDir, "data", "level1.dat"))
+	wtest.Must(t, err)
+	assert.EqualValues(t, "level one", string(contents))
+}
@@ -0,0 +1,114 @@
+package localrepo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/itchio/headway/state"
+	"github.com/itchio/savior/filesource"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/pwr/patcher"
+	"github.com/pkg/errors"
+)
+
+// Chain returns the builds that need to be applied, in order, to
+// end up with the contents of the given build: its ancestors up to
+// the first build of the channel, then the build itself.
+func (r *Repo) Chain(id int64) ([]*Build, error) {
+	var chain []*Build
+	seen := make(map[int64]bool)
+
+	for id != 0 {
+		if seen[id] {
+			return nil, errors.Errorf("build %d is its own ancestor", id)
+		}
+		seen[id] = true
+
+		b, err := r.Build(id)
+		if err != nil {
+			return nil, err
+		}
+		chain = append([]*Build{b}, chain...)
+		id = b.ParentID
+	}
+
+	return chain, nil
+}
+
+// Materialize writes the contents of a build to outDir, which must be
+// empty, by applying the patches of all its ancestors in turn. The
+// result is checked against the build's signature.
+func (r *Repo) Materialize(id int64, outDir string, consumer *state.Consumer) error {
+	chain, err := r.Chain(id)
+	if err != nil {
+		return err
+	}
+
+	scratchDir, err := ioutil.TempDir("", "butler-localrepo")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.RemoveAll(scratchDir)
+
+	// the first build is a patch from nothing
+	previousDir := filepath.Join(scratchDir, "empty")
+	err = os.MkdirAll(previousDir, 0o755)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for i, b := range chain {
+		stepDir := outDir
+		if i < len(chain)-1 {
+			stepDir = filepath.Join(scratchDir, strconv.FormatInt(b.ID, 10))
+		}
+
+		consumer.Infof("Applying patch of build %d (%d/%d)", b.ID, i+1, len(chain))
+		err := r.applyPatch(b.ID, previousDir, stepDir, consumer)
+		if err != nil {
+			return errors.Wrapf(err, "applying patch of build %d", b.ID)
+		}
+
+		if previousDir != outDir {
+			err = os.RemoveAll(previousDir)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		previousDir = stepDir
+	}
+
+	sig, err := r.ReadSignature(id)
+	if err != nil {
+		return err
+	}
+
+	err = pwr.AssertValid(outDir, sig)
+	if err != nil {
+		return errors.Wrapf(err, "verifying build %d", id)
+	}
+
+	err = pwr.AssertNoGhosts(outDir, sig)
+	if err != nil {
+		return errors.Wrapf(err, "verifying build %d", id)
+	}
+
+	return nil
+}
+
+func (r *Repo) applyPatch(id int64, targetDir string, outputDir string, consumer *state.Consumer) error {
+	patchSource, err := filesource.Open(r.PatchPath(id))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer patchSource.Close()
+
+	return patcher.PatchFresh(patcher.PatchFreshParams{
+		PatchReader: patchSource,
+		TargetDir:   targetDir,
+		OutputDir:   outputDir,
+		Consumer:    consumer,
+	})
+}
@@ -0,0 +1,77 @@
+package machoinfo
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Bundle is what we know about a macOS app bundle, mostly
+// from its Info.plist
+type Bundle struct {
+	Identifier           string `json:"identifier,omitempty"`
+	Name                 string `json:"name,omitempty"`
+	Version              string `json:"version,omitempty"`
+	MinimumSystemVersion string `json:"minimumSystemVersion,omitempty"`
+	// Executable is the path of the main executable, relative to
+	// the bundle, with forward slashes.
+	Executable string `json:"executable"`
+	// ExecutableInfo is nil if the main executable is missing
+	// or isn't a Mach-O file.
+	ExecutableInfo *Info `json:"executableInfo,omitempty"`
+	// ExecutableError is why ExecutableInfo is nil
+	ExecutableError string `json:"executableError,omitempty"`
+}
+
+// ProbeBundle reads the Info.plist of the app bundle at bundlePath
+// (for example 'Game.app') to find its main executable, then probes it.
+// Only a missing or unreadable Info.plist is an error.
+func ProbeBundle(bundlePath string, params ProbeParams) (*Bundle, error) {
+	consumer := params.Consumer
+
+	plistPath := filepath.Join(bundlePath, "Contents", "Info.plist")
+	contents, err := ioutil.ReadFile(plistPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading app bundle Info.plist")
+	}
+
+	values, err := readPlist(contents)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", plistPath)
+	}
+
+	b := &Bundle{
+		Identifier:           values["CFBundleIdentifier"],
+		Name:                 values["CFBundleName"],
+		Version:              values["CFBundleShortVersionString"],
+		MinimumSystemVersion: values["LSMinimumSystemVersion"],
+	}
+
+	executable := values["CFBundleExecutable"]
+	if executable == "" {
+		// macOS won't launch those, but the executable is
+		// usually named after the bundle anyway
+		executable = strings.TrimSuffix(filepath.Base(bundlePath), filepath.Ext(bundlePath))
+		consumer.Debugf("No CFBundleExecutable in Info.plist, guessing (%s)", executable)
+	}
+	b.Executable = path.Join("Contents", "MacOS", executable)
+
+	err = func() error {
+		f, err := os.Open(filepath.Join(bundlePath, filepath.FromSlash(b.Executable)))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		b.ExecutableInfo, err = Probe(f, params)
+		return err
+	}()
+	if err != nil {
+		b.ExecutableError = err.Error()
+	}
+	return b, nil
+}
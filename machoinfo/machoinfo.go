@@ -0,0 +1,235 @@
+// Package machoinfo inspects Mach-O binaries, thin or universal, and
+// macOS app bundles, without relying on any macOS tooling.
+package machoinfo
+
+import (
+	"bytes"
+	"debug/macho"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/itchio/headway/state"
+	"github.com/pkg/errors"
+)
+
+// Arch is the name Apple tools give to a CPU type
+type Arch string
+
+const (
+	Arch386   Arch = "i386"
+	ArchAmd64 Arch = "x86_64"
+	ArchArm   Arch = "arm"
+	ArchArm64 Arch = "arm64"
+	ArchPpc   Arch = "ppc"
+	ArchPpc64 Arch = "ppc64"
+)
+
+// Info describes a Mach-O file
+type Info struct {
+	// Universal is set for fat binaries, which hold one slice
+	// per architecture
+	Universal bool     `json:"universal"`
+	Slices    []*Slice `json:"slices"`
+}
+
+// Archs returns the architecture of each slice, in file order
+func (i *Info) Archs() []Arch {
+	var archs []Arch
+	for _, s := range i.Slices {
+		archs = append(archs, s.Arch)
+	}
+	return archs
+}
+
+// Slice is the part of a Mach-O file for a single architecture.
+// Thin files only have one.
+type Slice struct {
+	Arch Arch `json:"arch"`
+	// Type is executable, dylib, bundle or object
+	Type string `json:"type"`
+	// Platform is macos, ios, tvos, watchos or maccatalyst, if the slice says
+	Platform string `json:"platform,omitempty"`
+	// MinOSVersion is the oldest version of Platform the slice runs on
+	MinOSVersion string `json:"minOsVersion,omitempty"`
+	SDKVersion   string `json:"sdkVersion,omitempty"`
+	// Dylibs are the libraries the slice links against, weakly or not
+	Dylibs []string `json:"dylibs"`
+	// Rpaths are where @rpath/ references in Dylibs are looked up
+	Rpaths     []string `json:"rpaths"`
+	CodeSigned bool     `json:"codeSigned"`
+}
+
+// ProbeParams controls Probe and ProbeBundle
+type ProbeParams struct {
+	Consumer *state.Consumer
+}
+
+const (
+	loadCmdCodeSignature   macho.LoadCmd = 0x1d
+	loadCmdLazyLoadDylib   macho.LoadCmd = 0x20
+	loadCmdVersionMinOSX   macho.LoadCmd = 0x24
+	loadCmdVersionMinIOS   macho.LoadCmd = 0x25
+	loadCmdVersionMinTV    macho.LoadCmd = 0x2f
+	loadCmdVersionMinWatch macho.LoadCmd = 0x30
+	loadCmdBuildVersion    macho.LoadCmd = 0x32
+	loadCmdWeakDylib       macho.LoadCmd = 0x80000018
+	loadCmdRpath           macho.LoadCmd = 0x8000001c
+	loadCmdReexportDylib   macho.LoadCmd = 0x8000001f
+	loadCmdUpwardDylib     macho.LoadCmd = 0x80000023
+)
+
+// Probe parses a thin or universal Mach-O file
+func Probe(r io.ReaderAt, params ProbeParams) (*Info, error) {
+	consumer := params.Consumer
+
+	magic := make([]byte, 4)
+	_, err := r.ReadAt(magic, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading Mach-O magic")
+	}
+
+	if binary.BigEndian.Uint32(magic) == macho.MagicFat {
+		ff, err := macho.NewFatFile(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing universal Mach-O file")
+		}
+		info := &Info{Universal: true}
+		for _, arch := range ff.Arches {
+			consumer.Debugf("Parsing %s slice at offset %d", arch.Cpu, arch.Offset)
+			info.Slices = append(info.Slices, parseSlice(arch.File))
+		}
+		return info, nil
+	}
+
+	f, err := macho.NewFile(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing Mach-O file")
+	}
+	return &Info{
+		Slices: []*Slice{parseSlice(f)},
+	}, nil
+}
+
+func parseSlice(f *macho.File) *Slice {
+	s := &Slice{
+		Arch:   archOf(f.Cpu),
+		Type:   typeOf(f.Type),
+		Dylibs: []string{},
+		Rpaths: []string{},
+	}
+
+	bo := f.ByteOrder
+	for _, load := range f.Loads {
+		raw := load.Raw()
+		if len(raw) < 8 {
+			continue
+		}
+		word := func(offset int) uint32 {
+			if offset+4 > len(raw) {
+				return 0
+			}
+			return bo.Uint32(raw[offset:])
+		}
+
+		switch macho.LoadCmd(word(0)) {
+		case macho.LoadCmdDylib, loadCmdWeakDylib, loadCmdReexportDylib, loadCmdLazyLoadDylib, loadCmdUpwardDylib:
+			s.Dylibs = append(s.Dylibs, cstring(raw, word(8)))
+		case loadCmdRpath:
+			s.Rpaths = append(s.Rpaths, cstring(raw, word(8)))
+		case loadCmdCodeSignature:
+			s.CodeSigned = true
+		case loadCmdVersionMinOSX:
+			s.Platform = "macos"
+			s.MinOSVersion, s.SDKVersion = version(word(8)), version(word(12))
+		case loadCmdVersionMinIOS:
+			s.Platform = "ios"
+			s.MinOSVersion, s.SDKVersion = version(word(8)), version(word(12))
+		case loadCmdVersionMinTV:
+			s.Platform = "tvos"
+			s.MinOSVersion, s.SDKVersion = version(word(8)), version(word(12))
+		case loadCmdVersionMinWatch:
+			s.Platform = "watchos"
+			s.MinOSVersion, s.SDKVersion = version(word(8)), version(word(12))
+		case loadCmdBuildVersion:
+			s.Platform = platformOf(word(8))
+			s.MinOSVersion, s.SDKVersion = version(word(12)), version(word(16))
+		}
+	}
+	return s
+}
+
+func archOf(cpu macho.Cpu) Arch {
+	switch cpu {
+	case macho.Cpu386:
+		return Arch386
+	case macho.CpuAmd64:
+		return ArchAmd64
+	case macho.CpuArm:
+		return ArchArm
+	case macho.CpuArm64:
+		return ArchArm64
+	case macho.CpuPpc:
+		return ArchPpc
+	case macho.CpuPpc64:
+		return ArchPpc64
+	}
+	return Arch(fmt.Sprintf("cpu%d", uint32(cpu)))
+}
+
+func typeOf(t macho.Type) string {
+	switch t {
+	case macho.TypeExec:
+		return "executable"
+	case macho.TypeDylib:
+		return "dylib"
+	case macho.TypeBundle:
+		return "bundle"
+	case macho.TypeObj:
+		return "object"
+	}
+	return fmt.Sprintf("type%d", uint32(t))
+}
+
+// platformOf maps the platforms of LC_BUILD_VERSION to names
+func platformOf(platform uint32) string {
+	switch platform {
+	case 1:
+		return "macos"
+	case 2:
+		return "ios"
+	case 3:
+		return "tvos"
+	case 4:
+		return "watchos"
+	case 6:
+		return "maccatalyst"
+	}
+	return fmt.Sprintf("platform%d", platform)
+}
+
+// version decodes versions packed as xxxx.yy.zz, leaving
+// out the patch number when it's zero, like Apple tools do.
+func version(v uint32) string {
+	if v == 0 {
+		return ""
+	}
+	res := fmt.Sprintf("%d.%d", v>>16, (v>>8)&0xff)
+	if patch := v & 0xff; patch != 0 {
+		res += fmt.Sprintf(".%d", patch)
+	}
+	return res
+}
+
+// cstring reads the NUL-terminated string at offset in a load command
+func cstring(raw []byte, offset uint32) string {
+	if int(offset) >= len(raw) {
+		return ""
+	}
+	s := raw[offset:]
+	if i := bytes.IndexByte(s, 0); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(string(s))
+}
@@ -0,0 +1,203 @@
+package machoinfo_test
+
+import (
+	"bytes"
+	"debug/macho"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/itchio/butler/machoinfo"
+	"github.com/itchio/wharf/wtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func loadCmd(t *testing.T, cmd uint32, fields []uint32, str string) []byte {
+	buf := new(bytes.Buffer)
+	size := 8 + 4*len(fields)
+	if str != "" {
+		size += len(str) + 1
+		size = (size + 7) &^ 7
+	}
+	le := binary.LittleEndian
+	wtest.Must(t, binary.Write(buf, le, cmd))
+	wtest.Must(t, binary.Write(buf, le, uint32(size)))
+	wtest.Must(t, binary.Write(buf, le, fields))
+	buf.WriteString(str)
+	for buf.Len() < size {
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+func dylib(t *testing.T, cmd uint32, name string) []byte {
+	// name offset, timestamp, current version, compatibility version
+	return loadCmd(t, cmd, []uint32{24, 2, 0x10000, 0x10000}, name)
+}
+
+func rpath(t *testing.T, p string) []byte {
+	return loadCmd(t, 0x8000001c, []uint32{12}, p)
+}
+
+func makeMacho(t *testing.T, cpu macho.Cpu, loads ...[]byte) []byte {
+	var cmds []byte
+	for _, load := range loads {
+		cmds = append(cmds, load...)
+	}
+
+	buf := new(bytes.Buffer)
+	le := binary.LittleEndian
+	wtest.Must(t, binary.Write(buf, le, macho.FileHeader{
+		Magic: macho.Magic64,
+		Cpu:   cpu,
+		Type:  macho.TypeExec,
+		Ncmd:  uint32(len(loads)),
+		Cmdsz: uint32(len(cmds)),
+	}))
+	// reserved field of 64-bit headers
+	wtest.Must(t, binary.Write(buf, le, uint32(0)))
+	buf.Write(cmds)
+	return buf.Bytes()
+}
+
+func makeFat(t *testing.T, slices ...[]byte) []byte {
+	const align = 12
+	buf := new(bytes.Buffer)
+	be := binary.BigEndian
+	wtest.Must(t, binary.Write(buf, be, []uint32{macho.MagicFat, uint32(len(slices))}))
+
+	offset := uint32(1 << align)
+	for _, slice := range slices {
+		f, err := macho.NewFile(bytes.NewReader(slice))
+		wtest.Must(t, err)
+		wtest.Must(t, binary.Write(buf, be, []uint32{uint32(f.Cpu), f.SubCpu, offset, uint32(len(slice)), align}))
+		offset += (uint32(len(slice)) + (1<<align - 1)) &^ (1<<align - 1)
+	}
+	for _, slice := range slices {
+		for buf.Len()%(1<<align) != 0 {
+			buf.WriteByte(0)
+		}
+		buf.Write(slice)
+	}
+	return buf.Bytes()
+}
+
+func TestProbeThin(t *testing.T) {
+	exe := makeMacho(t, macho.CpuAmd64,
+		// LC_VERSION_MIN_MACOSX, 10.9 with the 10.14.6 SDK
+		loadCmd(t, 0x24, []uint32{0x0a0900, 0x0a0e06}, ""),
+		dylib(t, uint32(macho.LoadCmdDylib), "/usr/lib/libSystem.B.dylib"),
+		dylib(t, 0x80000018, "@rpath/libsteam_api.dylib"),
+		rpath(t, "@executable_path/../Frameworks"),
+	)
+
+	info, err := machoinfo.Probe(bytes.NewReader(exe), machoinfo.ProbeParams{})
+	wtest.Must(t, err)
+
+	assert.False(t, info.Universal)
+	assert.EqualValues(t, []machoinfo.Arch{machoinfo.ArchAmd64}, info.Archs())
+	assert.EqualValues(t, &machoinfo.Slice{
+		Arch:         machoinfo.ArchAmd64,
+		Type:         "executable",
+		Platform:     "macos",
+		MinOSVersion: "10.9",
+		SDKVersion:   "10.14.6",
+		Dylibs:       []string{"/usr/lib/libSystem.B.dylib", "@rpath/libsteam_api.dylib"},
+		Rpaths:       []string{"@executable_path/../Frameworks"},
+	}, info.Slices[0])
+
+	_, err = machoinfo.Probe(bytes.NewReader([]byte("#!/bin/sh\necho hi\n")), machoinfo.ProbeParams{})
+	assert.Error(t, err)
+}
+
+func TestProbeUniversal(t *testing.T) {
+	intel := makeMacho(t, macho.CpuAmd64,
+		loadCmd(t, 0x24, []uint32{0x0a0d00, 0}, ""),
+		dylib(t, uint32(macho.LoadCmdDylib), "/usr/lib/libSystem.B.dylib"),
+	)
+	arm := makeMacho(t, macho.CpuArm64,
+		// LC_BUILD_VERSION for macOS 11.0, SDK 12.3, no tools
+		loadCmd(t, 0x32, []uint32{1, 0x0b0000, 0x0c0300, 0}, ""),
+		dylib(t, uint32(macho.LoadCmdDylib), "/usr/lib/libSystem.B.dylib"),
+		// LC_CODE_SIGNATURE, arm64 binaries are always signed
+		loadCmd(t, 0x1d, []uint32{0x4000, 0x100}, ""),
+	)
+
+	info, err := machoinfo.Probe(bytes.NewReader(makeFat(t, intel, arm)), machoinfo.ProbeParams{})
+	wtest.Must(t, err)
+
+	assert.True(t, info.Universal)
+	assert.EqualValues(t, []machoinfo.Arch{machoinfo.ArchAmd64, machoinfo.ArchArm64}, info.Archs())
+
+	assert.EqualValues(t, "10.13", info.Slices[0].MinOSVersion)
+	assert.Empty(t, info.Slices[0].SDKVersion)
+	assert.False(t, info.Slices[0].CodeSigned)
+
+	assert.EqualValues(t, "macos", info.Slices[1].Platform)
+	assert.EqualValues(t, "11.0", info.Slices[1].MinOSVersion)
+	assert.EqualValues(t, "12.3", info.Slices[1].SDKVersion)
+	assert.True(t, info.Slices[1].CodeSigned)
+	assert.Empty(t, info.Slices[1].Rpaths)
+}
+
+func TestProbeBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "machoinfo")
+	wtest.Must(t, err)
+	defer os.RemoveAll(dir)
+
+	bundle := filepath.Join(dir, "Game.app")
+	wtest.Must(t, os.MkdirAll(filepath.Join(bundle, "Contents", "MacOS"), 0o755))
+	wtest.Must(t, ioutil.WriteFile(filepath.Join(bundle, "Contents", "MacOS", "Game Launcher"), makeMacho(t, macho.CpuArm64), 0o755))
+	wtest.Must(t, ioutil.WriteFile(filepath.Join(bundle, "Contents", "Info.plist"), []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>CFBundleDocumentTypes</key>
+	<array>
+		<dict>
+			<key>CFBundleExecutable</key>
+			<string>not this one</string>
+		</dict>
+	</array>
+	<key>CFBundleExecutable</key>
+	<string>Game Launcher</string>
+	<key>CFBundleIdentifier</key>
+	<string>io.itch.game</string>
+	<key>NSHighResolutionCapable</key>
+	<true/>
+	<key>LSMinimumSystemVersion</key>
+	<string>11.0</string>
+</dict>
+</plist>
+`), 0o644))
+
+	b, err := machoinfo.ProbeBundle(bundle, machoinfo.ProbeParams{})
+	wtest.Must(t, err)
+	assert.EqualValues(t, "Contents/MacOS/Game Launcher", b.Executable)
+	assert.EqualValues(t, "io.itch.game", b.Identifier)
+	assert.EqualValues(t, "11.0", b.MinimumSystemVersion)
+	assert.Empty(t, b.ExecutableError)
+	if assert.NotNil(t, b.ExecutableInfo) {
+		assert.EqualValues(t, []machoinfo.Arch{machoinfo.ArchArm64}, b.ExecutableInfo.Archs())
+	}
+
+	// binary plist, made with python's plistlib
+	contents, err := ioutil.ReadFile(filepath.Join("testdata", "Info.bplist"))
+	wtest.Must(t, err)
+	wtest.Must(t, ioutil.WriteFile(filepath.Join(bundle, "Contents", "Info.plist"), contents, 0o644))
+
+	b, err = machoinfo.ProbeBundle(bundle, machoinfo.ProbeParams{})
+	wtest.Must(t, err)
+	assert.EqualValues(t, "Contents/MacOS/Game", b.Executable)
+	assert.EqualValues(t, "Jeu vidéo", b.Name)
+	assert.EqualValues(t, "1.2.0", b.Version)
+	assert.EqualValues(t, "10.13", b.MinimumSystemVersion)
+	assert.Nil(t, b.ExecutableInfo)
+	assert.NotEmpty(t, b.ExecutableError)
+
+	wtest.Must(t, os.Remove(filepath.Join(bundle, "Contents", "Info.plist")))
+	_, err = machoinfo.ProbeBundle(bundle, machoinfo.ProbeParams{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,228 @@
+package machoinfo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"io"
+	"math"
+	"unicode/utf16"
+
+	"github.com/pkg/errors"
+)
+
+// readPlist returns the string values of the top-level dictionary of
+// a property list, in the XML or binary format. That's all there is
+// to read in an Info.plist to find out what a bundle is, so nested
+// values and other types are left out.
+func readPlist(contents []byte) (map[string]string, error) {
+	if bytes.HasPrefix(contents, []byte("bplist00")) {
+		return readBinaryPlist(contents)
+	}
+	return readXMLPlist(contents)
+}
+
+func readXMLPlist(contents []byte) (map[string]string, error) {
+	dec := xml.NewDecoder(bytes.NewReader(contents))
+	// Info.plist files are UTF-8 in practice, whatever they claim
+	dec.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+
+	// find the top-level dict
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, errors.Wrap(err, "looking for top-level dict in plist")
+		}
+		if se, ok := tok.(xml.StartElement); ok && se.Name.Local == "dict" {
+			break
+		}
+	}
+
+	res := make(map[string]string)
+	key := ""
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, errors.Wrap(err, "reading plist dict")
+		}
+
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			switch tok.Name.Local {
+			case "key":
+				err = dec.DecodeElement(&key, &tok)
+			case "string":
+				var value string
+				err = dec.DecodeElement(&value, &tok)
+				res[key] = value
+			default:
+				err = dec.Skip()
+			}
+			if err != nil {
+				return nil, errors.Wrap(err, "reading plist dict")
+			}
+		case xml.EndElement:
+			// end of the top-level dict
+			return res, nil
+		}
+	}
+}
+
+// binaryPlist reads the bplist00 format, as documented in
+// CoreFoundation's CFBinaryPList.c
+type binaryPlist struct {
+	contents   []byte
+	offsets    []uint64
+	objRefSize int
+}
+
+func readBinaryPlist(contents []byte) (map[string]string, error) {
+	if len(contents) < 8+32 {
+		return nil, errors.New("binary plist is truncated")
+	}
+	trailer := contents[len(contents)-32:]
+	offsetIntSize := int(trailer[6])
+	objRefSize := int(trailer[7])
+	numObjects := binary.BigEndian.Uint64(trailer[8:])
+	topObject := binary.BigEndian.Uint64(trailer[16:])
+	offsetTableOffset := binary.BigEndian.Uint64(trailer[24:])
+
+	if offsetIntSize < 1 || offsetIntSize > 8 || objRefSize < 1 || objRefSize > 8 {
+		return nil, errors.Errorf("binary plist has invalid int sizes (%d, %d)", offsetIntSize, objRefSize)
+	}
+	if numObjects > uint64(len(contents)) || offsetTableOffset > uint64(len(contents)) ||
+		offsetTableOffset+numObjects*uint64(offsetIntSize) > uint64(len(contents)) {
+		return nil, errors.New("binary plist has invalid offset table")
+	}
+
+	bp := &binaryPlist{
+		contents:   contents,
+		objRefSize: objRefSize,
+	}
+	for i := uint64(0); i < numObjects; i++ {
+		start := offsetTableOffset + i*uint64(offsetIntSize)
+		bp.offsets = append(bp.offsets, readUint(contents[start:start+uint64(offsetIntSize)]))
+	}
+
+	keys, values, err := bp.readDict(topObject)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]string)
+	for i := range keys {
+		key, ok, err := bp.readString(keys[i])
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		value, ok, err := bp.readString(values[i])
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			res[key] = value
+		}
+	}
+	return res, nil
+}
+
+func readUint(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// object returns the marker of an object, and what follows it
+func (bp *binaryPlist) object(ref uint64) (byte, []byte, error) {
+	if ref >= uint64(len(bp.offsets)) {
+		return 0, nil, errors.Errorf("binary plist refers to invalid object %d", ref)
+	}
+	offset := bp.offsets[ref]
+	if offset >= uint64(len(bp.contents)) {
+		return 0, nil, errors.Errorf("binary plist object %d is out of bounds", ref)
+	}
+	return bp.contents[offset], bp.contents[offset+1:], nil
+}
+
+// length decodes the size that follows markers, which is either in
+// their low nibble, or in an int object right after them.
+func (bp *binaryPlist) length(marker byte, rest []byte) (uint64, []byte, error) {
+	length := uint64(marker & 0xf)
+	if length != 0xf {
+		return length, rest, nil
+	}
+	if len(rest) < 1 || rest[0]&0xf0 != 0x10 {
+		return 0, nil, errors.New("binary plist has invalid length")
+	}
+	size := 1 << (rest[0] & 0xf)
+	if len(rest) < 1+size {
+		return 0, nil, errors.New("binary plist length is truncated")
+	}
+	return readUint(rest[1 : 1+size]), rest[1+size:], nil
+}
+
+func (bp *binaryPlist) readDict(ref uint64) ([]uint64, []uint64, error) {
+	marker, rest, err := bp.object(ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	if marker>>4 != 0xd {
+		return nil, nil, errors.New("binary plist top-level object isn't a dict")
+	}
+	count, rest, err := bp.length(marker, rest)
+	if err != nil {
+		return nil, nil, err
+	}
+	if count > math.MaxInt32 || uint64(len(rest)) < 2*count*uint64(bp.objRefSize) {
+		return nil, nil, errors.New("binary plist dict is truncated")
+	}
+
+	refs := make([]uint64, 2*count)
+	for i := range refs {
+		refs[i] = readUint(rest[i*bp.objRefSize : (i+1)*bp.objRefSize])
+	}
+	return refs[:count], refs[count:], nil
+}
+
+// readString returns false if ref isn't a string
+func (bp *binaryPlist) readString(ref uint64) (string, bool, error) {
+	marker, rest, err := bp.object(ref)
+	if err != nil {
+		return "", false, err
+	}
+
+	switch marker >> 4 {
+	case 0x5:
+		// ASCII
+		length, rest, err := bp.length(marker, rest)
+		if err != nil {
+			return "", false, err
+		}
+		if uint64(len(rest)) < length {
+			return "", false, errors.New("binary plist string is truncated")
+		}
+		return string(rest[:length]), true, nil
+	case 0x6:
+		// UTF-16, big endian
+		length, rest, err := bp.length(marker, rest)
+		if err != nil {
+			return "", false, err
+		}
+		if uint64(len(rest)) < 2*length {
+			return "", false, errors.New("binary plist string is truncated")
+		}
+		units := make([]uint16, length)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(rest[2*i:])
+		}
+		return string(utf16.Decode(units)), true, nil
+	}
+	return "", false, nil
+}
@@ -83,7 +83,7 @@ var appArgs = struct {
 	app.Flag("user-agent", "string to include in user-agent for all http requests").Default("").Hidden().String(),
 	app.Flag("dbpath", "Path of the sqlite database path to use (for butlerd)").Default("").Hidden().String(),
 
-	app.Flag("compression", "Compression algorithm to use when writing patch or signature files").Default("brotli").Hidden().Enum("none", "brotli", "gzip"),
+	app.Flag("compression", "Compression algorithm to use when writing patch or signature files").Default("brotli").Hidden().Enum("none", "brotli", "gzip", "zstd"),
 	app.Flag("quality", "Quality level to use when writing patch or signature files").Default("1").Short('q').Hidden().Int(),
 
 	app.Flag("cpuprofile", "Write CPU profile to given file").Hidden().String(),
@@ -148,6 +148,8 @@ func doMain(args []string) {
 	app.VersionFlag.Short('V')
 	app.Author("itch corp. <support@itch.io>")
 
+	args = ctx.MapStdinArgs(args)
+
 	cmd, err := app.Parse(args)
 	if err != nil {
 		ctx, _ := app.ParseContext(os.Args[1:])
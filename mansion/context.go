@@ -50,6 +50,10 @@ type Context struct {
 	apiAddress string
 	// url of the itch.io web instance we're talking to
 	webAddress string
+
+	// stdinArgs are the positional arguments of each command that
+	// accept "-", see AcceptStdin
+	stdinArgs map[string]map[string]bool
 }
 
 func NewContext(app *kingpin.Application) *Context {
@@ -108,6 +112,8 @@ func (ctx *Context) CompressionSettings() pwr.CompressionSettings {
 		algo = pwr.CompressionAlgorithm_BROTLI
 	case "gzip":
 		algo = pwr.CompressionAlgorithm_GZIP
+	case "zstd":
+		algo = pwr.CompressionAlgorithm_ZSTD
 	default:
 		panic(fmt.Errorf("Unknown compression algorithm: %s", algo))
 	}
@@ -0,0 +1,106 @@
+package mansion
+
+import (
+	"strings"
+
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+// Stdin is what MapStdinArgs turns a "-" argument into, since kingpin
+// refuses a lone "-" argument. Commands pass it on to archivesource,
+// which reads a tar stream from stdin for it.
+const Stdin = "<stdin>"
+
+// AcceptStdin marks positional arguments of a command as accepting
+// "-" to read from stdin. kingpin refuses a lone "-" argument, so
+// MapStdinArgs turns those, and only those, into Stdin
+// before the command line is parsed.
+func (ctx *Context) AcceptStdin(clause *kingpin.CmdClause, argNames ...string) {
+	if ctx.stdinArgs == nil {
+		ctx.stdinArgs = make(map[string]map[string]bool)
+	}
+	names := ctx.stdinArgs[clause.FullCommand()]
+	if names == nil {
+		names = make(map[string]bool)
+		ctx.stdinArgs[clause.FullCommand()] = names
+	}
+	for _, name := range argNames {
+		names[name] = true
+	}
+}
+
+// MapStdinArgs returns a copy of args where each "-" given for an
+// argument marked with AcceptStdin is replaced by Stdin.
+// Flag values and anything after "--" are left alone.
+func (ctx *Context) MapStdinArgs(args []string) []string {
+	res := append([]string(nil), args...)
+	model := ctx.App.Model()
+
+	var cmd *kingpin.CmdModel
+	commands := model.Commands
+	flags := model.Flags
+	positional := 0
+
+	takesValue := func(matches func(f *kingpin.FlagModel) bool) bool {
+		for _, f := range flags {
+			if matches(f) {
+				return !f.IsBoolFlag()
+			}
+		}
+		// unknown flags, including --no-something, are left for kingpin to complain about
+		return false
+	}
+
+	for i := 0; i < len(res); i++ {
+		arg := res[i]
+		switch {
+		case arg == "--":
+			return res
+		case strings.HasPrefix(arg, "--"):
+			name := arg[2:]
+			if !strings.Contains(name, "=") && takesValue(func(f *kingpin.FlagModel) bool { return f.Name == name }) {
+				i++
+			}
+			continue
+		case len(arg) == 2 && arg[0] == '-':
+			short := rune(arg[1])
+			if takesValue(func(f *kingpin.FlagModel) bool { return f.Short == short }) {
+				i++
+			}
+			continue
+		case len(arg) > 2 && arg[0] == '-':
+			// combined short flags, or a short flag with its value
+			continue
+		}
+
+		if sub := findCommand(commands, arg); sub != nil && positional == 0 {
+			cmd = sub
+			commands = sub.Commands
+			flags = append(append([]*kingpin.FlagModel(nil), flags...), sub.Flags...)
+			continue
+		}
+		if cmd == nil {
+			return res
+		}
+
+		if arg == "-" && positional < len(cmd.Args) && ctx.stdinArgs[cmd.FullCommand][cmd.Args[positional].Name] {
+			res[i] = Stdin
+		}
+		positional++
+	}
+	return res
+}
+
+func findCommand(commands []*kingpin.CmdModel, name string) *kingpin.CmdModel {
+	for _, c := range commands {
+		if c.Name == name {
+			return c
+		}
+		for _, alias := range c.Aliases {
+			if alias == name {
+				return c
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package mansion_test
+
+import (
+	"testing"
+
+	"github.com/itchio/butler/mansion"
+	"github.com/stretchr/testify/assert"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+func TestMapStdinArgs(t *testing.T) {
+	app := kingpin.New("butler", "")
+	app.Flag("identity", "").Short('i').String()
+	app.Flag("verbose", "").Bool()
+	ctx := mansion.NewContext(app)
+
+	push := app.Command("push", "")
+	ctx.AcceptStdin(push, "src")
+	push.Arg("src", "").String()
+	push.Arg("target", "").Strings()
+	push.Flag("userversion", "").String()
+	push.Flag("dry-run", "").Bool()
+
+	run := app.Command("run", "")
+	run.Arg("command", "").Strings()
+
+	stdin := mansion.Stdin
+	for _, tc := range []struct {
+		args     []string
+		expected []string
+	}{
+		{[]string{"push", "-", "a/b:c"}, []string{"push", stdin, "a/b:c"}},
+		{[]string{"--verbose", "-i", "creds", "push", "--dry-run", "-", "a/b:c"}, []string{"--verbose", "-i", "creds", "push", "--dry-run", stdin, "a/b:c"}},
+		// flag values and extra targets are left alone
+		{[]string{"push", "--userversion", "-", "dir", "-"}, []string{"push", "--userversion", "-", "dir", "-"}},
+		{[]string{"push", "--userversion=-", "-", "a/b:c"}, []string{"push", "--userversion=-", stdin, "a/b:c"}},
+		// so is anything after --
+		{[]string{"push", "--", "-", "a/b:c"}, []string{"push", "--", "-", "a/b:c"}},
+		// and commands that don't read from stdin
+		{[]string{"run", "-"}, []string{"run", "-"}},
+		{[]string{"-"}, []string{"-"}},
+	} {
+		assert.EqualValues(t, tc.expected, ctx.MapStdinArgs(tc.args), "%v", tc.args)
+	}
+}
@@ -0,0 +1,325 @@
+// Package portability finds files in a build that work fine on the
+// machine it was made on, but won't on players' machines: names that
+// only differ in case, names Windows doesn't allow, symlinks pointing
+// outside the build, executables missing their exec bit, and so on.
+package portability
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/itchio/lake"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/ox"
+	"github.com/pkg/errors"
+)
+
+// Severity is how bad breaking a rule is
+type Severity string
+
+const (
+	// SeverityError issues break the build on some players' machines
+	SeverityError Severity = "error"
+	// SeverityWarning issues might, depending on how the build is run
+	SeverityWarning Severity = "warning"
+)
+
+// MaxPathLength is the longest path most Windows programs can open
+const MaxPathLength = 260
+
+// Rule is a single portability check
+type Rule struct {
+	Name        string
+	Severity    Severity
+	Description string
+	// Platforms lists the platforms the rule is relevant for
+	Platforms []ox.Platform
+	// NeedsContents is true for rules that read files, which are
+	// skipped when there is no pool to read them from
+	NeedsContents bool
+
+	check func(l *linter)
+}
+
+// Rules lists every rule Lint knows about
+var Rules = []*Rule{
+	{
+		Name:        "case-conflict",
+		Severity:    SeverityError,
+		Description: "Paths that only differ in case overwrite each other on case-insensitive filesystems",
+		Platforms:   []ox.Platform{ox.PlatformWindows, ox.PlatformOSX},
+		check:       checkCaseConflicts,
+	},
+	{
+		Name:        "reserved-name",
+		Severity:    SeverityError,
+		Description: "Windows reserves names like CON, NUL or COM1, with or without an extension",
+		Platforms:   []ox.Platform{ox.PlatformWindows},
+		check:       checkReservedNames,
+	},
+	{
+		Name:        "invalid-character",
+		Severity:    SeverityError,
+		Description: `Windows doesn't allow control characters or any of <>:"\|?* in names`,
+		Platforms:   []ox.Platform{ox.PlatformWindows},
+		check:       checkInvalidCharacters,
+	},
+	{
+		Name:        "trailing-dot-or-space",
+		Severity:    SeverityError,
+		Description: "Windows silently strips dots and spaces at the end of names",
+		Platforms:   []ox.Platform{ox.PlatformWindows},
+		check:       checkTrailingDots,
+	},
+	{
+		Name:        "long-path",
+		Severity:    SeverityWarning,
+		Description: fmt.Sprintf("Paths longer than %d characters can't be opened by most Windows programs, and the install folder adds to that", MaxPathLength),
+		Platforms:   []ox.Platform{ox.PlatformWindows},
+		check:       checkLongPaths,
+	},
+	{
+		Name:        "symlink-escape",
+		Severity:    SeverityError,
+		Description: "Symlinks pointing outside the build are broken once it's installed",
+		Platforms:   []ox.Platform{ox.PlatformLinux, ox.PlatformOSX, ox.PlatformWindows},
+		check:       checkSymlinkEscapes,
+	},
+	{
+		Name:          "missing-exec-bit",
+		Severity:      SeverityWarning,
+		Description:   "Executables and scripts that aren't marked executable can't be launched",
+		Platforms:     []ox.Platform{ox.PlatformLinux, ox.PlatformOSX},
+		NeedsContents: true,
+		check:         checkExecBits,
+	},
+}
+
+// Issue is a single place where a build breaks a rule
+type Issue struct {
+	Rule     string   `json:"rule"`
+	Severity Severity `json:"severity"`
+	Path     string   `json:"path"`
+	Message  string   `json:"message"`
+}
+
+// Report lists all the issues found in a build
+type Report struct {
+	Platforms []ox.Platform `json:"platforms"`
+	// Skipped lists rules that need file contents, when those
+	// weren't available
+	Skipped  []string `json:"skipped,omitempty"`
+	Errors   int      `json:"errors"`
+	Warnings int      `json:"warnings"`
+	Issues   []*Issue `json:"issues"`
+}
+
+// Failed returns true if the build has errors, or, in strict mode,
+// if it has warnings.
+func (r *Report) Failed(strict bool) bool {
+	return r.Errors > 0 || (strict && r.Warnings > 0)
+}
+
+// Print calls log with one line per issue, errors first, then a summary.
+func (r *Report) Print(log func(line string)) {
+	for _, severity := range []Severity{SeverityError, SeverityWarning} {
+		for _, issue := range r.Issues {
+			if issue.Severity == severity {
+				log(fmt.Sprintf("%-7s [%s] %s: %s", issue.Severity, issue.Rule, issue.Path, issue.Message))
+			}
+		}
+	}
+	for _, name := range r.Skipped {
+		log(fmt.Sprintf("skipped [%s]: needs a build folder", name))
+	}
+	log(fmt.Sprintf("%d errors, %d warnings", r.Errors, r.Warnings))
+}
+
+// AllPlatforms is what Lint checks for when no platform is given
+var AllPlatforms = []ox.Platform{ox.PlatformWindows, ox.PlatformOSX, ox.PlatformLinux}
+
+// Lint runs all the rules relevant for any of platforms over container.
+// pool is used to read files, and may be nil, in which case rules that
+// need file contents are skipped. Issues are sorted by path.
+func Lint(container *tlc.Container, pool lake.Pool, platforms []ox.Platform) (*Report, error) {
+	if len(platforms) == 0 {
+		platforms = AllPlatforms
+	}
+
+	l := &linter{
+		container: container,
+		pool:      pool,
+		report: &Report{
+			Platforms: platforms,
+			Issues:    []*Issue{},
+		},
+	}
+
+	for _, rule := range Rules {
+		if !rule.appliesTo(platforms) {
+			continue
+		}
+		if rule.NeedsContents && pool == nil {
+			l.report.Skipped = append(l.report.Skipped, rule.Name)
+			continue
+		}
+
+		l.rule = rule
+		rule.check(l)
+		if l.err != nil {
+			return nil, errors.Wrapf(l.err, "checking %s", rule.Name)
+		}
+	}
+
+	sort.SliceStable(l.report.Issues, func(i, j int) bool {
+		return l.report.Issues[i].Path < l.report.Issues[j].Path
+	})
+	return l.report, nil
+}
+
+func (rule *Rule) appliesTo(platforms []ox.Platform) bool {
+	for _, p := range rule.Platforms {
+		for _, q := range platforms {
+			if p == q {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type linter struct {
+	container *tlc.Container
+	pool      lake.Pool
+	report    *Report
+
+	rule *Rule
+	err  error
+}
+
+func (l *linter) add(path string, format string, args ...interface{}) {
+	l.report.Issues = append(l.report.Issues, &Issue{
+		Rule:     l.rule.Name,
+		Severity: l.rule.Severity,
+		Path:     path,
+		Message:  fmt.Sprintf(format, args...),
+	})
+	switch l.rule.Severity {
+	case SeverityError:
+		l.report.Errors++
+	case SeverityWarning:
+		l.report.Warnings++
+	}
+}
+
+// forEachName calls f with every entry's path and its last component.
+// Checking the last component of every entry covers all components,
+// since parents are entries too.
+func (l *linter) forEachName(f func(path string, name string)) {
+	l.container.ForEachEntry(func(e tlc.Entry) tlc.ForEachOutcome {
+		p := e.GetPath()
+		f(p, path.Base(p))
+		return tlc.ForEachContinue
+	})
+}
+
+func checkCaseConflicts(l *linter) {
+	seen := make(map[string]string)
+	l.container.ForEachEntry(func(e tlc.Entry) tlc.ForEachOutcome {
+		p := e.GetPath()
+		lower := strings.ToLower(p)
+		if other, ok := seen[lower]; ok {
+			l.add(p, "conflicts with (%s)", other)
+		} else {
+			seen[lower] = p
+		}
+		return tlc.ForEachContinue
+	})
+}
+
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+func checkReservedNames(l *linter) {
+	l.forEachName(func(path string, name string) {
+		// 'aux.txt' and 'nul.tar.gz' are just as reserved as 'aux'
+		stem := name
+		if i := strings.IndexByte(stem, '.'); i >= 0 {
+			stem = stem[:i]
+		}
+		stem = strings.ToUpper(strings.TrimRight(stem, " "))
+		if reservedNames[stem] {
+			l.add(path, "(%s) is a reserved name on Windows", name)
+		}
+	})
+}
+
+func checkInvalidCharacters(l *linter) {
+	l.forEachName(func(path string, name string) {
+		for _, r := range name {
+			if r < 0x20 || strings.ContainsRune(`<>:"\|?*`, r) {
+				l.add(path, "(%s) contains %q, which isn't allowed on Windows", name, r)
+				return
+			}
+		}
+	})
+}
+
+func checkTrailingDots(l *linter) {
+	l.forEachName(func(path string, name string) {
+		if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+			l.add(path, "(%s) ends with a dot or a space", name)
+		}
+	})
+}
+
+func checkLongPaths(l *linter) {
+	l.container.ForEachEntry(func(e tlc.Entry) tlc.ForEachOutcome {
+		p := e.GetPath()
+		// Windows counts UTF-16 code units
+		length := len(utf16.Encode([]rune(p)))
+		if length > MaxPathLength {
+			l.add(p, "path is %d characters long", length)
+		}
+		return tlc.ForEachContinue
+	})
+}
+
+func checkSymlinkEscapes(l *linter) {
+	for _, s := range l.container.Symlinks {
+		if path.IsAbs(s.Dest) || strings.HasPrefix(s.Dest, `\`) || (len(s.Dest) >= 2 && s.Dest[1] == ':') {
+			l.add(s.Path, "points to absolute path (%s)", s.Dest)
+			continue
+		}
+
+		target := path.Join(path.Dir(s.Path), s.Dest)
+		if target == ".." || strings.HasPrefix(target, "../") {
+			l.add(s.Path, "points to (%s), outside of the build", s.Dest)
+		}
+	}
+}
+
+func checkExecBits(l *linter) {
+	// FixPermissions knows what executables look like, and only
+	// ever adds exec bits: any file it changes was missing some.
+	fixed := l.container.Clone()
+	err := fixed.FixPermissions(l.pool)
+	if err != nil {
+		l.err = err
+		return
+	}
+
+	for i, f := range l.container.Files {
+		if fixed.Files[i].Mode != f.Mode {
+			l.add(f.Path, "looks like an executable, but has mode %o", f.Mode&0o777)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package portability_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/itchio/butler/portability"
+	"github.com/itchio/lake/pools/fspool"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/ox"
+	"github.com/itchio/wharf/wtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func issuesByRule(report *portability.Report) map[string][]string {
+	res := make(map[string][]string)
+	for _, issue := range report.Issues {
+		res[issue.Rule] = append(res[issue.Rule], issue.Path)
+	}
+	return res
+}
+
+func TestLint(t *testing.T) {
+	container := &tlc.Container{
+		Dirs: []*tlc.Dir{
+			{Path: "Data", Mode: 0o755},
+			{Path: "data", Mode: 0o755},
+			{Path: "trailing.", Mode: 0o755},
+		},
+		Files: []*tlc.File{
+			{Path: "Data/level.pak", Mode: 0o644},
+			{Path: "data/aux.txt", Mode: 0o644},
+			{Path: "data/Com1", Mode: 0o644},
+			{Path: "data/console.txt", Mode: 0o644},
+			{Path: "what?.txt", Mode: 0o644},
+			{Path: "notes ", Mode: 0o644},
+			{Path: "trailing./file", Mode: 0o644},
+			{Path: strings.Repeat("a", 300), Mode: 0o644},
+		},
+		Symlinks: []*tlc.Symlink{
+			{Path: "data/lib.so", Dest: "lib.so.1"},
+			{Path: "data/up.so", Dest: "../lib/up.so"},
+			{Path: "data/escape", Dest: "../../etc/passwd"},
+			{Path: "absolute", Dest: "/usr/lib/libfoo.so"},
+		},
+	}
+
+	report, err := portability.Lint(container, nil, []ox.Platform{ox.PlatformWindows})
+	wtest.Must(t, err)
+
+	issues := issuesByRule(report)
+	assert.EqualValues(t, []string{"data"}, issues["case-conflict"])
+	assert.EqualValues(t, []string{"data/Com1", "data/aux.txt"}, issues["reserved-name"])
+	assert.EqualValues(t, []string{"what?.txt"}, issues["invalid-character"])
+	assert.EqualValues(t, []string{"notes ", "trailing."}, issues["trailing-dot-or-space"])
+	assert.EqualValues(t, []string{strings.Repeat("a", 300)}, issues["long-path"])
+	assert.EqualValues(t, []string{"absolute", "data/escape"}, issues["symlink-escape"])
+	assert.EqualValues(t, 8, report.Errors)
+	assert.EqualValues(t, 1, report.Warnings)
+	assert.True(t, report.Failed(false))
+	assert.Empty(t, report.Skipped)
+
+	// Linux doesn't care about names, only about symlinks
+	report, err = portability.Lint(container, nil, []ox.Platform{ox.PlatformLinux})
+	wtest.Must(t, err)
+	issues = issuesByRule(report)
+	assert.Len(t, issues, 1)
+	assert.Len(t, issues["symlink-escape"], 2)
+	assert.EqualValues(t, []string{"missing-exec-bit"}, report.Skipped)
+}
+
+func TestLintExecBits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "portability")
+	wtest.Must(t, err)
+	defer os.RemoveAll(dir)
+
+	write := func(name string, contents string, mode os.FileMode) {
+		path := filepath.Join(dir, name)
+		wtest.Must(t, ioutil.WriteFile(path, []byte(contents), mode))
+		wtest.Must(t, os.Chmod(path, mode))
+	}
+	write("start.sh", "#!/bin/sh\necho hi\n", 0o644)
+	write("game", "\x7fELF and then some", 0o755)
+	write("readme.txt", "just text", 0o644)
+
+	container, err := tlc.WalkDir(dir, tlc.WalkOpts{})
+	wtest.Must(t, err)
+
+	report, err := portability.Lint(container, fspool.New(container, dir), []ox.Platform{ox.PlatformLinux})
+	wtest.Must(t, err)
+
+	assert.EqualValues(t, map[string][]string{
+		"missing-exec-bit": {"start.sh"},
+	}, issuesByRule(report))
+	assert.False(t, report.Failed(false))
+	assert.True(t, report.Failed(true))
+
+	// linting doesn't change the container
+	for _, f := range container.Files {
+		if f.Path == "start.sh" {
+			assert.EqualValues(t, 0o644, f.Mode&0o777)
+		}
+	}
+}
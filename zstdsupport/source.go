@@ -0,0 +1,321 @@
+package zstdsupport
+
+import (
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+
+	"github.com/itchio/savior"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+const (
+	frameMagic         = 0xFD2FB528
+	skippableMagicMask = 0xFFFFFFF0
+	skippableMagic     = 0x184D2A50
+)
+
+type zstdSource struct {
+	// input
+	source  savior.Source
+	decoder *zstd.Decoder
+
+	// internal
+	resumed bool
+	frame   []byte
+	out     []byte
+	outPos  int
+	offset  int64
+	rOffset int64
+	bytebuf []byte
+
+	ssc              savior.SourceSaveConsumer
+	sourceCheckpoint *savior.SourceCheckpoint
+}
+
+// ZstdSourceCheckpoint is saved at frame boundaries
+type ZstdSourceCheckpoint struct {
+	// Offset is how much decompressed data was read
+	Offset int64
+	// Roffset is how much compressed data was read
+	Roffset          int64
+	SourceCheckpoint *savior.SourceCheckpoint
+}
+
+var _ savior.Source = (*zstdSource)(nil)
+
+func newSource(source savior.Source, decoder *zstd.Decoder) *zstdSource {
+	return &zstdSource{
+		source:  source,
+		decoder: decoder,
+		bytebuf: []byte{0x00},
+	}
+}
+
+func (zs *zstdSource) Features() savior.SourceFeatures {
+	return savior.SourceFeatures{
+		Name:          "zstd",
+		ResumeSupport: savior.ResumeSupportBlock,
+	}
+}
+
+func (zs *zstdSource) SetSourceSaveConsumer(ssc savior.SourceSaveConsumer) {
+	zs.ssc = ssc
+	zs.source.SetSourceSaveConsumer(&savior.CallbackSourceSaveConsumer{
+		OnSave: func(checkpoint *savior.SourceCheckpoint) error {
+			// we'll save at the next frame boundary
+			zs.sourceCheckpoint = checkpoint
+			return nil
+		},
+	})
+}
+
+func (zs *zstdSource) WantSave() {
+	zs.source.WantSave()
+}
+
+func (zs *zstdSource) Resume(checkpoint *savior.SourceCheckpoint) (int64, error) {
+	zs.resumed = true
+	zs.out = zs.out[:0]
+	zs.outPos = 0
+	zs.sourceCheckpoint = nil
+
+	if checkpoint != nil {
+		if ourCheckpoint, ok := checkpoint.Data.(*ZstdSourceCheckpoint); ok {
+			sourceOffset, err := zs.source.Resume(ourCheckpoint.SourceCheckpoint)
+			if err != nil {
+				return 0, errors.WithStack(err)
+			}
+
+			if sourceOffset < ourCheckpoint.Roffset {
+				delta := ourCheckpoint.Roffset - sourceOffset
+				savior.Debugf(`zstdsource: discarding %d bytes to align source with frame`, delta)
+				err = savior.DiscardByRead(zs.source, delta)
+				if err != nil {
+					return 0, errors.WithStack(err)
+				}
+				sourceOffset += delta
+			}
+
+			if sourceOffset == ourCheckpoint.Roffset {
+				zs.rOffset = ourCheckpoint.Roffset
+				zs.offset = ourCheckpoint.Offset
+				return zs.offset, nil
+			}
+			savior.Debugf(`zstdsource: expected source to resume at %d but got %d`, ourCheckpoint.Roffset, sourceOffset)
+		}
+	}
+
+	// start from beginning
+	sourceOffset, err := zs.source.Resume(nil)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	if sourceOffset != 0 {
+		msg := fmt.Sprintf("zstdsource: expected source to resume at start but got %d", sourceOffset)
+		return 0, errors.New(msg)
+	}
+
+	zs.rOffset = 0
+	zs.offset = 0
+	return 0, nil
+}
+
+func (zs *zstdSource) Read(buf []byte) (int, error) {
+	if !zs.resumed {
+		return 0, errors.WithStack(savior.ErrUninitializedSource)
+	}
+
+	for zs.outPos == len(zs.out) {
+		// the checkpoint for offset 0 is simply nil
+		if zs.sourceCheckpoint != nil && zs.ssc != nil && zs.offset > 0 {
+			checkpoint := &savior.SourceCheckpoint{
+				Offset: zs.offset,
+				Data: &ZstdSourceCheckpoint{
+					Offset:           zs.offset,
+					Roffset:          zs.rOffset,
+					SourceCheckpoint: zs.sourceCheckpoint,
+				},
+			}
+			zs.sourceCheckpoint = nil
+
+			// the consumer may resume us from the checkpoint, which
+			// leaves us at this same frame boundary
+			err := zs.ssc.Save(checkpoint)
+			if err != nil {
+				return 0, err
+			}
+			savior.Debugf("zstdsource: saved checkpoint at byte %d", zs.offset)
+		}
+
+		err := zs.readFrame()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(buf, zs.out[zs.outPos:])
+	zs.outPos += n
+	zs.offset += int64(n)
+	return n, nil
+}
+
+// readFrame reads and decodes the next frame, skipping skippable frames.
+// It returns io.EOF if the stream ends cleanly between two frames.
+func (zs *zstdSource) readFrame() error {
+	zs.frame = zs.frame[:0]
+
+	magic, err := zs.readUint32(true)
+	if err != nil {
+		return err
+	}
+
+	if magic&skippableMagicMask == skippableMagic {
+		size, err := zs.readUint32(false)
+		if err != nil {
+			return err
+		}
+		err = zs.readBytes(int(size))
+		if err != nil {
+			return err
+		}
+		zs.out = zs.out[:0]
+		zs.outPos = 0
+		return nil
+	}
+
+	if magic != frameMagic {
+		return errors.Errorf("zstdsource: invalid frame magic %x at byte %d", magic, zs.rOffset-4)
+	}
+
+	// frame header
+	err = zs.readBytes(1)
+	if err != nil {
+		return err
+	}
+	descriptor := zs.frame[len(zs.frame)-1]
+	fcsFlag := descriptor >> 6
+	singleSegment := descriptor&(1<<5) != 0
+	hasChecksum := descriptor&(1<<2) != 0
+	dictIDFlag := descriptor & 3
+
+	headerSize := []int{0, 1, 2, 4}[dictIDFlag]
+	if !singleSegment {
+		// window descriptor
+		headerSize++
+	}
+	switch fcsFlag {
+	case 0:
+		if singleSegment {
+			headerSize++
+		}
+	case 1:
+		headerSize += 2
+	case 2:
+		headerSize += 4
+	case 3:
+		headerSize += 8
+	}
+	err = zs.readBytes(headerSize)
+	if err != nil {
+		return err
+	}
+
+	// blocks
+	for {
+		err = zs.readBytes(3)
+		if err != nil {
+			return err
+		}
+		header := zs.frame[len(zs.frame)-3:]
+		blockHeader := uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16
+		lastBlock := blockHeader&1 != 0
+		blockType := (blockHeader >> 1) & 3
+		blockSize := int(blockHeader >> 3)
+
+		switch blockType {
+		case 0, 2:
+			// raw and compressed blocks
+		case 1:
+			// RLE blocks store a single byte
+			blockSize = 1
+		default:
+			return errors.Errorf("zstdsource: reserved block type at byte %d", zs.rOffset-3)
+		}
+		err = zs.readBytes(blockSize)
+		if err != nil {
+			return err
+		}
+
+		if lastBlock {
+			break
+		}
+	}
+
+	if hasChecksum {
+		err = zs.readBytes(4)
+		if err != nil {
+			return err
+		}
+	}
+
+	zs.out, err = zs.decoder.DecodeAll(zs.frame, zs.out[:0])
+	if err != nil {
+		return errors.Wrapf(err, "zstdsource: decoding frame ending at byte %d", zs.rOffset)
+	}
+	zs.outPos = 0
+	return nil
+}
+
+func (zs *zstdSource) readUint32(eofOK bool) (uint32, error) {
+	start := len(zs.frame)
+	err := zs.readBytes(4)
+	if err != nil {
+		if eofOK && errors.Cause(err) == io.ErrUnexpectedEOF && len(zs.frame) == start {
+			return 0, io.EOF
+		}
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(zs.frame[start:]), nil
+}
+
+// readBytes appends n bytes from the source to the current frame
+func (zs *zstdSource) readBytes(n int) error {
+	start := len(zs.frame)
+	if cap(zs.frame) < start+n {
+		grown := make([]byte, start, 2*(start+n))
+		copy(grown, zs.frame)
+		zs.frame = grown
+	}
+	zs.frame = zs.frame[:start+n]
+
+	read, err := io.ReadFull(zs.source, zs.frame[start:])
+	zs.rOffset += int64(read)
+	zs.frame = zs.frame[:start+read]
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func (zs *zstdSource) ReadByte() (byte, error) {
+	_, err := io.ReadFull(zs, zs.bytebuf)
+	return zs.bytebuf[0], err
+}
+
+func (zs *zstdSource) Progress() float64 {
+	// We can't tell how large the uncompressed stream is until we finish
+	// decompressing it. The underlying's source progress is a good enough
+	// approximation.
+	return zs.source.Progress()
+}
+
+func init() {
+	gob.Register(&ZstdSourceCheckpoint{})
+}
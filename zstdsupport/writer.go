@@ -0,0 +1,80 @@
+package zstdsupport
+
+import (
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+type zstdCompressor struct{}
+
+// Apply returns a writer that compresses to writer. Quality is a zstd
+// level, from 1 to 22, which is mapped to the closest level available.
+func (zc *zstdCompressor) Apply(writer io.Writer, quality int32) (io.Writer, error) {
+	encoder, err := zstd.NewWriter(nil,
+		zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(int(quality))),
+		zstd.WithEncoderConcurrency(1),
+	)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return &frameWriter{
+		writer:  writer,
+		encoder: encoder,
+		buf:     make([]byte, 0, FrameSize),
+	}, nil
+}
+
+// frameWriter compresses every FrameSize bytes written to it as a
+// separate zstd frame. Closing it writes the last frame, but doesn't
+// close the underlying writer.
+type frameWriter struct {
+	writer  io.Writer
+	encoder *zstd.Encoder
+	buf     []byte
+	frame   []byte
+}
+
+var _ io.WriteCloser = (*frameWriter)(nil)
+
+func (fw *frameWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := FrameSize - len(fw.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		fw.buf = append(fw.buf, p[:n]...)
+		p = p[n:]
+		written += n
+
+		if len(fw.buf) == FrameSize {
+			err := fw.flush()
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (fw *frameWriter) flush() error {
+	if len(fw.buf) == 0 {
+		return nil
+	}
+
+	fw.frame = fw.encoder.EncodeAll(fw.buf, fw.frame[:0])
+	fw.buf = fw.buf[:0]
+	_, err := fw.writer.Write(fw.frame)
+	return errors.WithStack(err)
+}
+
+func (fw *frameWriter) Close() error {
+	err := fw.flush()
+	if err != nil {
+		return err
+	}
+	return errors.WithStack(fw.encoder.Close())
+}
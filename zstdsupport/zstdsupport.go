@@ -0,0 +1,50 @@
+// Package zstdsupport lets wharf read and write patches, signatures and
+// manifests compressed with zstd. It only needs to be imported for its
+// side effects.
+//
+// Streams are written as a series of independent zstd frames, each
+// holding up to FrameSize bytes of input. Any zstd decoder can read them,
+// and they let the decompressor save checkpoints at frame boundaries, so
+// applying a zstd patch can be resumed like applying a brotli one.
+package zstdsupport
+
+import (
+	"sync"
+
+	"github.com/itchio/savior"
+	"github.com/itchio/wharf/pwr"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// FrameSize is how much uncompressed data goes into each frame
+const FrameSize = 4 * 1024 * 1024
+
+type zstdDecompressor struct{}
+
+func (zd *zstdDecompressor) Apply(source savior.Source) (savior.Source, error) {
+	decoder, err := getDecoder()
+	if err != nil {
+		return nil, err
+	}
+	return newSource(source, decoder), nil
+}
+
+var decoderOnce sync.Once
+var decoder *zstd.Decoder
+var decoderErr error
+
+// getDecoder returns a decoder shared by all sources: DecodeAll is
+// safe for concurrent use, and each decoder has its own goroutines.
+func getDecoder() (*zstd.Decoder, error) {
+	decoderOnce.Do(func() {
+		decoder, decoderErr = zstd.NewReader(nil)
+		decoderErr = errors.WithStack(decoderErr)
+	})
+	return decoder, decoderErr
+}
+
+func init() {
+	pwr.RegisterCompressor(pwr.CompressionAlgorithm_ZSTD, &zstdCompressor{})
+	pwr.RegisterDecompressor(pwr.CompressionAlgorithm_ZSTD, &zstdDecompressor{})
+}
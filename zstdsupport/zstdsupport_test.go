@@ -0,0 +1,60 @@
+package zstdsupport_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/itchio/savior/checker"
+	"github.com/itchio/savior/seeksource"
+	"github.com/itchio/savior/semirandom"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/wire"
+	"github.com/itchio/wharf/wtest"
+	"github.com/stretchr/testify/assert"
+
+	_ "github.com/itchio/butler/zstdsupport"
+)
+
+func TestZstd(t *testing.T) {
+	compression := &pwr.CompressionSettings{
+		Algorithm: pwr.CompressionAlgorithm_ZSTD,
+		Quality:   3,
+	}
+
+	// a few frames, the last one partial
+	reference := semirandom.Bytes(3*4*1024*1024 + 1234)
+
+	buf := new(bytes.Buffer)
+	wc, err := pwr.CompressWire(wire.NewWriteContext(buf), compression)
+	wtest.Must(t, err)
+	_, err = wc.Writer().Write(reference)
+	wtest.Must(t, err)
+	wtest.Must(t, wc.Close())
+	assert.True(t, buf.Len() < len(reference))
+
+	decompress := func() *wire.ReadContext {
+		source := seeksource.FromBytes(buf.Bytes())
+		_, err := source.Resume(nil)
+		wtest.Must(t, err)
+		rc, err := pwr.DecompressWire(wire.NewReadContext(source), compression)
+		wtest.Must(t, err)
+		return rc
+	}
+
+	// saves and resumes at frame boundaries
+	checker.RunSourceTest(t, decompress().GetSource(), reference)
+
+	// empty streams have no frames at all
+	buf.Reset()
+	wc, err = pwr.CompressWire(wire.NewWriteContext(buf), compression)
+	wtest.Must(t, err)
+	wtest.Must(t, wc.Close())
+	assert.EqualValues(t, 0, buf.Len())
+
+	rc := decompress()
+	_, err = rc.GetSource().Resume(nil)
+	wtest.Must(t, err)
+	n, err := rc.GetSource().Read(make([]byte, 16))
+	assert.EqualValues(t, 0, n)
+	assert.Error(t, err)
+}